@@ -0,0 +1,394 @@
+// Copyright 2024 Northern.tech AS
+//
+//	Licensed under the Apache License, Version 2.0 (the "License");
+//	you may not use this file except in compliance with the License.
+//	You may obtain a copy of the License at
+//
+//	    http://www.apache.org/licenses/LICENSE-2.0
+//
+//	Unless required by applicable law or agreed to in writing, software
+//	distributed under the License is distributed on an "AS IS" BASIS,
+//	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//	See the License for the specific language governing permissions and
+//	limitations under the License.
+
+// Package api serves a REST API running artifact generation jobs on a
+// bounded pool of workers, for services triggering them directly rather
+// than through the workflows service:
+//
+//	POST   /jobs       queue a job, given the workflow's input parameters
+//	GET    /jobs/{id}  status and logs of a job
+//	DELETE /jobs/{id}  cancel a queued or running job
+package api
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+
+	mlog "github.com/mendersoftware/create-artifact-worker/log"
+)
+
+const (
+	// DefaultMaxFinished is how many finished jobs are kept for GET, the
+	// oldest are forgotten first.
+	DefaultMaxFinished = 1000
+
+	// maxLogLines is how many log lines of a job are kept, the oldest
+	// are dropped first.
+	maxLogLines = 1000
+
+	maxRequestSize = 1 << 20
+
+	// retryAfter is the hint, in seconds, given to clients when the
+	// queue is full
+	retryAfter = "10"
+
+	shutdownTimeout = 10 * time.Second
+)
+
+// Task is a validated job, ready to run.
+type Task struct {
+	ArtifactId string
+	TenantId   string
+
+	Run func(ctx context.Context) error
+}
+
+// NewTaskFunc validates the input parameters of a job; an error is
+// returned to the client as a bad request.
+type NewTaskFunc func(inputs map[string]string) (*Task, error)
+
+type Config struct {
+	Listen string
+
+	// ApiKey, if set, is required as a bearer token on every request.
+	ApiKey string
+
+	// Concurrency is the number of jobs run in parallel.
+	Concurrency int
+
+	// QueueSize is the number of jobs waiting for a worker; more are
+	// rejected with 503 Service Unavailable.
+	QueueSize int
+
+	// MaxFinished is how many finished jobs are kept for GET.
+	MaxFinished int
+
+	// DrainTimeout is how long running jobs get to finish on shutdown,
+	// before being cancelled.
+	DrainTimeout time.Duration
+}
+
+type Server struct {
+	c       Config
+	newTask NewTaskFunc
+
+	mu       sync.Mutex
+	jobs     map[string]*job
+	finished []string
+	queue    chan *job
+	closed   bool
+}
+
+func New(c Config, newTask NewTaskFunc) *Server {
+	if c.Concurrency <= 0 {
+		c.Concurrency = 1
+	}
+	if c.QueueSize < 0 {
+		c.QueueSize = 0
+	}
+	if c.MaxFinished <= 0 {
+		c.MaxFinished = DefaultMaxFinished
+	}
+
+	return &Server{
+		c:       c,
+		newTask: newTask,
+		jobs:    map[string]*job{},
+		queue:   make(chan *job, c.QueueSize),
+	}
+}
+
+// Run listens on Config.Listen and serves until ctx is done.
+func (s *Server) Run(ctx context.Context) error {
+	l, err := net.Listen("tcp", s.c.Listen)
+	if err != nil {
+		return errors.Wrapf(err, "failed to listen on %s", s.c.Listen)
+	}
+
+	return s.Serve(ctx, l)
+}
+
+// Serve serves the API on l until ctx is done, then drains: new jobs are
+// rejected, queued ones cancelled and running ones get DrainTimeout to
+// finish.
+func (s *Server) Serve(ctx context.Context, l net.Listener) error {
+	log := mlog.FromContext(ctx)
+
+	// jobs outlive ctx while draining
+	jobCtx, cancelJobs := context.WithCancel(context.WithoutCancel(ctx))
+	defer cancelJobs()
+
+	wg := sync.WaitGroup{}
+	for i := 0; i < s.c.Concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := range s.queue {
+				s.run(jobCtx, j)
+			}
+		}()
+	}
+
+	srv := &http.Server{
+		Handler:           s.Handler(),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	errc := make(chan error, 1)
+	go func() {
+		errc <- srv.Serve(l)
+	}()
+
+	log.Info("serving the job api on %s, %d jobs at a time", l.Addr(), s.c.Concurrency)
+
+	var err error
+	select {
+	case <-ctx.Done():
+	case err = <-errc:
+		err = errors.Wrap(err, "failed to serve")
+	}
+
+	log.Info("draining, waiting for running jobs to finish")
+
+	sctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), shutdownTimeout)
+	_ = srv.Shutdown(sctx)
+	cancel()
+
+	s.close()
+
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(s.c.DrainTimeout):
+		log.Warn("drain timeout of %s exceeded, cancelling running jobs", s.c.DrainTimeout)
+		s.cancelRunning("drain timeout exceeded")
+		cancelJobs()
+		<-done
+	}
+
+	log.Info("drained")
+
+	return err
+}
+
+// close stops taking jobs and cancels the queued ones.
+func (s *Server) close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return
+	}
+	s.closed = true
+
+	for _, j := range s.jobs {
+		j.cancelQueued("server shutting down")
+	}
+	close(s.queue)
+}
+
+// cancelRunning marks the running jobs cancelled, before their context
+// is, so they don't end as failed.
+func (s *Server) cancelRunning(reason string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, j := range s.jobs {
+		j.cancelRunning(reason)
+	}
+}
+
+func (s *Server) run(ctx context.Context, j *job) {
+	ctx, ok := j.start(ctx)
+	if !ok {
+		// cancelled while queued
+		s.finish(j)
+		return
+	}
+
+	l := mlog.FromContext(ctx).With("job_id", j.Id).Tee(j.logs)
+	l.Info("running job")
+
+	err := j.task.Run(mlog.NewContext(ctx, l))
+	if err != nil {
+		l.Error("job failed: %s", err.Error())
+	} else {
+		l.Info("job done")
+	}
+
+	j.end(err)
+	s.finish(j)
+}
+
+// finish keeps j for GET, forgetting the oldest finished jobs over
+// MaxFinished.
+func (s *Server) finish(j *job) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.finished = append(s.finished, j.Id)
+	for len(s.finished) > s.c.MaxFinished {
+		delete(s.jobs, s.finished[0])
+		s.finished = s.finished[1:]
+	}
+}
+
+func (s *Server) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/jobs", s.handleJobs)
+	mux.HandleFunc("/jobs/", s.handleJob)
+
+	return s.authenticate(mux)
+}
+
+func (s *Server) authenticate(h http.Handler) http.Handler {
+	if s.c.ApiKey == "" {
+		return h
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(key), []byte(s.c.ApiKey)) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			writeError(w, http.StatusUnauthorized, errors.New("invalid api key"))
+			return
+		}
+
+		h.ServeHTTP(w, r)
+	})
+}
+
+func (s *Server) handleJobs(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		writeError(w, http.StatusMethodNotAllowed, errors.Errorf("method %s not allowed", r.Method))
+		return
+	}
+
+	inputs := map[string]string{}
+	err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxRequestSize)).Decode(&inputs)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, errors.Wrap(err, "can't parse the input parameters"))
+		return
+	}
+
+	task, err := s.newTask(inputs)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	id, err := newId()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	j := newJob(id, task)
+
+	if err := s.enqueue(j); err != nil {
+		w.Header().Set("Retry-After", retryAfter)
+		writeError(w, http.StatusServiceUnavailable, err)
+		return
+	}
+
+	mlog.FromContext(r.Context()).With("job_id", j.Id).
+		Info("queued job of artifact %s", task.ArtifactId)
+
+	w.Header().Set("Location", "/jobs/"+j.Id)
+	writeJSON(w, http.StatusAccepted, j.record())
+}
+
+func (s *Server) enqueue(j *job) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return errors.New("server shutting down")
+	}
+
+	select {
+	case s.queue <- j:
+	default:
+		return errors.New("job queue full")
+	}
+
+	s.jobs[j.Id] = j
+
+	return nil
+}
+
+func (s *Server) handleJob(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimPrefix(r.URL.Path, "/jobs/")
+
+	s.mu.Lock()
+	j, ok := s.jobs[id]
+	s.mu.Unlock()
+
+	if !ok || id == "" || strings.Contains(id, "/") {
+		writeError(w, http.StatusNotFound, errors.Errorf("job %q not found", id))
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		rec := j.record()
+		rec.Logs = j.logs.Lines()
+		writeJSON(w, http.StatusOK, rec)
+	case http.MethodDelete:
+		if !j.cancel() {
+			writeError(w, http.StatusConflict, errors.Errorf("job %s already finished", id))
+			return
+		}
+		mlog.FromContext(r.Context()).With("job_id", j.Id).Info("cancelled job")
+		writeJSON(w, http.StatusOK, j.record())
+	default:
+		w.Header().Set("Allow", http.MethodGet+", "+http.MethodDelete)
+		writeError(w, http.StatusMethodNotAllowed, errors.Errorf("method %s not allowed", r.Method))
+	}
+}
+
+func newId() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", errors.Wrap(err, "failed to generate job id")
+	}
+
+	return hex.EncodeToString(b), nil
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, map[string]string{"error": mlog.Redact(err.Error())})
+}
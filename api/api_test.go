@@ -0,0 +1,340 @@
+// Copyright 2024 Northern.tech AS
+//
+//	Licensed under the Apache License, Version 2.0 (the "License");
+//	you may not use this file except in compliance with the License.
+//	You may obtain a copy of the License at
+//
+//	    http://www.apache.org/licenses/LICENSE-2.0
+//
+//	Unless required by applicable law or agreed to in writing, software
+//	distributed under the License is distributed on an "AS IS" BASIS,
+//	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//	See the License for the specific language governing permissions and
+//	limitations under the License.
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+
+	mlog "github.com/mendersoftware/create-artifact-worker/log"
+)
+
+// testTask makes tasks running fn, and rejects inputs without an
+// artifact_id.
+func testTask(fn func(ctx context.Context) error) NewTaskFunc {
+	return func(inputs map[string]string) (*Task, error) {
+		if inputs["artifact_id"] == "" {
+			return nil, errors.New("missing input parameter artifact_id")
+		}
+
+		return &Task{
+			ArtifactId: inputs["artifact_id"],
+			TenantId:   inputs["tenant_id"],
+			Run:        fn,
+		}, nil
+	}
+}
+
+// start serves s until the returned func is called.
+func start(t *testing.T, s *Server) (string, func()) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- s.Serve(ctx, l)
+	}()
+
+	return "http://" + l.Addr().String(), func() {
+		cancel()
+		assert.NoError(t, <-done)
+	}
+}
+
+func do(t *testing.T, method, url, key, body string) (*http.Response, map[string]interface{}) {
+	req, err := http.NewRequest(method, url, strings.NewReader(body))
+	assert.NoError(t, err)
+	if key != "" {
+		req.Header.Set("Authorization", "Bearer "+key)
+	}
+
+	rsp, err := http.DefaultClient.Do(req)
+	assert.NoError(t, err)
+	defer rsp.Body.Close()
+
+	res := map[string]interface{}{}
+	assert.NoError(t, json.NewDecoder(rsp.Body).Decode(&res))
+
+	return rsp, res
+}
+
+func waitStatus(t *testing.T, url, id string, status Status) map[string]interface{} {
+	var res map[string]interface{}
+	assert.Eventually(t, func() bool {
+		_, res = do(t, http.MethodGet, url+"/jobs/"+id, "", "")
+		return res["status"] == string(status)
+	}, 10*time.Second, 10*time.Millisecond)
+
+	return res
+}
+
+func TestServerJob(t *testing.T) {
+	testCases := map[string]struct {
+		err error
+
+		status Status
+		errMsg string
+	}{
+		"done": {
+			status: StatusDone,
+		},
+		"failed": {
+			err:    errors.New("generator failed"),
+			status: StatusFailed,
+			errMsg: "generator failed",
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			s := New(Config{Concurrency: 1, QueueSize: 1, DrainTimeout: time.Second},
+				testTask(func(ctx context.Context) error {
+					mlog.FromContext(ctx).Info("generating")
+					return tc.err
+				}))
+
+			url, stop := start(t, s)
+			defer stop()
+
+			rsp, res := do(t, http.MethodPost, url+"/jobs", "",
+				`{"artifact_id":"aid","tenant_id":"tid","token":"s3cr3t"}`)
+			assert.Equal(t, http.StatusAccepted, rsp.StatusCode)
+			assert.Equal(t, "aid", res["artifact_id"])
+			assert.Equal(t, "tid", res["tenant_id"])
+
+			id := res["id"].(string)
+			assert.Len(t, id, 32)
+			assert.Equal(t, "/jobs/"+id, rsp.Header.Get("Location"))
+
+			res = waitStatus(t, url, id, tc.status)
+			errMsg, _ := res["error"].(string)
+			assert.Equal(t, tc.errMsg, errMsg)
+			assert.NotEmpty(t, res["started"])
+			assert.NotEmpty(t, res["finished"])
+
+			logs := strings.Join(toStrings(res["logs"]), "\n")
+			assert.Contains(t, logs, "msg=generating")
+			assert.Contains(t, logs, "job_id="+id)
+			assert.NotContains(t, logs, "s3cr3t")
+
+			// a finished job can't be cancelled
+			rsp, _ = do(t, http.MethodDelete, url+"/jobs/"+id, "", "")
+			assert.Equal(t, http.StatusConflict, rsp.StatusCode)
+		})
+	}
+}
+
+func toStrings(v interface{}) []string {
+	var s []string
+	l, _ := v.([]interface{})
+	for _, e := range l {
+		s = append(s, e.(string))
+	}
+	return s
+}
+
+func TestServerErrors(t *testing.T) {
+	testCases := map[string]struct {
+		method string
+		path   string
+		key    string
+		body   string
+
+		status int
+		err    string
+	}{
+		"invalid json": {
+			method: http.MethodPost,
+			path:   "/jobs",
+			body:   "{",
+			status: http.StatusBadRequest,
+			err:    "can't parse the input parameters",
+		},
+		"invalid inputs": {
+			method: http.MethodPost,
+			path:   "/jobs",
+			body:   `{"name":"release"}`,
+			status: http.StatusBadRequest,
+			err:    "missing input parameter artifact_id",
+		},
+		"unknown job": {
+			method: http.MethodGet,
+			path:   "/jobs/nonexistent",
+			status: http.StatusNotFound,
+			err:    `job "nonexistent" not found`,
+		},
+		"method not allowed": {
+			method: http.MethodGet,
+			path:   "/jobs",
+			status: http.StatusMethodNotAllowed,
+			err:    "method GET not allowed",
+		},
+		"missing api key": {
+			method: http.MethodPost,
+			path:   "/jobs",
+			body:   `{"artifact_id":"aid"}`,
+			key:    "-",
+			status: http.StatusUnauthorized,
+			err:    "invalid api key",
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			s := New(Config{ApiKey: "key", DrainTimeout: time.Second},
+				testTask(func(ctx context.Context) error { return nil }))
+
+			url, stop := start(t, s)
+			defer stop()
+
+			key := "key"
+			if tc.key != "" {
+				key = ""
+			}
+
+			rsp, res := do(t, tc.method, url+tc.path, key, tc.body)
+			assert.Equal(t, tc.status, rsp.StatusCode)
+			assert.Contains(t, res["error"], tc.err)
+		})
+	}
+}
+
+func TestServerCancel(t *testing.T) {
+	s := New(Config{Concurrency: 1, QueueSize: 1, DrainTimeout: time.Second},
+		testTask(func(ctx context.Context) error {
+			<-ctx.Done()
+			return ctx.Err()
+		}))
+
+	url, stop := start(t, s)
+	defer stop()
+
+	_, res := do(t, http.MethodPost, url+"/jobs", "", `{"artifact_id":"running"}`)
+	running := res["id"].(string)
+	waitStatus(t, url, running, StatusRunning)
+
+	_, res = do(t, http.MethodPost, url+"/jobs", "", `{"artifact_id":"queued"}`)
+	queued := res["id"].(string)
+
+	// the worker is busy and the queue is full
+	rsp, res := do(t, http.MethodPost, url+"/jobs", "", `{"artifact_id":"rejected"}`)
+	assert.Equal(t, http.StatusServiceUnavailable, rsp.StatusCode)
+	assert.Equal(t, retryAfter, rsp.Header.Get("Retry-After"))
+	assert.Equal(t, "job queue full", res["error"])
+
+	rsp, res = do(t, http.MethodDelete, url+"/jobs/"+queued, "", "")
+	assert.Equal(t, http.StatusOK, rsp.StatusCode)
+	assert.Equal(t, string(StatusCancelled), res["status"])
+
+	rsp, _ = do(t, http.MethodDelete, url+"/jobs/"+running, "", "")
+	assert.Equal(t, http.StatusOK, rsp.StatusCode)
+	res = waitStatus(t, url, running, StatusCancelled)
+	assert.Empty(t, res["error"])
+}
+
+func TestServerDrain(t *testing.T) {
+	testCases := map[string]struct {
+		drainTimeout time.Duration
+
+		status Status
+		err    string
+	}{
+		"running job finishes": {
+			drainTimeout: 10 * time.Second,
+			status:       StatusDone,
+		},
+		"drain timeout cancels running job": {
+			drainTimeout: 10 * time.Millisecond,
+			status:       StatusCancelled,
+			err:          "drain timeout exceeded",
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			started := make(chan struct{})
+			s := New(Config{Concurrency: 1, QueueSize: 1, DrainTimeout: tc.drainTimeout},
+				testTask(func(ctx context.Context) error {
+					close(started)
+
+					select {
+					case <-time.After(200 * time.Millisecond):
+						return nil
+					case <-ctx.Done():
+						return ctx.Err()
+					}
+				}))
+
+			url, stop := start(t, s)
+
+			_, res := do(t, http.MethodPost, url+"/jobs", "", `{"artifact_id":"running"}`)
+			running := res["id"].(string)
+			<-started
+
+			_, res = do(t, http.MethodPost, url+"/jobs", "", `{"artifact_id":"queued"}`)
+			queued := res["id"].(string)
+
+			stop()
+
+			assert.Equal(t, tc.status, s.jobs[running].record().Status)
+			assert.Equal(t, tc.err, s.jobs[running].record().Error)
+			assert.Equal(t, StatusCancelled, s.jobs[queued].record().Status)
+			assert.Equal(t, "server shutting down", s.jobs[queued].record().Error)
+
+			assert.EqualError(t, s.enqueue(newJob("new", &Task{})), "server shutting down")
+		})
+	}
+}
+
+func TestServerMaxFinished(t *testing.T) {
+	s := New(Config{Concurrency: 1, QueueSize: 10, MaxFinished: 2, DrainTimeout: time.Second},
+		testTask(func(ctx context.Context) error { return nil }))
+
+	url, stop := start(t, s)
+	defer stop()
+
+	var ids []string
+	for i := 0; i < 3; i++ {
+		_, res := do(t, http.MethodPost, url+"/jobs", "", `{"artifact_id":"aid"}`)
+		ids = append(ids, res["id"].(string))
+		waitStatus(t, url, ids[i], StatusDone)
+	}
+
+	rsp, _ := do(t, http.MethodGet, url+"/jobs/"+ids[0], "", "")
+	assert.Equal(t, http.StatusNotFound, rsp.StatusCode)
+	for _, id := range ids[1:] {
+		rsp, _ := do(t, http.MethodGet, url+"/jobs/"+id, "", "")
+		assert.Equal(t, http.StatusOK, rsp.StatusCode)
+	}
+}
+
+func TestLogBuffer(t *testing.T) {
+	b := &logBuffer{max: 3}
+
+	_, _ = b.Write([]byte("1\n"))
+	_, _ = b.Write([]byte("2\n3\n"))
+	assert.Equal(t, []string{"1", "2", "3"}, b.Lines())
+
+	_, _ = b.Write([]byte("4\n"))
+	assert.Equal(t, []string{"2", "3", "4"}, b.Lines())
+}
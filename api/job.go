@@ -0,0 +1,191 @@
+// Copyright 2024 Northern.tech AS
+//
+//	Licensed under the Apache License, Version 2.0 (the "License");
+//	you may not use this file except in compliance with the License.
+//	You may obtain a copy of the License at
+//
+//	    http://www.apache.org/licenses/LICENSE-2.0
+//
+//	Unless required by applicable law or agreed to in writing, software
+//	distributed under the License is distributed on an "AS IS" BASIS,
+//	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//	See the License for the specific language governing permissions and
+//	limitations under the License.
+package api
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"sync"
+	"time"
+)
+
+type Status string
+
+const (
+	StatusQueued    Status = "queued"
+	StatusRunning   Status = "running"
+	StatusDone      Status = "done"
+	StatusFailed    Status = "failed"
+	StatusCancelled Status = "cancelled"
+)
+
+// Job is a job as returned by the API; the input parameters, the token
+// included, are never returned.
+type Job struct {
+	Id         string     `json:"id"`
+	Status     Status     `json:"status"`
+	Error      string     `json:"error,omitempty"`
+	ArtifactId string     `json:"artifact_id,omitempty"`
+	TenantId   string     `json:"tenant_id,omitempty"`
+	Created    time.Time  `json:"created"`
+	Started    *time.Time `json:"started,omitempty"`
+	Finished   *time.Time `json:"finished,omitempty"`
+	Logs       []string   `json:"logs,omitempty"`
+}
+
+type job struct {
+	Job
+
+	mu        sync.Mutex
+	task      *Task
+	logs      *logBuffer
+	stop      context.CancelFunc
+	cancelled bool
+}
+
+func newJob(id string, task *Task) *job {
+	return &job{
+		Job: Job{
+			Id:         id,
+			Status:     StatusQueued,
+			ArtifactId: task.ArtifactId,
+			TenantId:   task.TenantId,
+			Created:    time.Now().UTC(),
+		},
+		task: task,
+		logs: &logBuffer{max: maxLogLines},
+	}
+}
+
+func (j *job) record() Job {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	return j.Job
+}
+
+// start marks j as running, returning its context; false if j was
+// cancelled while queued.
+func (j *job) start(ctx context.Context) (context.Context, bool) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if j.Status != StatusQueued {
+		return nil, false
+	}
+
+	ctx, j.stop = context.WithCancel(ctx)
+	now := time.Now().UTC()
+	j.Status = StatusRunning
+	j.Started = &now
+
+	return ctx, true
+}
+
+func (j *job) end(err error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	j.stop()
+
+	now := time.Now().UTC()
+	j.Finished = &now
+
+	switch {
+	case j.cancelled:
+		j.Status = StatusCancelled
+	case err != nil:
+		j.Status = StatusFailed
+		j.Error = err.Error()
+	default:
+		j.Status = StatusDone
+	}
+}
+
+// cancel cancels a queued or running job; false if it already finished.
+func (j *job) cancel() bool {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	switch j.Status {
+	case StatusQueued:
+		j.setCancelled("")
+	case StatusRunning:
+		j.cancelled = true
+		j.stop()
+	default:
+		return false
+	}
+
+	return true
+}
+
+// cancelQueued cancels j if it's still queued.
+func (j *job) cancelQueued(reason string) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if j.Status == StatusQueued {
+		j.setCancelled(reason)
+	}
+}
+
+// cancelRunning marks j cancelled if it's running; its context is
+// cancelled by the caller.
+func (j *job) cancelRunning(reason string) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if j.Status == StatusRunning {
+		j.cancelled = true
+		j.Error = reason
+	}
+}
+
+func (j *job) setCancelled(reason string) {
+	now := time.Now().UTC()
+	j.cancelled = true
+	j.Status = StatusCancelled
+	j.Error = reason
+	j.Finished = &now
+}
+
+// logBuffer keeps the last max lines written to it.
+type logBuffer struct {
+	mu    sync.Mutex
+	max   int
+	lines []string
+}
+
+func (b *logBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for _, line := range strings.Split(string(bytes.TrimRight(p, "\n")), "\n") {
+		b.lines = append(b.lines, line)
+	}
+	if over := len(b.lines) - b.max; over > 0 {
+		b.lines = append([]string(nil), b.lines[over:]...)
+	}
+
+	return len(p), nil
+}
+
+func (b *logBuffer) Lines() []string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return append([]string(nil), b.lines...)
+}
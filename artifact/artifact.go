@@ -0,0 +1,422 @@
+// Copyright 2024 Northern.tech AS
+//
+//	Licensed under the Apache License, Version 2.0 (the "License");
+//	you may not use this file except in compliance with the License.
+//	You may obtain a copy of the License at
+//
+//	    http://www.apache.org/licenses/LICENSE-2.0
+//
+//	Unless required by applicable law or agreed to in writing, software
+//	distributed under the License is distributed on an "AS IS" BASIS,
+//	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//	See the License for the specific language governing permissions and
+//	limitations under the License.
+
+// Package artifact reads Mender artifacts: a tar of the version, the
+// manifest, a compressed header tar and a compressed data tar per payload.
+// It's what the inspect command prints, and is meant for other tooling too.
+package artifact
+
+import (
+	"archive/tar"
+	"bufio"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/pkg/errors"
+)
+
+// Artifact is what the header of an artifact says about it, and the
+// files its payloads carry.
+type Artifact struct {
+	Format  string `json:"format"`
+	Version int    `json:"version"`
+
+	// Compression is the header's: gzip, zstd or none
+	Compression string `json:"compression"`
+	Signed      bool   `json:"signed"`
+
+	Name        string   `json:"name"`
+	DeviceTypes []string `json:"device_types"`
+
+	Provides map[string]string `json:"provides,omitempty"`
+	Depends  Depends           `json:"depends,omitempty"`
+
+	Payloads []Payload `json:"payloads"`
+}
+
+type Payload struct {
+	Type string `json:"type"`
+
+	Provides map[string]string `json:"provides,omitempty"`
+	Depends  Depends           `json:"depends,omitempty"`
+
+	Files []File `json:"files"`
+}
+
+type File struct {
+	Name     string `json:"name"`
+	Size     int64  `json:"size"`
+	Checksum string `json:"checksum"`
+}
+
+// Depends maps keys to the accepted values; the format allows a single
+// value as a plain string.
+type Depends map[string][]string
+
+func (d *Depends) UnmarshalJSON(b []byte) error {
+	raw := map[string]json.RawMessage{}
+	if err := json.Unmarshal(b, &raw); err != nil {
+		return err
+	}
+
+	*d = Depends{}
+	for k, v := range raw {
+		var l []string
+		if err := json.Unmarshal(v, &l); err != nil {
+			var s string
+			if err := json.Unmarshal(v, &s); err != nil {
+				return errors.Errorf("invalid depends %q", k)
+			}
+			l = []string{s}
+		}
+		(*d)[k] = l
+	}
+
+	return nil
+}
+
+type version struct {
+	Format  string `json:"format"`
+	Version int    `json:"version"`
+}
+
+// headerInfo is the header-info of format versions 2 and 3
+type headerInfo struct {
+	// version 3
+	Payloads         []struct{ Type string } `json:"payloads"`
+	ArtifactProvides map[string]string       `json:"artifact_provides"`
+	ArtifactDepends  Depends                 `json:"artifact_depends"`
+
+	// version 2
+	Updates               []struct{ Type string } `json:"updates"`
+	DeviceTypesCompatible []string                `json:"device_types_compatible"`
+	ArtifactName          string                  `json:"artifact_name"`
+}
+
+type typeInfo struct {
+	Type             string            `json:"type"`
+	ArtifactProvides map[string]string `json:"artifact_provides"`
+	ArtifactDepends  Depends           `json:"artifact_depends"`
+}
+
+// Read reads the artifact from r; the checksums of the files are
+// verified if the manifest has them.
+func Read(r io.Reader) (*Artifact, error) {
+	a := &Artifact{}
+	var sums map[string]string
+
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to read artifact")
+		}
+
+		name := hdr.Name
+		switch {
+		case name == "version":
+			v := version{}
+			if err := json.NewDecoder(tr).Decode(&v); err != nil {
+				return nil, errors.Wrap(err, "invalid version")
+			}
+			if v.Format != "mender" || v.Version < 2 || v.Version > 3 {
+				return nil, errors.Errorf("unsupported artifact format %s version %d",
+					v.Format, v.Version)
+			}
+			a.Format, a.Version = v.Format, v.Version
+		case name == "manifest":
+			if sums, err = readManifest(tr); err != nil {
+				return nil, err
+			}
+		case name == "manifest.sig":
+			a.Signed = true
+		case isCompressed(name, "header.tar"):
+			if a.Version == 0 {
+				return nil, errors.New("invalid artifact: header before version")
+			}
+			if err := a.readHeader(tr, name); err != nil {
+				return nil, err
+			}
+			a.Compression = compression(name)
+		case strings.HasPrefix(name, "data/"):
+			if err := a.readData(tr, name, sums); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if a.Version == 0 {
+		return nil, errors.New("invalid artifact: no version")
+	}
+	if a.Payloads == nil {
+		return nil, errors.New("invalid artifact: no header")
+	}
+
+	return a, nil
+}
+
+// isCompressed tells if name is base, compressed.
+func isCompressed(name, base string) bool {
+	return name == base+".gz" || name == base+".zst" || name == base+".xz" || name == base
+}
+
+// compression names the compression of name
+func compression(name string) string {
+	switch path.Ext(name) {
+	case ".gz":
+		return "gzip"
+	case ".zst":
+		return "zstd"
+	case ".xz":
+		return "xz"
+	}
+	return "none"
+}
+
+// readManifest returns the checksums of the manifest, by file name
+func readManifest(r io.Reader) (map[string]string, error) {
+	sums := map[string]string{}
+
+	s := bufio.NewScanner(r)
+	for s.Scan() {
+		f := strings.Fields(s.Text())
+		if len(f) == 0 {
+			continue
+		}
+		if len(f) != 2 {
+			return nil, errors.Errorf("invalid manifest line %q", s.Text())
+		}
+		sums[f[1]] = f[0]
+	}
+	if err := s.Err(); err != nil {
+		return nil, errors.Wrap(err, "failed to read manifest")
+	}
+
+	return sums, nil
+}
+
+func decompress(r io.Reader, name string) (io.Reader, func(), error) {
+	switch path.Ext(name) {
+	case ".gz":
+		zr, err := gzip.NewReader(r)
+		if err != nil {
+			return nil, nil, errors.Wrapf(err, "failed to decompress %s", name)
+		}
+		return zr, func() { zr.Close() }, nil
+	case ".zst":
+		zr, err := zstd.NewReader(r)
+		if err != nil {
+			return nil, nil, errors.Wrapf(err, "failed to decompress %s", name)
+		}
+		return zr, zr.Close, nil
+	case ".tar":
+		return r, func() {}, nil
+	}
+
+	return nil, nil, errors.Errorf("unsupported compression of %s", name)
+}
+
+func (a *Artifact) readHeader(r io.Reader, name string) error {
+	zr, closer, err := decompress(r, name)
+	if err != nil {
+		return err
+	}
+	defer closer()
+
+	tr := tar.NewReader(zr)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return errors.Wrap(err, "failed to read header")
+		}
+
+		switch {
+		case hdr.Name == "header-info":
+			hi := headerInfo{}
+			if err := json.NewDecoder(tr).Decode(&hi); err != nil {
+				return errors.Wrap(err, "invalid header-info")
+			}
+			a.setHeaderInfo(&hi)
+		case path.Base(hdr.Name) == "type-info":
+			p, err := a.payload(hdr.Name)
+			if err != nil {
+				return err
+			}
+			ti := typeInfo{}
+			if err := json.NewDecoder(tr).Decode(&ti); err != nil {
+				return errors.Wrapf(err, "invalid %s", hdr.Name)
+			}
+			if ti.Type != "" {
+				p.Type = ti.Type
+			}
+			p.Provides = ti.ArtifactProvides
+			p.Depends = ti.ArtifactDepends
+		}
+	}
+
+	if a.Payloads == nil {
+		return errors.New("invalid header: no header-info")
+	}
+
+	return nil
+}
+
+func (a *Artifact) setHeaderInfo(hi *headerInfo) {
+	payloads := hi.Payloads
+	if a.Version == 2 {
+		payloads = hi.Updates
+		a.Name = hi.ArtifactName
+		a.DeviceTypes = hi.DeviceTypesCompatible
+	} else {
+		a.Provides = hi.ArtifactProvides
+		a.Depends = hi.ArtifactDepends
+		a.Name = hi.ArtifactProvides["artifact_name"]
+		a.DeviceTypes = hi.ArtifactDepends["device_type"]
+	}
+
+	a.Payloads = make([]Payload, len(payloads))
+	for i, p := range payloads {
+		a.Payloads[i].Type = p.Type
+	}
+}
+
+// payload returns the payload of a header or data file, e.g.
+// headers/0000/type-info or data/0000.tar.gz
+func (a *Artifact) payload(name string) (*Payload, error) {
+	parts := strings.Split(name, "/")
+	var i int
+	if len(parts) < 2 {
+		return nil, errors.Errorf("invalid artifact: unexpected %s", name)
+	}
+	if _, err := fmt.Sscanf(parts[1], "%04d", &i); err != nil || i >= len(a.Payloads) {
+		return nil, errors.Errorf("invalid artifact: %s of no payload", name)
+	}
+
+	return &a.Payloads[i], nil
+}
+
+func (a *Artifact) readData(r io.Reader, name string, sums map[string]string) error {
+	p, err := a.payload(name)
+	if err != nil {
+		return err
+	}
+
+	zr, closer, err := decompress(r, name)
+	if err != nil {
+		return err
+	}
+	defer closer()
+
+	tr := tar.NewReader(zr)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return errors.Wrapf(err, "failed to read %s", name)
+		}
+
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+
+		h := sha256.New()
+		if _, err := io.Copy(h, tr); err != nil {
+			return errors.Wrapf(err, "failed to read %s", name)
+		}
+		sum := hex.EncodeToString(h.Sum(nil))
+
+		// the manifest lists the files as data/0000/<name>
+		key := strings.SplitN(name, ".", 2)[0] + "/" + hdr.Name
+		if s, ok := sums[key]; ok && s != sum {
+			return errors.Errorf("invalid artifact: checksum mismatch of %s", key)
+		}
+
+		p.Files = append(p.Files, File{Name: hdr.Name, Size: hdr.Size, Checksum: sum})
+	}
+
+	return nil
+}
+
+// String summarizes the artifact, like mender-artifact read.
+func (a *Artifact) String() string {
+	var b strings.Builder
+
+	fmt.Fprintf(&b, "Format: %s, version %d\n", a.Format, a.Version)
+	fmt.Fprintf(&b, "Compression: %s\n", a.Compression)
+	if a.Signed {
+		fmt.Fprintf(&b, "Signature: yes\n")
+	} else {
+		fmt.Fprintf(&b, "Signature: no\n")
+	}
+	fmt.Fprintf(&b, "Name: %s\n", a.Name)
+	fmt.Fprintf(&b, "Compatible devices: %s\n", strings.Join(a.DeviceTypes, ", "))
+	writeMap(&b, "", "Provides", a.Provides)
+	writeDepends(&b, "", a.Depends)
+
+	for i, p := range a.Payloads {
+		fmt.Fprintf(&b, "Payload %d: %s\n", i, p.Type)
+		writeMap(&b, "  ", "Provides", p.Provides)
+		writeDepends(&b, "  ", p.Depends)
+		fmt.Fprintf(&b, "  Files:\n")
+		for _, f := range p.Files {
+			fmt.Fprintf(&b, "    %s (%d bytes, sha256 %s)\n", f.Name, f.Size, f.Checksum)
+		}
+	}
+
+	return b.String()
+}
+
+func writeMap(b *strings.Builder, indent, title string, m map[string]string) {
+	if len(m) == 0 {
+		return
+	}
+
+	fmt.Fprintf(b, "%s%s:\n", indent, title)
+	for _, k := range sortedKeys(m) {
+		fmt.Fprintf(b, "%s  %s: %s\n", indent, k, m[k])
+	}
+}
+
+func writeDepends(b *strings.Builder, indent string, d Depends) {
+	m := map[string]string{}
+	for k, v := range d {
+		m[k] = strings.Join(v, ", ")
+	}
+	writeMap(b, indent, "Depends", m)
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,267 @@
+// Copyright 2024 Northern.tech AS
+//
+//	Licensed under the Apache License, Version 2.0 (the "License");
+//	you may not use this file except in compliance with the License.
+//	You may obtain a copy of the License at
+//
+//	    http://www.apache.org/licenses/LICENSE-2.0
+//
+//	Unless required by applicable law or agreed to in writing, software
+//	distributed under the License is distributed on an "AS IS" BASIS,
+//	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//	See the License for the specific language governing permissions and
+//	limitations under the License.
+package artifact
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/stretchr/testify/assert"
+)
+
+// the checksums of the files of testArtifactV3
+const (
+	sumHello = "2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824"
+	sumEtc   = "2824684de3d1a19390ca88cf826e77c6f750657e552edb83d466666c37521a08"
+)
+
+type entry struct {
+	name string
+	data []byte
+}
+
+func tarOf(t *testing.T, entries ...entry) []byte {
+	var b bytes.Buffer
+	tw := tar.NewWriter(&b)
+	for _, e := range entries {
+		assert.NoError(t, tw.WriteHeader(&tar.Header{
+			Name: e.name,
+			Mode: 0644,
+			Size: int64(len(e.data)),
+		}))
+		_, err := tw.Write(e.data)
+		assert.NoError(t, err)
+	}
+	assert.NoError(t, tw.Close())
+	return b.Bytes()
+}
+
+func gz(t *testing.T, b []byte) []byte {
+	var out bytes.Buffer
+	zw := gzip.NewWriter(&out)
+	_, err := zw.Write(b)
+	assert.NoError(t, err)
+	assert.NoError(t, zw.Close())
+	return out.Bytes()
+}
+
+func zst(t *testing.T, b []byte) []byte {
+	var out bytes.Buffer
+	zw, err := zstd.NewWriter(&out)
+	assert.NoError(t, err)
+	_, err = zw.Write(b)
+	assert.NoError(t, err)
+	assert.NoError(t, zw.Close())
+	return out.Bytes()
+}
+
+func testArtifactV3(t *testing.T, ext string, compress func(*testing.T, []byte) []byte) []byte {
+	header := tarOf(t,
+		entry{"header-info", []byte(`{"payloads":[{"type":"single-file"}],` +
+			`"artifact_provides":{"artifact_name":"release-1"},` +
+			`"artifact_depends":{"device_type":["dt1","dt2"]}}`)},
+		entry{"headers/0000/type-info", []byte(`{"type":"single-file",` +
+			`"artifact_provides":{"rootfs-image.single-file.version":"release-1"},` +
+			`"artifact_depends":{"rootfs-image.checksum":"abc"}}`)},
+		entry{"headers/0000/meta-data", []byte(`{"dest_dir":"/etc"}`)},
+	)
+	data := tarOf(t, entry{"file", []byte("hello")}, entry{"dest_dir", []byte("/etc")})
+
+	return tarOf(t,
+		entry{"version", []byte(`{"format":"mender","version":3}`)},
+		entry{"manifest", []byte("")},
+		entry{"header.tar" + ext, compress(t, header)},
+		entry{"data/0000.tar" + ext, compress(t, data)},
+	)
+}
+
+func TestRead(t *testing.T) {
+	v2 := tarOf(t,
+		entry{"version", []byte(`{"format":"mender","version":2}`)},
+		entry{"manifest", []byte("")},
+		entry{"header.tar.gz", gz(t, tarOf(t,
+			entry{"header-info", []byte(`{"updates":[{"type":"rootfs-image"}],` +
+				`"device_types_compatible":["dt"],"artifact_name":"old"}`)},
+			entry{"headers/0000/type-info", []byte(`{"type":"rootfs-image"}`)},
+		))},
+		entry{"data/0000.tar.gz", gz(t, tarOf(t, entry{"rootfs.ext4", []byte("fs")}))},
+	)
+
+	v3 := func(compression string) *Artifact {
+		return &Artifact{
+			Format:      "mender",
+			Version:     3,
+			Compression: compression,
+			Name:        "release-1",
+			DeviceTypes: []string{"dt1", "dt2"},
+			Provides:    map[string]string{"artifact_name": "release-1"},
+			Depends:     Depends{"device_type": {"dt1", "dt2"}},
+			Payloads: []Payload{{
+				Type:     "single-file",
+				Provides: map[string]string{"rootfs-image.single-file.version": "release-1"},
+				Depends:  Depends{"rootfs-image.checksum": {"abc"}},
+				Files: []File{
+					{Name: "file", Size: 5, Checksum: sumHello},
+					{Name: "dest_dir", Size: 4, Checksum: sumEtc},
+				},
+			}},
+		}
+	}
+
+	// signed, with the checksums of the files in the manifest
+	signed := func(fileSum string) []byte {
+		return tarOf(t,
+			entry{"version", []byte(`{"format":"mender","version":3}`)},
+			entry{"manifest", []byte(fileSum + "  data/0000/file\n" +
+				sumEtc + "  data/0000/dest_dir\n")},
+			entry{"manifest.sig", []byte("c2lnbmF0dXJl")},
+			entry{"header.tar", tarOf(t, entry{"header-info", []byte(
+				`{"payloads":[{"type":"single-file"}],` +
+					`"artifact_provides":{"artifact_name":"release-1"},` +
+					`"artifact_depends":{"device_type":["dt1","dt2"]}}`)})},
+			entry{"data/0000.tar", tarOf(t,
+				entry{"file", []byte("hello")}, entry{"dest_dir", []byte("/etc")})},
+		)
+	}
+
+	testCases := map[string]struct {
+		artifact []byte
+
+		res *Artifact
+		err string
+	}{
+		"v3, gzip": {
+			artifact: testArtifactV3(t, ".gz", gz),
+			res:      v3("gzip"),
+		},
+		"v3, zstd": {
+			artifact: testArtifactV3(t, ".zst", zst),
+			res:      v3("zstd"),
+		},
+		"v3, signed": {
+			artifact: signed(sumHello),
+			res: &Artifact{
+				Format:      "mender",
+				Version:     3,
+				Compression: "none",
+				Signed:      true,
+				Name:        "release-1",
+				DeviceTypes: []string{"dt1", "dt2"},
+				Provides:    map[string]string{"artifact_name": "release-1"},
+				Depends:     Depends{"device_type": {"dt1", "dt2"}},
+				Payloads: []Payload{{
+					Type: "single-file",
+					Files: []File{
+						{Name: "file", Size: 5, Checksum: sumHello},
+						{Name: "dest_dir", Size: 4, Checksum: sumEtc},
+					},
+				}},
+			},
+		},
+		"checksum mismatch": {
+			artifact: signed(sumEtc),
+			err:      "invalid artifact: checksum mismatch of data/0000/file",
+		},
+		"invalid manifest": {
+			artifact: tarOf(t,
+				entry{"version", []byte(`{"format":"mender","version":3}`)},
+				entry{"manifest", []byte("abc\n")},
+			),
+			err: `invalid manifest line "abc"`,
+		},
+		"v2": {
+			artifact: v2,
+			res: &Artifact{
+				Format:      "mender",
+				Version:     2,
+				Compression: "gzip",
+				Name:        "old",
+				DeviceTypes: []string{"dt"},
+				Payloads: []Payload{{
+					Type: "rootfs-image",
+					Files: []File{{Name: "rootfs.ext4", Size: 2,
+						Checksum: "dce7cce055566bed799f788cd0048e209a27a473c0f48b956fa1f1780e80d2c1"}},
+				}},
+			},
+		},
+		"unsupported version": {
+			artifact: tarOf(t, entry{"version", []byte(`{"format":"mender","version":1}`)}),
+			err:      "unsupported artifact format mender version 1",
+		},
+		"unsupported compression": {
+			artifact: tarOf(t,
+				entry{"version", []byte(`{"format":"mender","version":3}`)},
+				entry{"header.tar.xz", []byte("xz")},
+			),
+			err: "unsupported compression of header.tar.xz",
+		},
+		"no header": {
+			artifact: tarOf(t, entry{"version", []byte(`{"format":"mender","version":3}`)}),
+			err:      "invalid artifact: no header",
+		},
+		"data of no payload": {
+			artifact: tarOf(t,
+				entry{"version", []byte(`{"format":"mender","version":2}`)},
+				entry{"header.tar", tarOf(t, entry{"header-info", []byte(`{"updates":[]}`)})},
+				entry{"data/0000.tar", tarOf(t)},
+			),
+			err: "invalid artifact: data/0000.tar of no payload",
+		},
+		"not a tar": {
+			artifact: []byte("generated\n"),
+			err:      "failed to read artifact",
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			a, err := Read(bytes.NewReader(tc.artifact))
+			if tc.err != "" {
+				assert.Error(t, err)
+				assert.Contains(t, err.Error(), tc.err)
+				return
+			}
+
+			assert.NoError(t, err)
+			assert.Equal(t, tc.res, a)
+		})
+	}
+}
+
+func TestArtifactString(t *testing.T) {
+	a, err := Read(bytes.NewReader(testArtifactV3(t, ".gz", gz)))
+	assert.NoError(t, err)
+
+	assert.Equal(t, `Format: mender, version 3
+Compression: gzip
+Signature: no
+Name: release-1
+Compatible devices: dt1, dt2
+Provides:
+  artifact_name: release-1
+Depends:
+  device_type: dt1, dt2
+Payload 0: single-file
+  Provides:
+    rootfs-image.single-file.version: release-1
+  Depends:
+    rootfs-image.checksum: abc
+  Files:
+    file (5 bytes, sha256 `+sumHello+`)
+    dest_dir (4 bytes, sha256 `+sumEtc+`)
+`, a.String())
+}
@@ -0,0 +1,428 @@
+// Copyright 2024 Northern.tech AS
+//
+//	Licensed under the Apache License, Version 2.0 (the "License");
+//	you may not use this file except in compliance with the License.
+//	You may obtain a copy of the License at
+//
+//	    http://www.apache.org/licenses/LICENSE-2.0
+//
+//	Unless required by applicable law or agreed to in writing, software
+//	distributed under the License is distributed on an "AS IS" BASIS,
+//	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//	See the License for the specific language governing permissions and
+//	limitations under the License.
+package artifact
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/pkg/errors"
+)
+
+// maxHeaderSize bounds the header read into memory
+const maxHeaderSize = 16 * 1024 * 1024
+
+// the keys set by Name and DeviceTypes
+var reservedKeys = map[string]bool{
+	"artifact_name":  true,
+	"artifact_group": true,
+	"device_type":    true,
+}
+
+// state scripts of artifacts, e.g. ArtifactInstall_Enter_00
+var scriptRe = regexp.MustCompile(
+	`^Artifact(Install|Reboot|Commit|Rollback|RollbackReboot|Failure)_(Enter|Leave|Error)_[0-9]{2}(_\S+)?$`)
+
+// Modification rewrites header fields of an artifact; the zero values
+// keep them.
+type Modification struct {
+	Name        string
+	DeviceTypes []string
+
+	// Provides and Depends are set in the type-info of each payload; nil
+	// values remove the keys.
+	Provides map[string]*string
+	Depends  map[string][]string
+
+	// Scripts are the state scripts to add or replace, by name; nil
+	// contents remove them.
+	Scripts map[string]*string
+}
+
+func (m *Modification) Validate() error {
+	for k := range m.Provides {
+		if k == "" || reservedKeys[k] {
+			return errors.Errorf("invalid provides key %q", k)
+		}
+	}
+	for k := range m.Depends {
+		if k == "" || reservedKeys[k] {
+			return errors.Errorf("invalid depends key %q", k)
+		}
+	}
+	for n, s := range m.Scripts {
+		if !scriptRe.MatchString(n) {
+			return errors.Errorf("invalid state script name %q", n)
+		}
+		if s != nil && *s == "" {
+			return errors.Errorf("state script %s can't be empty", n)
+		}
+	}
+	for _, dt := range m.DeviceTypes {
+		if dt == "" {
+			return errors.New("device types can't be empty")
+		}
+	}
+
+	return nil
+}
+
+// Empty tells if m changes nothing.
+func (m *Modification) Empty() bool {
+	return m.Name == "" && len(m.DeviceTypes) == 0 && len(m.Provides) == 0 &&
+		len(m.Depends) == 0 && len(m.Scripts) == 0
+}
+
+// Modify copies the version 3 artifact read from r to w, modified by m,
+// with a new manifest signed by s, if not nil; the signature of r is
+// dropped otherwise. The payloads are copied as they are.
+func Modify(r io.Reader, w io.Writer, m *Modification, s Signer) error {
+	if err := m.Validate(); err != nil {
+		return err
+	}
+
+	var version, manifest, header []byte
+	var headerName string
+	written := false
+
+	tr := tar.NewReader(r)
+	tw := tar.NewWriter(w)
+
+	// the manifest comes first, but depends on the header
+	writeHead := func() error {
+		if written {
+			return nil
+		}
+		written = true
+
+		if version == nil || header == nil || manifest == nil {
+			return errors.New("invalid artifact: no version, manifest or header")
+		}
+
+		sum := sha256.Sum256(header)
+		mf, err := setChecksum(manifest, headerName, hex.EncodeToString(sum[:]))
+		if err != nil {
+			return err
+		}
+
+		if err := writeFile(tw, "version", version); err != nil {
+			return err
+		}
+		if err := writeFile(tw, "manifest", mf); err != nil {
+			return err
+		}
+		if s != nil {
+			sig, err := s.Sign(mf)
+			if err != nil {
+				return err
+			}
+			if err := writeFile(tw, "manifest.sig", sig); err != nil {
+				return err
+			}
+		}
+		return writeFile(tw, headerName, header)
+	}
+
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return errors.Wrap(err, "failed to read artifact")
+		}
+
+		name := hdr.Name
+		switch {
+		case name == "version":
+			if version, err = io.ReadAll(io.LimitReader(tr, maxHeaderSize)); err != nil {
+				return errors.Wrap(err, "failed to read version")
+			}
+			v := struct {
+				Format  string `json:"format"`
+				Version int    `json:"version"`
+			}{}
+			if err := json.Unmarshal(version, &v); err != nil {
+				return errors.Wrap(err, "invalid version")
+			}
+			if v.Format != "mender" || v.Version != 3 {
+				return errors.Errorf("can't modify artifact format %s version %d, only mender 3",
+					v.Format, v.Version)
+			}
+		case name == "manifest":
+			if manifest, err = io.ReadAll(io.LimitReader(tr, maxHeaderSize)); err != nil {
+				return errors.Wrap(err, "failed to read manifest")
+			}
+		case name == "manifest.sig":
+			// invalid once modified
+		case isCompressed(name, "header.tar"):
+			if version == nil {
+				return errors.New("invalid artifact: header before version")
+			}
+			headerName = name
+			if header, err = modifyHeader(tr, name, m); err != nil {
+				return err
+			}
+		case strings.HasPrefix(name, "data/"):
+			if err := writeHead(); err != nil {
+				return err
+			}
+			if err := tw.WriteHeader(dataHeader(hdr)); err != nil {
+				return errors.Wrap(err, "failed to write artifact")
+			}
+			if _, err := io.Copy(tw, tr); err != nil {
+				return errors.Wrapf(err, "failed to copy %s", name)
+			}
+		default:
+			// e.g. the augmented headers of delta artifacts
+			return errors.Errorf("can't modify artifacts with %s", name)
+		}
+	}
+
+	if err := writeHead(); err != nil {
+		return err
+	}
+
+	return errors.Wrap(tw.Close(), "failed to write artifact")
+}
+
+func dataHeader(hdr *tar.Header) *tar.Header {
+	return &tar.Header{
+		Name:     hdr.Name,
+		Mode:     hdr.Mode,
+		Size:     hdr.Size,
+		ModTime:  hdr.ModTime,
+		Typeflag: tar.TypeReg,
+	}
+}
+
+func writeFile(tw *tar.Writer, name string, data []byte) error {
+	err := tw.WriteHeader(&tar.Header{
+		Name:     name,
+		Mode:     0644,
+		Size:     int64(len(data)),
+		Typeflag: tar.TypeReg,
+	})
+	if err == nil {
+		_, err = tw.Write(data)
+	}
+
+	return errors.Wrapf(err, "failed to write %s", name)
+}
+
+// setChecksum sets the checksum of name in the manifest, lines of
+// "<sha256>  <name>".
+func setChecksum(manifest []byte, name, sum string) ([]byte, error) {
+	var b bytes.Buffer
+	found := false
+
+	for _, l := range strings.Split(strings.TrimSuffix(string(manifest), "\n"), "\n") {
+		fields := strings.Fields(l)
+		if len(fields) != 2 {
+			return nil, errors.Errorf("invalid manifest line %q", l)
+		}
+		if fields[1] == name {
+			fields[0] = sum
+			found = true
+		}
+		fmt.Fprintf(&b, "%s  %s\n", fields[0], fields[1])
+	}
+
+	if !found {
+		return nil, errors.Errorf("invalid manifest: no %s", name)
+	}
+
+	return b.Bytes(), nil
+}
+
+// modifyHeader returns the header tar read from r, modified by m and
+// compressed like r.
+func modifyHeader(r io.Reader, name string, m *Modification) ([]byte, error) {
+	zr, closer, err := decompress(r, name)
+	if err != nil {
+		return nil, err
+	}
+	defer closer()
+
+	var out bytes.Buffer
+	zw, err := compress(&out, name)
+	if err != nil {
+		return nil, err
+	}
+
+	tr := tar.NewReader(io.LimitReader(zr, maxHeaderSize))
+	tw := tar.NewWriter(zw)
+
+	scripts := map[string]*string{}
+	for n, s := range m.Scripts {
+		scripts[n] = s
+	}
+	// addScripts adds the new scripts, after the existing ones
+	addScripts := func() error {
+		names := make([]string, 0, len(scripts))
+		for n := range scripts {
+			names = append(names, n)
+		}
+		sort.Strings(names)
+
+		for _, n := range names {
+			if s := scripts[n]; s != nil {
+				if err := writeFile(tw, "scripts/"+n, []byte(*s)); err != nil {
+					return err
+				}
+			}
+			delete(scripts, n)
+		}
+		return nil
+	}
+
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to read header")
+		}
+
+		data, err := io.ReadAll(tr)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to read header")
+		}
+
+		switch {
+		case hdr.Name == "header-info":
+			data, err = modifyJSON(data, m.modifyHeaderInfo)
+		case strings.HasPrefix(hdr.Name, "scripts/"):
+			if s, ok := scripts[path.Base(hdr.Name)]; ok {
+				delete(scripts, path.Base(hdr.Name))
+				if s == nil {
+					continue
+				}
+				data = []byte(*s)
+			}
+		case strings.HasPrefix(hdr.Name, "headers/"):
+			// the scripts precede the payload headers
+			err = addScripts()
+			if err == nil && path.Base(hdr.Name) == "type-info" {
+				data, err = modifyJSON(data, m.modifyTypeInfo)
+			}
+		}
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to modify %s", hdr.Name)
+		}
+
+		if err := writeFile(tw, hdr.Name, data); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := addScripts(); err != nil {
+		return nil, err
+	}
+	if err := tw.Close(); err != nil {
+		return nil, errors.Wrap(err, "failed to write header")
+	}
+	if err := zw.Close(); err != nil {
+		return nil, errors.Wrap(err, "failed to write header")
+	}
+
+	return out.Bytes(), nil
+}
+
+func compress(w io.Writer, name string) (io.WriteCloser, error) {
+	switch path.Ext(name) {
+	case ".gz":
+		return gzip.NewWriter(w), nil
+	case ".zst":
+		return zstd.NewWriter(w)
+	case ".tar":
+		return nopCloser{w}, nil
+	}
+
+	return nil, errors.Errorf("unsupported compression of %s", name)
+}
+
+type nopCloser struct {
+	io.Writer
+}
+
+func (nopCloser) Close() error { return nil }
+
+// modifyJSON applies fn to the json object b, keeping the fields fn
+// doesn't know about.
+func modifyJSON(b []byte, fn func(map[string]interface{})) ([]byte, error) {
+	obj := map[string]interface{}{}
+	if err := json.Unmarshal(b, &obj); err != nil {
+		return nil, err
+	}
+
+	fn(obj)
+
+	return json.Marshal(obj)
+}
+
+// object returns the json object obj[key], adding it if missing.
+func object(obj map[string]interface{}, key string) map[string]interface{} {
+	o, ok := obj[key].(map[string]interface{})
+	if !ok {
+		o = map[string]interface{}{}
+		obj[key] = o
+	}
+	return o
+}
+
+func (m *Modification) modifyHeaderInfo(hi map[string]interface{}) {
+	if m.Name != "" {
+		object(hi, "artifact_provides")["artifact_name"] = m.Name
+	}
+	if len(m.DeviceTypes) > 0 {
+		object(hi, "artifact_depends")["device_type"] = m.DeviceTypes
+	}
+}
+
+func (m *Modification) modifyTypeInfo(ti map[string]interface{}) {
+	if len(m.Provides) > 0 {
+		provides := object(ti, "artifact_provides")
+		for k, v := range m.Provides {
+			if v == nil {
+				delete(provides, k)
+			} else {
+				provides[k] = *v
+			}
+		}
+	}
+
+	if len(m.Depends) > 0 {
+		depends := object(ti, "artifact_depends")
+		for k, v := range m.Depends {
+			if v == nil {
+				delete(depends, k)
+			} else {
+				depends[k] = v
+			}
+		}
+	}
+}
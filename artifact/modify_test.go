@@ -0,0 +1,338 @@
+// Copyright 2024 Northern.tech AS
+//
+//	Licensed under the Apache License, Version 2.0 (the "License");
+//	you may not use this file except in compliance with the License.
+//	You may obtain a copy of the License at
+//
+//	    http://www.apache.org/licenses/LICENSE-2.0
+//
+//	Unless required by applicable law or agreed to in writing, software
+//	distributed under the License is distributed on an "AS IS" BASIS,
+//	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//	See the License for the specific language governing permissions and
+//	limitations under the License.
+package artifact
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"math/big"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// testArtifact is a v3 artifact, with a manifest, of a header with the
+// entries given.
+func testArtifact(t *testing.T, ext string, compress func(*testing.T, []byte) []byte,
+	sig bool, header ...entry) []byte {
+	version := []byte(`{"format":"mender","version":3}`)
+	h := compress(t, tarOf(t, header...))
+	data := compress(t, tarOf(t, entry{"file", []byte("hello")}))
+
+	var manifest bytes.Buffer
+	for _, e := range []entry{{"version", version}, {"header.tar" + ext, h}, {"data/0000.tar" + ext, data}} {
+		sum := sha256.Sum256(e.data)
+		fmt.Fprintf(&manifest, "%s  %s\n", hex.EncodeToString(sum[:]), e.name)
+	}
+
+	entries := []entry{{"version", version}, {"manifest", manifest.Bytes()}}
+	if sig {
+		entries = append(entries, entry{"manifest.sig", []byte("c2lnbmF0dXJl")})
+	}
+	return tarOf(t, append(entries,
+		entry{"header.tar" + ext, h},
+		entry{"data/0000.tar" + ext, data},
+	)...)
+}
+
+func testHeader() []entry {
+	return []entry{
+		{"header-info", []byte(`{"payloads":[{"type":"single-file"}],` +
+			`"artifact_provides":{"artifact_name":"release-1"},` +
+			`"artifact_depends":{"device_type":["dt1"]}}`)},
+		{"scripts/ArtifactInstall_Enter_00", []byte("#!/bin/sh\necho enter\n")},
+		{"scripts/ArtifactCommit_Leave_00", []byte("#!/bin/sh\necho leave\n")},
+		{"headers/0000/type-info", []byte(`{"type":"single-file",` +
+			`"artifact_provides":{"rootfs-image.single-file.version":"release-1","old":"x"},` +
+			`"artifact_depends":{"rootfs-image.checksum":"abc"},` +
+			`"clears_artifact_provides":["rootfs-image.single-file.*"]}`)},
+		{"headers/0000/meta-data", []byte(`{"dest_dir":"/etc"}`)},
+	}
+}
+
+// untar returns the files of a tar, and their order
+func untar(t *testing.T, r io.Reader) (map[string][]byte, []string) {
+	files := map[string][]byte{}
+	var names []string
+
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		assert.NoError(t, err)
+		b, err := io.ReadAll(tr)
+		assert.NoError(t, err)
+		files[hdr.Name] = b
+		names = append(names, hdr.Name)
+	}
+
+	return files, names
+}
+
+// checkManifest verifies the checksums of the manifest of an artifact
+func checkManifest(t *testing.T, files map[string][]byte) {
+	for _, l := range strings.Split(strings.TrimSpace(string(files["manifest"])), "\n") {
+		f := strings.Fields(l)
+		assert.Len(t, f, 2)
+		sum := sha256.Sum256(files[f[1]])
+		assert.Equal(t, hex.EncodeToString(sum[:]), f[0], f[1])
+	}
+}
+
+func str(s string) *string {
+	return &s
+}
+
+func TestModify(t *testing.T) {
+	tc := map[string]struct {
+		artifact []byte
+		mod      Modification
+
+		res     *Artifact
+		scripts map[string]string
+		err     string
+	}{
+		"name and device types": {
+			artifact: testArtifact(t, ".gz", gz, false, testHeader()...),
+			mod: Modification{
+				Name:        "release-2",
+				DeviceTypes: []string{"dt1", "dt2"},
+			},
+			res: &Artifact{
+				Format:      "mender",
+				Version:     3,
+				Compression: "gzip",
+				Name:        "release-2",
+				DeviceTypes: []string{"dt1", "dt2"},
+				Provides:    map[string]string{"artifact_name": "release-2"},
+				Depends:     Depends{"device_type": {"dt1", "dt2"}},
+				Payloads: []Payload{{
+					Type: "single-file",
+					Provides: map[string]string{
+						"rootfs-image.single-file.version": "release-1",
+						"old":                              "x",
+					},
+					Depends: Depends{"rootfs-image.checksum": {"abc"}},
+					Files:   []File{{Name: "file", Size: 5, Checksum: sumHello}},
+				}},
+			},
+			scripts: map[string]string{
+				"ArtifactInstall_Enter_00": "#!/bin/sh\necho enter\n",
+				"ArtifactCommit_Leave_00":  "#!/bin/sh\necho leave\n",
+			},
+		},
+		"provides, depends and scripts, zstd": {
+			artifact: testArtifact(t, ".zst", zst, true, testHeader()...),
+			mod: Modification{
+				Provides: map[string]*string{
+					"rootfs-image.single-file.version": str("release-2"),
+					"old":                              nil,
+				},
+				Depends: map[string][]string{
+					"rootfs-image.checksum": nil,
+					"rootfs-image.version":  {"v1", "v2"},
+				},
+				Scripts: map[string]*string{
+					"ArtifactInstall_Enter_00":   str("#!/bin/sh\necho new\n"),
+					"ArtifactCommit_Leave_00":    nil,
+					"ArtifactFailure_Enter_01_x": str("#!/bin/sh\necho failed\n"),
+				},
+			},
+			res: &Artifact{
+				Format:      "mender",
+				Version:     3,
+				Compression: "zstd",
+				Name:        "release-1",
+				DeviceTypes: []string{"dt1"},
+				Provides:    map[string]string{"artifact_name": "release-1"},
+				Depends:     Depends{"device_type": {"dt1"}},
+				Payloads: []Payload{{
+					Type:     "single-file",
+					Provides: map[string]string{"rootfs-image.single-file.version": "release-2"},
+					Depends:  Depends{"rootfs-image.version": {"v1", "v2"}},
+					Files:    []File{{Name: "file", Size: 5, Checksum: sumHello}},
+				}},
+			},
+			scripts: map[string]string{
+				"ArtifactInstall_Enter_00":   "#!/bin/sh\necho new\n",
+				"ArtifactFailure_Enter_01_x": "#!/bin/sh\necho failed\n",
+			},
+		},
+		"version 2": {
+			artifact: tarOf(t, entry{"version", []byte(`{"format":"mender","version":2}`)}),
+			mod:      Modification{Name: "x"},
+			err:      "can't modify artifact format mender version 2, only mender 3",
+		},
+		"augmented": {
+			artifact: tarOf(t,
+				entry{"version", []byte(`{"format":"mender","version":3}`)},
+				entry{"manifest-augment", nil},
+			),
+			mod: Modification{Name: "x"},
+			err: "can't modify artifacts with manifest-augment",
+		},
+		"invalid script": {
+			artifact: testArtifact(t, ".gz", gz, false, testHeader()...),
+			mod:      Modification{Scripts: map[string]*string{"Download_Enter_00": str("x")}},
+			err:      `invalid state script name "Download_Enter_00"`,
+		},
+		"reserved key": {
+			artifact: testArtifact(t, ".gz", gz, false, testHeader()...),
+			mod:      Modification{Provides: map[string]*string{"artifact_name": str("x")}},
+			err:      `invalid provides key "artifact_name"`,
+		},
+	}
+
+	for name, tc := range tc {
+		t.Run(name, func(t *testing.T) {
+			var out bytes.Buffer
+			err := Modify(bytes.NewReader(tc.artifact), &out, &tc.mod, nil)
+			if tc.err != "" {
+				assert.EqualError(t, err, tc.err)
+				return
+			}
+			assert.NoError(t, err)
+
+			a, err := Read(bytes.NewReader(out.Bytes()))
+			assert.NoError(t, err)
+			assert.Equal(t, tc.res, a)
+
+			files, names := untar(t, bytes.NewReader(out.Bytes()))
+			checkManifest(t, files)
+			// the old signature is invalid
+			assert.NotContains(t, names, "manifest.sig")
+			assert.Equal(t, "version", names[0])
+			assert.Equal(t, "manifest", names[1])
+
+			var header string
+			for _, n := range names {
+				if strings.HasPrefix(n, "header.tar") {
+					header = n
+				}
+			}
+			zr, closer, err := decompress(bytes.NewReader(files[header]), header)
+			assert.NoError(t, err)
+			defer closer()
+			hfiles, hnames := untar(t, zr)
+
+			scripts := map[string]string{}
+			for n, b := range hfiles {
+				if strings.HasPrefix(n, "scripts/") {
+					scripts[strings.TrimPrefix(n, "scripts/")] = string(b)
+				}
+			}
+			assert.Equal(t, tc.scripts, scripts)
+			assert.Equal(t, "header-info", hnames[0])
+			assert.Equal(t, "headers/0000/meta-data", hnames[len(hnames)-1])
+			// unknown fields are kept
+			assert.Contains(t, string(hfiles["headers/0000/type-info"]), "clears_artifact_provides")
+		})
+	}
+}
+
+func TestModifySigned(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.NoError(t, err)
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	assert.NoError(t, err)
+
+	pkcs8 := func(k interface{}) []byte {
+		b, err := x509.MarshalPKCS8PrivateKey(k)
+		assert.NoError(t, err)
+		return pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: b})
+	}
+	ecDer, err := x509.MarshalECPrivateKey(ecKey)
+	assert.NoError(t, err)
+
+	tc := map[string]struct {
+		key    []byte
+		verify func(manifest, sig []byte) bool
+	}{
+		"rsa": {
+			key: pem.EncodeToMemory(&pem.Block{
+				Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(rsaKey)}),
+			verify: func(manifest, sig []byte) bool {
+				sum := sha256.Sum256(manifest)
+				return rsa.VerifyPKCS1v15(&rsaKey.PublicKey, crypto.SHA256, sum[:], sig) == nil
+			},
+		},
+		"ecdsa": {
+			key: pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: ecDer}),
+			verify: func(manifest, sig []byte) bool {
+				sum := sha256.Sum256(manifest)
+				r := new(big.Int).SetBytes(sig[:32])
+				s := new(big.Int).SetBytes(sig[32:])
+				return len(sig) == 64 && ecdsa.Verify(&ecKey.PublicKey, sum[:], r, s)
+			},
+		},
+		"ed25519": {
+			key: pkcs8(edKey),
+			verify: func(manifest, sig []byte) bool {
+				return ed25519.Verify(edKey.Public().(ed25519.PublicKey), manifest, sig)
+			},
+		},
+	}
+
+	for name, tc := range tc {
+		t.Run(name, func(t *testing.T) {
+			s, err := NewSigner(tc.key)
+			assert.NoError(t, err)
+
+			var out bytes.Buffer
+			err = Modify(bytes.NewReader(testArtifact(t, ".gz", gz, true, testHeader()...)),
+				&out, &Modification{Name: "release-2"}, s)
+			assert.NoError(t, err)
+
+			files, names := untar(t, &out)
+			assert.Equal(t, []string{"version", "manifest", "manifest.sig",
+				"header.tar.gz", "data/0000.tar.gz"}, names)
+			checkManifest(t, files)
+
+			sig, err := base64.StdEncoding.DecodeString(string(files["manifest.sig"]))
+			assert.NoError(t, err)
+			assert.True(t, tc.verify(files["manifest"], sig))
+		})
+	}
+}
+
+func TestNewSigner(t *testing.T) {
+	p384, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	assert.NoError(t, err)
+	der, err := x509.MarshalECPrivateKey(p384)
+	assert.NoError(t, err)
+
+	_, err = NewSigner([]byte("not a key"))
+	assert.EqualError(t, err, "invalid signing key: no PEM data")
+
+	_, err = NewSigner(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}))
+	assert.EqualError(t, err, "invalid signing key: only P-256 ECDSA keys are supported")
+}
@@ -0,0 +1,111 @@
+// Copyright 2024 Northern.tech AS
+//
+//	Licensed under the Apache License, Version 2.0 (the "License");
+//	you may not use this file except in compliance with the License.
+//	You may obtain a copy of the License at
+//
+//	    http://www.apache.org/licenses/LICENSE-2.0
+//
+//	Unless required by applicable law or agreed to in writing, software
+//	distributed under the License is distributed on an "AS IS" BASIS,
+//	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//	See the License for the specific language governing permissions and
+//	limitations under the License.
+package artifact
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+
+	"github.com/pkg/errors"
+)
+
+// Signer signs the manifest of artifacts, like mender-artifact does.
+type Signer interface {
+	// Sign returns the base64 encoded signature of the manifest.
+	Sign(manifest []byte) ([]byte, error)
+}
+
+type signer struct {
+	key crypto.Signer
+}
+
+// NewSigner makes a signer of a PEM private key: RSA, ECDSA P-256 or
+// ed25519.
+func NewSigner(pemKey []byte) (Signer, error) {
+	block, _ := pem.Decode(pemKey)
+	if block == nil {
+		return nil, errors.New("invalid signing key: no PEM data")
+	}
+
+	var key interface{}
+	var err error
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		key, err = x509.ParseECPrivateKey(block.Bytes)
+	default:
+		key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid signing key")
+	}
+
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		return &signer{key: k}, nil
+	case *ecdsa.PrivateKey:
+		if k.Curve != elliptic.P256() {
+			return nil, errors.New("invalid signing key: only P-256 ECDSA keys are supported")
+		}
+		return &signer{key: k}, nil
+	case ed25519.PrivateKey:
+		return &signer{key: k}, nil
+	}
+
+	return nil, errors.Errorf("invalid signing key: unsupported type %T", key)
+}
+
+func (sg *signer) Sign(manifest []byte) ([]byte, error) {
+	var sig []byte
+	var err error
+
+	sum := sha256.Sum256(manifest)
+	switch k := sg.key.(type) {
+	case *rsa.PrivateKey:
+		sig, err = rsa.SignPKCS1v15(rand.Reader, k, crypto.SHA256, sum[:])
+	case *ecdsa.PrivateKey:
+		sig, err = signECDSA(k, sum[:])
+	case ed25519.PrivateKey:
+		sig = ed25519.Sign(k, manifest)
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to sign manifest")
+	}
+
+	out := make([]byte, base64.StdEncoding.EncodedLen(len(sig)))
+	base64.StdEncoding.Encode(out, sig)
+	return out, nil
+}
+
+// signECDSA returns r and s, 32 bytes each, rather than ASN.1.
+func signECDSA(k *ecdsa.PrivateKey, hash []byte) ([]byte, error) {
+	r, s, err := ecdsa.Sign(rand.Reader, k, hash)
+	if err != nil {
+		return nil, err
+	}
+
+	sig := make([]byte, 64)
+	r.FillBytes(sig[:32])
+	s.FillBytes(sig[32:])
+	return sig, nil
+}
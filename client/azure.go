@@ -0,0 +1,285 @@
+// Copyright 2024 Northern.tech AS
+//
+//	Licensed under the Apache License, Version 2.0 (the "License");
+//	you may not use this file except in compliance with the License.
+//	You may obtain a copy of the License at
+//
+//	    http://www.apache.org/licenses/LICENSE-2.0
+//
+//	Unless required by applicable law or agreed to in writing, software
+//	distributed under the License is distributed on an "AS IS" BASIS,
+//	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//	See the License for the specific language governing permissions and
+//	limitations under the License.
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/pkg/errors"
+
+	"github.com/mendersoftware/create-artifact-worker/progress"
+)
+
+const (
+	azureApiVersion = "2021-08-06"
+
+	hdrAzureVersion  = "x-ms-version"
+	hdrAzureBlobType = "x-ms-blob-type"
+
+	azureBlockBlob = "BlockBlob"
+)
+
+var (
+	// blobs up to this size are uploaded with a single Put Blob,
+	// bigger ones are staged in blocks of the same size
+	azureBlockSize int64 = 64 * 1024 * 1024
+
+	azureHostSuffixes = []string{
+		".blob.core.windows.net",
+		".blob.core.chinacloudapi.cn",
+		".blob.core.usgovcloudapi.net",
+	}
+)
+
+type azureStorage struct {
+	c        *http.Client
+	par      ParallelDownload
+	timeouts Timeouts
+}
+
+// NewAzureStorage returns a Storage talking to Azure Blob Storage
+// (or Azurite) via SAS urls.
+func NewAzureStorage(skipSsl bool) Storage {
+	// can't fail without ca or client certificate files
+	c, _ := NewHTTPClient(skipVerifyConfig(skipSsl))
+
+	return newAzureStorage(c, ParallelDownload{}, Timeouts{})
+}
+
+func newAzureStorage(c *http.Client, par ParallelDownload, t Timeouts) *azureStorage {
+	return &azureStorage{
+		c:        c,
+		par:      par,
+		timeouts: t.withDefaults(),
+	}
+}
+
+func (s *azureStorage) Download(ctx context.Context, url, path string) error {
+	ctx, cancel := context.WithTimeout(ctx, s.timeouts.Download)
+	defer cancel()
+
+	newReq := func(ctx context.Context, method, url string) (*http.Request, error) {
+		return s.newRequest(ctx, method, url, nil)
+	}
+
+	if s.par.enabled() {
+		return rangedDownload(ctx, s.c, newReq, storageErr, url, path, s.par)
+	}
+
+	return singleDownload(ctx, s.c, newReq, storageErr, url, path)
+}
+
+func (s *azureStorage) Delete(ctx context.Context, url string) error {
+	ctx, cancel := context.WithTimeout(ctx, s.timeouts.Delete)
+	defer cancel()
+
+	req, err := s.newRequest(ctx, http.MethodDelete, url, nil)
+	if err != nil {
+		return err
+	}
+
+	res, err := doRequest(s.c, req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	// Delete Blob answers 202 Accepted
+	if res.StatusCode != http.StatusAccepted && res.StatusCode != http.StatusNoContent {
+		return storageErr(res, "failed to delete artifact at url "+url)
+	}
+
+	return nil
+}
+
+// Upload creates a block blob from the file at path. Small files go in a
+// single Put Blob, bigger ones are staged with Put Block and committed
+// with Put Block List - the SAS signature covers both.
+func (s *azureStorage) Upload(ctx context.Context, url, path string) error {
+	ctx, cancel := context.WithTimeout(ctx, s.timeouts.Upload)
+	defer cancel()
+
+	f, err := os.Open(path)
+	if err != nil {
+		return errors.Wrapf(err, "cannot read file %s", path)
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return errors.Wrapf(err, "cannot stat file %s", path)
+	}
+
+	pt := progress.FromContext(ctx)
+	pt.SetTotal(fi.Size())
+
+	if fi.Size() <= azureBlockSize {
+		return s.putBlob(ctx, url, pt.Reader(f), fi.Size())
+	}
+
+	var ids []string
+	for off, n := int64(0), 0; off < fi.Size(); off, n = off+azureBlockSize, n+1 {
+		size := fi.Size() - off
+		if size > azureBlockSize {
+			size = azureBlockSize
+		}
+
+		id := base64.StdEncoding.EncodeToString([]byte(fmt.Sprintf("block-%08d", n)))
+
+		err := s.putBlock(ctx, url, id, io.NewSectionReader(f, off, size), size)
+		if err != nil {
+			return err
+		}
+		pt.Add(size)
+
+		ids = append(ids, id)
+	}
+
+	return s.putBlockList(ctx, url, ids)
+}
+
+func (s *azureStorage) putBlob(ctx context.Context, url string, r io.Reader, size int64) error {
+	req, err := s.newRequest(ctx, http.MethodPut, url, r)
+	if err != nil {
+		return err
+	}
+
+	req.ContentLength = size
+	req.Header.Set(hdrAzureBlobType, azureBlockBlob)
+	req.Header.Set("Content-Type", "application/octet-stream")
+
+	return s.doPut(req, "failed to upload artifact to url "+url)
+}
+
+func (s *azureStorage) putBlock(
+	ctx context.Context,
+	rawurl, id string,
+	r io.Reader,
+	size int64,
+) error {
+	u, err := withQuery(rawurl, map[string]string{"comp": "block", "blockid": id})
+	if err != nil {
+		return err
+	}
+
+	req, err := s.newRequest(ctx, http.MethodPut, u, r)
+	if err != nil {
+		return err
+	}
+
+	req.ContentLength = size
+
+	return s.doPut(req, "failed to upload block to url "+rawurl)
+}
+
+func (s *azureStorage) putBlockList(ctx context.Context, rawurl string, ids []string) error {
+	list := struct {
+		XMLName xml.Name `xml:"BlockList"`
+		Latest  []string `xml:"Latest"`
+	}{
+		Latest: ids,
+	}
+
+	body, err := xml.Marshal(list)
+	if err != nil {
+		return errors.Wrap(err, "cannot create block list")
+	}
+
+	u, err := withQuery(rawurl, map[string]string{"comp": "blocklist"})
+	if err != nil {
+		return err
+	}
+
+	req, err := s.newRequest(ctx, http.MethodPut, u, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Content-Type", "application/xml")
+
+	return s.doPut(req, "failed to commit block list at url "+rawurl)
+}
+
+func (s *azureStorage) doPut(req *http.Request, msg string) error {
+	res, err := doRequest(s.c, req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusCreated {
+		return storageErr(res, msg)
+	}
+
+	return nil
+}
+
+func (s *azureStorage) newRequest(
+	ctx context.Context,
+	method, url string,
+	body io.Reader,
+) (*http.Request, error) {
+	req, err := http.NewRequest(method, url, body)
+	if err != nil {
+		return nil, err
+	}
+
+	req = req.WithContext(ctx)
+	req.Header.Set(hdrAzureVersion, azureApiVersion)
+
+	return req, nil
+}
+
+// isAzureUrl tells if a url points to Azure Blob Storage - either by a
+// well known host or by carrying a SAS token (Azurite, custom domains).
+func isAzureUrl(rawurl string) bool {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return false
+	}
+
+	host := strings.ToLower(u.Hostname())
+	for _, s := range azureHostSuffixes {
+		if strings.HasSuffix(host, s) {
+			return true
+		}
+	}
+
+	q := u.Query()
+	return q.Get("sv") != "" && q.Get("sig") != ""
+}
+
+func withQuery(rawurl string, params map[string]string) (string, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return "", err
+	}
+
+	q := u.Query()
+	for k, v := range params {
+		q.Set(k, v)
+	}
+	u.RawQuery = q.Encode()
+
+	return u.String(), nil
+}
@@ -0,0 +1,194 @@
+// Copyright 2024 Northern.tech AS
+//
+//	Licensed under the Apache License, Version 2.0 (the "License");
+//	you may not use this file except in compliance with the License.
+//	You may obtain a copy of the License at
+//
+//	    http://www.apache.org/licenses/LICENSE-2.0
+//
+//	Unless required by applicable law or agreed to in writing, software
+//	distributed under the License is distributed on an "AS IS" BASIS,
+//	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//	See the License for the specific language governing permissions and
+//	limitations under the License.
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/mendersoftware/create-artifact-worker/progress"
+)
+
+const azuriteSas = "?sv=2021-08-06&ss=b&srt=sco&sp=rwdlac&se=2030-01-01T00:00:00Z&sig=c2ln"
+
+// fakeAzurite mimics the subset of the Azurite blob api used by azureStorage
+type fakeAzurite struct {
+	sync.Mutex
+
+	blobs  map[string][]byte
+	blocks map[string][]byte
+}
+
+func newFakeAzurite() *fakeAzurite {
+	return &fakeAzurite{
+		blobs:  map[string][]byte{},
+		blocks: map[string][]byte{},
+	}
+}
+
+func (f *fakeAzurite) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.Lock()
+	defer f.Unlock()
+
+	if r.Header.Get(hdrAzureVersion) == "" {
+		azuriteErr(w, http.StatusBadRequest, "MissingRequiredHeader")
+		return
+	}
+
+	if r.URL.Query().Get("sig") == "" {
+		azuriteErr(w, http.StatusForbidden, "AuthenticationFailed")
+		return
+	}
+
+	name := r.URL.Path
+
+	switch r.Method {
+	case http.MethodGet:
+		b, ok := f.blobs[name]
+		if !ok {
+			azuriteErr(w, http.StatusNotFound, "BlobNotFound")
+			return
+		}
+		_, _ = w.Write(b)
+	case http.MethodDelete:
+		if _, ok := f.blobs[name]; !ok {
+			azuriteErr(w, http.StatusNotFound, "BlobNotFound")
+			return
+		}
+		delete(f.blobs, name)
+		w.WriteHeader(http.StatusAccepted)
+	case http.MethodPut:
+		body, _ := ioutil.ReadAll(r.Body)
+
+		switch r.URL.Query().Get("comp") {
+		case "block":
+			f.blocks[r.URL.Query().Get("blockid")] = body
+		case "blocklist":
+			list := struct {
+				Latest []string `xml:"Latest"`
+			}{}
+			if err := xml.Unmarshal(body, &list); err != nil {
+				azuriteErr(w, http.StatusBadRequest, "InvalidXmlDocument")
+				return
+			}
+			var blob []byte
+			for _, id := range list.Latest {
+				blob = append(blob, f.blocks[id]...)
+			}
+			f.blobs[name] = blob
+		default:
+			if r.Header.Get(hdrAzureBlobType) != azureBlockBlob {
+				azuriteErr(w, http.StatusBadRequest, "MissingRequiredHeader")
+				return
+			}
+			f.blobs[name] = body
+		}
+		w.WriteHeader(http.StatusCreated)
+	}
+}
+
+func azuriteErr(w http.ResponseWriter, code int, ecode string) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(code)
+	_, _ = w.Write([]byte(`<?xml version="1.0" encoding="utf-8"?>` +
+		`<Error><Code>` + ecode + `</Code><Message>` + ecode + ` message</Message></Error>`))
+}
+
+func TestAzureStorage(t *testing.T) {
+	az := newFakeAzurite()
+	server := httptest.NewServer(az)
+	defer server.Close()
+
+	blobUrl := server.URL + "/devstoreaccount1/artifacts/input" + azuriteSas
+
+	s := NewAzureStorage(false)
+	ctx := context.TODO()
+	dir := t.TempDir()
+
+	// small upload, single put blob
+	in := filepath.Join(dir, "in")
+	content := []byte("foobar")
+	assert.NoError(t, ioutil.WriteFile(in, content, 0644))
+	assert.NoError(t, s.Upload(ctx, blobUrl, in))
+
+	out := filepath.Join(dir, "out")
+	assert.NoError(t, s.Download(ctx, blobUrl, out))
+	b, err := ioutil.ReadFile(out)
+	assert.NoError(t, err)
+	assert.Equal(t, content, b)
+
+	assert.NoError(t, s.Delete(ctx, blobUrl))
+
+	// the signature is redacted from errors
+	redacted := strings.Replace(blobUrl, "sig=c2ln", "sig=xxxxx", 1)
+
+	err = s.Download(ctx, blobUrl, out)
+	assert.EqualError(t, err,
+		"failed to download artifact at url "+redacted+
+			", http 404, code: BlobNotFound, msg: BlobNotFound message")
+
+	err = s.Delete(ctx, blobUrl)
+	assert.EqualError(t, err,
+		"failed to delete artifact at url "+redacted+
+			", http 404, code: BlobNotFound, msg: BlobNotFound message")
+}
+
+func TestAzureStorageUploadBlocks(t *testing.T) {
+	defer func(s int64) { azureBlockSize = s }(azureBlockSize)
+	azureBlockSize = 4
+
+	az := newFakeAzurite()
+	server := httptest.NewServer(az)
+	defer server.Close()
+
+	blobUrl := server.URL + "/devstoreaccount1/artifacts/big" + azuriteSas
+
+	s := NewAzureStorage(false)
+
+	in := filepath.Join(t.TempDir(), "in")
+	content := bytes.Repeat([]byte("0123456789"), 3)
+	assert.NoError(t, ioutil.WriteFile(in, content, 0644))
+
+	tr := (&progress.Reporter{Interval: time.Hour}).Start(context.TODO(), "upload", 0)
+	defer tr.Done()
+
+	assert.NoError(t, s.Upload(progress.NewContext(context.TODO(), tr), blobUrl, in))
+	assert.Len(t, az.blocks, 8)
+	assert.Equal(t, content, az.blobs["/devstoreaccount1/artifacts/big"])
+
+	u := tr.Update()
+	assert.Equal(t, int64(len(content)), u.Bytes)
+	assert.Equal(t, int64(len(content)), u.Total)
+}
+
+func TestAzureStorageUploadMissingFile(t *testing.T) {
+	s := NewAzureStorage(false)
+
+	err := s.Upload(context.TODO(), "http://localhost/foo"+azuriteSas, "/non/existent")
+	assert.Error(t, err)
+	assert.True(t, os.IsNotExist(errors.Cause(err)))
+}
@@ -16,50 +16,166 @@ package client
 import (
 	"bytes"
 	"context"
-	"crypto/tls"
 	"encoding/json"
-	"fmt"
 	"io"
 	"mime/multipart"
 	"net/http"
 	"os"
 	"path/filepath"
+	"strconv"
 	"time"
 
 	"github.com/pkg/errors"
+
+	"github.com/mendersoftware/create-artifact-worker/progress"
 )
 
 const (
-	uriInternalUpload = "/api/internal/v1/deployments/tenants/{id}/artifacts"
+	uriInternalUpload     = "/api/internal/v1/deployments/tenants/{id}/artifacts"
+	uriInternalUploadLink = "/api/internal/v1/deployments/tenants/{id}/artifacts/{aid}/upload"
+	uriInternalComplete   = "/api/internal/v1/deployments/tenants/{id}/artifacts/{aid}/complete"
+	uriInternalStatus     = "/api/internal/v1/deployments/tenants/{id}/artifacts/{aid}/status"
+	uriInternalArtifact   = "/api/internal/v1/deployments/tenants/{id}/artifacts/{aid}"
+
+	uriManagementUpload = "/api/management/v1/deployments/artifacts"
 )
 
 var (
+	// default deadline of a whole operation
 	timeoutSec = 900 * time.Second
+
+	ErrArtifactNotFound = errors.New("artifact not found")
+
+	// ErrArtifactConflict means deployments refused an artifact clashing
+	// with an existing one (same id, or same name and device types).
+	ErrArtifactConflict = errors.New("artifact conflict")
 )
 
 type Deployments interface {
 	UploadArtifactInternal(ctx context.Context, path, aid, tid, desc string) error
+	UploadArtifact(ctx context.Context, path, aid, desc string) error
+	GetUploadLink(ctx context.Context, aid, tid string, size int64) (*UploadLink, error)
+	CompleteUpload(ctx context.Context, tid string, c *UploadComplete) error
+	ReportStatus(ctx context.Context, aid, tid string, s *JobStatus) error
+	GetArtifact(ctx context.Context, aid, tid string) (*Artifact, error)
+}
+
+// Artifact is the deployments' record of an uploaded artifact.
+type Artifact struct {
+	Id                    string   `json:"id"`
+	Name                  string   `json:"name"`
+	Description           string   `json:"description"`
+	DeviceTypesCompatible []string `json:"device_types_compatible"`
+	Size                  int64    `json:"size"`
+	Updates               []Update `json:"updates"`
+
+	Provides map[string]string `json:"artifact_provides,omitempty"`
+	// Depends values are a string, or a list of them
+	Depends map[string]interface{} `json:"artifact_depends,omitempty"`
+}
+
+type Update struct {
+	TypeInfo TypeInfo     `json:"type_info"`
+	Files    []UpdateFile `json:"files"`
+}
+
+type TypeInfo struct {
+	Type string `json:"type"`
+}
+
+type UpdateFile struct {
+	Name     string `json:"name"`
+	Checksum string `json:"checksum"`
+	Size     int64  `json:"size"`
+}
+
+// File returns the payload file with the given name, nil if not found.
+func (a *Artifact) File(name string) *UpdateFile {
+	for _, u := range a.Updates {
+		for i := range u.Files {
+			if u.Files[i].Name == name {
+				return &u.Files[i]
+			}
+		}
+	}
+
+	return nil
+}
+
+// DependsOn tells if the artifact depends on key having value.
+func (a *Artifact) DependsOn(key, value string) bool {
+	switch v := a.Depends[key].(type) {
+	case string:
+		return v == value
+	case []interface{}:
+		for _, e := range v {
+			if e == value {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+const (
+	StatusDownloading = "downloading"
+	StatusGenerating  = "generating"
+	StatusUploading   = "uploading"
+	StatusFailed      = "failed"
+	StatusDone        = "done"
+)
+
+// JobStatus is a stage of artifact generation reported to deployments;
+// Reason explains a StatusFailed.
+type JobStatus struct {
+	Status string `json:"status"`
+	Reason string `json:"reason,omitempty"`
+}
+
+// UploadLink is where to upload a generated artifact directly to the
+// object storage. Big artifacts get a multipart upload: one pre-signed
+// url per part of PartSize bytes, in part order.
+type UploadLink struct {
+	Uri      string   `json:"uri"`
+	PartUris []string `json:"part_uris,omitempty"`
+	PartSize int64    `json:"part_size,omitempty"`
+}
+
+// UploadComplete tells deployments a direct upload is done, so it can
+// finish a multipart upload and register the artifact.
+type UploadComplete struct {
+	ArtifactId  string          `json:"artifact_id"`
+	Size        int64           `json:"size"`
+	Checksum    string          `json:"checksum"`
+	Description string          `json:"description"`
+	Parts       []CompletedPart `json:"parts,omitempty"`
 }
 
 type deployments struct {
-	deplUrl string
-	c       *http.Client
+	deplUrl  string
+	token    string
+	c        *http.Client
+	timeouts Timeouts
 }
 
 func NewDeployments(deplUrl string, skipSsl bool) (Deployments, error) {
-	tr := &http.Transport{
-		TLSClientConfig: &tls.Config{
-			InsecureSkipVerify: skipSsl,
-		},
-	}
+	return NewDeploymentsWithToken(deplUrl, "", skipVerifyConfig(skipSsl))
+}
 
-	c := &http.Client{
-		Transport: tr,
+// NewDeploymentsWithToken returns a client which can also call the
+// management api on behalf of the token's user.
+func NewDeploymentsWithToken(deplUrl, token string, cfg HTTPConfig) (Deployments, error) {
+	c, err := NewTracingHTTPClient(cfg)
+	if err != nil {
+		return nil, err
 	}
 
 	return &deployments{
-		deplUrl: deplUrl,
-		c:       c,
+		deplUrl:  deplUrl,
+		token:    token,
+		c:        c,
+		timeouts: cfg.Timeouts.withDefaults(),
 	}, nil
 }
 
@@ -70,84 +186,333 @@ func (d *deployments) UploadArtifactInternal(
 	tid,
 	desc string,
 ) error {
-	ctx, cancel := context.WithTimeout(ctx, timeoutSec)
+	ctx, cancel := context.WithTimeout(ctx, d.timeouts.Upload)
 	defer cancel()
 
-	artifact, err := os.Open(fpath)
+	body, ctype, err := uploadBody(fpath, []formField{
+		{"id", tid},
+		{"artifact_id", aid},
+		{"description", desc},
+	})
+	if err != nil {
+		return err
+	}
+
+	if tid == "" {
+		tid = "default"
+	}
+
+	url, err := join(d.deplUrl, uriInternalUpload, map[string]string{"id": tid})
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPost,
+		url,
+		body)
+	if err != nil {
+		return errors.Wrap(err, "cannot create artifact upload request")
+	}
+
+	req = req.WithContext(ctx)
+	trackBody(ctx, req)
+
+	req.Header.Set("Content-Type", ctype)
+
+	res, err := d.c.Do(req)
+	if err != nil {
+		return errors.Wrapf(err, "failed to upload artifact %s", aid)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusCreated {
+		return errors.Wrapf(apiErr(res, uriInternalUpload), "failed to upload artifact %s", aid)
+	}
+
+	return nil
+}
+
+// UploadArtifact uploads via the management api, authenticated with the
+// user's token instead of the internal, trusted endpoint.
+func (d *deployments) UploadArtifact(ctx context.Context, fpath, aid, desc string) error {
+	if d.token == "" {
+		return errors.New("management api needs an auth token")
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, d.timeouts.Upload)
+	defer cancel()
+
+	fi, err := os.Stat(fpath)
 	if err != nil {
 		return errors.Wrapf(err, "cannot read artifact file %s", fpath)
 	}
+
+	body, ctype, err := uploadBody(fpath, []formField{
+		{"artifact_id", aid},
+		{"description", desc},
+		{"size", strconv.FormatInt(fi.Size(), 10)},
+	})
+	if err != nil {
+		return err
+	}
+
+	url, err := join(d.deplUrl, uriManagementUpload, nil)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, url, body)
+	if err != nil {
+		return errors.Wrap(err, "cannot create artifact upload request")
+	}
+
+	req = req.WithContext(ctx)
+	trackBody(ctx, req)
+
+	req.Header.Set("Content-Type", ctype)
+	req.Header.Set("Authorization", "Bearer "+d.token)
+
+	res, err := d.c.Do(req)
+	if err != nil {
+		return errors.Wrapf(err, "failed to upload artifact %s", aid)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusCreated {
+		return errors.Wrapf(apiErr(res, uriManagementUpload), "failed to upload artifact %s", aid)
+	}
+
+	return nil
+}
+
+type formField struct {
+	name, value string
+}
+
+// trackBody counts the bytes of req's body sent as upload progress.
+func trackBody(ctx context.Context, req *http.Request) {
+	pt := progress.FromContext(ctx)
+	if pt == nil {
+		return
+	}
+
+	pt.SetTotal(req.ContentLength)
+	req.Body = io.NopCloser(pt.Reader(req.Body))
+}
+
+// uploadBody builds a multipart form with the given fields, followed by
+// the artifact file; returns the body and its content type.
+func uploadBody(fpath string, fields []formField) (*bytes.Buffer, string, error) {
+	artifact, err := os.Open(fpath)
+	if err != nil {
+		return nil, "", errors.Wrapf(err, "cannot read artifact file %s", fpath)
+	}
 	defer artifact.Close()
 
 	body := &bytes.Buffer{}
 
 	writer := multipart.NewWriter(body)
 
-	_ = writer.WriteField("id", tid)
-	_ = writer.WriteField("artifact_id", aid)
-	_ = writer.WriteField("description", desc)
+	for _, f := range fields {
+		_ = writer.WriteField(f.name, f.value)
+	}
 
 	part, err := writer.CreateFormFile("artifact", filepath.Base(fpath))
 	if err != nil {
-		return errors.Wrap(err, "cannot create artifact upload request")
+		return nil, "", errors.Wrap(err, "cannot create artifact upload request")
 	}
 
 	_, err = io.Copy(part, artifact)
 	if err != nil {
-		return errors.Wrap(err, "cannot create artifact upload request")
+		return nil, "", errors.Wrap(err, "cannot create artifact upload request")
 	}
 
 	err = writer.Close()
 	if err != nil {
-		return errors.Wrap(err, "cannot create artifact upload request")
+		return nil, "", errors.Wrap(err, "cannot create artifact upload request")
 	}
 
+	return body, writer.FormDataContentType(), nil
+}
+
+func (d *deployments) GetUploadLink(
+	ctx context.Context,
+	aid,
+	tid string,
+	size int64,
+) (*UploadLink, error) {
+	ctx, cancel := context.WithTimeout(ctx, d.timeouts.API)
+	defer cancel()
+
 	if tid == "" {
 		tid = "default"
 	}
 
-	url, err := join(d.deplUrl, uriInternalUpload, map[string]string{"id": tid})
+	url, err := join(d.deplUrl, uriInternalUploadLink, map[string]string{"id": tid, "aid": aid})
+	if err != nil {
+		return nil, err
+	}
+
+	body, err := json.Marshal(map[string]int64{"size": size})
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot create upload link request")
+	}
+
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot create upload link request")
+	}
+
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/json")
+
+	res, err := d.c.Do(req)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to get upload link for artifact %s", aid)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return nil, errors.Wrapf(apiErr(res, uriInternalUploadLink),
+			"failed to get upload link for artifact %s", aid)
+	}
+
+	link := &UploadLink{}
+	if err := json.NewDecoder(res.Body).Decode(link); err != nil {
+		return nil, errors.Wrap(err, "failed to decode upload link")
+	}
+
+	if link.Uri == "" && len(link.PartUris) == 0 {
+		return nil, errors.New("got empty upload link")
+	}
+
+	if len(link.PartUris) > 0 && link.PartSize <= 0 {
+		return nil, errors.New("got multipart upload link without part size")
+	}
+
+	return link, nil
+}
+
+func (d *deployments) CompleteUpload(ctx context.Context, tid string, c *UploadComplete) error {
+	ctx, cancel := context.WithTimeout(ctx, d.timeouts.API)
+	defer cancel()
+
+	if tid == "" {
+		tid = "default"
+	}
+
+	url, err := join(d.deplUrl, uriInternalComplete,
+		map[string]string{"id": tid, "aid": c.ArtifactId})
 	if err != nil {
 		return err
 	}
 
-	req, err := http.NewRequest(http.MethodPost,
-		url,
-		body)
+	body, err := json.Marshal(c)
 	if err != nil {
-		return errors.Wrap(err, "cannot create artifact upload request")
+		return errors.Wrap(err, "cannot create upload complete request")
+	}
+
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return errors.Wrap(err, "cannot create upload complete request")
 	}
 
 	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/json")
+
+	res, err := d.c.Do(req)
+	if err != nil {
+		return errors.Wrapf(err, "failed to complete upload of artifact %s", c.ArtifactId)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusCreated && res.StatusCode != http.StatusNoContent {
+		return errors.Wrapf(apiErr(res, uriInternalComplete),
+			"failed to complete upload of artifact %s", c.ArtifactId)
+	}
+
+	return nil
+}
+
+func (d *deployments) ReportStatus(ctx context.Context, aid, tid string, s *JobStatus) error {
+	ctx, cancel := context.WithTimeout(ctx, d.timeouts.API)
+	defer cancel()
+
+	if tid == "" {
+		tid = "default"
+	}
+
+	url, err := join(d.deplUrl, uriInternalStatus, map[string]string{"id": tid, "aid": aid})
+	if err != nil {
+		return err
+	}
+
+	body, err := json.Marshal(s)
+	if err != nil {
+		return errors.Wrap(err, "cannot create status request")
+	}
 
-	req.Header.Set("Content-Type", writer.FormDataContentType())
+	req, err := http.NewRequest(http.MethodPut, url, bytes.NewReader(body))
+	if err != nil {
+		return errors.Wrap(err, "cannot create status request")
+	}
+
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/json")
 
 	res, err := d.c.Do(req)
 	if err != nil {
-		return errors.Wrapf(err, "failed to upload artifact %s", aid)
+		return errors.Wrapf(err, "failed to report status of artifact %s", aid)
 	}
 	defer res.Body.Close()
 
-	if res.StatusCode != http.StatusCreated {
-		return errors.Wrapf(apiErr(res), "failed to upload artifact %s", aid)
+	if res.StatusCode != http.StatusNoContent {
+		return errors.Wrapf(apiErr(res, uriInternalStatus), "failed to report status of artifact %s", aid)
 	}
 
 	return nil
 }
 
-func apiErr(r *http.Response) error {
-	e := struct {
-		Reqid string `json:"request_id"`
-		Msg   string `json:"error"`
-	}{}
+// GetArtifact looks up an artifact by id; ErrArtifactNotFound if there's
+// no such artifact.
+func (d *deployments) GetArtifact(ctx context.Context, aid, tid string) (*Artifact, error) {
+	ctx, cancel := context.WithTimeout(ctx, d.timeouts.API)
+	defer cancel()
+
+	if tid == "" {
+		tid = "default"
+	}
+
+	url, err := join(d.deplUrl, uriInternalArtifact, map[string]string{"id": tid, "aid": aid})
+	if err != nil {
+		return nil, err
+	}
 
-	err := json.NewDecoder(r.Body).Decode(&e)
+	req, err := http.NewRequest(http.MethodGet, url, nil)
 	if err != nil {
-		return errors.New(fmt.Sprintf(
-			"got error code %d from api but failed to decode response",
-			r.StatusCode,
-		))
+		return nil, errors.Wrap(err, "cannot create artifact request")
+	}
+
+	req = req.WithContext(ctx)
+
+	res, err := d.c.Do(req)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to get artifact %s", aid)
+	}
+	defer res.Body.Close()
+
+	switch res.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return nil, ErrArtifactNotFound
+	default:
+		return nil, errors.Wrapf(apiErr(res, uriInternalArtifact), "failed to get artifact %s", aid)
+	}
+
+	a := &Artifact{}
+	if err := json.NewDecoder(res.Body).Decode(a); err != nil {
+		return nil, errors.Wrap(err, "failed to decode artifact")
 	}
 
-	return errors.New(fmt.Sprintf("http %d, reqid: %s, msg: %s", r.StatusCode, e.Reqid, e.Msg))
+	return a, nil
 }
@@ -155,3 +155,333 @@ func restErr(t *testing.T, msg string) []byte {
 
 	return b
 }
+
+func TestDeploymentsDirectUpload(t *testing.T) {
+	t.Parallel()
+
+	tc := map[string]struct {
+		tenantId string
+
+		linkCode int
+		linkBody string
+
+		link *UploadLink
+		err  string
+	}{
+		"ok": {
+			tenantId: "1",
+			linkCode: http.StatusOK,
+			linkBody: `{"uri": "https://s3/bucket/aid?X-Amz-Signature=foo"}`,
+			link:     &UploadLink{Uri: "https://s3/bucket/aid?X-Amz-Signature=foo"},
+		},
+		"ok, multipart, default tenant": {
+			linkCode: http.StatusOK,
+			linkBody: `{"part_uris": ["https://s3/1", "https://s3/2"], "part_size": 1024}`,
+			link: &UploadLink{
+				PartUris: []string{"https://s3/1", "https://s3/2"},
+				PartSize: 1024,
+			},
+		},
+		"error, empty link": {
+			tenantId: "1",
+			linkCode: http.StatusOK,
+			linkBody: `{}`,
+			err:      "got empty upload link",
+		},
+		"error, multipart without part size": {
+			tenantId: "1",
+			linkCode: http.StatusOK,
+			linkBody: `{"part_uris": ["https://s3/1"]}`,
+			err:      "got multipart upload link without part size",
+		},
+		"error, api": {
+			tenantId: "1",
+			linkCode: http.StatusInternalServerError,
+			linkBody: string(restErr(t, "internal error")),
+			err: "failed to get upload link for artifact aid: " +
+				"http 500, reqid: 1234, msg: internal error",
+		},
+	}
+
+	for name := range tc {
+		tc := tc[name]
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			tid := tc.tenantId
+			if tid == "" {
+				tid = "default"
+			}
+
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				assert.Equal(t, http.MethodPost, r.Method)
+				assert.Equal(t, "application/json", r.Header.Get("Content-Type"))
+
+				switch r.URL.Path {
+				case "/api/internal/v1/deployments/tenants/" + tid + "/artifacts/aid/upload":
+					req := map[string]int64{}
+					assert.NoError(t, json.NewDecoder(r.Body).Decode(&req))
+					assert.Equal(t, int64(2048), req["size"])
+
+					w.WriteHeader(tc.linkCode)
+					_, _ = w.Write([]byte(tc.linkBody))
+				case "/api/internal/v1/deployments/tenants/" + tid + "/artifacts/aid/complete":
+					req := UploadComplete{}
+					assert.NoError(t, json.NewDecoder(r.Body).Decode(&req))
+					assert.Equal(t, UploadComplete{
+						ArtifactId:  "aid",
+						Size:        2048,
+						Checksum:    "abcd",
+						Description: "desc",
+						Parts:       []CompletedPart{{Number: 1, ETag: `"etag"`}},
+					}, req)
+
+					w.WriteHeader(http.StatusNoContent)
+				default:
+					t.Errorf("unexpected request %s", r.URL.Path)
+				}
+			}))
+			defer server.Close()
+
+			c, err := NewDeployments(server.URL, false)
+			assert.NoError(t, err)
+
+			link, err := c.GetUploadLink(context.TODO(), "aid", tc.tenantId, 2048)
+			if tc.err != "" {
+				assert.EqualError(t, err, tc.err)
+				return
+			}
+
+			assert.NoError(t, err)
+			assert.Equal(t, tc.link, link)
+
+			err = c.CompleteUpload(context.TODO(), tc.tenantId, &UploadComplete{
+				ArtifactId:  "aid",
+				Size:        2048,
+				Checksum:    "abcd",
+				Description: "desc",
+				Parts:       []CompletedPart{{Number: 1, ETag: `"etag"`}},
+			})
+			assert.NoError(t, err)
+		})
+	}
+}
+
+func TestDeploymentsUploadArtifact(t *testing.T) {
+	t.Parallel()
+
+	path := filepath.Join(t.TempDir(), "artifact")
+	assert.NoError(t, ioutil.WriteFile(path, []byte("foobar"), 0644))
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/api/management/v1/deployments/artifacts", r.URL.Path)
+		assert.Equal(t, "Bearer tkn", r.Header.Get("Authorization"))
+
+		assert.NoError(t, r.ParseMultipartForm(1024))
+		assert.Equal(t, "aid", r.FormValue("artifact_id"))
+		assert.Equal(t, "desc", r.FormValue("description"))
+		assert.Equal(t, "6", r.FormValue("size"))
+
+		f, _, err := r.FormFile("artifact")
+		assert.NoError(t, err)
+		b, _ := ioutil.ReadAll(f)
+		assert.Equal(t, []byte("foobar"), b)
+
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer server.Close()
+
+	c, err := NewDeploymentsWithToken(server.URL, "tkn", HTTPConfig{})
+	assert.NoError(t, err)
+	assert.NoError(t, c.UploadArtifact(context.TODO(), path, "aid", "desc"))
+
+	c, err = NewDeployments(server.URL, false)
+	assert.NoError(t, err)
+	assert.EqualError(t, c.UploadArtifact(context.TODO(), path, "aid", "desc"),
+		"management api needs an auth token")
+}
+
+func TestDeploymentsReportStatus(t *testing.T) {
+	t.Parallel()
+
+	tc := map[string]struct {
+		tenantId string
+		status   *JobStatus
+
+		code int
+		err  string
+	}{
+		"ok": {
+			tenantId: "1",
+			status:   &JobStatus{Status: StatusGenerating},
+			code:     http.StatusNoContent,
+		},
+		"ok, failed with reason, default tenant": {
+			status: &JobStatus{Status: StatusFailed, Reason: "generator exited with 1"},
+			code:   http.StatusNoContent,
+		},
+		"error": {
+			tenantId: "1",
+			status:   &JobStatus{Status: StatusDone},
+			code:     http.StatusNotFound,
+			err:      "failed to report status of artifact aid: http 404, reqid: 1234, msg: not found",
+		},
+	}
+
+	for name := range tc {
+		tc := tc[name]
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			tid := tc.tenantId
+			if tid == "" {
+				tid = "default"
+			}
+
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				assert.Equal(t, http.MethodPut, r.Method)
+				assert.Equal(t,
+					"/api/internal/v1/deployments/tenants/"+tid+"/artifacts/aid/status",
+					r.URL.Path)
+
+				s := &JobStatus{}
+				assert.NoError(t, json.NewDecoder(r.Body).Decode(s))
+				assert.Equal(t, tc.status, s)
+
+				w.WriteHeader(tc.code)
+				if tc.err != "" {
+					_, _ = w.Write(restErr(t, "not found"))
+				}
+			}))
+			defer server.Close()
+
+			c, err := NewDeployments(server.URL, false)
+			assert.NoError(t, err)
+
+			err = c.ReportStatus(context.TODO(), "aid", tc.tenantId, tc.status)
+			if tc.err != "" {
+				assert.EqualError(t, err, tc.err)
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
+
+func TestDeploymentsGetArtifact(t *testing.T) {
+	t.Parallel()
+
+	tc := map[string]struct {
+		code int
+		body string
+
+		artifact *Artifact
+		err      error
+		errmsg   string
+	}{
+		"ok": {
+			code: http.StatusOK,
+			body: `{"id": "aid", "name": "name", "updates": [{"type_info": {"type": "single-file"},
+				"files": [{"name": "file", "checksum": "abc", "size": 3}]}],
+				"artifact_provides": {"artifact_name": "name"},
+				"artifact_depends": {"device_type": ["dt"]}}`,
+			artifact: &Artifact{
+				Id:   "aid",
+				Name: "name",
+				Updates: []Update{{
+					TypeInfo: TypeInfo{Type: "single-file"},
+					Files:    []UpdateFile{{Name: "file", Checksum: "abc", Size: 3}},
+				}},
+				Provides: map[string]string{"artifact_name": "name"},
+				Depends:  map[string]interface{}{"device_type": []interface{}{"dt"}},
+			},
+		},
+		"not found": {
+			code: http.StatusNotFound,
+			err:  ErrArtifactNotFound,
+		},
+		"error": {
+			code:   http.StatusInternalServerError,
+			body:   string(restErr(t, "internal error")),
+			errmsg: "failed to get artifact aid: http 500, reqid: 1234, msg: internal error",
+		},
+	}
+
+	for name := range tc {
+		tc := tc[name]
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				assert.Equal(t, http.MethodGet, r.Method)
+				assert.Equal(t, "/api/internal/v1/deployments/tenants/1/artifacts/aid", r.URL.Path)
+
+				w.WriteHeader(tc.code)
+				_, _ = w.Write([]byte(tc.body))
+			}))
+			defer server.Close()
+
+			c, err := NewDeployments(server.URL, false)
+			assert.NoError(t, err)
+
+			a, err := c.GetArtifact(context.TODO(), "aid", "1")
+			switch {
+			case tc.err != nil:
+				assert.Equal(t, tc.err, err)
+			case tc.errmsg != "":
+				assert.EqualError(t, err, tc.errmsg)
+			default:
+				assert.NoError(t, err)
+				assert.Equal(t, tc.artifact, a)
+				assert.NotNil(t, a.File("file"))
+				assert.Nil(t, a.File("other"))
+			}
+		})
+	}
+}
+
+func TestArtifactDependsOn(t *testing.T) {
+	a := &Artifact{Depends: map[string]interface{}{
+		"device_type":           []interface{}{"dt1", "dt2"},
+		"rootfs-image.checksum": "abc",
+	}}
+
+	assert.True(t, a.DependsOn("device_type", "dt2"))
+	assert.True(t, a.DependsOn("rootfs-image.checksum", "abc"))
+	assert.False(t, a.DependsOn("device_type", "dt3"))
+	assert.False(t, a.DependsOn("rootfs-image.checksum", "def"))
+	assert.False(t, a.DependsOn("other", "abc"))
+}
+
+func TestDeploymentsUploadConflict(t *testing.T) {
+	t.Parallel()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusConflict)
+		_, _ = w.Write(restErr(t, "artifact exists"))
+	}))
+	defer server.Close()
+
+	path := filepath.Join(t.TempDir(), "artifact")
+	assert.NoError(t, ioutil.WriteFile(path, []byte("artifact"), 0644))
+
+	c, err := NewDeployments(server.URL, false)
+	assert.NoError(t, err)
+
+	err = c.UploadArtifactInternal(context.TODO(), path, "aid", "1", "desc")
+	assert.True(t, errors.Is(err, ErrArtifactConflict))
+	assert.Contains(t, err.Error(), "http 409, reqid: 1234, msg: artifact exists")
+
+	// a 409 of any other endpoint isn't about the artifact clashing
+	err = c.ReportStatus(context.TODO(), "aid", "1", &JobStatus{Status: "processing"})
+	assert.Contains(t, err.Error(), "http 409")
+	assert.False(t, errors.Is(err, ErrArtifactConflict))
+
+	_, err = c.GetUploadLink(context.TODO(), "aid", "1", 8)
+	assert.Contains(t, err.Error(), "http 409")
+	assert.False(t, errors.Is(err, ErrArtifactConflict))
+
+	err = c.CompleteUpload(context.TODO(), "1", &UploadComplete{ArtifactId: "aid", Size: 8})
+	assert.Contains(t, err.Error(), "http 409")
+	assert.False(t, errors.Is(err, ErrArtifactConflict))
+}
@@ -0,0 +1,274 @@
+// Copyright 2024 Northern.tech AS
+//
+//	Licensed under the Apache License, Version 2.0 (the "License");
+//	you may not use this file except in compliance with the License.
+//	You may obtain a copy of the License at
+//
+//	    http://www.apache.org/licenses/LICENSE-2.0
+//
+//	Unless required by applicable law or agreed to in writing, software
+//	distributed under the License is distributed on an "AS IS" BASIS,
+//	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//	See the License for the specific language governing permissions and
+//	limitations under the License.
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/pkg/errors"
+
+	mlog "github.com/mendersoftware/create-artifact-worker/log"
+)
+
+// maxBodyExcerpt limits how much of an undecodable response body is kept.
+const maxBodyExcerpt = 512
+
+const hdrRequestId = "X-MEN-RequestID"
+
+// APIError is a failed response of a Mender service API.
+type APIError struct {
+	// Endpoint is the path template of the request, e.g. uriInternalUpload
+	Endpoint   string
+	StatusCode int
+	RequestId  string
+	Message    string
+
+	// Body is an excerpt of the response body, set if it wasn't the
+	// standard json error.
+	Body string
+}
+
+func (e *APIError) Error() string {
+	if e.Message == "" {
+		return fmt.Sprintf("http %d, reqid: %s, response: %s", e.StatusCode, e.RequestId, e.Body)
+	}
+	return fmt.Sprintf("http %d, reqid: %s, msg: %s", e.StatusCode, e.RequestId, e.Message)
+}
+
+// Is makes a 409 of an artifact upload match ErrArtifactConflict: the
+// artifact clashes with an existing one.
+func (e *APIError) Is(target error) bool {
+	return target == ErrArtifactConflict && e.StatusCode == http.StatusConflict &&
+		(e.Endpoint == uriInternalUpload || e.Endpoint == uriManagementUpload)
+}
+
+// StorageError is a failed response of an object storage (S3, Azure Blob).
+type StorageError struct {
+	// Op describes what failed, e.g. "failed to delete artifact at url ..."
+	Op         string
+	StatusCode int
+
+	// Code and Message come from the XML error document, e.g.
+	// "NoSuchKey" (S3) or "BlobNotFound" (Azure).
+	Code      string
+	Message   string
+	RequestId string
+
+	// Body is an excerpt of the response body if it had no error code.
+	Body string
+}
+
+func (e *StorageError) Error() string {
+	if e.Code == "" {
+		return fmt.Sprintf("%s, http %d, response: \n %s", e.Op, e.StatusCode, e.Body)
+	}
+	return fmt.Sprintf("%s, http %d, code: %s, msg: %s", e.Op, e.StatusCode, e.Code, e.Message)
+}
+
+func apiErr(r *http.Response, endpoint string) error {
+	e := &APIError{
+		Endpoint:   endpoint,
+		StatusCode: r.StatusCode,
+		RequestId:  r.Header.Get(hdrRequestId),
+	}
+
+	body, err := readExcerpt(r.Body)
+	if err != nil {
+		e.Body = "<failed to read body>"
+		return e
+	}
+
+	msg := struct {
+		Reqid string `json:"request_id"`
+		Msg   string `json:"error"`
+	}{}
+
+	if err := json.Unmarshal(body, &msg); err != nil || msg.Msg == "" {
+		e.Body = strings.TrimSpace(string(body))
+		return e
+	}
+
+	e.Message = msg.Msg
+	if msg.Reqid != "" {
+		e.RequestId = msg.Reqid
+	}
+
+	return e
+}
+
+// storageErr builds a *StorageError, parsing the XML error document
+// S3 and Azure share: <Error><Code/><Message/><RequestId/></Error>.
+func storageErr(r *http.Response, msg string) error {
+	e := &StorageError{
+		Op:         mlog.Redact(msg),
+		StatusCode: r.StatusCode,
+		RequestId:  r.Header.Get("x-amz-request-id"),
+	}
+	if e.RequestId == "" {
+		e.RequestId = r.Header.Get("x-ms-request-id")
+	}
+
+	body, err := readExcerpt(r.Body)
+	if err != nil {
+		e.Body = "<failed to read body>"
+		return e
+	}
+
+	doc := struct {
+		Code      string `xml:"Code"`
+		Message   string `xml:"Message"`
+		RequestId string `xml:"RequestId"`
+	}{}
+
+	if err := xml.Unmarshal(body, &doc); err != nil || doc.Code == "" {
+		e.Body = string(body)
+		return e
+	}
+
+	e.Code = doc.Code
+	e.Message = strings.TrimSpace(doc.Message)
+	if doc.RequestId != "" {
+		e.RequestId = doc.RequestId
+	}
+
+	return e
+}
+
+// doRequest is http.Client.Do for pre-signed urls: the *url.Error it
+// may return has the url's signature and credentials masked.
+func doRequest(c *http.Client, req *http.Request) (*http.Response, error) {
+	res, err := c.Do(req)
+	if ue, ok := err.(*url.Error); ok {
+		ue.URL = mlog.RedactURL(ue.URL)
+	}
+
+	return res, err
+}
+
+func readExcerpt(r io.Reader) ([]byte, error) {
+	body, err := ioutil.ReadAll(io.LimitReader(r, maxBodyExcerpt))
+	if err != nil {
+		return nil, err
+	}
+
+	return body, nil
+}
+
+// status extracts the http status and storage error code of err.
+func status(err error) (int, string, bool) {
+	var ae *APIError
+	if errors.As(err, &ae) {
+		return ae.StatusCode, "", true
+	}
+
+	var se *StorageError
+	if errors.As(err, &se) {
+		return se.StatusCode, se.Code, true
+	}
+
+	return 0, "", false
+}
+
+var retryableCodes = map[string]bool{
+	// S3
+	"SlowDown":           true,
+	"RequestTimeout":     true,
+	"InternalError":      true,
+	"ServiceUnavailable": true,
+	// Azure
+	"ServerBusy":        true,
+	"OperationTimedOut": true,
+}
+
+// IsRetryable tells if err is a transient failure worth retrying: network
+// timeouts, throttling and server side errors. An expired or canceled
+// context is not - retrying under it fails again.
+func IsRetryable(err error) bool {
+	if errors.Is(err, context.DeadlineExceeded) || errors.Is(err, context.Canceled) {
+		return false
+	}
+
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return true
+	}
+
+	code, storageCode, ok := status(err)
+	if !ok {
+		return false
+	}
+
+	if retryableCodes[storageCode] {
+		return true
+	}
+
+	switch code {
+	case http.StatusRequestTimeout, http.StatusTooManyRequests:
+		return true
+	case http.StatusNotImplemented:
+		return false
+	}
+
+	return code >= 500
+}
+
+// IsConflict tells if err is an artifact clashing with an existing one.
+func IsConflict(err error) bool {
+	return errors.Is(err, ErrArtifactConflict)
+}
+
+// IsNotFound tells if err is a storage's answer that the object doesn't
+// exist.
+func IsNotFound(err error) bool {
+	var se *StorageError
+	if !errors.As(err, &se) {
+		return false
+	}
+
+	return se.StatusCode == http.StatusNotFound ||
+		se.Code == "NoSuchKey" || se.Code == "BlobNotFound"
+}
+
+// IsAuth tells if err is an authentication or authorization failure,
+// including expired or badly signed pre-signed urls.
+func IsAuth(err error) bool {
+	code, _, ok := status(err)
+	return ok && (code == http.StatusUnauthorized || code == http.StatusForbidden)
+}
+
+// IsValidation tells if err is a rejection of the request's contents.
+func IsValidation(err error) bool {
+	code, _, ok := status(err)
+	if !ok {
+		return false
+	}
+
+	switch code {
+	case http.StatusBadRequest,
+		http.StatusRequestEntityTooLarge,
+		http.StatusUnprocessableEntity:
+		return true
+	}
+
+	return false
+}
@@ -0,0 +1,268 @@
+// Copyright 2024 Northern.tech AS
+//
+//	Licensed under the Apache License, Version 2.0 (the "License");
+//	you may not use this file except in compliance with the License.
+//	You may obtain a copy of the License at
+//
+//	    http://www.apache.org/licenses/LICENSE-2.0
+//
+//	Unless required by applicable law or agreed to in writing, software
+//	distributed under the License is distributed on an "AS IS" BASIS,
+//	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//	See the License for the specific language governing permissions and
+//	limitations under the License.
+package client
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+func response(code int, body string, hdr ...string) *http.Response {
+	r := &http.Response{
+		StatusCode: code,
+		Header:     http.Header{},
+		Body:       ioutil.NopCloser(strings.NewReader(body)),
+	}
+	for i := 0; i+1 < len(hdr); i += 2 {
+		r.Header.Set(hdr[i], hdr[i+1])
+	}
+	return r
+}
+
+func TestAPIErr(t *testing.T) {
+	tc := map[string]struct {
+		res *http.Response
+
+		err *APIError
+		msg string
+	}{
+		"json": {
+			res: response(500, `{"request_id": "1234", "error": "general service error"}`),
+			err: &APIError{Endpoint: uriInternalStatus,
+				StatusCode: 500, RequestId: "1234", Message: "general service error"},
+			msg: "http 500, reqid: 1234, msg: general service error",
+		},
+		"not json, request id header": {
+			res: response(502, "<html>Bad Gateway</html>\n", "X-MEN-RequestID", "abcd"),
+			err: &APIError{Endpoint: uriInternalStatus,
+				StatusCode: 502, RequestId: "abcd", Body: "<html>Bad Gateway</html>"},
+			msg: "http 502, reqid: abcd, response: <html>Bad Gateway</html>",
+		},
+		"json without error": {
+			res: response(404, `{"foo": "bar"}`),
+			err: &APIError{Endpoint: uriInternalStatus, StatusCode: 404, Body: `{"foo": "bar"}`},
+			msg: `http 404, reqid: , response: {"foo": "bar"}`,
+		},
+		"long body is cut": {
+			res: response(500, strings.Repeat("x", 2*maxBodyExcerpt)),
+			err: &APIError{Endpoint: uriInternalStatus,
+				StatusCode: 500, Body: strings.Repeat("x", maxBodyExcerpt)},
+			msg: "http 500, reqid: , response: " + strings.Repeat("x", maxBodyExcerpt),
+		},
+	}
+
+	for name, tc := range tc {
+		t.Run(name, func(t *testing.T) {
+			err := errors.Wrap(apiErr(tc.res, uriInternalStatus), "failed")
+
+			var e *APIError
+			assert.True(t, errors.As(err, &e))
+			assert.Equal(t, tc.err, e)
+			assert.Equal(t, tc.msg, e.Error())
+		})
+	}
+}
+
+func TestStorageErr(t *testing.T) {
+	tc := map[string]struct {
+		res *http.Response
+
+		err *StorageError
+		msg string
+	}{
+		"s3": {
+			res: response(404, `<?xml version="1.0" encoding="UTF-8"?>
+<Error><Code>NoSuchKey</Code><Message>The specified key does not exist.</Message>
+<RequestId>4442587FB7D0A2F9</RequestId></Error>`),
+			err: &StorageError{
+				Op:         "failed",
+				StatusCode: 404,
+				Code:       "NoSuchKey",
+				Message:    "The specified key does not exist.",
+				RequestId:  "4442587FB7D0A2F9",
+			},
+			msg: "failed, http 404, code: NoSuchKey, msg: The specified key does not exist.",
+		},
+		"azure, request id header": {
+			res: response(403, `<Error><Code>AuthenticationFailed</Code>
+<Message>Signature did not match</Message></Error>`, "x-ms-request-id", "abcd"),
+			err: &StorageError{
+				Op:         "failed",
+				StatusCode: 403,
+				Code:       "AuthenticationFailed",
+				Message:    "Signature did not match",
+				RequestId:  "abcd",
+			},
+			msg: "failed, http 403, code: AuthenticationFailed, msg: Signature did not match",
+		},
+		"not xml": {
+			res: response(500, "oops", "x-amz-request-id", "1234"),
+			err: &StorageError{Op: "failed", StatusCode: 500, RequestId: "1234", Body: "oops"},
+			msg: "failed, http 500, response: \n oops",
+		},
+	}
+
+	for name, tc := range tc {
+		t.Run(name, func(t *testing.T) {
+			err := errors.Wrap(storageErr(tc.res, "failed"), "download")
+
+			var e *StorageError
+			assert.True(t, errors.As(err, &e))
+			assert.Equal(t, tc.err, e)
+			assert.Equal(t, tc.msg, e.Error())
+		})
+	}
+}
+
+func TestErrorClassification(t *testing.T) {
+	tc := map[string]struct {
+		err error
+
+		retryable  bool
+		conflict   bool
+		auth       bool
+		validation bool
+		notFound   bool
+	}{
+		"api 503": {
+			err:       &APIError{StatusCode: 503},
+			retryable: true,
+		},
+		"api 501": {
+			err: &APIError{StatusCode: 501},
+		},
+		"api 429": {
+			err:       errors.Wrap(&APIError{StatusCode: 429}, "wrapped"),
+			retryable: true,
+		},
+		"api 409, upload": {
+			err:      &APIError{Endpoint: uriInternalUpload, StatusCode: 409},
+			conflict: true,
+		},
+		"api 409, management upload": {
+			err:      errors.Wrap(&APIError{Endpoint: uriManagementUpload, StatusCode: 409}, "wrapped"),
+			conflict: true,
+		},
+		"api 409, status report": {
+			err: &APIError{Endpoint: uriInternalStatus, StatusCode: 409},
+		},
+		"storage 409": {
+			err: &StorageError{StatusCode: 409, Code: "BlobAlreadyExists"},
+		},
+		"artifact conflict": {
+			err:      errors.Wrap(ErrArtifactConflict, "wrapped"),
+			conflict: true,
+		},
+		"api 401": {
+			err:  &APIError{StatusCode: 401},
+			auth: true,
+		},
+		"storage 403": {
+			err:  &StorageError{StatusCode: 403, Code: "AccessDenied"},
+			auth: true,
+		},
+		"storage 400": {
+			err:        &StorageError{StatusCode: 400, Code: "InvalidArgument"},
+			validation: true,
+		},
+		"storage 404": {
+			err:      errors.Wrap(&StorageError{StatusCode: 404}, "wrapped"),
+			notFound: true,
+		},
+		"storage no such key": {
+			err:      &StorageError{StatusCode: 404, Code: "NoSuchKey"},
+			notFound: true,
+		},
+		"storage blob not found": {
+			err:      &StorageError{StatusCode: 404, Code: "BlobNotFound"},
+			notFound: true,
+		},
+		"api 404": {
+			err: &APIError{StatusCode: 404},
+		},
+		"storage slow down": {
+			err:       &StorageError{StatusCode: 503, Code: "SlowDown"},
+			retryable: true,
+		},
+		"storage request timeout": {
+			err:       &StorageError{StatusCode: 400, Code: "RequestTimeout"},
+			retryable: true,
+			// still a 400
+			validation: true,
+		},
+		"api 422": {
+			err:        &APIError{StatusCode: 422},
+			validation: true,
+		},
+		"deadline": {
+			err: context.DeadlineExceeded,
+		},
+		"other": {
+			err: errors.New("foo"),
+		},
+	}
+
+	for name, tc := range tc {
+		t.Run(name, func(t *testing.T) {
+			assert.Equal(t, tc.retryable, IsRetryable(tc.err), "retryable")
+			assert.Equal(t, tc.conflict, IsConflict(tc.err), "conflict")
+			assert.Equal(t, tc.auth, IsAuth(tc.err), "auth")
+			assert.Equal(t, tc.validation, IsValidation(tc.err), "validation")
+			assert.Equal(t, tc.notFound, IsNotFound(tc.err), "not found")
+		})
+	}
+}
+
+func TestStorageErrorsRedacted(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusForbidden)
+		_, _ = w.Write([]byte(`<Error><Code>AccessDenied</Code><Message>Request has expired</Message></Error>`))
+	}))
+	defer server.Close()
+
+	closed := httptest.NewServer(http.NotFoundHandler())
+	closed.Close()
+
+	path := filepath.Join(t.TempDir(), "file")
+	assert.NoError(t, ioutil.WriteFile(path, []byte("data"), 0644))
+
+	for _, base := range []string{server.URL, closed.URL} {
+		url := base + "/bucket/key?X-Amz-Credential=s3cr3t&X-Amz-Signature=s3cr3t"
+
+		for name, s := range map[string]Storage{
+			"s3":    NewStorage(false),
+			"azure": NewAzureStorage(false),
+		} {
+			errs := []error{
+				s.Download(context.TODO(), url, filepath.Join(t.TempDir(), "out")),
+				s.Delete(context.TODO(), url),
+				s.Upload(context.TODO(), url, path),
+			}
+
+			for _, err := range errs {
+				assert.Error(t, err, name)
+				assert.NotContains(t, err.Error(), "s3cr3t", name)
+				assert.Contains(t, err.Error(), "X-Amz-Signature=xxxxx", name)
+			}
+		}
+	}
+}
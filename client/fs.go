@@ -0,0 +1,210 @@
+// Copyright 2024 Northern.tech AS
+//
+//	Licensed under the Apache License, Version 2.0 (the "License");
+//	you may not use this file except in compliance with the License.
+//	You may obtain a copy of the License at
+//
+//	    http://www.apache.org/licenses/LICENSE-2.0
+//
+//	Unless required by applicable law or agreed to in writing, software
+//	distributed under the License is distributed on an "AS IS" BASIS,
+//	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//	See the License for the specific language governing permissions and
+//	limitations under the License.
+package client
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+
+	"github.com/mendersoftware/create-artifact-worker/progress"
+)
+
+const schemeFile = "file"
+
+// fileStorage serves file:// urls from the local filesystem, confined
+// to a root directory.
+type fileStorage struct {
+	root string
+}
+
+// NewFileStorage returns a Storage for file:// urls; any path outside
+// root, including via symlinks, is refused.
+func NewFileStorage(root string) (Storage, error) {
+	if !filepath.IsAbs(root) {
+		return nil, errors.Errorf("file storage root %q is not an absolute path", root)
+	}
+
+	return &fileStorage{
+		root: filepath.Clean(root),
+	}, nil
+}
+
+func (s *fileStorage) Download(ctx context.Context, url, path string) error {
+	src, err := s.resolve(url)
+	if err != nil {
+		return fileErr(err, "failed to download artifact at url "+url)
+	}
+
+	in, err := os.Open(src)
+	if err != nil {
+		return fileErr(err, "failed to download artifact at url "+url)
+	}
+	defer in.Close()
+
+	out, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	pt := progress.FromContext(ctx)
+	if fi, err := in.Stat(); err == nil {
+		pt.SetTotal(fi.Size())
+	}
+
+	_, err = io.Copy(out, pt.Reader(&ctxReader{ctx: ctx, r: in}))
+	return err
+}
+
+func (s *fileStorage) Delete(ctx context.Context, url string) error {
+	p, err := s.resolve(url)
+	if err != nil {
+		return fileErr(err, "failed to delete artifact at url "+url)
+	}
+
+	err = os.Remove(p)
+	if err != nil {
+		return fileErr(err, "failed to delete artifact at url "+url)
+	}
+
+	return nil
+}
+
+func (s *fileStorage) Upload(ctx context.Context, url, path string) error {
+	dst, err := s.resolve(url)
+	if err != nil {
+		return err
+	}
+
+	in, err := os.Open(path)
+	if err != nil {
+		return errors.Wrapf(err, "cannot read file %s", path)
+	}
+	defer in.Close()
+
+	out, err := os.Create(dst)
+	if err != nil {
+		return errors.Wrapf(err, "failed to upload artifact to url %s", url)
+	}
+
+	pt := progress.FromContext(ctx)
+	if fi, err := in.Stat(); err == nil {
+		pt.SetTotal(fi.Size())
+	}
+
+	_, err = io.Copy(out, pt.Reader(&ctxReader{ctx: ctx, r: in}))
+	if err != nil {
+		out.Close()
+		return errors.Wrapf(err, "failed to upload artifact to url %s", url)
+	}
+
+	return out.Close()
+}
+
+// resolve maps a file:// url to a path under the root. Symlinks are
+// followed and the result checked again, so a link can't escape the root,
+// but the path itself is returned: deleting a link removes the link.
+// For files that don't exist yet, the parent dir is resolved instead.
+func (s *fileStorage) resolve(rawurl string) (string, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return "", err
+	}
+
+	if u.Scheme != schemeFile {
+		return "", errors.Errorf("unsupported url scheme %q, need %q", u.Scheme, schemeFile)
+	}
+
+	if u.Host != "" && u.Host != "localhost" {
+		return "", errors.Errorf("file url with remote host %q is not supported", u.Host)
+	}
+
+	p := filepath.Clean(u.Path)
+	if !filepath.IsAbs(p) {
+		return "", errors.Errorf("file url path %q is not absolute", u.Path)
+	}
+
+	root, err := filepath.EvalSymlinks(s.root)
+	if err != nil {
+		return "", errors.Wrapf(err, "invalid file storage root %s", s.root)
+	}
+
+	if !within(s.root, p) && !within(root, p) {
+		return "", errors.Errorf("path %s is outside of file storage root %s", p, s.root)
+	}
+
+	resolved, err := filepath.EvalSymlinks(p)
+	if os.IsNotExist(err) {
+		var dir string
+		dir, err = filepath.EvalSymlinks(filepath.Dir(p))
+		resolved = filepath.Join(dir, filepath.Base(p))
+	}
+	if err != nil {
+		return "", errors.Wrapf(err, "cannot resolve path %s", p)
+	}
+
+	if !within(root, resolved) {
+		return "", errors.Errorf("path %s resolves outside of file storage root %s", p, s.root)
+	}
+
+	return p, nil
+}
+
+// fileErr is err from resolving or opening the file for op. A missing
+// file is a not found StorageError, like the object storages answer; the
+// errors of resolve already tell what's wrong and are kept as they are.
+func fileErr(err error, op string) error {
+	if os.IsNotExist(errors.Cause(err)) {
+		return &StorageError{
+			Op:         op,
+			StatusCode: http.StatusNotFound,
+			Body:       errors.Cause(err).Error(),
+		}
+	}
+
+	if _, ok := err.(*os.PathError); ok {
+		return errors.Wrap(err, op)
+	}
+
+	return err
+}
+
+// ctxReader stops reading once ctx is done.
+type ctxReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (r *ctxReader) Read(p []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return r.r.Read(p)
+}
+
+func within(root, p string) bool {
+	rel, err := filepath.Rel(root, p)
+	if err != nil {
+		return false
+	}
+
+	return rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
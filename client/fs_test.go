@@ -0,0 +1,159 @@
+// Copyright 2024 Northern.tech AS
+//
+//	Licensed under the Apache License, Version 2.0 (the "License");
+//	you may not use this file except in compliance with the License.
+//	You may obtain a copy of the License at
+//
+//	    http://www.apache.org/licenses/LICENSE-2.0
+//
+//	Unless required by applicable law or agreed to in writing, software
+//	distributed under the License is distributed on an "AS IS" BASIS,
+//	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//	See the License for the specific language governing permissions and
+//	limitations under the License.
+package client
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFileStorage(t *testing.T) {
+	root := t.TempDir()
+	work := t.TempDir()
+
+	s, err := NewFileStorage(root)
+	assert.NoError(t, err)
+
+	ctx := context.TODO()
+
+	content := []byte("foobar")
+	in := filepath.Join(work, "in")
+	assert.NoError(t, ioutil.WriteFile(in, content, 0644))
+
+	uri := "file://" + filepath.Join(root, "artifact")
+
+	assert.NoError(t, s.Upload(ctx, uri, in))
+
+	out := filepath.Join(work, "out")
+	assert.NoError(t, s.Download(ctx, uri, out))
+	b, err := ioutil.ReadFile(out)
+	assert.NoError(t, err)
+	assert.Equal(t, content, b)
+
+	assert.NoError(t, s.Delete(ctx, uri))
+	_, err = os.Stat(filepath.Join(root, "artifact"))
+	assert.True(t, os.IsNotExist(err))
+
+	err = s.Download(ctx, uri, out)
+	assert.True(t, IsNotFound(err), err)
+	err = s.Delete(ctx, uri)
+	assert.True(t, IsNotFound(err), err)
+	err = s.Download(ctx, "file://"+filepath.Join(root, "dir", "artifact"), out)
+	assert.True(t, IsNotFound(err), err)
+
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	assert.True(t, errors.Is(s.Upload(cancelled, uri, in), context.Canceled))
+	assert.NoError(t, s.Upload(ctx, uri, in))
+	assert.True(t, errors.Is(s.Download(cancelled, uri, out), context.Canceled))
+}
+
+func TestFileStorageDeleteSymlink(t *testing.T) {
+	root := t.TempDir()
+
+	target := filepath.Join(root, "target")
+	assert.NoError(t, ioutil.WriteFile(target, []byte("target"), 0644))
+	link := filepath.Join(root, "link")
+	assert.NoError(t, os.Symlink(target, link))
+
+	s, err := NewFileStorage(root)
+	assert.NoError(t, err)
+
+	assert.NoError(t, s.Delete(context.TODO(), "file://"+link))
+
+	_, err = os.Lstat(link)
+	assert.True(t, os.IsNotExist(err))
+	_, err = os.Stat(target)
+	assert.NoError(t, err)
+}
+
+func TestFileStorageConfinement(t *testing.T) {
+	root := t.TempDir()
+	outside := t.TempDir()
+
+	secret := filepath.Join(outside, "secret")
+	assert.NoError(t, ioutil.WriteFile(secret, []byte("secret"), 0644))
+
+	assert.NoError(t, os.Symlink(secret, filepath.Join(root, "link")))
+	assert.NoError(t, os.Symlink(outside, filepath.Join(root, "dirlink")))
+
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(root, "ok"), []byte("ok"), 0644))
+	assert.NoError(t, os.Symlink(filepath.Join(root, "ok"), filepath.Join(root, "oklink")))
+
+	s, err := NewFileStorage(root)
+	assert.NoError(t, err)
+
+	ctx := context.TODO()
+	out := filepath.Join(t.TempDir(), "out")
+
+	tc := map[string]struct {
+		url string
+		err string
+	}{
+		"outside root": {
+			url: "file://" + secret,
+			err: "path " + secret + " is outside of file storage root " + root,
+		},
+		"dot dot": {
+			url: "file://" + root + "/../" + filepath.Base(outside) + "/secret",
+			err: "path " + secret + " is outside of file storage root " + root,
+		},
+		"symlink escaping": {
+			url: "file://" + filepath.Join(root, "link"),
+			err: "path " + filepath.Join(root, "link") +
+				" resolves outside of file storage root " + root,
+		},
+		"symlinked dir escaping": {
+			url: "file://" + filepath.Join(root, "dirlink", "new"),
+			err: "path " + filepath.Join(root, "dirlink", "new") +
+				" resolves outside of file storage root " + root,
+		},
+		"remote host": {
+			url: "file://server" + filepath.Join(root, "ok"),
+			err: `file url with remote host "server" is not supported`,
+		},
+		"wrong scheme": {
+			url: "https://server/ok",
+			err: `unsupported url scheme "https", need "file"`,
+		},
+		"symlink inside root": {
+			url: "file://" + filepath.Join(root, "oklink"),
+		},
+	}
+
+	for name, tc := range tc {
+		t.Run(name, func(t *testing.T) {
+			err := s.Download(ctx, tc.url, out)
+			if tc.err != "" {
+				assert.EqualError(t, err, tc.err)
+				assert.EqualError(t, s.Delete(ctx, tc.url), tc.err)
+				assert.EqualError(t, s.Upload(ctx, tc.url, out), tc.err)
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+
+	_, err = os.Stat(secret)
+	assert.NoError(t, err)
+
+	_, err = NewFileStorage("relative/dir")
+	assert.EqualError(t, err, `file storage root "relative/dir" is not an absolute path`)
+}
@@ -0,0 +1,184 @@
+// Copyright 2024 Northern.tech AS
+//
+//	Licensed under the Apache License, Version 2.0 (the "License");
+//	you may not use this file except in compliance with the License.
+//	You may obtain a copy of the License at
+//
+//	    http://www.apache.org/licenses/LICENSE-2.0
+//
+//	Unless required by applicable law or agreed to in writing, software
+//	distributed under the License is distributed on an "AS IS" BASIS,
+//	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//	See the License for the specific language governing permissions and
+//	limitations under the License.
+package client
+
+import (
+	"crypto/x509"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// HTTPConfig configures the http clients talking to deployments and
+// the storage backends. Zero values mean the net/http defaults, except
+// for Timeouts, which default to timeoutSec.
+type HTTPConfig struct {
+	TLS TLSConfig
+
+	DialTimeout           time.Duration
+	TLSHandshakeTimeout   time.Duration
+	ResponseHeaderTimeout time.Duration
+	IdleConnTimeout       time.Duration
+
+	MaxIdleConns        int
+	MaxIdleConnsPerHost int
+	MaxConnsPerHost     int
+
+	Timeouts Timeouts
+}
+
+// Timeouts are the deadlines of whole operations, including transferring
+// the request and response bodies.
+type Timeouts struct {
+	Download time.Duration
+	Upload   time.Duration
+	Delete   time.Duration
+	API      time.Duration
+}
+
+func (t Timeouts) withDefaults() Timeouts {
+	for _, d := range []*time.Duration{&t.Download, &t.Upload, &t.Delete, &t.API} {
+		if *d <= 0 {
+			*d = timeoutSec
+		}
+	}
+
+	return t
+}
+
+// NewHTTPClient returns an http client set up according to c. Proxies
+// are taken from the HTTP_PROXY, HTTPS_PROXY and NO_PROXY env vars.
+func NewHTTPClient(c HTTPConfig) (*http.Client, error) {
+	tlsConf, cas, err := newTLSConfig(c.TLS)
+	if err != nil {
+		return nil, err
+	}
+
+	dialer := &net.Dialer{
+		Timeout:   c.DialTimeout,
+		KeepAlive: 30 * time.Second,
+	}
+
+	tr := &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		DialContext:           dialer.DialContext,
+		TLSClientConfig:       tlsConf,
+		TLSHandshakeTimeout:   c.TLSHandshakeTimeout,
+		ResponseHeaderTimeout: c.ResponseHeaderTimeout,
+		IdleConnTimeout:       c.IdleConnTimeout,
+		MaxIdleConns:          c.MaxIdleConns,
+		MaxIdleConnsPerHost:   c.MaxIdleConnsPerHost,
+		MaxConnsPerHost:       c.MaxConnsPerHost,
+		ExpectContinueTimeout: time.Second,
+	}
+
+	var next http.RoundTripper = tr
+	if cas != nil {
+		next = &caReloadTransport{cas: cas, pool: tlsConf.RootCAs, tr: tr}
+	}
+
+	return &http.Client{
+		Transport: next,
+	}, nil
+}
+
+// NewTracingHTTPClient is NewHTTPClient also propagating the trace context
+// of requests, for the services taking part in the job; storage requests,
+// e.g. to pre-signed urls, go without it.
+func NewTracingHTTPClient(c HTTPConfig) (*http.Client, error) {
+	hc, err := NewHTTPClient(c)
+	if err != nil {
+		return nil, err
+	}
+
+	hc.Transport = &traceTransport{next: hc.Transport}
+	return hc, nil
+}
+
+// caReloadTransport swaps in a copy of the transport trusting the CA
+// bundle as it's on disk whenever it changes; the servers are verified
+// the standard way, against the name or address dialed.
+type caReloadTransport struct {
+	cas *reloader
+
+	mu   sync.Mutex
+	pool *x509.CertPool
+	tr   *http.Transport
+}
+
+func (t *caReloadTransport) transport() *http.Transport {
+	// the last good bundle is kept if reloading fails
+	v, err := t.cas.get()
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if pool, ok := v.(*x509.CertPool); err == nil && ok && pool != t.pool {
+		old := t.tr
+		t.tr = old.Clone()
+		t.tr.TLSClientConfig.RootCAs = pool
+		t.pool = pool
+		old.CloseIdleConnections()
+	}
+
+	return t.tr
+}
+
+func (t *caReloadTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	return t.transport().RoundTrip(req)
+}
+
+func (t *caReloadTransport) CloseIdleConnections() {
+	t.mu.Lock()
+	tr := t.tr
+	t.mu.Unlock()
+
+	tr.CloseIdleConnections()
+}
+
+// traceTransport propagates the trace context of requests in W3C
+// traceparent/tracestate headers, joining up the services' traces.
+type traceTransport struct {
+	next http.RoundTripper
+}
+
+func (t *traceTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if trace.SpanContextFromContext(req.Context()).IsValid() {
+		req = req.Clone(req.Context())
+		otel.GetTextMapPropagator().Inject(req.Context(), propagation.HeaderCarrier(req.Header))
+	}
+
+	return t.next.RoundTrip(req)
+}
+
+// CloseIdleConnections makes http.Client.CloseIdleConnections reach the
+// wrapped transport.
+func (t *traceTransport) CloseIdleConnections() {
+	if ci, ok := t.next.(interface{ CloseIdleConnections() }); ok {
+		ci.CloseIdleConnections()
+	}
+}
+
+func skipVerifyConfig(skipSsl bool) HTTPConfig {
+	return HTTPConfig{
+		TLS: TLSConfig{
+			SkipVerify: skipSsl,
+		},
+	}
+}
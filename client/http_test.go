@@ -0,0 +1,126 @@
+// Copyright 2024 Northern.tech AS
+//
+//	Licensed under the Apache License, Version 2.0 (the "License");
+//	you may not use this file except in compliance with the License.
+//	You may obtain a copy of the License at
+//
+//	    http://www.apache.org/licenses/LICENSE-2.0
+//
+//	Unless required by applicable law or agreed to in writing, software
+//	distributed under the License is distributed on an "AS IS" BASIS,
+//	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//	See the License for the specific language governing permissions and
+//	limitations under the License.
+package client
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+)
+
+func TestNewHTTPClient(t *testing.T) {
+	t.Parallel()
+
+	c, err := NewHTTPClient(HTTPConfig{
+		TLSHandshakeTimeout:   time.Second,
+		ResponseHeaderTimeout: 2 * time.Second,
+		IdleConnTimeout:       3 * time.Second,
+		MaxIdleConns:          4,
+		MaxIdleConnsPerHost:   5,
+		MaxConnsPerHost:       6,
+	})
+	assert.NoError(t, err)
+
+	tr := c.Transport.(*http.Transport)
+	assert.NotNil(t, tr.Proxy)
+	assert.NotNil(t, tr.DialContext)
+	assert.Equal(t, time.Second, tr.TLSHandshakeTimeout)
+	assert.Equal(t, 2*time.Second, tr.ResponseHeaderTimeout)
+	assert.Equal(t, 3*time.Second, tr.IdleConnTimeout)
+	assert.Equal(t, 4, tr.MaxIdleConns)
+	assert.Equal(t, 5, tr.MaxIdleConnsPerHost)
+	assert.Equal(t, 6, tr.MaxConnsPerHost)
+
+	assert.Equal(t, Timeouts{
+		Download: timeoutSec,
+		Upload:   time.Minute,
+		Delete:   timeoutSec,
+		API:      timeoutSec,
+	}, Timeouts{Upload: time.Minute}.withDefaults())
+}
+
+func TestStorageOperationTimeout(t *testing.T) {
+	t.Parallel()
+
+	done := make(chan struct{})
+	defer close(done)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-done:
+		case <-r.Context().Done():
+		}
+	}))
+	defer server.Close()
+
+	s, err := NewStorageForUrl(server.URL, StorageConfig{
+		Kind: StorageS3,
+		HTTP: HTTPConfig{
+			Timeouts: Timeouts{
+				Download: 50 * time.Millisecond,
+			},
+		},
+	})
+	assert.NoError(t, err)
+
+	err = s.Download(context.TODO(), server.URL, filepath.Join(t.TempDir(), "out"))
+	assert.Error(t, err)
+	assert.True(t, errors.Is(err, context.DeadlineExceeded), err.Error())
+}
+
+func TestHTTPClientPropagatesTraceContext(t *testing.T) {
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+
+	var headers []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		headers = append(headers, r.Header.Get("traceparent"))
+	}))
+	defer server.Close()
+
+	c, err := NewTracingHTTPClient(HTTPConfig{})
+	assert.NoError(t, err)
+	storage, err := NewHTTPClient(HTTPConfig{})
+	assert.NoError(t, err)
+
+	traceparent := "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	ctx := otel.GetTextMapPropagator().Extract(context.Background(),
+		propagation.MapCarrier{"traceparent": traceparent})
+
+	for _, ctx := range []context.Context{ctx, context.Background()} {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, server.URL, nil)
+		assert.NoError(t, err)
+
+		res, err := c.Do(req)
+		assert.NoError(t, err)
+		res.Body.Close()
+
+		// the caller's request is left as it was
+		assert.Empty(t, req.Header.Get("traceparent"))
+
+		res, err = storage.Do(req)
+		assert.NoError(t, err)
+		res.Body.Close()
+	}
+
+	// storage requests go without
+	assert.Equal(t, []string{traceparent, "", "", ""}, headers)
+}
@@ -0,0 +1,56 @@
+// Copyright 2024 Northern.tech AS
+//
+//	Licensed under the Apache License, Version 2.0 (the "License");
+//	you may not use this file except in compliance with the License.
+//	You may obtain a copy of the License at
+//
+//	    http://www.apache.org/licenses/LICENSE-2.0
+//
+//	Unless required by applicable law or agreed to in writing, software
+//	distributed under the License is distributed on an "AS IS" BASIS,
+//	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//	See the License for the specific language governing permissions and
+//	limitations under the License.
+package client
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Claims are the Mender specific JWT claims of a user token.
+type Claims struct {
+	Subject   string `json:"sub"`
+	Tenant    string `json:"mender.tenant,omitempty"`
+	User      bool   `json:"mender.user,omitempty"`
+	ExpiresAt int64  `json:"exp,omitempty"`
+}
+
+// ParseClaims decodes the claims of a JWT. The signature is NOT verified -
+// the worker has no access to the keys; that's up to the services the
+// token is forwarded to. Use the claims for consistency checks only.
+func ParseClaims(token string) (*Claims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("malformed token: expected 3 parts")
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(parts[1], "="))
+	if err != nil {
+		return nil, errors.Wrap(err, "malformed token payload")
+	}
+
+	claims := &Claims{}
+	if err := json.Unmarshal(payload, claims); err != nil {
+		return nil, errors.Wrap(err, "malformed token claims")
+	}
+
+	if claims.Subject == "" {
+		return nil, errors.New("token has no subject")
+	}
+
+	return claims, nil
+}
@@ -0,0 +1,88 @@
+// Copyright 2024 Northern.tech AS
+//
+//	Licensed under the Apache License, Version 2.0 (the "License");
+//	you may not use this file except in compliance with the License.
+//	You may obtain a copy of the License at
+//
+//	    http://www.apache.org/licenses/LICENSE-2.0
+//
+//	Unless required by applicable law or agreed to in writing, software
+//	distributed under the License is distributed on an "AS IS" BASIS,
+//	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//	See the License for the specific language governing permissions and
+//	limitations under the License.
+package client
+
+import (
+	"encoding/base64"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func token(payload string) string {
+	return "eyJhbGciOiJSUzI1NiIsInR5cCI6IkpXVCJ9." +
+		base64.RawURLEncoding.EncodeToString([]byte(payload)) +
+		".c2lnbmF0dXJl"
+}
+
+func TestParseClaims(t *testing.T) {
+	t.Parallel()
+
+	tc := map[string]struct {
+		token string
+
+		claims *Claims
+		err    string
+	}{
+		"ok": {
+			token: token(`{"sub":"user-1","mender.tenant":"tenant-1",` +
+				`"mender.user":true,"exp":1700000000}`),
+			claims: &Claims{
+				Subject:   "user-1",
+				Tenant:    "tenant-1",
+				User:      true,
+				ExpiresAt: 1700000000,
+			},
+		},
+		"ok, no tenant": {
+			token: token(`{"sub":"user-1","mender.user":true}`),
+			claims: &Claims{
+				Subject: "user-1",
+				User:    true,
+			},
+		},
+		"error, not a jwt": {
+			token: "foo",
+			err:   "malformed token: expected 3 parts",
+		},
+		"error, bad encoding": {
+			token: "a.!!!.c",
+			err:   "malformed token payload: illegal base64 data at input byte 0",
+		},
+		"error, bad json": {
+			token: token(`{"sub":`),
+			err:   "malformed token claims: unexpected end of JSON input",
+		},
+		"error, no subject": {
+			token: token(`{"mender.tenant":"tenant-1"}`),
+			err:   "token has no subject",
+		},
+	}
+
+	for name := range tc {
+		tc := tc[name]
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			claims, err := ParseClaims(tc.token)
+			if tc.err != "" {
+				assert.EqualError(t, err, tc.err)
+				return
+			}
+
+			assert.NoError(t, err)
+			assert.Equal(t, tc.claims, claims)
+		})
+	}
+}
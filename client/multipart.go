@@ -0,0 +1,127 @@
+// Copyright 2024 Northern.tech AS
+//
+//	Licensed under the Apache License, Version 2.0 (the "License");
+//	you may not use this file except in compliance with the License.
+//	You may obtain a copy of the License at
+//
+//	    http://www.apache.org/licenses/LICENSE-2.0
+//
+//	Unless required by applicable law or agreed to in writing, software
+//	distributed under the License is distributed on an "AS IS" BASIS,
+//	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//	See the License for the specific language governing permissions and
+//	limitations under the License.
+package client
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"os"
+
+	"github.com/pkg/errors"
+
+	"github.com/mendersoftware/create-artifact-worker/progress"
+)
+
+// CompletedPart identifies an uploaded part of a multipart upload.
+type CompletedPart struct {
+	Number int    `json:"part_number"`
+	ETag   string `json:"etag"`
+}
+
+// MultipartUploader is implemented by storages which can upload a file
+// in parts, each to its own pre-signed url.
+type MultipartUploader interface {
+	UploadParts(ctx context.Context, urls []string, partSize int64, path string) (
+		[]CompletedPart, error)
+}
+
+// UploadParts PUTs consecutive partSize slices of the file to urls
+// (S3 UploadPart), returning the parts' etags for completing the upload.
+func (s *storage) UploadParts(
+	ctx context.Context,
+	urls []string,
+	partSize int64,
+	path string,
+) ([]CompletedPart, error) {
+	ctx, cancel := context.WithTimeout(ctx, s.timeouts.Upload)
+	defer cancel()
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "cannot read file %s", path)
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, errors.Wrapf(err, "cannot stat file %s", path)
+	}
+
+	if partSize <= 0 || int64(len(urls))*partSize < fi.Size() {
+		return nil, errors.Errorf("%d parts of %d bytes can't hold %d bytes",
+			len(urls), partSize, fi.Size())
+	}
+
+	pt := progress.FromContext(ctx)
+	pt.SetTotal(fi.Size())
+
+	var parts []CompletedPart
+	for i, url := range urls {
+		off := int64(i) * partSize
+		if off >= fi.Size() && i > 0 {
+			break
+		}
+
+		size := fi.Size() - off
+		if size > partSize {
+			size = partSize
+		}
+
+		etag, err := s.uploadPart(ctx, url, io.NewSectionReader(f, off, size), size)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to upload part %d", i+1)
+		}
+		pt.Add(size)
+
+		parts = append(parts, CompletedPart{
+			Number: i + 1,
+			ETag:   etag,
+		})
+	}
+
+	return parts, nil
+}
+
+func (s *storage) uploadPart(
+	ctx context.Context,
+	url string,
+	r io.Reader,
+	size int64,
+) (string, error) {
+	req, err := http.NewRequest(http.MethodPut, url, r)
+	if err != nil {
+		return "", err
+	}
+
+	req = req.WithContext(ctx)
+	req.ContentLength = size
+
+	res, err := doRequest(s.c, req)
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return "", storageErr(res, "failed to upload part to url "+url)
+	}
+
+	etag := res.Header.Get("ETag")
+	if etag == "" {
+		return "", errors.New("no etag in part upload response")
+	}
+
+	return etag, nil
+}
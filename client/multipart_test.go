@@ -0,0 +1,78 @@
+// Copyright 2024 Northern.tech AS
+//
+//	Licensed under the Apache License, Version 2.0 (the "License");
+//	you may not use this file except in compliance with the License.
+//	You may obtain a copy of the License at
+//
+//	    http://www.apache.org/licenses/LICENSE-2.0
+//
+//	Unless required by applicable law or agreed to in writing, software
+//	distributed under the License is distributed on an "AS IS" BASIS,
+//	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//	See the License for the specific language governing permissions and
+//	limitations under the License.
+package client
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/mendersoftware/create-artifact-worker/progress"
+)
+
+func TestStorageUploadParts(t *testing.T) {
+	lock := sync.Mutex{}
+	parts := map[string][]byte{}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, http.MethodPut, r.Method)
+
+		b, err := ioutil.ReadAll(r.Body)
+		assert.NoError(t, err)
+
+		lock.Lock()
+		parts[r.URL.Path] = b
+		lock.Unlock()
+
+		w.Header().Set("ETag", `"etag`+strings.TrimPrefix(r.URL.Path, "/part")+`"`)
+	}))
+	defer server.Close()
+
+	content := bytes.Repeat([]byte("0123456789"), 25)
+	path := filepath.Join(t.TempDir(), "artifact")
+	assert.NoError(t, ioutil.WriteFile(path, content, 0644))
+
+	s := NewStorage(false).(MultipartUploader)
+
+	urls := []string{server.URL + "/part1", server.URL + "/part2", server.URL + "/part3"}
+
+	tr := (&progress.Reporter{Interval: time.Hour}).Start(context.TODO(), "upload", 0)
+	defer tr.Done()
+
+	res, err := s.UploadParts(progress.NewContext(context.TODO(), tr), urls, 100, path)
+	assert.NoError(t, err)
+	assert.Equal(t, []CompletedPart{
+		{Number: 1, ETag: `"etag1"`},
+		{Number: 2, ETag: `"etag2"`},
+		{Number: 3, ETag: `"etag3"`},
+	}, res)
+
+	assert.Equal(t, content[:100], parts["/part1"])
+	assert.Equal(t, content[100:200], parts["/part2"])
+	assert.Equal(t, content[200:], parts["/part3"])
+	assert.Equal(t, int64(250), tr.Update().Bytes)
+	assert.Equal(t, int64(250), tr.Update().Total)
+
+	_, err = s.UploadParts(context.TODO(), urls[:2], 100, path)
+	assert.EqualError(t, err, "2 parts of 100 bytes can't hold 250 bytes")
+}
@@ -0,0 +1,584 @@
+// Copyright 2024 Northern.tech AS
+//
+//	Licensed under the Apache License, Version 2.0 (the "License");
+//	you may not use this file except in compliance with the License.
+//	You may obtain a copy of the License at
+//
+//	    http://www.apache.org/licenses/LICENSE-2.0
+//
+//	Unless required by applicable law or agreed to in writing, software
+//	distributed under the License is distributed on an "AS IS" BASIS,
+//	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//	See the License for the specific language governing permissions and
+//	limitations under the License.
+package client
+
+import (
+	"context"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"net/http"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+
+	mlog "github.com/mendersoftware/create-artifact-worker/log"
+	"github.com/mendersoftware/create-artifact-worker/metrics"
+	"github.com/mendersoftware/create-artifact-worker/progress"
+)
+
+const (
+	DefaultChunkSize = 16 * 1024 * 1024
+
+	// most part sizes tried to reproduce a multipart etag
+	maxPartSizes = 16
+)
+
+var (
+	// delay before retrying a failed chunk, multiplied by the attempt
+	chunkRetryDelay = time.Second
+
+	reContentRange = regexp.MustCompile(`^bytes 0-0/(\d+)$`)
+	reMd5Etag      = regexp.MustCompile(`^[0-9a-fA-F]{32}$`)
+
+	// md5 of the parts' md5s and the part count
+	reMultipartEtag = regexp.MustCompile(`^([0-9a-fA-F]{32})-(\d+)$`)
+
+	// multipart etags don't record the part size; clients use multiples of this
+	partSizeUnit int64 = 1024 * 1024
+
+	errObjectChanged = errors.New("object changed during download")
+)
+
+// ParallelDownload configures downloading with concurrent ranged GETs.
+// It's enabled when Concurrency > 1.
+type ParallelDownload struct {
+	Concurrency int
+	ChunkSize   int64
+	Retries     int
+}
+
+func (p ParallelDownload) enabled() bool {
+	return p.Concurrency > 1
+}
+
+type reqFunc func(ctx context.Context, method, url string) (*http.Request, error)
+
+type errFunc func(r *http.Response, msg string) error
+
+// rangedDownload fetches url into path with concurrent ranged GETs. The
+// object size is probed with a 1 byte range first; if the server answers
+// with the whole object instead (no range support), it is streamed to
+// path as a regular download. If the object changes midway, the download
+// starts over, at most p.Retries times.
+func rangedDownload(
+	ctx context.Context,
+	c *http.Client,
+	newReq reqFunc,
+	errf errFunc,
+	url, path string,
+	p ParallelDownload,
+) error {
+	for restarts := 0; ; restarts++ {
+		err := rangedDownloadOnce(ctx, c, newReq, errf, url, path, p)
+		if !errors.Is(err, errObjectChanged) || restarts >= p.Retries {
+			return err
+		}
+
+		mlog.FromContext(ctx).Warn("%s changed while downloading, starting over",
+			mlog.RedactURL(url))
+	}
+}
+
+func rangedDownloadOnce(
+	ctx context.Context,
+	c *http.Client,
+	newReq reqFunc,
+	errf errFunc,
+	url, path string,
+	p ParallelDownload,
+) error {
+	req, err := newReq(ctx, http.MethodGet, url)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Range", "bytes=0-0")
+
+	res, err := doRequest(c, req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	msg := "failed to download artifact at url " + url
+
+	size, ranged := rangeSupport(res)
+	if !ranged {
+		switch res.StatusCode {
+		case http.StatusOK:
+			// range ignored, we're getting the whole object anyway
+			out, err := os.Create(path)
+			if err != nil {
+				return err
+			}
+			defer out.Close()
+
+			pt := progress.FromContext(ctx)
+			pt.SetTotal(res.ContentLength)
+
+			_, err = io.Copy(out, pt.Reader(res.Body))
+			return err
+		case http.StatusPartialContent, http.StatusRequestedRangeNotSatisfiable:
+			// unusable range response or an empty object, start over
+			res.Body.Close()
+			return singleDownload(ctx, c, newReq, errf, url, path)
+		default:
+			return errf(res, msg)
+		}
+	}
+
+	etag := res.Header.Get("ETag")
+
+	out, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	if err := out.Truncate(size); err != nil {
+		return errors.Wrapf(err, "cannot preallocate %s", path)
+	}
+	progress.FromContext(ctx).SetTotal(size)
+
+	chunkSize := p.ChunkSize
+	if chunkSize <= 0 {
+		chunkSize = DefaultChunkSize
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	chunks := make(chan int64)
+	errs := make(chan error, p.Concurrency)
+	wg := sync.WaitGroup{}
+
+	for i := 0; i < p.Concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for off := range chunks {
+				end := off + chunkSize - 1
+				if end >= size {
+					end = size - 1
+				}
+
+				err := downloadChunk(ctx, c, newReq, errf, url, etag, out, off, end, p.Retries)
+				if err != nil {
+					errs <- err
+					cancel()
+					return
+				}
+			}
+		}()
+	}
+
+feed:
+	for off := int64(0); off < size; off += chunkSize {
+		select {
+		case chunks <- off:
+		case <-ctx.Done():
+			break feed
+		}
+	}
+	close(chunks)
+	wg.Wait()
+
+	select {
+	case err := <-errs:
+		return errors.Wrap(err, msg)
+	default:
+	}
+
+	if err := ctx.Err(); err != nil {
+		return errors.Wrap(err, msg)
+	}
+
+	verified, err := verifyDownload(out, res, size)
+	if err != nil {
+		return errors.Wrap(err, msg)
+	}
+
+	if !verified {
+		mlog.FromContext(ctx).Warn("no usable checksum to verify the download of %s",
+			mlog.RedactURL(url))
+		metrics.FromContext(ctx).Unverified()
+	}
+
+	return nil
+}
+
+func singleDownload(
+	ctx context.Context,
+	c *http.Client,
+	newReq reqFunc,
+	errf errFunc,
+	url, path string,
+) error {
+	req, err := newReq(ctx, http.MethodGet, url)
+	if err != nil {
+		return err
+	}
+
+	res, err := doRequest(c, req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return errf(res, "failed to download artifact at url "+url)
+	}
+
+	out, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	pt := progress.FromContext(ctx)
+	pt.SetTotal(res.ContentLength)
+
+	_, err = io.Copy(out, pt.Reader(res.Body))
+	return err
+}
+
+func downloadChunk(
+	ctx context.Context,
+	c *http.Client,
+	newReq reqFunc,
+	errf errFunc,
+	url, etag string,
+	out io.WriterAt,
+	start, end int64,
+	retries int,
+) error {
+	var err error
+
+	for attempt := 0; attempt <= retries; attempt++ {
+		if attempt > 0 {
+			select {
+			case <-time.After(time.Duration(attempt) * chunkRetryDelay):
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+
+		err = func() error {
+			req, err := newReq(ctx, http.MethodGet, url)
+			if err != nil {
+				return err
+			}
+
+			req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", start, end))
+			if etag != "" {
+				// fail instead of mixing chunks of different versions
+				req.Header.Set("If-Match", etag)
+			}
+
+			res, err := doRequest(c, req)
+			if err != nil {
+				return err
+			}
+			defer res.Body.Close()
+
+			if res.StatusCode != http.StatusPartialContent {
+				return errf(res, fmt.Sprintf("failed to download bytes %d-%d", start, end))
+			}
+
+			n, err := io.Copy(&offsetWriter{w: out, off: start}, res.Body)
+			if err != nil {
+				return err
+			}
+
+			if n != end-start+1 {
+				return errors.Errorf("short read of bytes %d-%d: got %d bytes", start, end, n)
+			}
+
+			// counted once complete, retried chunks would count twice
+			progress.FromContext(ctx).Add(n)
+
+			return nil
+		}()
+
+		if err == nil || ctx.Err() != nil {
+			return err
+		}
+
+		// a changed etag won't change back, only starting over helps
+		code, _, ok := status(err)
+		if ok && code == http.StatusPreconditionFailed {
+			return errors.Wrapf(errObjectChanged, "bytes %d-%d", start, end)
+		}
+
+		// neither would e.g. a 403 or 404; broken connections and short
+		// reads carry no status and are retried
+		if ok && !IsRetryable(err) {
+			return err
+		}
+	}
+
+	return err
+}
+
+// rangeSupport returns the object size if the response to a 'bytes=0-0'
+// probe shows the server supports ranged requests.
+func rangeSupport(res *http.Response) (int64, bool) {
+	if res.StatusCode != http.StatusPartialContent ||
+		res.Header.Get("Accept-Ranges") != "bytes" {
+		return 0, false
+	}
+
+	m := reContentRange.FindStringSubmatch(res.Header.Get("Content-Range"))
+	if m == nil {
+		return 0, false
+	}
+
+	size, err := strconv.ParseInt(m[1], 10, 64)
+	if err != nil {
+		return 0, false
+	}
+
+	return size, true
+}
+
+// verifyDownload checks f against a checksum of the whole object from
+// the response: an md5, an x-amz-checksum-* or a multipart etag. It
+// returns false if there's none it can check.
+func verifyDownload(f *os.File, res *http.Response, size int64) (bool, error) {
+	if sum := expectedMd5(res); sum != "" {
+		return true, verifyHash(f, md5.New(), "md5", sum)
+	}
+
+	if alg, h, sum := amzChecksum(res); h != nil {
+		return true, verifyHash(f, h, alg, sum)
+	}
+
+	if sum, parts := multipartEtag(res); parts > 0 {
+		return verifyMultipartEtag(f, size, sum, parts)
+	}
+
+	return false, nil
+}
+
+// expectedMd5 extracts the whole-object md5 (hex) from the response, if
+// the backend publishes one: Azure sends it in x-ms-blob-content-md5,
+// S3 etags are plain md5s unless the object was uploaded in parts or
+// encrypted with KMS.
+func expectedMd5(res *http.Response) string {
+	if b64 := res.Header.Get("x-ms-blob-content-md5"); b64 != "" {
+		if b, err := base64.StdEncoding.DecodeString(b64); err == nil {
+			return hex.EncodeToString(b)
+		}
+	}
+
+	if sseKms(res) {
+		return ""
+	}
+
+	etag := strings.Trim(res.Header.Get("ETag"), `"`)
+	if reMd5Etag.MatchString(etag) {
+		return strings.ToLower(etag)
+	}
+
+	return ""
+}
+
+var amzChecksums = []struct {
+	alg     string
+	newHash func() hash.Hash
+}{
+	{"sha256", sha256.New},
+	{"sha1", sha1.New},
+	{"crc32c", func() hash.Hash { return crc32.New(crc32.MakeTable(crc32.Castagnoli)) }},
+	{"crc32", func() hash.Hash { return crc32.NewIEEE() }},
+}
+
+// amzChecksum returns the first full-object checksum (hex) S3 sent and
+// its hash. Composite ones, of the parts' checksums, are skipped.
+func amzChecksum(res *http.Response) (string, hash.Hash, string) {
+	if res.Header.Get("x-amz-checksum-type") == "COMPOSITE" {
+		return "", nil, ""
+	}
+
+	for _, c := range amzChecksums {
+		b64 := res.Header.Get("x-amz-checksum-" + c.alg)
+		if b64 == "" || strings.Contains(b64, "-") {
+			continue
+		}
+
+		if b, err := base64.StdEncoding.DecodeString(b64); err == nil {
+			return c.alg, c.newHash(), hex.EncodeToString(b)
+		}
+	}
+
+	return "", nil, ""
+}
+
+// multipartEtag returns the md5 of the parts' md5s and the part count of
+// a multipart upload's etag.
+func multipartEtag(res *http.Response) (string, int64) {
+	if sseKms(res) {
+		return "", 0
+	}
+
+	m := reMultipartEtag.FindStringSubmatch(strings.Trim(res.Header.Get("ETag"), `"`))
+	if m == nil {
+		return "", 0
+	}
+
+	parts, err := strconv.ParseInt(m[2], 10, 64)
+	if err != nil || parts < 1 {
+		return "", 0
+	}
+
+	return strings.ToLower(m[1]), parts
+}
+
+func sseKms(res *http.Response) bool {
+	return strings.HasPrefix(res.Header.Get("x-amz-server-side-encryption"), "aws:kms")
+}
+
+func verifyHash(f *os.File, h hash.Hash, alg, expected string) error {
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	if _, err := io.Copy(h, f); err != nil {
+		return err
+	}
+
+	if sum := hex.EncodeToString(h.Sum(nil)); sum != expected {
+		return errors.Errorf("checksum mismatch: expected %s %s, got %s", alg, expected, sum)
+	}
+
+	return nil
+}
+
+// verifyMultipartEtag hashes f in parts of each size the upload may have
+// used. A mismatch can't tell a corrupt download from a wrong guess, so
+// it only leaves the download unverified.
+func verifyMultipartEtag(f *os.File, size int64, expected string, parts int64) (bool, error) {
+	sizes := partSizes(size, parts)
+	if len(sizes) == 0 {
+		return false, nil
+	}
+
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return false, err
+	}
+
+	hashers := make([]*partHasher, len(sizes))
+	writers := make([]io.Writer, len(sizes))
+	for i, s := range sizes {
+		hashers[i] = &partHasher{size: s, h: md5.New()}
+		writers[i] = hashers[i]
+	}
+
+	if _, err := io.Copy(io.MultiWriter(writers...), f); err != nil {
+		return false, err
+	}
+
+	for _, ph := range hashers {
+		sum := md5.Sum(ph.sums())
+		if hex.EncodeToString(sum[:]) == expected {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// partSizes returns the multiples of partSizeUnit that split size bytes
+// into exactly parts parts.
+func partSizes(size, parts int64) []int64 {
+	if parts == 1 {
+		return []int64{size}
+	}
+
+	// ceil(size/s) == parts
+	lo := (size + parts - 1) / parts
+	hi := (size - 1) / (parts - 1)
+
+	var sizes []int64
+	for s := (lo + partSizeUnit - 1) / partSizeUnit * partSizeUnit; s <= hi; s += partSizeUnit {
+		if len(sizes) == maxPartSizes {
+			break
+		}
+		sizes = append(sizes, s)
+	}
+
+	return sizes
+}
+
+// partHasher collects the md5s of consecutive parts of size bytes.
+type partHasher struct {
+	size int64
+	n    int64
+	h    hash.Hash
+	sum  []byte
+}
+
+func (p *partHasher) Write(b []byte) (int, error) {
+	total := len(b)
+
+	for len(b) > 0 {
+		k := p.size - p.n
+		if int64(len(b)) < k {
+			k = int64(len(b))
+		}
+
+		p.h.Write(b[:k])
+		p.n += k
+		b = b[k:]
+
+		if p.n == p.size {
+			p.sum = p.h.Sum(p.sum)
+			p.h.Reset()
+			p.n = 0
+		}
+	}
+
+	return total, nil
+}
+
+func (p *partHasher) sums() []byte {
+	if p.n > 0 {
+		p.sum = p.h.Sum(p.sum)
+		p.n = 0
+	}
+
+	return p.sum
+}
+
+type offsetWriter struct {
+	w   io.WriterAt
+	off int64
+}
+
+func (o *offsetWriter) Write(b []byte) (int, error) {
+	n, err := o.w.WriteAt(b, o.off)
+	o.off += int64(n)
+	return n, err
+}
@@ -0,0 +1,341 @@
+// Copyright 2024 Northern.tech AS
+//
+//	Licensed under the Apache License, Version 2.0 (the "License");
+//	you may not use this file except in compliance with the License.
+//	You may obtain a copy of the License at
+//
+//	    http://www.apache.org/licenses/LICENSE-2.0
+//
+//	Unless required by applicable law or agreed to in writing, software
+//	distributed under the License is distributed on an "AS IS" BASIS,
+//	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//	See the License for the specific language governing permissions and
+//	limitations under the License.
+package client
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"hash/crc32"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/mendersoftware/create-artifact-worker/progress"
+)
+
+func TestStorageParallelDownload(t *testing.T) {
+	defer func(d time.Duration) { chunkRetryDelay = d }(chunkRetryDelay)
+	chunkRetryDelay = time.Millisecond
+	defer func(u int64) { partSizeUnit = u }(partSizeUnit)
+	partSizeUnit = 1000
+
+	content := bytes.Repeat([]byte("0123456789abcdef"), 1000)
+	sum := md5.Sum(content)
+	md5etag := `"` + hex.EncodeToString(sum[:]) + `"`
+	sha := sha256.Sum256(content)
+
+	tc := map[string]struct {
+		etag        string
+		header      map[string]string
+		noRanges    bool
+		failFirst   int32
+		failCode    int
+		staleProbes int32
+		code        int
+
+		ranged int32
+		probes int32
+		err    string
+	}{
+		"ok": {
+			etag:   md5etag,
+			ranged: 1 + 8,
+		},
+		"ok, multipart etag": {
+			etag:   multipartEtagOf(content, 2000),
+			ranged: 1 + 8,
+		},
+		"ok, unknown multipart etag, unverified": {
+			etag:   `"0123456789abcdef0123456789abcdef-3"`,
+			ranged: 1 + 8,
+		},
+		"ok, sha256 checksum": {
+			etag: `"0123456789abcdef0123456789abcdef-3"`,
+			header: map[string]string{
+				"x-amz-checksum-sha256": base64.StdEncoding.EncodeToString(sha[:]),
+			},
+			ranged: 1 + 8,
+		},
+		"ok, object changed, restarted": {
+			etag:        md5etag,
+			staleProbes: 1,
+			probes:      2,
+		},
+		"object keeps changing": {
+			etag:        md5etag,
+			staleProbes: 100,
+			probes:      1 + 2,
+			err:         "object changed during download",
+		},
+		"sha256 checksum mismatch": {
+			etag: md5etag,
+			header: map[string]string{
+				"x-amz-checksum-sha256":        base64.StdEncoding.EncodeToString(make([]byte, 32)),
+				"x-amz-server-side-encryption": "aws:kms",
+			},
+			ranged: 1 + 8,
+			err:    "checksum mismatch: expected sha256",
+		},
+		"ok, chunk retried": {
+			etag:      md5etag,
+			failFirst: 2,
+			ranged:    1 + 8 + 2,
+		},
+		"fallback, no range support": {
+			noRanges: true,
+		},
+		"checksum mismatch": {
+			etag:   `"00000000000000000000000000000000"`,
+			ranged: 1 + 8,
+			err:    "checksum mismatch",
+		},
+		"chunk retries exhausted": {
+			etag:      md5etag,
+			failFirst: 100,
+			err:       "failed to download bytes",
+		},
+		"chunk forbidden, not retried": {
+			etag:      md5etag,
+			failFirst: 100,
+			failCode:  http.StatusForbidden,
+			err:       "http 403",
+		},
+		"not found": {
+			code: http.StatusNotFound,
+			err:  "http 404",
+		},
+	}
+
+	for name, tc := range tc {
+		t.Run(name, func(t *testing.T) {
+			var ranged, failures, probes, stale int32
+
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if tc.code != 0 {
+					w.WriteHeader(tc.code)
+					return
+				}
+
+				if tc.noRanges {
+					_, _ = w.Write(content)
+					return
+				}
+
+				rng := r.Header.Get("Range")
+				if rng != "" {
+					atomic.AddInt32(&ranged, 1)
+				}
+
+				etag := tc.etag
+				if rng == "bytes=0-0" && atomic.AddInt32(&probes, 1) <= tc.staleProbes {
+					etag = `"stale"`
+				}
+
+				if rng != "" && rng != "bytes=0-0" {
+					if r.Header.Get("If-Match") != tc.etag {
+						atomic.AddInt32(&stale, 1)
+						w.WriteHeader(http.StatusPreconditionFailed)
+						return
+					}
+					if atomic.AddInt32(&failures, 1) <= tc.failFirst {
+						code := http.StatusServiceUnavailable
+						if tc.failCode != 0 {
+							code = tc.failCode
+						}
+						w.WriteHeader(code)
+						return
+					}
+				}
+
+				for k, v := range tc.header {
+					w.Header().Set(k, v)
+				}
+				w.Header().Set("ETag", etag)
+				http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(content))
+			}))
+			defer server.Close()
+
+			s, err := NewStorageForUrl(server.URL, StorageConfig{
+				Kind: StorageS3,
+				Download: ParallelDownload{
+					Concurrency: 3,
+					ChunkSize:   2000,
+					Retries:     2,
+				},
+			})
+			assert.NoError(t, err)
+
+			tr := (&progress.Reporter{Interval: time.Hour}).Start(context.TODO(), "download", 0)
+			defer tr.Done()
+
+			out := filepath.Join(t.TempDir(), "out")
+			err = s.Download(progress.NewContext(context.TODO(), tr), server.URL+"/input", out)
+			if tc.staleProbes > 0 {
+				// chunks failing the precondition restart the download
+				// instead of being retried, at most one per worker
+				assert.Equal(t, tc.probes, probes)
+				assert.LessOrEqual(t, stale, 3*tc.staleProbes)
+			}
+
+			if tc.failCode != 0 {
+				// at most one attempt per worker
+				assert.LessOrEqual(t, failures, int32(3))
+			}
+
+			if tc.err != "" {
+				assert.Error(t, err)
+				assert.True(t, strings.Contains(err.Error(), tc.err), err.Error())
+				return
+			}
+
+			assert.NoError(t, err)
+			b, err := ioutil.ReadFile(out)
+			assert.NoError(t, err)
+			assert.Equal(t, content, b)
+
+			if tc.staleProbes == 0 {
+				assert.Equal(t, tc.ranged, ranged)
+			}
+
+			// retried chunks are counted once
+			u := tr.Update()
+			assert.Equal(t, int64(len(content)), u.Bytes)
+			if !tc.noRanges {
+				// the fallback is chunked, without a content length
+				assert.Equal(t, int64(len(content)), u.Total)
+			}
+		})
+	}
+}
+
+func multipartEtagOf(b []byte, partSize int) string {
+	var sums []byte
+	for off := 0; off < len(b); off += partSize {
+		end := off + partSize
+		if end > len(b) {
+			end = len(b)
+		}
+		sum := md5.Sum(b[off:end])
+		sums = append(sums, sum[:]...)
+	}
+
+	sum := md5.Sum(sums)
+	return `"` + hex.EncodeToString(sum[:]) + "-" + strconv.Itoa((len(b)+partSize-1)/partSize) + `"`
+}
+
+func TestVerifyDownload(t *testing.T) {
+	defer func(u int64) { partSizeUnit = u }(partSizeUnit)
+	partSizeUnit = 1000
+
+	content := bytes.Repeat([]byte("0123456789abcdef"), 1000)
+	path := filepath.Join(t.TempDir(), "out")
+	assert.NoError(t, ioutil.WriteFile(path, content, 0644))
+
+	md5sum := md5.Sum(content)
+	crc := crc32.Checksum(content, crc32.MakeTable(crc32.Castagnoli))
+
+	tc := map[string]struct {
+		header map[string]string
+
+		verified bool
+		err      string
+	}{
+		"md5 etag": {
+			header:   map[string]string{"ETag": `"` + hex.EncodeToString(md5sum[:]) + `"`},
+			verified: true,
+		},
+		"azure md5": {
+			header: map[string]string{
+				"x-ms-blob-content-md5": base64.StdEncoding.EncodeToString(md5sum[:]),
+			},
+			verified: true,
+		},
+		"crc32c checksum": {
+			header: map[string]string{
+				"x-amz-checksum-crc32c": base64.StdEncoding.EncodeToString(
+					[]byte{byte(crc >> 24), byte(crc >> 16), byte(crc >> 8), byte(crc)}),
+			},
+			verified: true,
+		},
+		"multipart etag, 3 parts of 6000": {
+			header:   map[string]string{"ETag": multipartEtagOf(content, 6000)},
+			verified: true,
+		},
+		"multipart etag, single part": {
+			header:   map[string]string{"ETag": multipartEtagOf(content, 16000)},
+			verified: true,
+		},
+		"multipart etag, unaligned part size": {
+			header: map[string]string{"ETag": multipartEtagOf(content, 5500)},
+		},
+		"composite checksum": {
+			header: map[string]string{
+				"x-amz-checksum-crc32c": "AAAAAA==-3",
+				"x-amz-checksum-type":   "COMPOSITE",
+			},
+		},
+		"kms etag": {
+			header: map[string]string{
+				"ETag":                         `"` + hex.EncodeToString(md5sum[:]) + `"`,
+				"x-amz-server-side-encryption": "aws:kms",
+			},
+		},
+		"none": {},
+		"md5 mismatch": {
+			header:   map[string]string{"ETag": `"00000000000000000000000000000000"`},
+			verified: true,
+			err:      "checksum mismatch: expected md5",
+		},
+		"crc32 mismatch": {
+			header:   map[string]string{"x-amz-checksum-crc32": "AAAAAA=="},
+			verified: true,
+			err:      "checksum mismatch: expected crc32 00000000",
+		},
+	}
+
+	for name, tc := range tc {
+		t.Run(name, func(t *testing.T) {
+			res := &http.Response{Header: http.Header{}}
+			for k, v := range tc.header {
+				res.Header.Set(k, v)
+			}
+
+			f, err := os.Open(path)
+			assert.NoError(t, err)
+			defer f.Close()
+
+			verified, err := verifyDownload(f, res, int64(len(content)))
+			assert.Equal(t, tc.verified, verified)
+			if tc.err != "" {
+				assert.Error(t, err)
+				assert.Contains(t, err.Error(), tc.err)
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
@@ -15,120 +15,120 @@ package client
 
 import (
 	"context"
-	"crypto/tls"
-	"fmt"
-	"io"
-	"io/ioutil"
 	"net/http"
 	"os"
 
 	"github.com/pkg/errors"
+
+	"github.com/mendersoftware/create-artifact-worker/progress"
 )
 
 type Storage interface {
 	Download(ctx context.Context, url, path string) error
 	Delete(ctx context.Context, url string) error
+	Upload(ctx context.Context, url, path string) error
 }
 
 type storage struct {
-	c *http.Client
+	c        *http.Client
+	par      ParallelDownload
+	timeouts Timeouts
 }
 
 func NewStorage(skipSsl bool) Storage {
-	tr := &http.Transport{
-		TLSClientConfig: &tls.Config{
-			InsecureSkipVerify: skipSsl,
-		},
-	}
+	// can't fail without ca or client certificate files
+	c, _ := NewHTTPClient(skipVerifyConfig(skipSsl))
 
-	c := &http.Client{
-		Transport: tr,
-	}
+	return newS3Storage(c, ParallelDownload{}, Timeouts{})
+}
 
+func newS3Storage(c *http.Client, par ParallelDownload, t Timeouts) *storage {
 	return &storage{
-		c: c,
+		c:        c,
+		par:      par,
+		timeouts: t.withDefaults(),
 	}
 }
 
 func (s *storage) Download(ctx context.Context, url, path string) error {
-	ctx, cancel := context.WithTimeout(ctx, timeoutSec)
+	ctx, cancel := context.WithTimeout(ctx, s.timeouts.Download)
+	defer cancel()
+
+	if s.par.enabled() {
+		return rangedDownload(ctx, s.c, s.newRequest, storageErr, url, path, s.par)
+	}
+
+	return singleDownload(ctx, s.c, s.newRequest, storageErr, url, path)
+}
+
+func (s *storage) Delete(ctx context.Context, url string) error {
+	ctx, cancel := context.WithTimeout(ctx, s.timeouts.Delete)
 	defer cancel()
 
-	req, err := http.NewRequest(http.MethodGet, url, nil)
+	req, err := s.newRequest(ctx, http.MethodDelete, url)
 	if err != nil {
 		return err
 	}
 
-	req = req.WithContext(ctx)
-
-	res, err := s.c.Do(req)
+	res, err := doRequest(s.c, req)
 	if err != nil {
 		return err
 	}
 	defer res.Body.Close()
 
-	if res.StatusCode != http.StatusOK {
-		var body string
-
-		bbody, err := ioutil.ReadAll(res.Body)
-		if err != nil {
-			body = "<failed to read body>"
-		} else {
-			body = string(bbody)
-		}
-
-		return errors.New(fmt.Sprintf(
-			"failed to download artifact at url %s, http %d, response: \n %s",
-			url,
-			res.StatusCode,
-			body,
-		))
+	if res.StatusCode != http.StatusNoContent && res.StatusCode != http.StatusAccepted {
+		return storageErr(res, "failed to delete artifact at url "+url)
 	}
 
-	out, err := os.Create(path)
+	return nil
+}
+
+// Upload PUTs the file at path to a pre-signed url in a single request.
+func (s *storage) Upload(ctx context.Context, url, path string) error {
+	ctx, cancel := context.WithTimeout(ctx, s.timeouts.Upload)
+	defer cancel()
+
+	f, err := os.Open(path)
 	if err != nil {
-		return err
+		return errors.Wrapf(err, "cannot read file %s", path)
 	}
-	defer out.Close()
+	defer f.Close()
 
-	_, err = io.Copy(out, res.Body)
-	return err
-}
+	fi, err := f.Stat()
+	if err != nil {
+		return errors.Wrapf(err, "cannot stat file %s", path)
+	}
 
-func (s *storage) Delete(ctx context.Context, url string) error {
-	ctx, cancel := context.WithTimeout(ctx, timeoutSec)
-	defer cancel()
+	pt := progress.FromContext(ctx)
+	pt.SetTotal(fi.Size())
 
-	req, err := http.NewRequest(http.MethodDelete, url, nil)
+	req, err := http.NewRequest(http.MethodPut, url, pt.Reader(f))
 	if err != nil {
 		return err
 	}
 
 	req = req.WithContext(ctx)
+	req.ContentLength = fi.Size()
+	req.Header.Set("Content-Type", "application/octet-stream")
 
-	res, err := s.c.Do(req)
+	res, err := doRequest(s.c, req)
 	if err != nil {
 		return err
 	}
 	defer res.Body.Close()
 
-	if res.StatusCode != http.StatusNoContent && res.StatusCode != http.StatusAccepted {
-		var body string
-
-		bbody, err := ioutil.ReadAll(res.Body)
-		if err != nil {
-			body = "<failed to read body>"
-		} else {
-			body = string(bbody)
-		}
-
-		return errors.New(fmt.Sprintf(
-			"failed to delete artifact at url %s, http %d, response: \n %s",
-			url,
-			res.StatusCode,
-			body,
-		))
+	if res.StatusCode != http.StatusOK && res.StatusCode != http.StatusCreated {
+		return storageErr(res, "failed to upload artifact to url "+url)
 	}
 
 	return nil
 }
+
+func (s *storage) newRequest(ctx context.Context, method, url string) (*http.Request, error) {
+	req, err := http.NewRequest(method, url, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return req.WithContext(ctx), nil
+}
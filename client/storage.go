@@ -0,0 +1,82 @@
+// Copyright 2024 Northern.tech AS
+//
+//	Licensed under the Apache License, Version 2.0 (the "License");
+//	you may not use this file except in compliance with the License.
+//	You may obtain a copy of the License at
+//
+//	    http://www.apache.org/licenses/LICENSE-2.0
+//
+//	Unless required by applicable law or agreed to in writing, software
+//	distributed under the License is distributed on an "AS IS" BASIS,
+//	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//	See the License for the specific language governing permissions and
+//	limitations under the License.
+package client
+
+import (
+	"net/url"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	StorageAuto  = "auto"
+	StorageS3    = "s3"
+	StorageAzure = "azure"
+	StorageFile  = "file"
+)
+
+// StorageConfig selects and configures a Storage implementation.
+type StorageConfig struct {
+	// Kind is one of the Storage* constants; StorageAuto (or empty)
+	// detects the backend from the url.
+	Kind string
+	HTTP HTTPConfig
+
+	// FileRoot confines file:// urls; file storage is disabled if empty.
+	FileRoot string
+
+	// Download enables parallel ranged downloads for s3 and azure.
+	Download ParallelDownload
+}
+
+// NewStorageForUrl picks the Storage implementation by cfg.Kind; with
+// StorageAuto the backend is detected from the url itself.
+func NewStorageForUrl(rawurl string, cfg StorageConfig) (Storage, error) {
+	kind := cfg.Kind
+	if kind == StorageAuto || kind == "" {
+		kind = detectStorage(rawurl)
+	}
+
+	switch kind {
+	case StorageS3, StorageAzure:
+		c, err := NewHTTPClient(cfg.HTTP)
+		if err != nil {
+			return nil, err
+		}
+
+		if kind == StorageAzure {
+			return newAzureStorage(c, cfg.Download, cfg.HTTP.Timeouts), nil
+		}
+		return newS3Storage(c, cfg.Download, cfg.HTTP.Timeouts), nil
+	case StorageFile:
+		if cfg.FileRoot == "" {
+			return nil, errors.New("file storage root not configured")
+		}
+		return NewFileStorage(cfg.FileRoot)
+	default:
+		return nil, errors.Errorf("unknown storage type %q", kind)
+	}
+}
+
+func detectStorage(rawurl string) string {
+	if u, err := url.Parse(rawurl); err == nil && u.Scheme == schemeFile {
+		return StorageFile
+	}
+
+	if isAzureUrl(rawurl) {
+		return StorageAzure
+	}
+
+	return StorageS3
+}
@@ -0,0 +1,87 @@
+// Copyright 2024 Northern.tech AS
+//
+//	Licensed under the Apache License, Version 2.0 (the "License");
+//	you may not use this file except in compliance with the License.
+//	You may obtain a copy of the License at
+//
+//	    http://www.apache.org/licenses/LICENSE-2.0
+//
+//	Unless required by applicable law or agreed to in writing, software
+//	distributed under the License is distributed on an "AS IS" BASIS,
+//	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//	See the License for the specific language governing permissions and
+//	limitations under the License.
+package client
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewStorageForUrl(t *testing.T) {
+	t.Parallel()
+
+	tc := map[string]struct {
+		kind string
+		url  string
+
+		storage Storage
+		err     string
+	}{
+		"auto, s3": {
+			kind:    StorageAuto,
+			url:     "https://bucket.s3.amazonaws.com/foo?X-Amz-Signature=abc",
+			storage: &storage{},
+		},
+		"auto, azure host": {
+			kind:    StorageAuto,
+			url:     "https://acc.blob.core.windows.net/c/foo",
+			storage: &azureStorage{},
+		},
+		"auto, azurite sas": {
+			kind:    StorageAuto,
+			url:     "http://127.0.0.1:10000/devstoreaccount1/c/foo" + azuriteSas,
+			storage: &azureStorage{},
+		},
+		"forced azure": {
+			kind:    StorageAzure,
+			url:     "https://minio:9000/foo",
+			storage: &azureStorage{},
+		},
+		"forced s3": {
+			kind:    StorageS3,
+			url:     "https://acc.blob.core.windows.net/c/foo",
+			storage: &storage{},
+		},
+		"auto, file": {
+			kind:    StorageAuto,
+			url:     "file:///var/lib/artifacts/foo",
+			storage: &fileStorage{},
+		},
+		"unknown": {
+			kind: "gcs",
+			url:  "https://foo",
+			err:  `unknown storage type "gcs"`,
+		},
+	}
+
+	for name := range tc {
+		tc := tc[name]
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			s, err := NewStorageForUrl(tc.url, StorageConfig{
+				Kind:     tc.kind,
+				FileRoot: "/var/lib/artifacts",
+			})
+			if tc.err != "" {
+				assert.EqualError(t, err, tc.err)
+				return
+			}
+
+			assert.NoError(t, err)
+			assert.IsType(t, tc.storage, s)
+		})
+	}
+}
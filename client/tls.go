@@ -0,0 +1,184 @@
+// Copyright 2024 Northern.tech AS
+//
+//	Licensed under the Apache License, Version 2.0 (the "License");
+//	you may not use this file except in compliance with the License.
+//	You may obtain a copy of the License at
+//
+//	    http://www.apache.org/licenses/LICENSE-2.0
+//
+//	Unless required by applicable law or agreed to in writing, software
+//	distributed under the License is distributed on an "AS IS" BASIS,
+//	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//	See the License for the specific language governing permissions and
+//	limitations under the License.
+package client
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// TLSConfig configures the TLS side of all http clients in the package.
+type TLSConfig struct {
+	SkipVerify bool
+
+	// CAFile is a PEM bundle trusted on top of the system roots.
+	CAFile string
+
+	// CertFile and KeyFile are the PEM client certificate and key
+	// presented to servers asking for one (mutual TLS).
+	CertFile string
+	KeyFile  string
+
+	// MinVersion is one of "1.0", "1.1", "1.2", "1.3"; default "1.2".
+	MinVersion string
+}
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// NewTLSConfig builds a *tls.Config from c. The client certificate is
+// re-read whenever its files change on disk, so rotated certificates are
+// picked up without restarting; the clients of NewHTTPClient re-read the
+// CA bundle too.
+func NewTLSConfig(c TLSConfig) (*tls.Config, error) {
+	conf, _, err := newTLSConfig(c)
+	return conf, err
+}
+
+// newTLSConfig is NewTLSConfig, also returning the reloader of the CA
+// bundle the config's RootCAs were loaded by, if there's one.
+func newTLSConfig(c TLSConfig) (*tls.Config, *reloader, error) {
+	conf := &tls.Config{
+		InsecureSkipVerify: c.SkipVerify,
+		MinVersion:         tls.VersionTLS12,
+	}
+
+	if c.MinVersion != "" {
+		v, ok := tlsVersions[c.MinVersion]
+		if !ok {
+			return nil, nil, errors.Errorf("invalid minimum tls version %q", c.MinVersion)
+		}
+		conf.MinVersion = v
+	}
+
+	if (c.CertFile == "") != (c.KeyFile == "") {
+		return nil, nil, errors.New("tls client certificate and key must be given together")
+	}
+
+	if c.CertFile != "" {
+		r := &reloader{
+			files: []string{c.CertFile, c.KeyFile},
+			load: func() (interface{}, error) {
+				cert, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+				return &cert, err
+			},
+		}
+
+		if _, err := r.get(); err != nil {
+			return nil, nil, errors.Wrap(err, "failed to load tls client certificate")
+		}
+
+		conf.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			cert, err := r.get()
+			if err != nil {
+				return nil, err
+			}
+			return cert.(*tls.Certificate), nil
+		}
+	}
+
+	var cas *reloader
+	if c.CAFile != "" && !c.SkipVerify {
+		cas = &reloader{
+			files: []string{c.CAFile},
+			load: func() (interface{}, error) {
+				return loadCertPool(c.CAFile)
+			},
+		}
+
+		pool, err := cas.get()
+		if err != nil {
+			return nil, nil, errors.Wrap(err, "failed to load tls ca bundle")
+		}
+		conf.RootCAs = pool.(*x509.CertPool)
+	}
+
+	return conf, cas, nil
+}
+
+func loadCertPool(path string) (*x509.CertPool, error) {
+	pem, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	pool, err := x509.SystemCertPool()
+	if err != nil || pool == nil {
+		pool = x509.NewCertPool()
+	}
+
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, errors.Errorf("no certificates found in %s", path)
+	}
+
+	return pool, nil
+}
+
+// reloader caches the result of load until any of files is modified.
+// If reloading fails, the last good value is kept.
+type reloader struct {
+	files []string
+	load  func() (interface{}, error)
+
+	mu      sync.Mutex
+	modTime time.Time
+	value   interface{}
+}
+
+func (r *reloader) get() (interface{}, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var latest time.Time
+	for _, f := range r.files {
+		fi, err := os.Stat(f)
+		if err != nil {
+			if r.value != nil {
+				return r.value, nil
+			}
+			return nil, err
+		}
+
+		if fi.ModTime().After(latest) {
+			latest = fi.ModTime()
+		}
+	}
+
+	if r.value != nil && !latest.After(r.modTime) {
+		return r.value, nil
+	}
+
+	v, err := r.load()
+	if err != nil {
+		if r.value != nil {
+			return r.value, nil
+		}
+		return nil, err
+	}
+
+	r.value = v
+	r.modTime = latest
+
+	return v, nil
+}
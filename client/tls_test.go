@@ -0,0 +1,317 @@
+// Copyright 2024 Northern.tech AS
+//
+//	Licensed under the Apache License, Version 2.0 (the "License");
+//	you may not use this file except in compliance with the License.
+//	You may obtain a copy of the License at
+//
+//	    http://www.apache.org/licenses/LICENSE-2.0
+//
+//	Unless required by applicable law or agreed to in writing, software
+//	distributed under the License is distributed on an "AS IS" BASIS,
+//	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//	See the License for the specific language governing permissions and
+//	limitations under the License.
+package client
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pem  []byte
+}
+
+func newTestCA(t *testing.T, name string) *testCA {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	assert.NoError(t, err)
+
+	cert, err := x509.ParseCertificate(der)
+	assert.NoError(t, err)
+
+	return &testCA{
+		cert: cert,
+		key:  key,
+		pem:  pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+	}
+}
+
+// issue returns a PEM certificate and key signed by the CA, a server's
+// one being for 127.0.0.1
+func (ca *testCA) issue(t *testing.T, server bool) ([]byte, []byte) {
+	if server {
+		return ca.issueServer(t, nil, net.ParseIP("127.0.0.1"))
+	}
+	return ca.issueLeaf(t, x509.ExtKeyUsageClientAuth, nil, nil)
+}
+
+// issueServer returns a PEM server certificate and key for the names
+// and address given
+func (ca *testCA) issueServer(t *testing.T, names []string, ip net.IP) ([]byte, []byte) {
+	var ips []net.IP
+	if ip != nil {
+		ips = []net.IP{ip}
+	}
+	return ca.issueLeaf(t, x509.ExtKeyUsageServerAuth, names, ips)
+}
+
+func (ca *testCA) issueLeaf(
+	t *testing.T,
+	usage x509.ExtKeyUsage,
+	names []string,
+	ips []net.IP,
+) ([]byte, []byte) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: "leaf"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+		DNSNames:     names,
+		IPAddresses:  ips,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, &key.PublicKey, ca.key)
+	assert.NoError(t, err)
+
+	kder, err := x509.MarshalECPrivateKey(key)
+	assert.NoError(t, err)
+
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: kder})
+}
+
+func writeFile(t *testing.T, path string, b []byte, mtime time.Time) {
+	assert.NoError(t, ioutil.WriteFile(path, b, 0600))
+	assert.NoError(t, os.Chtimes(path, mtime, mtime))
+}
+
+func TestNewHTTPClientMutualTLS(t *testing.T) {
+	serverCA := newTestCA(t, "server ca")
+	clientCA := newTestCA(t, "client ca")
+	otherCA := newTestCA(t, "other ca")
+
+	srvCert, srvKey := serverCA.issue(t, true)
+	srvPair, err := tls.X509KeyPair(srvCert, srvKey)
+	assert.NoError(t, err)
+
+	clientPool := x509.NewCertPool()
+	clientPool.AddCert(clientCA.cert)
+
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	server.TLS = &tls.Config{
+		Certificates: []tls.Certificate{srvPair},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    clientPool,
+	}
+	server.StartTLS()
+	defer server.Close()
+
+	dir := t.TempDir()
+	caFile := filepath.Join(dir, "ca.pem")
+	certFile := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+
+	mtime := time.Now().Add(-time.Minute)
+
+	// start with a certificate the server doesn't trust
+	cert, key := otherCA.issue(t, false)
+	writeFile(t, caFile, serverCA.pem, mtime)
+	writeFile(t, certFile, cert, mtime)
+	writeFile(t, keyFile, key, mtime)
+
+	c, err := NewHTTPClient(HTTPConfig{
+		TLS: TLSConfig{
+			CAFile:   caFile,
+			CertFile: certFile,
+			KeyFile:  keyFile,
+		},
+	})
+	assert.NoError(t, err)
+
+	_, err = c.Get(server.URL)
+	assert.Error(t, err)
+
+	// rotate the client certificate, same client picks it up
+	mtime = mtime.Add(time.Second)
+	cert, key = clientCA.issue(t, false)
+	writeFile(t, certFile, cert, mtime)
+	writeFile(t, keyFile, key, mtime)
+
+	res, err := c.Get(server.URL)
+	assert.NoError(t, err)
+	if err == nil {
+		res.Body.Close()
+		assert.Equal(t, http.StatusNoContent, res.StatusCode)
+	}
+	c.CloseIdleConnections()
+
+	// rotate the ca bundle to one not matching the server
+	mtime = mtime.Add(time.Second)
+	writeFile(t, caFile, otherCA.pem, mtime)
+
+	_, err = c.Get(server.URL)
+	assert.Error(t, err)
+
+	// without the ca bundle the server isn't trusted at all
+	c, err = NewHTTPClient(HTTPConfig{
+		TLS: TLSConfig{
+			CertFile: certFile,
+			KeyFile:  keyFile,
+		},
+	})
+	assert.NoError(t, err)
+
+	_, err = c.Get(server.URL)
+	assert.Error(t, err)
+}
+
+func TestNewHTTPClientVerifiesServerName(t *testing.T) {
+	ca := newTestCA(t, "server ca")
+
+	tc := map[string]struct {
+		names []string
+		ip    net.IP
+
+		err bool
+	}{
+		"ip matches": {
+			ip: net.ParseIP("127.0.0.1"),
+		},
+		"certificate for another name": {
+			names: []string{"deployments.example.com"},
+			err:   true,
+		},
+		"certificate for another ip": {
+			ip:  net.ParseIP("10.0.0.1"),
+			err: true,
+		},
+	}
+
+	for name, tc := range tc {
+		t.Run(name, func(t *testing.T) {
+			cert, key := ca.issueServer(t, tc.names, tc.ip)
+			pair, err := tls.X509KeyPair(cert, key)
+			assert.NoError(t, err)
+
+			// httptest listens on 127.0.0.1, dialed by address
+			server := httptest.NewUnstartedServer(http.HandlerFunc(
+				func(w http.ResponseWriter, r *http.Request) {
+					w.WriteHeader(http.StatusNoContent)
+				}))
+			server.TLS = &tls.Config{Certificates: []tls.Certificate{pair}}
+			server.StartTLS()
+			defer server.Close()
+
+			caFile := filepath.Join(t.TempDir(), "ca.pem")
+			writeFile(t, caFile, ca.pem, time.Now())
+
+			c, err := NewHTTPClient(HTTPConfig{TLS: TLSConfig{CAFile: caFile}})
+			assert.NoError(t, err)
+
+			res, err := c.Get(server.URL)
+			if tc.err {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			res.Body.Close()
+		})
+	}
+}
+
+func TestNewTLSConfig(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	empty := filepath.Join(dir, "empty.pem")
+	assert.NoError(t, ioutil.WriteFile(empty, []byte("foo"), 0600))
+
+	tc := map[string]struct {
+		conf TLSConfig
+
+		minVersion uint16
+		err        string
+	}{
+		"defaults": {
+			minVersion: tls.VersionTLS12,
+		},
+		"tls 1.3": {
+			conf:       TLSConfig{MinVersion: "1.3"},
+			minVersion: tls.VersionTLS13,
+		},
+		"error, bad version": {
+			conf: TLSConfig{MinVersion: "2.0"},
+			err:  `invalid minimum tls version "2.0"`,
+		},
+		"error, cert without key": {
+			conf: TLSConfig{CertFile: "cert.pem"},
+			err:  "tls client certificate and key must be given together",
+		},
+		"error, missing cert": {
+			conf: TLSConfig{
+				CertFile: filepath.Join(dir, "cert.pem"),
+				KeyFile:  filepath.Join(dir, "key.pem"),
+			},
+			err: "failed to load tls client certificate: stat " +
+				filepath.Join(dir, "cert.pem") + ": no such file or directory",
+		},
+		"error, no certs in bundle": {
+			conf: TLSConfig{CAFile: empty},
+			err:  "failed to load tls ca bundle: no certificates found in " + empty,
+		},
+	}
+
+	for name := range tc {
+		tc := tc[name]
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			conf, err := NewTLSConfig(tc.conf)
+			if tc.err != "" {
+				assert.EqualError(t, err, tc.err)
+				return
+			}
+
+			assert.NoError(t, err)
+			assert.Equal(t, tc.minVersion, conf.MinVersion)
+		})
+	}
+}
@@ -0,0 +1,580 @@
+// Copyright 2024 Northern.tech AS
+//
+//	Licensed under the Apache License, Version 2.0 (the "License");
+//	you may not use this file except in compliance with the License.
+//	You may obtain a copy of the License at
+//
+//	    http://www.apache.org/licenses/LICENSE-2.0
+//
+//	Unless required by applicable law or agreed to in writing, software
+//	distributed under the License is distributed on an "AS IS" BASIS,
+//	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//	See the License for the specific language governing permissions and
+//	limitations under the License.
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"go.opentelemetry.io/otel/attribute"
+	"gopkg.in/yaml.v3"
+
+	"github.com/mendersoftware/create-artifact-worker/client"
+	"github.com/mendersoftware/create-artifact-worker/config"
+	mlog "github.com/mendersoftware/create-artifact-worker/log"
+	"github.com/mendersoftware/create-artifact-worker/metrics"
+	"github.com/mendersoftware/create-artifact-worker/progress"
+	"github.com/mendersoftware/create-artifact-worker/tracing"
+)
+
+const (
+	argManifest = "manifest"
+	argReport   = "report"
+)
+
+const generatorBatch = "batch"
+
+var batchCmd = &cobra.Command{
+	Use:   "batch",
+	Short: "Generate several single-file artifacts of one input file.",
+	Long: "\nGenerates an artifact of the input file for each variant of a manifest, e.g.\n" +
+		"per hardware revision or device type group, downloading the input once:\n\n" +
+		"variants:\n" +
+		"  - artifact_id: <ARTIFACT_ID>\n" +
+		"    artifact_name: <ARTIFACT_NAME>\n" +
+		"    description: <DESCRIPTION>\n" +
+		"    device_types: [<DEVICE_TYPE>, ...]\n" +
+		"    args: {filename: <FILE>, dest_dir: <DIR>, software_filesystem: <FS>,\n" +
+		"           software_name: <NAME>, software_version: <VERSION>}\n\n" +
+		"The manifest is yaml or json. The variants are generated and uploaded in\n" +
+		"parallel, each reporting its status like a single-file job; the input is\n" +
+		"deleted once all of them succeeded. A json report of the variants is written\n" +
+		"to --report, or stdout.\n\n" +
+		"Supports the env vars of single-file, and the following:\n\n" +
+		"CREATE_ARTIFACT_WORKER_CONCURRENCY parallel variants (default: 10)\n",
+	Run: func(cmd *cobra.Command, args []string) {
+		c, err := NewBatchCmd(cmd, args)
+		if err != nil {
+			mlog.Error(err.Error())
+			os.Exit(1)
+		}
+
+		err = c.Run()
+		if err != nil {
+			mlog.Error(err.Error())
+			os.Exit(exitCode(err))
+		}
+	},
+}
+
+func init() {
+	batchCmd.Flags().String(argManifest, "", "yaml or json manifest of the variants")
+	_ = batchCmd.MarkFlagRequired(argManifest)
+
+	batchCmd.Flags().String(argToken, "", "auth token")
+	_ = batchCmd.MarkFlagRequired(argToken)
+
+	batchCmd.Flags().String(argTenantId, "", "tenant id")
+	_ = batchCmd.MarkFlagRequired(argTenantId)
+
+	batchCmd.Flags().String(
+		argGetArtifactUri,
+		"",
+		"pre-signed s3 url to uploaded temp artifact (GET)",
+	)
+	_ = batchCmd.MarkFlagRequired(argGetArtifactUri)
+
+	batchCmd.Flags().String(
+		argDelArtifactUri,
+		"",
+		"pre-signed s3 url to uploaded temp artifact (DELETE)",
+	)
+	_ = batchCmd.MarkFlagRequired(argDelArtifactUri)
+
+	batchCmd.Flags().String(argReport, "", "path the json report is written to (default: stdout)")
+}
+
+// manifest lists the variants of a batch
+type manifest struct {
+	Variants []variant `yaml:"variants"`
+}
+
+type variant struct {
+	ArtifactId   string   `yaml:"artifact_id"`
+	ArtifactName string   `yaml:"artifact_name"`
+	Description  string   `yaml:"description"`
+	DeviceTypes  []string `yaml:"device_types"`
+	Args         args     `yaml:"args"`
+}
+
+// BatchReport is the outcome of a batch, written as json.
+type BatchReport struct {
+	Variants []VariantResult `json:"variants"`
+	Done     int             `json:"done"`
+	Failed   int             `json:"failed"`
+}
+
+type VariantResult struct {
+	ArtifactId   string  `json:"artifact_id"`
+	ArtifactName string  `json:"artifact_name"`
+	Status       string  `json:"status"`
+	Error        string  `json:"error,omitempty"`
+	Size         int64   `json:"size,omitempty"`
+	Duration     float64 `json:"duration_seconds"`
+}
+
+type BatchCmd struct {
+	Manifest    string
+	Report      string
+	Concurrency int
+
+	// Job is the configuration and the input shared by the variants.
+	Job SingleFileCmd
+	// Variants are the jobs of the manifest's variants.
+	Variants []*SingleFileCmd
+
+	stdout io.Writer
+}
+
+func NewBatchCmd(cmd *cobra.Command, args []string) (*BatchCmd, error) {
+	c := &BatchCmd{}
+
+	if err := c.init(cmd); err != nil {
+		return nil, err
+	}
+
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+func (c *BatchCmd) init(cmd *cobra.Command) error {
+	c.Job.initConfig()
+	c.Concurrency = viper.GetInt(config.CfgWorkerConcurrency)
+	c.Job.Traceparent = os.Getenv("TRACEPARENT")
+	c.Job.Tracestate = os.Getenv("TRACESTATE")
+
+	for _, f := range []struct {
+		name string
+		dst  *string
+	}{
+		{argManifest, &c.Manifest},
+		{argReport, &c.Report},
+		{argToken, &c.Job.AuthToken},
+		{argTenantId, &c.Job.TenantId},
+		{argGetArtifactUri, &c.Job.GetArtifactUri},
+		{argDelArtifactUri, &c.Job.DelArtifactUri},
+	} {
+		arg, err := cmd.Flags().GetString(f.name)
+		if err != nil {
+			return err
+		}
+		*f.dst = arg
+	}
+
+	return nil
+}
+
+// Validate reads the manifest and validates each variant as a job.
+func (c *BatchCmd) Validate() error {
+	if c.Concurrency <= 0 {
+		return errors.New("worker concurrency must be positive")
+	}
+
+	m, err := readManifest(c.Manifest)
+	if err != nil {
+		return err
+	}
+
+	c.Variants = nil
+	ids := map[string]bool{}
+	for i, v := range m.Variants {
+		if ids[v.ArtifactId] {
+			return errors.Errorf("invalid variant %d: duplicate artifact id %s", i, v.ArtifactId)
+		}
+		ids[v.ArtifactId] = true
+
+		vc, err := c.variant(v)
+		if err != nil {
+			return errors.Wrapf(err, "invalid variant %d", i)
+		}
+		c.Variants = append(c.Variants, vc)
+	}
+
+	return nil
+}
+
+func readManifest(path string) (*manifest, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to open manifest")
+	}
+	defer f.Close()
+
+	// yaml is a superset of json
+	m := &manifest{}
+	dec := yaml.NewDecoder(f)
+	dec.KnownFields(true)
+	if err := dec.Decode(m); err != nil {
+		return nil, errors.Wrap(err, "invalid manifest")
+	}
+
+	if len(m.Variants) == 0 {
+		return nil, errors.New("invalid manifest: no variants")
+	}
+
+	return m, nil
+}
+
+// variant makes the job of v, with c.Job as the configuration.
+func (c *BatchCmd) variant(v variant) (*SingleFileCmd, error) {
+	if v.ArtifactId == "" {
+		return nil, errors.New("artifact id can't be empty")
+	}
+	if v.ArtifactName == "" {
+		return nil, errors.New("artifact name can't be empty")
+	}
+	if len(v.DeviceTypes) == 0 {
+		return nil, errors.New("device types can't be empty")
+	}
+
+	b, err := json.Marshal(v.Args)
+	if err != nil {
+		return nil, err
+	}
+
+	vc := c.Job
+	vc.ArtifactId = v.ArtifactId
+	vc.ArtifactName = v.ArtifactName
+	vc.Description = v.Description
+	vc.DeviceTypes = v.DeviceTypes
+	vc.Args = string(b)
+
+	if err := vc.Validate(); err != nil {
+		return nil, err
+	}
+
+	return &vc, nil
+}
+
+// Run runs the batch until it's done or cancelled by SIGINT or SIGTERM.
+func (c *BatchCmd) Run() error {
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	// a second signal kills the process right away
+	go func() {
+		<-ctx.Done()
+		stop()
+	}()
+
+	shutdown, err := tracing.Init(context.Background(), c.Job.Tracing)
+	if err != nil {
+		return err
+	}
+	defer flushTraces(mlog.With("tenant_id", c.Job.TenantId), shutdown)
+
+	return c.RunContext(ctx)
+}
+
+// RunContext runs the batch and writes its report; it fails if any of the
+// variants did.
+func (c *BatchCmd) RunContext(ctx context.Context) error {
+	l := mlog.FromContext(ctx).With("tenant_id", c.Job.TenantId)
+
+	l.Info("running batch generation of %d variants of %s", len(c.Variants),
+		mlog.RedactURL(c.Job.GetArtifactUri))
+	l.Info("config:\n%s", config.Dump())
+
+	cd, err := client.NewDeploymentsWithToken(c.Job.DeploymentsUrl, c.Job.AuthToken,
+		c.Job.httpConfig())
+	if err != nil {
+		return errors.Wrap(err, "failed to configure 'deployments' client")
+	}
+
+	cs3, err := client.NewStorageForUrl(c.Job.GetArtifactUri, c.Job.storageConfig())
+	if err != nil {
+		return errors.Wrap(err, "failed to configure storage client")
+	}
+
+	for _, v := range c.Variants {
+		v.Progress.ArtifactId = v.ArtifactId
+		v.Progress.TenantId = v.TenantId
+		if v.Progress.CallbackUrl != "" {
+			v.Progress.Client, err = client.NewTracingHTTPClient(v.httpConfig())
+			if err != nil {
+				return errors.Wrap(err, "failed to configure progress callback client")
+			}
+		}
+	}
+
+	defer c.Job.exportMetrics(l)
+
+	ctx = tracing.WithParent(ctx, c.Job.Traceparent, c.Job.Tracestate)
+	ctx, span := tracing.Start(ctx, "create-artifact "+generatorBatch,
+		attribute.String("tenant_id", c.Job.TenantId),
+		attribute.Int("variants", len(c.Variants)),
+	)
+	if span.SpanContext().IsValid() {
+		l = l.With("trace_id", span.SpanContext().TraceID().String())
+	}
+	ctx = mlog.NewContext(ctx, l)
+	start := time.Now()
+
+	report, err := c.run(ctx, cd, cs3)
+	if werr := c.writeReport(report); werr != nil && err == nil {
+		err = werr
+	}
+	if err != nil {
+		l.With("duration", time.Since(start)).Error("batch failed: %s", err.Error())
+		tracing.End(span, err)
+		return err
+	}
+
+	l.With("duration", time.Since(start)).Info("batch done")
+	tracing.End(span, nil)
+
+	return nil
+}
+
+// run downloads the input and runs the variants on it. Each variant is a
+// job of its own in the metrics, the shared download is counted once.
+func (c *BatchCmd) run(ctx context.Context, cd client.Deployments, cs3 client.Storage) (*BatchReport, error) {
+	l := mlog.FromContext(ctx)
+
+	results := make([]VariantResult, len(c.Variants))
+	jobs := make([]*metrics.Job, len(c.Variants))
+	existing := make([]*client.Artifact, len(c.Variants))
+	for i, v := range c.Variants {
+		results[i] = VariantResult{ArtifactId: v.ArtifactId, ArtifactName: v.ArtifactName}
+		jobs[i] = metrics.NewJob(generatorBatch)
+		// a retried batch may find some artifacts already uploaded
+		existing[i] = v.lookupArtifact(ctx, cd)
+	}
+
+	// fail ends the variants not done yet with err
+	fail := func(err error) {
+		for i, v := range c.Variants {
+			if results[i].Status == "" {
+				c.endVariant(ctx, cd, v, jobs[i], &results[i], err)
+			}
+		}
+	}
+
+	dir, err := ioutil.TempDir(c.Job.Workdir, "batch")
+	if err != nil {
+		err = errors.Wrapf(err, "failed to create temp dir under workdir %s", c.Job.Workdir)
+		fail(err)
+		return c.report(results), err
+	}
+	defer c.Job.removeDir(ctx, dir)
+
+	input := filepath.Join(dir, "input")
+
+	sl := l.With("stage", "download")
+	sl.Debug("downloading temp artifact to %s", input)
+	for i, v := range c.Variants {
+		v.reportStatus(ctx, cd, client.StatusDownloading, "")
+		jobs[i].Stage(metrics.StageDownload)
+	}
+
+	start := time.Now()
+	spanCtx, span := tracing.Start(ctx, "storage.Download")
+	tr := c.Job.Progress.Start(spanCtx, progress.StageDownload, 0)
+	err = cs3.Download(progress.NewContext(spanCtx, tr), c.Job.GetArtifactUri, input)
+	tr.Done()
+	tracing.End(span, err)
+	if client.IsNotFound(err) && allUploaded(c.Variants, existing) {
+		// the input is deleted only after all the variants succeeded
+		sl.Info("artifacts already uploaded and input file gone, nothing to do")
+		fail(nil)
+		return c.report(results), nil
+	}
+	if err != nil {
+		err = errors.Wrapf(err, "failed to download input file at %s",
+			mlog.RedactURL(c.Job.GetArtifactUri))
+		fail(err)
+		return c.report(results), err
+	}
+	sl.With("duration", time.Since(start)).Info("downloaded input file")
+	if fi, err := os.Stat(input); err == nil {
+		jobs[0].Downloaded(fi.Size())
+	}
+
+	sem := make(chan struct{}, c.Concurrency)
+	var wg sync.WaitGroup
+	for i, v := range c.Variants {
+		wg.Add(1)
+		go func(i int, v *SingleFileCmd) {
+			defer wg.Done()
+
+			sem <- struct{}{}
+			defer func() { <-sem }()
+
+			vctx := metrics.NewContext(ctx, jobs[i])
+			vctx = mlog.NewContext(vctx, l.With("artifact_id", v.ArtifactId))
+			start := time.Now()
+			err := c.runVariant(vctx, cd, v, dir, input, existing[i], &results[i])
+			results[i].Duration = time.Since(start).Seconds()
+			c.endVariant(vctx, cd, v, jobs[i], &results[i], err)
+		}(i, v)
+	}
+	wg.Wait()
+
+	report := c.report(results)
+	if report.Failed > 0 {
+		return report, errors.Errorf("%d of %d variants failed", report.Failed, len(results))
+	}
+
+	err = c.Job.deleteInput(ctx, cs3)
+	if err != nil {
+		return report, errors.Wrapf(err, "failed to delete artifact at %s",
+			mlog.RedactURL(c.Job.DelArtifactUri))
+	}
+
+	return report, nil
+}
+
+// allUploaded tells if every variant's artifact is uploaded already.
+func allUploaded(variants []*SingleFileCmd, existing []*client.Artifact) bool {
+	for i, v := range variants {
+		if !v.uploadedAs(existing[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// runVariant generates and uploads the artifact of v in a dir of its own,
+// with a copy of the input as the generator may change it.
+func (c *BatchCmd) runVariant(
+	ctx context.Context,
+	cd client.Deployments,
+	v *SingleFileCmd,
+	dir, input string,
+	existing *client.Artifact,
+	res *VariantResult,
+) error {
+	l := mlog.FromContext(ctx)
+	job := metrics.FromContext(ctx)
+
+	vdir, err := ioutil.TempDir(dir, "variant")
+	if err != nil {
+		return errors.Wrapf(err, "failed to create temp dir under %s", dir)
+	}
+	defer v.removeDir(ctx, vdir)
+
+	//gotcha: the generator names the file on the device after the input
+	vinput := filepath.Join(vdir, v.FileName)
+	if err := copyFile(input, vinput); err != nil {
+		return err
+	}
+
+	if existing != nil {
+		if err := v.checkExisting(ctx, existing, vinput); err != nil {
+			return err
+		}
+		l.Info("artifact already uploaded, skipping generation")
+		return nil
+	}
+
+	outfile := filepath.Join(vdir, v.ArtifactId+"-generated")
+
+	v.reportStatus(ctx, cd, client.StatusGenerating, "")
+	job.Stage(metrics.StageGenerate)
+
+	if err := v.generate(ctx, vdir, vinput, outfile); err != nil {
+		return err
+	}
+
+	v.reportStatus(ctx, cd, client.StatusUploading, "")
+	job.Stage(metrics.StageUpload)
+
+	err = v.uploadGenerated(mlog.NewContext(ctx, l.With("stage", "upload")), cd, outfile, vinput)
+	if err != nil {
+		return err
+	}
+	if fi, err := os.Stat(outfile); err == nil {
+		res.Size = fi.Size()
+		job.Uploaded(fi.Size())
+	}
+
+	return nil
+}
+
+// endVariant records the outcome of a variant and reports its status.
+func (c *BatchCmd) endVariant(
+	ctx context.Context,
+	cd client.Deployments,
+	v *SingleFileCmd,
+	job *metrics.Job,
+	res *VariantResult,
+	err error,
+) {
+	if err != nil && ctx.Err() != nil {
+		err = errors.Wrap(ctx.Err(), "batch cancelled")
+	}
+
+	if err != nil {
+		job.Fail(errorClass(err))
+		res.Status = client.StatusFailed
+		res.Error = mlog.Redact(err.Error())
+		// a cancelled variant still gets its failure reported
+		sctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), statusReportTimeout)
+		v.reportStatus(sctx, cd, client.StatusFailed, res.Error)
+		cancel()
+		mlog.FromContext(ctx).With("artifact_id", v.ArtifactId).
+			Error("variant failed: %s", err.Error())
+		return
+	}
+
+	job.Done()
+	res.Status = client.StatusDone
+	v.reportStatus(ctx, cd, client.StatusDone, "")
+}
+
+func (c *BatchCmd) report(results []VariantResult) *BatchReport {
+	r := &BatchReport{Variants: results}
+	for _, res := range results {
+		if res.Status == client.StatusDone {
+			r.Done++
+		} else {
+			r.Failed++
+		}
+	}
+	return r
+}
+
+func (c *BatchCmd) writeReport(r *BatchReport) error {
+	b, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return err
+	}
+	b = append(b, '\n')
+
+	if c.Report != "" {
+		return errors.Wrap(ioutil.WriteFile(c.Report, b, 0644), "failed to write report")
+	}
+
+	out := c.stdout
+	if out == nil {
+		out = os.Stdout
+	}
+	_, err = fmt.Fprintf(out, "%s", b)
+	return err
+}
@@ -0,0 +1,352 @@
+// Copyright 2024 Northern.tech AS
+//
+//	Licensed under the Apache License, Version 2.0 (the "License");
+//	you may not use this file except in compliance with the License.
+//	You may obtain a copy of the License at
+//
+//	    http://www.apache.org/licenses/LICENSE-2.0
+//
+//	Unless required by applicable law or agreed to in writing, software
+//	distributed under the License is distributed on an "AS IS" BASIS,
+//	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//	See the License for the specific language governing permissions and
+//	limitations under the License.
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sort"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/mendersoftware/create-artifact-worker/client"
+)
+
+const (
+	testManifest = `variants:
+  - artifact_id: aid1
+    artifact_name: name-rev1
+    device_types: [dt1]
+    args: {filename: file, dest_dir: /etc/rev1}
+  - artifact_id: aid2
+    artifact_name: name-rev2
+    description: rev 2
+    device_types: [dt2, dt3]
+    args: {filename: file, dest_dir: /etc/rev2, software_name: sw}
+`
+	// variantGenerator fails generating artifacts named "bad"
+	variantGenerator = `#!/bin/sh
+while [ $# -gt 0 ]; do
+	case "$1" in
+		-o) out="$2"; shift;;
+		-n) name="$2"; shift;;
+	esac
+	shift
+done
+if [ "$name" = "bad" ]; then
+	echo "bad variant"
+	exit 1
+fi
+echo generated > "$out"
+`
+)
+
+func newTestBatchCmd(t *testing.T, deplUrl, storageUrl, generator, manifest string) *BatchCmd {
+	job := newTestSingleFileCmd(t, deplUrl, storageUrl, generator)
+	job.AuthToken = testToken("tid")
+
+	path := filepath.Join(t.TempDir(), "manifest.yaml")
+	assert.NoError(t, ioutil.WriteFile(path, []byte(manifest), 0644))
+
+	return &BatchCmd{
+		Manifest:    path,
+		Concurrency: 2,
+		Job:         *job,
+	}
+}
+
+func TestBatchCmdValidate(t *testing.T) {
+	tc := map[string]struct {
+		manifest string
+
+		variants []SingleFileCmd
+		err      string
+	}{
+		"yaml": {
+			manifest: testManifest,
+			variants: []SingleFileCmd{
+				{
+					ArtifactId:   "aid1",
+					ArtifactName: "name-rev1",
+					DeviceTypes:  []string{"dt1"},
+					FileName:     "file",
+					DestDir:      "/etc/rev1",
+				},
+				{
+					ArtifactId:   "aid2",
+					ArtifactName: "name-rev2",
+					Description:  "rev 2",
+					DeviceTypes:  []string{"dt2", "dt3"},
+					FileName:     "file",
+					DestDir:      "/etc/rev2",
+					SoftwareName: "sw",
+				},
+			},
+		},
+		"json": {
+			manifest: `{"variants":[{"artifact_id":"aid1","artifact_name":"name-rev1",` +
+				`"device_types":["dt1"],"args":{"filename":"file","dest_dir":"/etc/rev1"}}]}`,
+			variants: []SingleFileCmd{
+				{
+					ArtifactId:   "aid1",
+					ArtifactName: "name-rev1",
+					DeviceTypes:  []string{"dt1"},
+					FileName:     "file",
+					DestDir:      "/etc/rev1",
+				},
+			},
+		},
+		"no variants": {
+			manifest: "variants: []\n",
+			err:      "invalid manifest: no variants",
+		},
+		"unknown field": {
+			manifest: "variants:\n  - artifact_id: aid\n    dest_dir: /etc\n",
+			err:      "field dest_dir not found",
+		},
+		"duplicate artifact id": {
+			manifest: testManifest + "  - artifact_id: aid1\n",
+			err:      "invalid variant 2: duplicate artifact id aid1",
+		},
+		"no device types": {
+			manifest: "variants:\n  - {artifact_id: aid, artifact_name: n, args: {filename: f, dest_dir: /etc}}\n",
+			err:      "invalid variant 0: device types can't be empty",
+		},
+		"invalid args": {
+			manifest: "variants:\n  - {artifact_id: aid, artifact_name: n, device_types: [dt], " +
+				"args: {filename: f, dest_dir: etc}}\n",
+			err: "invalid variant 0: invalid artifact destination dir",
+		},
+	}
+
+	for name, tc := range tc {
+		t.Run(name, func(t *testing.T) {
+			c := newTestBatchCmd(t, "http://deployments", "http://storage", fakeGenerator, tc.manifest)
+
+			err := c.Validate()
+			if tc.err != "" {
+				assert.Error(t, err)
+				assert.Contains(t, err.Error(), tc.err)
+				return
+			}
+
+			assert.NoError(t, err)
+			assert.Len(t, c.Variants, len(tc.variants))
+			for i, v := range tc.variants {
+				assert.Equal(t, v.ArtifactId, c.Variants[i].ArtifactId)
+				assert.Equal(t, v.ArtifactName, c.Variants[i].ArtifactName)
+				assert.Equal(t, v.Description, c.Variants[i].Description)
+				assert.Equal(t, v.DeviceTypes, c.Variants[i].DeviceTypes)
+				assert.Equal(t, v.FileName, c.Variants[i].FileName)
+				assert.Equal(t, v.DestDir, c.Variants[i].DestDir)
+				assert.Equal(t, v.SoftwareName, c.Variants[i].SoftwareName)
+				assert.Equal(t, "tid", c.Variants[i].TenantId)
+			}
+		})
+	}
+}
+
+// batchStorage serves the input and counts its downloads and deletes
+type batchStorage struct {
+	sync.Mutex
+
+	gone bool
+	// fail makes downloads fail with this status
+	fail      int
+	downloads int
+	deletes   int
+}
+
+func (s *batchStorage) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.Lock()
+	defer s.Unlock()
+
+	switch {
+	case s.gone:
+		w.WriteHeader(http.StatusNotFound)
+	case s.fail != 0:
+		w.WriteHeader(s.fail)
+	case r.Method == http.MethodGet:
+		s.downloads++
+		_, _ = w.Write([]byte("input file"))
+	case r.Method == http.MethodDelete:
+		s.deletes++
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func TestBatchCmdRun(t *testing.T) {
+	uploaded := map[string]*client.Artifact{
+		"aid1": {
+			Name:                  "name-rev1",
+			DeviceTypesCompatible: []string{"dt1"},
+			Updates:               []client.Update{{Files: []client.UpdateFile{{Name: "file"}}}},
+		},
+		"aid2": {
+			Name:                  "name-rev2",
+			Description:           "rev 2",
+			DeviceTypesCompatible: []string{"dt3", "dt2"},
+			Updates:               []client.Update{{Files: []client.UpdateFile{{Name: "file"}}}},
+		},
+	}
+
+	tc := map[string]struct {
+		manifest  string
+		inputGone bool
+		fail      int
+		artifacts map[string]*client.Artifact
+
+		uploads  []string
+		statuses []string
+		results  map[string]string
+		deletes  int
+		err      string
+	}{
+		"ok": {
+			manifest: testManifest,
+			uploads:  []string{"aid1", "aid2"},
+			statuses: []string{
+				client.StatusDownloading, client.StatusDownloading,
+				client.StatusGenerating, client.StatusGenerating,
+				client.StatusUploading, client.StatusUploading,
+				client.StatusDone, client.StatusDone,
+			},
+			results: map[string]string{"aid1": client.StatusDone, "aid2": client.StatusDone},
+			deletes: 1,
+		},
+		"variant fails": {
+			manifest: testManifest +
+				"  - {artifact_id: aid3, artifact_name: bad, device_types: [dt], " +
+				"args: {filename: file, dest_dir: /etc}}\n",
+			uploads: []string{"aid1", "aid2"},
+			statuses: []string{
+				client.StatusDownloading, client.StatusDownloading, client.StatusDownloading,
+				client.StatusGenerating, client.StatusGenerating, client.StatusGenerating,
+				client.StatusUploading, client.StatusUploading,
+				client.StatusDone, client.StatusDone,
+				client.StatusFailed,
+			},
+			results: map[string]string{
+				"aid1": client.StatusDone,
+				"aid2": client.StatusDone,
+				"aid3": client.StatusFailed,
+			},
+			err: "1 of 3 variants failed",
+		},
+		"download fails": {
+			manifest:  testManifest,
+			inputGone: true,
+			statuses: []string{
+				client.StatusDownloading, client.StatusDownloading,
+				client.StatusFailed, client.StatusFailed,
+			},
+			results: map[string]string{"aid1": client.StatusFailed, "aid2": client.StatusFailed},
+			err:     "failed to download input file",
+		},
+		"already uploaded, input gone": {
+			manifest:  testManifest,
+			inputGone: true,
+			artifacts: uploaded,
+			results:   map[string]string{"aid1": client.StatusDone, "aid2": client.StatusDone},
+			statuses: []string{
+				client.StatusDownloading, client.StatusDownloading,
+				client.StatusDone, client.StatusDone,
+			},
+		},
+		"already uploaded, download forbidden": {
+			manifest:  testManifest,
+			fail:      http.StatusForbidden,
+			artifacts: uploaded,
+			statuses: []string{
+				client.StatusDownloading, client.StatusDownloading,
+				client.StatusFailed, client.StatusFailed,
+			},
+			results: map[string]string{"aid1": client.StatusFailed, "aid2": client.StatusFailed},
+			err:     "failed to download input file",
+		},
+	}
+
+	for name, tc := range tc {
+		t.Run(name, func(t *testing.T) {
+			depl := &fakeDeployments{artifacts: tc.artifacts}
+			deplServer := httptest.NewServer(depl)
+			defer deplServer.Close()
+
+			storage := &batchStorage{gone: tc.inputGone, fail: tc.fail}
+			storageServer := httptest.NewServer(storage)
+			defer storageServer.Close()
+
+			c := newTestBatchCmd(t, deplServer.URL, storageServer.URL, variantGenerator, tc.manifest)
+			var out bytes.Buffer
+			c.stdout = &out
+			assert.NoError(t, c.Validate())
+
+			err := c.RunContext(context.Background())
+			if tc.err != "" {
+				assert.Error(t, err)
+				assert.Contains(t, err.Error(), tc.err)
+			} else {
+				assert.NoError(t, err)
+			}
+
+			statuses := depl.status()
+			sort.Slice(statuses, func(i, j int) bool {
+				return statusOrder(statuses[i]) < statusOrder(statuses[j])
+			})
+			assert.Equal(t, tc.statuses, statuses)
+
+			sort.Strings(depl.uploads)
+			assert.Equal(t, tc.uploads, depl.uploads)
+
+			if !tc.inputGone && tc.fail == 0 {
+				assert.Equal(t, 1, storage.downloads)
+			}
+			assert.Equal(t, tc.deletes, storage.deletes)
+
+			var report BatchReport
+			assert.NoError(t, json.Unmarshal(out.Bytes(), &report))
+			results := map[string]string{}
+			for _, r := range report.Variants {
+				results[r.ArtifactId] = r.Status
+				if r.Status == client.StatusFailed {
+					assert.NotEmpty(t, r.Error)
+				}
+			}
+			assert.Equal(t, tc.results, results)
+		})
+	}
+}
+
+// statusOrder orders the statuses of parallel variants by stage.
+func statusOrder(s string) int {
+	for i, st := range []string{
+		client.StatusDownloading,
+		client.StatusGenerating,
+		client.StatusUploading,
+		client.StatusDone,
+		client.StatusFailed,
+	} {
+		if s == st {
+			return i
+		}
+	}
+	return -1
+}
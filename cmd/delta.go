@@ -0,0 +1,277 @@
+// Copyright 2024 Northern.tech AS
+//
+//	Licensed under the Apache License, Version 2.0 (the "License");
+//	you may not use this file except in compliance with the License.
+//	You may obtain a copy of the License at
+//
+//	    http://www.apache.org/licenses/LICENSE-2.0
+//
+//	Unless required by applicable law or agreed to in writing, software
+//	distributed under the License is distributed on an "AS IS" BASIS,
+//	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//	See the License for the specific language governing permissions and
+//	limitations under the License.
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+
+	"github.com/mendersoftware/create-artifact-worker/client"
+	mlog "github.com/mendersoftware/create-artifact-worker/log"
+	"github.com/mendersoftware/create-artifact-worker/metrics"
+	"github.com/mendersoftware/create-artifact-worker/progress"
+	"github.com/mendersoftware/create-artifact-worker/tracing"
+)
+
+const argBaseArtifactUri = "base-artifact-uri"
+
+const (
+	generatorDelta = "delta"
+
+	// deltaChecksumKey is the provides of the image checksum, the base
+	// image's the delta depends on
+	deltaChecksumKey = "rootfs-image.checksum"
+
+	// the downloaded images
+	deltaTarget = "target"
+	deltaBase   = "base"
+)
+
+var deltaCmd = &cobra.Command{
+	Use:   "delta",
+	Short: "Generate an update of the binary delta between two images.",
+	Long: "\nDownloads the base image from --base-artifact-uri and the target image from\n" +
+		"--get-artifact-uri, and generates an artifact of the delta between them. It\n" +
+		"depends on the base image's checksum and provides the target's, as\n" +
+		"rootfs-image.checksum, so it only installs on top of the base and deltas can\n" +
+		"be chained; the meta-data names the delta algorithm. Like single-file, the\n" +
+		"target image is deleted after generating, the base one is kept.\n\n" +
+		"--args is optional software info in json form: {\"software_filesystem\":\n" +
+		"<SOFTWARE_FILESYSTEM>, \"software_name\":<SOFTWARE_NAME>, \"software_version\":\n" +
+		"<SOFTWARE_VERSION>}\n\n" +
+		"Supports the env vars of single-file, and the following:\n\n" +
+		"CREATE_ARTIFACT_DELTA_GENERATOR mender-artifact (default: /usr/bin/mender-artifact)\n" +
+		"CREATE_ARTIFACT_DELTA_BACKEND delta tool: xdelta3, bsdiff (default: xdelta3)\n" +
+		"CREATE_ARTIFACT_DELTA_BACKEND_PATH path to the delta tool (default: looked up in PATH)\n",
+	Run: func(cmd *cobra.Command, args []string) {
+		c, err := NewDeltaCmd(cmd, args)
+		if err != nil {
+			mlog.Error(err.Error())
+			os.Exit(1)
+		}
+
+		err = c.Run()
+		if err != nil {
+			mlog.Error(err.Error())
+			os.Exit(exitCode(err))
+		}
+	},
+}
+
+func init() {
+	addJobFlags(deltaCmd,
+		"software info in json form: {\"software_filesystem\":<SOFTWARE_FILESYSTEM>,"+
+			" \"software_name\":<SOFTWARE_NAME>,"+
+			" \"software_version\":<SOFTWARE_VERSION>}",
+	)
+	// there are no args a delta needs
+	_ = deltaCmd.Flags().SetAnnotation(argArgs, cobra.BashCompOneRequiredFlag, []string{"false"})
+
+	deltaCmd.Flags().String(
+		argBaseArtifactUri,
+		"",
+		"pre-signed url to the base image (GET)",
+	)
+	_ = deltaCmd.MarkFlagRequired(argBaseArtifactUri)
+}
+
+type deltaArgs struct {
+	SoftwareFilesystem string `json:"software_filesystem"`
+	SoftwareName       string `json:"software_name"`
+	SoftwareVersion    string `json:"software_version"`
+}
+
+// deltaMetaData tells the update module how to apply the delta
+type deltaMetaData struct {
+	Algorithm string `json:"algorithm"`
+}
+
+// NewDeltaCmd makes the job of a delta artifact; it runs like a
+// single-file one, with the target image as the input.
+func NewDeltaCmd(cmd *cobra.Command, args []string) (*SingleFileCmd, error) {
+	c := &SingleFileCmd{Type: generatorDelta}
+
+	if err := c.init(cmd); err != nil {
+		return nil, err
+	}
+
+	arg, err := cmd.Flags().GetString(argBaseArtifactUri)
+	c.BaseArtifactUri = arg
+	if err != nil {
+		return nil, err
+	}
+
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+func (c *SingleFileCmd) parseDeltaArgs() error {
+	if c.local() {
+		return errors.New("local runs don't support delta artifacts")
+	}
+
+	if c.BaseArtifactUri == "" {
+		return errors.New("base artifact uri can't be empty")
+	}
+
+	if err := c.Delta.Validate(); err != nil {
+		return err
+	}
+
+	var args deltaArgs
+
+	if c.Args != "" {
+		dec := json.NewDecoder(strings.NewReader(c.Args))
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(&args); err != nil {
+			return errors.Wrap(err, "can't parse 'args'")
+		}
+	}
+
+	c.FileName = deltaTarget
+	c.SoftwareFilesystem = args.SoftwareFilesystem
+	c.SoftwareName = args.SoftwareName
+	c.SoftwareVersion = args.SoftwareVersion
+
+	return nil
+}
+
+// downloadBase downloads the base image next to the target in dir.
+func (c *SingleFileCmd) downloadBase(ctx context.Context, dir string) error {
+	l := mlog.FromContext(ctx)
+
+	cs, err := client.NewStorageForUrl(c.BaseArtifactUri, c.storageConfig())
+	if err != nil {
+		return errors.Wrap(err, "failed to configure storage client")
+	}
+
+	path := filepath.Join(dir, deltaBase)
+	l.Debug("downloading base image to %s", path)
+
+	start := time.Now()
+	spanCtx, span := tracing.Start(ctx, "storage.Download")
+	tr := c.Progress.Start(spanCtx, progress.StageDownload, 0)
+	err = cs.Download(progress.NewContext(spanCtx, tr), c.BaseArtifactUri, path)
+	tr.Done()
+	tracing.End(span, err)
+	if err != nil {
+		return errors.Wrapf(err, "failed to download base image at %s",
+			mlog.RedactURL(c.BaseArtifactUri))
+	}
+	l.With("duration", time.Since(start)).Info("downloaded base image")
+	if fi, err := os.Stat(path); err == nil {
+		metrics.FromContext(ctx).Downloaded(fi.Size())
+	}
+
+	return nil
+}
+
+// generateDelta computes the delta of the base image in dir to the input,
+// the target, and runs mender-artifact on it.
+func (c *SingleFileCmd) generateDelta(ctx context.Context, dir, input, output string) error {
+	base := filepath.Join(dir, deltaBase)
+
+	_, baseSum, err := c.fileChecksum(ctx, base)
+	if err != nil {
+		return err
+	}
+	_, targetSum, err := c.fileChecksum(ctx, input)
+	if err != nil {
+		return err
+	}
+	if baseSum == targetSum {
+		return errors.New("the base and target images are the same")
+	}
+
+	file := filepath.Join(dir, "image"+c.Delta.Ext())
+	name, args := c.Delta.Command(base, input, file)
+	if err := c.runGenerator(ctx, dir, file, name, args); err != nil {
+		return err
+	}
+
+	meta, err := ioutil.TempFile(dir, "meta-data")
+	if err != nil {
+		return errors.Wrap(err, "failed to write meta-data")
+	}
+	err = json.NewEncoder(meta).Encode(deltaMetaData{Algorithm: c.Delta.Name})
+	if cerr := meta.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return errors.Wrap(err, "failed to write meta-data")
+	}
+
+	args = []string{
+		"write", "module-image",
+		"-T", generatorDelta,
+		"-n", c.ArtifactName,
+		"-o", output,
+		"-m", meta.Name(),
+		"--depends", deltaChecksumKey + ":" + baseSum,
+		"--provides", deltaChecksumKey + ":" + targetSum,
+	}
+	if c.SoftwareFilesystem != "" {
+		args = append(args, "--software-filesystem", c.SoftwareFilesystem)
+	}
+	if c.SoftwareName != "" {
+		args = append(args, "--software-name", c.SoftwareName)
+	}
+	if c.SoftwareVersion != "" {
+		args = append(args, "--software-version", c.SoftwareVersion)
+	}
+
+	for _, deviceType := range c.DeviceTypes {
+		args = append(args, "-t", deviceType)
+	}
+	args = append(args, "-f", file)
+
+	return c.runGenerator(ctx, dir, output, c.Generator, args)
+}
+
+// checkExistingDelta verifies the artifact is the delta of the base image
+// to the target one, the input.
+func (c *SingleFileCmd) checkExistingDelta(ctx context.Context, a *client.Artifact, input string) error {
+	_, targetSum, err := c.fileChecksum(ctx, input)
+	if err != nil {
+		return err
+	}
+	if a.Provides[deltaChecksumKey] != targetSum {
+		return errors.Wrapf(client.ErrArtifactConflict,
+			"artifact %s exists with a different target (checksum %s, expected %s)",
+			c.ArtifactId, a.Provides[deltaChecksumKey], targetSum)
+	}
+
+	_, baseSum, err := c.fileChecksum(ctx, filepath.Join(filepath.Dir(input), deltaBase))
+	if err != nil {
+		return err
+	}
+	if !a.DependsOn(deltaChecksumKey, baseSum) {
+		return errors.Wrapf(client.ErrArtifactConflict,
+			"artifact %s exists with a different base (expected checksum %s)",
+			c.ArtifactId, baseSum)
+	}
+
+	return nil
+}
@@ -0,0 +1,244 @@
+// Copyright 2024 Northern.tech AS
+//
+//	Licensed under the Apache License, Version 2.0 (the "License");
+//	you may not use this file except in compliance with the License.
+//	You may obtain a copy of the License at
+//
+//	    http://www.apache.org/licenses/LICENSE-2.0
+//
+//	Unless required by applicable law or agreed to in writing, software
+//	distributed under the License is distributed on an "AS IS" BASIS,
+//	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//	See the License for the specific language governing permissions and
+//	limitations under the License.
+package cmd
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/mendersoftware/create-artifact-worker/client"
+	"github.com/mendersoftware/create-artifact-worker/delta"
+)
+
+const (
+	// fakeDeltaBackend writes the delta to its last argument
+	fakeDeltaBackend = `#!/bin/sh
+for a; do out="$a"; done
+echo delta > "$out"
+`
+	// recordingDeltaGenerator records the args and the meta-data it's
+	// given at %[1]s
+	recordingDeltaGenerator = `#!/bin/sh
+: > %[1]s
+while [ $# -gt 0 ]; do
+	case "$1" in
+		-o) out="$2"; shift;;
+		-T|--depends|--provides) echo "$1 $2" >> %[1]s; shift;;
+		-m) cp "$2" %[1]s.meta; shift;;
+		-f) echo "-f $(basename "$2") $(cat "$2")" >> %[1]s; shift;;
+	esac
+	shift
+done
+echo generated > "$out"
+`
+)
+
+func sha256Hex(s string) string {
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+// newImageStorage serves the base and target images
+func newImageStorage(t *testing.T, base string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == http.MethodGet && r.URL.Path == "/base":
+			_, _ = w.Write([]byte(base))
+		case r.Method == http.MethodGet:
+			_, _ = w.Write([]byte("target"))
+		case r.Method == http.MethodDelete:
+			w.WriteHeader(http.StatusNoContent)
+		}
+	}))
+}
+
+func newTestDeltaCmd(t *testing.T, deplUrl, storageUrl, generator string) *SingleFileCmd {
+	c := newTestSingleFileCmd(t, deplUrl, storageUrl, generator)
+	c.Type = generatorDelta
+	c.AuthToken = testToken("tid")
+	c.BaseArtifactUri = storageUrl + "/base?X-Amz-Signature=s3cr3t-base"
+	c.Args = `{"software_name":"rootfs"}`
+
+	backend := filepath.Join(t.TempDir(), "xdelta3")
+	assert.NoError(t, ioutil.WriteFile(backend, []byte(fakeDeltaBackend), 0755))
+	c.Delta = delta.Backend{Name: delta.XDelta3, Path: backend}
+
+	return c
+}
+
+func TestDeltaCmdValidate(t *testing.T) {
+	tc := map[string]struct {
+		args    string
+		base    string
+		backend string
+		input   string
+
+		err string
+	}{
+		"ok": {
+			args: `{"software_name":"rootfs","software_version":"v2"}`,
+		},
+		"no args": {},
+		"no base": {
+			base: "-",
+			err:  "base artifact uri can't be empty",
+		},
+		"unsupported backend": {
+			backend: "rsync",
+			err:     `unsupported delta backend "rsync"`,
+		},
+		"unknown args": {
+			args: `{"filename":"file"}`,
+			err:  `can't parse 'args': json: unknown field "filename"`,
+		},
+		"local": {
+			input: "input",
+			err:   "local runs don't support delta artifacts",
+		},
+	}
+
+	for name, tc := range tc {
+		t.Run(name, func(t *testing.T) {
+			c := newTestDeltaCmd(t, "http://deployments", "http://storage", fakeGenerator)
+			c.Args = tc.args
+			if tc.base == "-" {
+				c.BaseArtifactUri = ""
+			}
+			if tc.backend != "" {
+				c.Delta.Name = tc.backend
+			}
+			if tc.input != "" {
+				c.Input = filepath.Join(c.Workdir, "generator")
+				c.Output = filepath.Join(c.Workdir, "out")
+			}
+
+			err := c.Validate()
+			if tc.err != "" {
+				assert.EqualError(t, err, tc.err)
+				return
+			}
+
+			assert.NoError(t, err)
+			assert.Equal(t, deltaTarget, c.FileName)
+		})
+	}
+}
+
+func TestDeltaCmdRun(t *testing.T) {
+	depl := &fakeDeployments{}
+	deplServer := httptest.NewServer(depl)
+	defer deplServer.Close()
+
+	storage := newImageStorage(t, "base")
+	defer storage.Close()
+
+	rec := filepath.Join(t.TempDir(), "rec")
+	c := newTestDeltaCmd(t, deplServer.URL, storage.URL,
+		fmt.Sprintf(recordingDeltaGenerator, rec))
+	assert.NoError(t, c.Validate())
+
+	assert.NoError(t, c.Run())
+	assert.Equal(t, []string{"aid"}, depl.uploads)
+
+	b, err := ioutil.ReadFile(rec)
+	assert.NoError(t, err)
+	assert.Equal(t, "-T delta\n"+
+		"--depends rootfs-image.checksum:"+sha256Hex("base")+"\n"+
+		"--provides rootfs-image.checksum:"+sha256Hex("target")+"\n"+
+		"-f image.vcdiff delta\n",
+		string(b))
+
+	b, err = ioutil.ReadFile(rec + ".meta")
+	assert.NoError(t, err)
+	assert.JSONEq(t, `{"algorithm":"xdelta3"}`, string(b))
+}
+
+func TestDeltaCmdRunSameImages(t *testing.T) {
+	depl := &fakeDeployments{}
+	deplServer := httptest.NewServer(depl)
+	defer deplServer.Close()
+
+	storage := newImageStorage(t, "target")
+	defer storage.Close()
+
+	c := newTestDeltaCmd(t, deplServer.URL, storage.URL, fakeGenerator)
+	assert.NoError(t, c.Validate())
+
+	err := c.Run()
+	assert.EqualError(t, err, "the base and target images are the same")
+	assert.Empty(t, depl.uploads)
+}
+
+func TestDeltaCmdRunExistingArtifact(t *testing.T) {
+	artifact := func(base, target string) *client.Artifact {
+		return &client.Artifact{
+			Id:       "aid",
+			Name:     "name",
+			Provides: map[string]string{deltaChecksumKey: sha256Hex(target)},
+			Depends:  map[string]interface{}{deltaChecksumKey: sha256Hex(base)},
+		}
+	}
+
+	tc := map[string]struct {
+		artifact *client.Artifact
+
+		err string
+	}{
+		"already uploaded": {
+			artifact: artifact("base", "target"),
+		},
+		"different target": {
+			artifact: artifact("base", "other"),
+			err:      "artifact aid exists with a different target",
+		},
+		"different base": {
+			artifact: artifact("other", "target"),
+			err:      "artifact aid exists with a different base",
+		},
+	}
+
+	for name, tc := range tc {
+		t.Run(name, func(t *testing.T) {
+			depl := &fakeDeployments{artifact: tc.artifact}
+			deplServer := httptest.NewServer(depl)
+			defer deplServer.Close()
+
+			storage := newImageStorage(t, "base")
+			defer storage.Close()
+
+			// generating again must not be needed
+			c := newTestDeltaCmd(t, deplServer.URL, storage.URL, failingGenerator)
+			assert.NoError(t, c.Validate())
+
+			err := c.Run()
+			if tc.err != "" {
+				assert.True(t, errors.Is(err, client.ErrArtifactConflict), "%v", err)
+				assert.Contains(t, err.Error(), tc.err)
+			} else {
+				assert.NoError(t, err)
+			}
+
+			assert.Empty(t, depl.uploads)
+		})
+	}
+}
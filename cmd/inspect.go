@@ -0,0 +1,179 @@
+// Copyright 2024 Northern.tech AS
+//
+//	Licensed under the Apache License, Version 2.0 (the "License");
+//	you may not use this file except in compliance with the License.
+//	You may obtain a copy of the License at
+//
+//	    http://www.apache.org/licenses/LICENSE-2.0
+//
+//	Unless required by applicable law or agreed to in writing, software
+//	distributed under the License is distributed on an "AS IS" BASIS,
+//	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//	See the License for the specific language governing permissions and
+//	limitations under the License.
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+
+	"github.com/mendersoftware/create-artifact-worker/artifact"
+	"github.com/mendersoftware/create-artifact-worker/client"
+	"github.com/mendersoftware/create-artifact-worker/config"
+	mlog "github.com/mendersoftware/create-artifact-worker/log"
+)
+
+const argJSON = "json"
+
+var inspectCmd = &cobra.Command{
+	Use:   "inspect <FILE|URL>",
+	Short: "Print what an artifact's header says about it, and its files.",
+	Long: "\nReads a local artifact file, or downloads one from a url like the jobs' input,\n" +
+		"and prints its format version, header compression, whether it's signed, name,\n" +
+		"device types, provides and depends, and the payloads with their files' sizes\n" +
+		"and sha256 checksums; the checksums are verified if the manifest has them.\n\n" +
+		"Supports the storage env vars of single-file.\n",
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		c, err := NewInspectCmd(cmd, args)
+		if err != nil {
+			mlog.Error(err.Error())
+			os.Exit(1)
+		}
+
+		err = c.Run()
+		if err != nil {
+			mlog.Error(err.Error())
+			os.Exit(1)
+		}
+	},
+}
+
+func init() {
+	inspectCmd.Flags().Bool(argJSON, false, "print the artifact as json")
+}
+
+type InspectCmd struct {
+	// Source is the path or the url of the artifact
+	Source string
+	JSON   bool
+
+	// Job is the configuration urls are downloaded with.
+	Job SingleFileCmd
+
+	stdout io.Writer
+}
+
+func NewInspectCmd(cmd *cobra.Command, args []string) (*InspectCmd, error) {
+	c := &InspectCmd{Source: args[0]}
+
+	c.Job.initConfig()
+
+	arg, err := cmd.Flags().GetBool(argJSON)
+	c.JSON = arg
+	if err != nil {
+		return nil, err
+	}
+
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+func (c *InspectCmd) Validate() error {
+	if !c.remote() {
+		return nil
+	}
+
+	if err := config.ValidAbsPath(c.Job.Workdir); err != nil {
+		return errors.Wrap(err, "invalid workdir")
+	}
+	if _, err := client.NewTLSConfig(c.Job.TLS); err != nil {
+		return errors.Wrap(err, "invalid tls configuration")
+	}
+
+	return nil
+}
+
+// remote tells if the source is a url, rather than a local path.
+func (c *InspectCmd) remote() bool {
+	u, err := url.Parse(c.Source)
+	return err == nil && u.Scheme != ""
+}
+
+func (c *InspectCmd) Run() error {
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	return c.RunContext(ctx)
+}
+
+// RunContext prints the artifact, downloading it first if it's remote.
+func (c *InspectCmd) RunContext(ctx context.Context) error {
+	path := c.Source
+	if c.remote() {
+		dir, err := ioutil.TempDir(c.Job.Workdir, "inspect")
+		if err != nil {
+			return errors.Wrapf(err, "failed to create temp dir under workdir %s", c.Job.Workdir)
+		}
+		defer c.Job.removeDir(ctx, dir)
+
+		path = filepath.Join(dir, "artifact")
+		if err := c.download(ctx, path); err != nil {
+			return err
+		}
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return errors.Wrap(err, "failed to open artifact")
+	}
+	defer f.Close()
+
+	a, err := artifact.Read(f)
+	if err != nil {
+		return errors.Wrap(err, "failed to read artifact")
+	}
+
+	out := c.stdout
+	if out == nil {
+		out = os.Stdout
+	}
+
+	if c.JSON {
+		enc := json.NewEncoder(out)
+		enc.SetIndent("", "  ")
+		return errors.Wrap(enc.Encode(a), "failed to write artifact")
+	}
+
+	_, err = fmt.Fprintf(out, "Artifact %s\n%s", mlog.RedactURL(c.Source), a)
+	return errors.Wrap(err, "failed to write artifact")
+}
+
+func (c *InspectCmd) download(ctx context.Context, path string) error {
+	cs, err := client.NewStorageForUrl(c.Source, c.Job.storageConfig())
+	if err != nil {
+		return errors.Wrap(err, "failed to configure storage client")
+	}
+
+	mlog.FromContext(ctx).Debug("downloading artifact to %s", path)
+	if err := cs.Download(ctx, c.Source, path); err != nil {
+		return errors.Wrapf(err, "failed to download artifact at %s",
+			mlog.RedactURL(c.Source))
+	}
+
+	return nil
+}
@@ -0,0 +1,136 @@
+// Copyright 2024 Northern.tech AS
+//
+//	Licensed under the Apache License, Version 2.0 (the "License");
+//	you may not use this file except in compliance with the License.
+//	You may obtain a copy of the License at
+//
+//	    http://www.apache.org/licenses/LICENSE-2.0
+//
+//	Unless required by applicable law or agreed to in writing, software
+//	distributed under the License is distributed on an "AS IS" BASIS,
+//	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//	See the License for the specific language governing permissions and
+//	limitations under the License.
+package cmd
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/mendersoftware/create-artifact-worker/artifact"
+	"github.com/mendersoftware/create-artifact-worker/client"
+)
+
+func TestInspectCmdRun(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "release-1.mender")
+	assert.NoError(t, ioutil.WriteFile(file, testSourceArtifact(t), 0644))
+	notArtifact := filepath.Join(dir, "file")
+	assert.NoError(t, ioutil.WriteFile(notArtifact, []byte("input file"), 0644))
+
+	storage := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/artifact" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		_, _ = w.Write(testSourceArtifact(t))
+	}))
+	defer storage.Close()
+
+	summary := `
+Format: mender, version 3
+Compression: gzip
+Signature: no
+Name: release-1
+Compatible devices: dt1
+Provides:
+  artifact_name: release-1
+Depends:
+  device_type: dt1
+Payload 0: single-file
+  Provides:
+    rootfs-image.single-file.version: release-1
+  Files:
+    app.conf (10 bytes, sha256 ae2132f49016c5f7de1dbdcae027fcd4da86de355e3d1cfaf3d46e9005d14241)
+`
+
+	tc := map[string]struct {
+		source string
+		json   bool
+
+		out string
+		err string
+	}{
+		"file": {
+			source: file,
+			out:    "Artifact " + file + summary,
+		},
+		"url": {
+			source: storage.URL + "/artifact?X-Amz-Signature=s3cr3t",
+			out:    "Artifact " + storage.URL + "/artifact?X-Amz-Signature=xxxxx" + summary,
+		},
+		"json": {
+			source: file,
+			json:   true,
+		},
+		"missing file": {
+			source: filepath.Join(dir, "missing"),
+			err:    "failed to open artifact",
+		},
+		"not an artifact": {
+			source: notArtifact,
+			err:    "failed to read artifact",
+		},
+		"missing url": {
+			source: storage.URL + "/missing",
+			err:    "failed to download artifact at " + storage.URL + "/missing",
+		},
+	}
+
+	for name, tc := range tc {
+		t.Run(name, func(t *testing.T) {
+			var out bytes.Buffer
+			c := &InspectCmd{
+				Source: tc.source,
+				JSON:   tc.json,
+				Job: SingleFileCmd{
+					Workdir:     t.TempDir(),
+					StorageType: client.StorageS3,
+				},
+				stdout: &out,
+			}
+			assert.NoError(t, c.Validate())
+
+			err := c.Run()
+			if tc.err != "" {
+				assert.Error(t, err)
+				assert.Contains(t, err.Error(), tc.err)
+				return
+			}
+			assert.NoError(t, err)
+
+			if tc.json {
+				var a artifact.Artifact
+				assert.NoError(t, json.Unmarshal(out.Bytes(), &a))
+				assert.Equal(t, "release-1", a.Name)
+				assert.Equal(t, "gzip", a.Compression)
+				assert.Equal(t, []artifact.File{{Name: "app.conf", Size: 10,
+					Checksum: "ae2132f49016c5f7de1dbdcae027fcd4da86de355e3d1cfaf3d46e9005d14241"}},
+					a.Payloads[0].Files)
+				return
+			}
+			assert.Equal(t, tc.out, out.String())
+
+			// the download is gone
+			dirs, _ := filepath.Glob(filepath.Join(c.Job.Workdir, "inspect*"))
+			assert.Empty(t, dirs)
+		})
+	}
+}
@@ -0,0 +1,248 @@
+// Copyright 2024 Northern.tech AS
+//
+//	Licensed under the Apache License, Version 2.0 (the "License");
+//	you may not use this file except in compliance with the License.
+//	You may obtain a copy of the License at
+//
+//	    http://www.apache.org/licenses/LICENSE-2.0
+//
+//	Unless required by applicable law or agreed to in writing, software
+//	distributed under the License is distributed on an "AS IS" BASIS,
+//	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//	See the License for the specific language governing permissions and
+//	limitations under the License.
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+
+	"github.com/mendersoftware/create-artifact-worker/artifact"
+	"github.com/mendersoftware/create-artifact-worker/client"
+	mlog "github.com/mendersoftware/create-artifact-worker/log"
+	"github.com/mendersoftware/create-artifact-worker/tracing"
+)
+
+const (
+	generatorModify = "modify"
+
+	// modifySource names the downloaded artifact
+	modifySource = "artifact"
+)
+
+var modifyCmd = &cobra.Command{
+	Use:   "modify",
+	Short: "Repack an existing artifact with modified header fields.",
+	Long: "\nDownloads the artifact at --get-artifact-uri, rewrites its header and uploads it\n" +
+		"as a new artifact; the payloads are kept as they are. --artifact-name and\n" +
+		"--device-type replace the name and the compatible device types, if given;\n" +
+		"--description is the new artifact's. --args has the changes of each payload's\n" +
+		"provides and depends, and of the state scripts, in json form:\n\n" +
+		"{\"provides\": {<KEY>: <VALUE>|null, ...}, \"depends\": {<KEY>: [<VALUE>, ...]|null, ...},\n" +
+		" \"state_scripts\": {<NAME>: <CONTENTS>|null, ...}}\n\n" +
+		"where null removes the key or the script. The source artifact must be a version\n" +
+		"3 one; it's only deleted if --delete-artifact-uri is given. Its signature is\n" +
+		"dropped, the new artifact is signed if a signing key is configured.\n\n" +
+		"Supports the flags, local mode and env vars of single-file, and the following:\n\n" +
+		"CREATE_ARTIFACT_SIGNING_KEY PEM file of the RSA, ECDSA P-256 or ed25519 private key\n" +
+		"signing modified artifacts (default: none, unsigned)\n",
+	PreRunE: liftOnlineArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		c, err := NewModifyCmd(cmd, args)
+		if err != nil {
+			mlog.Error(err.Error())
+			os.Exit(1)
+		}
+
+		err = c.Run()
+		if err != nil {
+			mlog.Error(err.Error())
+			os.Exit(exitCode(err))
+		}
+	},
+}
+
+func init() {
+	addJobFlags(modifyCmd,
+		"changes in json form: {\"provides\":{<KEY>:<VALUE>},"+
+			" \"depends\":{<KEY>:[<VALUE>]},"+
+			" \"state_scripts\":{<NAME>:<CONTENTS>}}",
+	)
+	// the source artifact's are kept unless given
+	for _, arg := range []string{argArtifactName, argDeviceType, argDelArtifactUri, argArgs} {
+		_ = modifyCmd.Flags().SetAnnotation(arg, cobra.BashCompOneRequiredFlag, []string{"false"})
+	}
+	addLocalFlags(modifyCmd)
+}
+
+type modifyArgs struct {
+	Provides map[string]*string  `json:"provides"`
+	Depends  map[string][]string `json:"depends"`
+	Scripts  map[string]*string  `json:"state_scripts"`
+}
+
+// NewModifyCmd makes the job of modifying an artifact; it runs like a
+// single-file one, with the source artifact as the input.
+func NewModifyCmd(cmd *cobra.Command, args []string) (*SingleFileCmd, error) {
+	c := &SingleFileCmd{Type: generatorModify}
+
+	if err := c.init(cmd); err != nil {
+		return nil, err
+	}
+
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+func (c *SingleFileCmd) parseModifyArgs() error {
+	var args modifyArgs
+
+	if c.Args != "" {
+		dec := json.NewDecoder(strings.NewReader(c.Args))
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(&args); err != nil {
+			return errors.Wrap(err, "can't parse 'args'")
+		}
+	}
+
+	var deviceTypes []string
+	for _, dt := range c.DeviceTypes {
+		if dt != "" {
+			deviceTypes = append(deviceTypes, dt)
+		}
+	}
+	c.DeviceTypes = deviceTypes
+
+	c.Modification = artifact.Modification{
+		Name:        c.ArtifactName,
+		DeviceTypes: deviceTypes,
+		Provides:    args.Provides,
+		Depends:     args.Depends,
+		Scripts:     args.Scripts,
+	}
+	if err := c.Modification.Validate(); err != nil {
+		return errors.Wrap(err, "invalid 'args'")
+	}
+
+	if c.SigningKey != "" {
+		key, err := ioutil.ReadFile(c.SigningKey)
+		if err != nil {
+			return errors.Wrap(err, "failed to read signing key")
+		}
+		if c.Signer, err = artifact.NewSigner(key); err != nil {
+			return err
+		}
+	}
+
+	if c.Modification.Empty() && c.Signer == nil {
+		return errors.New("nothing to modify")
+	}
+
+	c.FileName = modifySource
+
+	return nil
+}
+
+// generateModify writes the input artifact, modified, to output.
+func (c *SingleFileCmd) generateModify(ctx context.Context, input, output string) error {
+	sl := mlog.FromContext(ctx).With("stage", "generate")
+	sl.Debug("modifying artifact to %s", output)
+
+	start := time.Now()
+	_, span := tracing.Start(ctx, "artifact.Modify")
+	err := modifyFile(input, output, &c.Modification, c.Signer)
+	tracing.End(span, err)
+	if err != nil {
+		return errors.Wrap(err, "failed to modify artifact")
+	}
+	sl.With("duration", time.Since(start)).Info("generated artifact")
+
+	return nil
+}
+
+func modifyFile(input, output string, m *artifact.Modification, s artifact.Signer) error {
+	in, err := os.Open(input)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.Create(output)
+	if err != nil {
+		return err
+	}
+
+	if err := artifact.Modify(in, out, m, s); err != nil {
+		out.Close()
+		return err
+	}
+
+	return out.Close()
+}
+
+// checkExistingModify verifies the artifact has the name and device types
+// of the input modified; the rest of the header isn't known to
+// deployments.
+func (c *SingleFileCmd) checkExistingModify(a *client.Artifact, input string) error {
+	f, err := os.Open(input)
+	if err != nil {
+		return errors.Wrap(err, "failed to open input")
+	}
+	defer f.Close()
+
+	src, err := artifact.Read(f)
+	if err != nil {
+		return errors.Wrap(err, "failed to read input artifact")
+	}
+
+	name := src.Name
+	if c.Modification.Name != "" {
+		name = c.Modification.Name
+	}
+	if a.Name != name {
+		return errors.Wrapf(client.ErrArtifactConflict,
+			"artifact %s exists with name %q", c.ArtifactId, a.Name)
+	}
+
+	deviceTypes := src.DeviceTypes
+	if len(c.Modification.DeviceTypes) > 0 {
+		deviceTypes = c.Modification.DeviceTypes
+	}
+	if !sameStrings(a.DeviceTypesCompatible, deviceTypes) {
+		return errors.Wrapf(client.ErrArtifactConflict,
+			"artifact %s exists with device types %s, expected %s", c.ArtifactId,
+			strings.Join(a.DeviceTypesCompatible, ","), strings.Join(deviceTypes, ","))
+	}
+
+	return nil
+}
+
+// sameStrings tells if a and b have the same strings, in any order.
+func sameStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	a = append([]string(nil), a...)
+	b = append([]string(nil), b...)
+	sort.Strings(a)
+	sort.Strings(b)
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+
+	return true
+}
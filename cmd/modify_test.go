@@ -0,0 +1,337 @@
+// Copyright 2024 Northern.tech AS
+//
+//	Licensed under the Apache License, Version 2.0 (the "License");
+//	you may not use this file except in compliance with the License.
+//	You may obtain a copy of the License at
+//
+//	    http://www.apache.org/licenses/LICENSE-2.0
+//
+//	Unless required by applicable law or agreed to in writing, software
+//	distributed under the License is distributed on an "AS IS" BASIS,
+//	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//	See the License for the specific language governing permissions and
+//	limitations under the License.
+package cmd
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/mendersoftware/create-artifact-worker/artifact"
+	"github.com/mendersoftware/create-artifact-worker/client"
+)
+
+// testSourceArtifact is a v3 single-file artifact named release-1, for dt1
+func testSourceArtifact(t *testing.T) []byte {
+	tarGz := func(files ...string) []byte {
+		var b bytes.Buffer
+		zw := gzip.NewWriter(&b)
+		tw := tar.NewWriter(zw)
+		for i := 0; i < len(files); i += 2 {
+			assert.NoError(t, tw.WriteHeader(&tar.Header{
+				Name: files[i], Mode: 0644, Size: int64(len(files[i+1]))}))
+			_, err := tw.Write([]byte(files[i+1]))
+			assert.NoError(t, err)
+		}
+		assert.NoError(t, tw.Close())
+		assert.NoError(t, zw.Close())
+		return b.Bytes()
+	}
+
+	version := `{"format":"mender","version":3}`
+	header := string(tarGz(
+		"header-info", `{"payloads":[{"type":"single-file"}],`+
+			`"artifact_provides":{"artifact_name":"release-1"},`+
+			`"artifact_depends":{"device_type":["dt1"]}}`,
+		"headers/0000/type-info", `{"type":"single-file",`+
+			`"artifact_provides":{"rootfs-image.single-file.version":"release-1"}}`,
+	))
+	data := string(tarGz("app.conf", "input file"))
+
+	var manifest string
+	files := []string{"version", version, "header.tar.gz", header, "data/0000.tar.gz", data}
+	for i := 0; i < len(files); i += 2 {
+		sum := sha256.Sum256([]byte(files[i+1]))
+		manifest += fmt.Sprintf("%s  %s\n", hex.EncodeToString(sum[:]), files[i])
+	}
+
+	var b bytes.Buffer
+	tw := tar.NewWriter(&b)
+	for _, f := range [][2]string{
+		{"version", version},
+		{"manifest", manifest},
+		{"header.tar.gz", header},
+		{"data/0000.tar.gz", data},
+	} {
+		assert.NoError(t, tw.WriteHeader(&tar.Header{
+			Name: f[0], Mode: 0644, Size: int64(len(f[1]))}))
+		_, err := tw.Write([]byte(f[1]))
+		assert.NoError(t, err)
+	}
+	assert.NoError(t, tw.Close())
+
+	return b.Bytes()
+}
+
+// newArtifactStorage serves the source artifact, counting deletes
+func newArtifactStorage(t *testing.T, deletes *int32) *httptest.Server {
+	src := testSourceArtifact(t)
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			_, _ = w.Write(src)
+		case http.MethodDelete:
+			atomic.AddInt32(deletes, 1)
+			w.WriteHeader(http.StatusNoContent)
+		}
+	}))
+}
+
+func newTestModifyCmd(t *testing.T, deplUrl, storageUrl string) *SingleFileCmd {
+	// modifying needs no generator
+	c := newTestSingleFileCmd(t, deplUrl, storageUrl, failingGenerator)
+	c.Type = generatorModify
+	c.AuthToken = testToken("tid")
+	c.ArtifactName = "release-2"
+	c.DeviceTypes = []string{""}
+	c.DelArtifactUri = ""
+	c.Args = `{"provides":{"rootfs-image.single-file.version":"release-2"}}`
+
+	return c
+}
+
+func testSigningKey(t *testing.T) string {
+	_, k, err := ed25519.GenerateKey(rand.Reader)
+	assert.NoError(t, err)
+	b, err := x509.MarshalPKCS8PrivateKey(k)
+	assert.NoError(t, err)
+
+	path := filepath.Join(t.TempDir(), "key.pem")
+	assert.NoError(t, ioutil.WriteFile(path,
+		pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: b}), 0600))
+
+	return path
+}
+
+func TestModifyCmdValidate(t *testing.T) {
+	tc := map[string]struct {
+		name        string
+		deviceTypes []string
+		args        string
+		key         string
+
+		mod artifact.Modification
+		err string
+	}{
+		"ok": {
+			name:        "release-2",
+			deviceTypes: []string{"dt1", "", "dt2"},
+			args: `{"provides":{"a":"1","b":null},"depends":{"c":["x","y"]},` +
+				`"state_scripts":{"ArtifactInstall_Enter_00":"#!/bin/sh\n"}}`,
+			mod: artifact.Modification{
+				Name:        "release-2",
+				DeviceTypes: []string{"dt1", "dt2"},
+				Provides:    map[string]*string{"a": strPtr("1"), "b": nil},
+				Depends:     map[string][]string{"c": {"x", "y"}},
+				Scripts:     map[string]*string{"ArtifactInstall_Enter_00": strPtr("#!/bin/sh\n")},
+			},
+		},
+		"only signing": {
+			key: "test",
+		},
+		"nothing to modify": {
+			deviceTypes: []string{""},
+			err:         "nothing to modify",
+		},
+		"unknown args": {
+			args: `{"files":{}}`,
+			err:  `can't parse 'args': json: unknown field "files"`,
+		},
+		"invalid script": {
+			args: `{"state_scripts":{"Download_Enter_00":"#!/bin/sh\n"}}`,
+			err:  `invalid 'args': invalid state script name "Download_Enter_00"`,
+		},
+		"reserved key": {
+			args: `{"provides":{"artifact_name":"x"}}`,
+			err:  `invalid 'args': invalid provides key "artifact_name"`,
+		},
+		"missing key": {
+			name: "release-2",
+			key:  "/nonexistent/key.pem",
+			err:  "failed to read signing key: open /nonexistent/key.pem: no such file or directory",
+		},
+	}
+
+	for name, tc := range tc {
+		t.Run(name, func(t *testing.T) {
+			c := newTestModifyCmd(t, "http://deployments", "http://storage")
+			c.ArtifactName = tc.name
+			c.DeviceTypes = tc.deviceTypes
+			c.Args = tc.args
+			c.SigningKey = tc.key
+			if tc.key == "test" {
+				c.SigningKey = testSigningKey(t)
+			}
+
+			err := c.Validate()
+			if tc.err != "" {
+				assert.EqualError(t, err, tc.err)
+				return
+			}
+
+			assert.NoError(t, err)
+			assert.Equal(t, modifySource, c.FileName)
+			assert.Equal(t, tc.mod, c.Modification)
+			assert.Equal(t, tc.key != "", c.Signer != nil)
+		})
+	}
+}
+
+func strPtr(s string) *string {
+	return &s
+}
+
+func TestModifyCmdRun(t *testing.T) {
+	tc := map[string]struct {
+		delete bool
+
+		deletes int32
+	}{
+		"source kept": {},
+		"source deleted": {
+			delete:  true,
+			deletes: 1,
+		},
+	}
+
+	for name, tc := range tc {
+		t.Run(name, func(t *testing.T) {
+			depl := &fakeDeployments{}
+			deplServer := httptest.NewServer(depl)
+			defer deplServer.Close()
+
+			var deletes int32
+			storage := newArtifactStorage(t, &deletes)
+			defer storage.Close()
+
+			c := newTestModifyCmd(t, deplServer.URL, storage.URL)
+			if tc.delete {
+				c.DelArtifactUri = storage.URL + "/input?X-Amz-Signature=s3cr3t-delete"
+			}
+			assert.NoError(t, c.Validate())
+
+			assert.NoError(t, c.Run())
+			assert.Equal(t, []string{"aid"}, depl.uploads)
+			assert.Equal(t, tc.deletes, atomic.LoadInt32(&deletes))
+		})
+	}
+}
+
+func TestModifyCmdRunLocal(t *testing.T) {
+	dir := t.TempDir()
+	input := filepath.Join(dir, "release-1.mender")
+	assert.NoError(t, ioutil.WriteFile(input, testSourceArtifact(t), 0644))
+
+	c := newTestModifyCmd(t, "http://localhost:1", "http://localhost:1")
+	c.AuthToken = ""
+	c.ArtifactId = ""
+	c.GetArtifactUri = ""
+	c.DeviceTypes = []string{"dt1", "dt2"}
+	c.SigningKey = testSigningKey(t)
+	c.Input = input
+	c.Output = filepath.Join(dir, "release-2.mender")
+
+	var out bytes.Buffer
+	c.stdout = &out
+
+	assert.NoError(t, c.Validate())
+	assert.NoError(t, c.Run())
+
+	assert.Equal(t, "Artifact "+c.Output+`
+Format: mender, version 3
+Compression: gzip
+Signature: yes
+Name: release-2
+Compatible devices: dt1, dt2
+Provides:
+  artifact_name: release-2
+Depends:
+  device_type: dt1, dt2
+Payload 0: single-file
+  Provides:
+    rootfs-image.single-file.version: release-2
+  Files:
+    app.conf (10 bytes, sha256 ae2132f49016c5f7de1dbdcae027fcd4da86de355e3d1cfaf3d46e9005d14241)
+`, out.String())
+
+	// the source is left alone
+	b, err := os.ReadFile(input)
+	assert.NoError(t, err)
+	assert.Equal(t, testSourceArtifact(t), b)
+}
+
+func TestModifyCmdRunExistingArtifact(t *testing.T) {
+	tc := map[string]struct {
+		artifact *client.Artifact
+
+		err string
+	}{
+		"already uploaded": {
+			artifact: &client.Artifact{
+				Id: "aid", Name: "release-2", DeviceTypesCompatible: []string{"dt1"}},
+		},
+		"different name": {
+			artifact: &client.Artifact{
+				Id: "aid", Name: "release-1", DeviceTypesCompatible: []string{"dt1"}},
+			err: `artifact aid exists with name "release-1"`,
+		},
+		"different device types": {
+			artifact: &client.Artifact{
+				Id: "aid", Name: "release-2", DeviceTypesCompatible: []string{"dt2"}},
+			err: "artifact aid exists with device types dt2, expected dt1",
+		},
+	}
+
+	for name, tc := range tc {
+		t.Run(name, func(t *testing.T) {
+			depl := &fakeDeployments{artifact: tc.artifact}
+			deplServer := httptest.NewServer(depl)
+			defer deplServer.Close()
+
+			var deletes int32
+			storage := newArtifactStorage(t, &deletes)
+			defer storage.Close()
+
+			c := newTestModifyCmd(t, deplServer.URL, storage.URL)
+			assert.NoError(t, c.Validate())
+
+			err := c.Run()
+			if tc.err != "" {
+				assert.True(t, errors.Is(err, client.ErrArtifactConflict), "%v", err)
+				assert.Contains(t, err.Error(), tc.err)
+			} else {
+				assert.NoError(t, err)
+			}
+
+			assert.Empty(t, depl.uploads)
+		})
+	}
+}
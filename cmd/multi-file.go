@@ -0,0 +1,209 @@
+// Copyright 2024 Northern.tech AS
+//
+//	Licensed under the Apache License, Version 2.0 (the "License");
+//	you may not use this file except in compliance with the License.
+//	You may obtain a copy of the License at
+//
+//	    http://www.apache.org/licenses/LICENSE-2.0
+//
+//	Unless required by applicable law or agreed to in writing, software
+//	distributed under the License is distributed on an "AS IS" BASIS,
+//	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//	See the License for the specific language governing permissions and
+//	limitations under the License.
+package cmd
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+
+	"github.com/mendersoftware/create-artifact-worker/client"
+	mlog "github.com/mendersoftware/create-artifact-worker/log"
+	"github.com/mendersoftware/create-artifact-worker/multifile"
+)
+
+const (
+	generatorMultiFile = "multi-file"
+
+	// multiFileArchive names the downloaded archive
+	multiFileArchive = "archive"
+)
+
+var multiFileCmd = &cobra.Command{
+	Use:   "multi-file",
+	Short: "Generate an update using a multi-file update module, of a tar or zip archive.",
+	Long: "\nThe input is a tar, gzipped tar or zip archive; --args maps each of its files\n" +
+		"to where and how it's installed on the device:\n\n" +
+		"{\"files\": {\"<PATH_IN_ARCHIVE>\": {\"dest\": <DESTINATION_PATH_ON_DEVICE>,\n" +
+		"  \"mode\": <OCTAL_MODE>, \"owner\": <OWNER>, \"group\": <GROUP>}, ...},\n" +
+		" \"software_filesystem\": <SOFTWARE_FILESYSTEM>, \"software_name\": <SOFTWARE_NAME>,\n" +
+		" \"software_version\": <SOFTWARE_VERSION>}\n\n" +
+		"The mode defaults to 0644, the owner to root and the group to the owner. The\n" +
+		"archive may only have the files mapped, and dirs; the payload has the files\n" +
+		"under their base names, which must be unique, and the meta-data lists them.\n\n" +
+		"Supports the flags, local mode and env vars of single-file, and the following:\n\n" +
+		"CREATE_ARTIFACT_MULTI_FILE_GENERATOR mender-artifact (default: /usr/bin/mender-artifact)\n" +
+		"CREATE_ARTIFACT_MULTI_FILE_MAX_SIZE limit of the files' total size, 0 disables " +
+		"(default: 1073741824)\n",
+	PreRunE: liftOnlineArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		c, err := NewMultiFileCmd(cmd, args)
+		if err != nil {
+			mlog.Error(err.Error())
+			os.Exit(1)
+		}
+
+		err = c.Run()
+		if err != nil {
+			mlog.Error(err.Error())
+			os.Exit(exitCode(err))
+		}
+	},
+}
+
+func init() {
+	addJobFlags(multiFileCmd,
+		"specific args in json form: {\"files\":{<PATH_IN_ARCHIVE>:{\"dest\":<DESTINATION_PATH>,"+
+			" \"mode\":<MODE>, \"owner\":<OWNER>, \"group\":<GROUP>}},"+
+			" \"software_filesystem\":<SOFTWARE_FILESYSTEM>,"+
+			" \"software_name\":<SOFTWARE_NAME>,"+
+			" \"software_version\":<SOFTWARE_VERSION>}",
+	)
+	addLocalFlags(multiFileCmd)
+}
+
+type multiFileArgs struct {
+	Files              multifile.Files `json:"files"`
+	SoftwareFilesystem string          `json:"software_filesystem"`
+	SoftwareName       string          `json:"software_name"`
+	SoftwareVersion    string          `json:"software_version"`
+}
+
+// NewMultiFileCmd makes the job of a multi-file artifact; it runs like a
+// single-file one, but for generating.
+func NewMultiFileCmd(cmd *cobra.Command, args []string) (*SingleFileCmd, error) {
+	c := &SingleFileCmd{Type: generatorMultiFile}
+
+	if err := c.init(cmd); err != nil {
+		return nil, err
+	}
+
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+func (c *SingleFileCmd) parseMultiFileArgs() error {
+	var args multiFileArgs
+
+	// the archive is untrusted input, so are its specs
+	dec := json.NewDecoder(strings.NewReader(c.Args))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&args); err != nil {
+		return errors.Wrap(err, "can't parse 'args'")
+	}
+
+	if err := args.Files.Validate(); err != nil {
+		return errors.Wrap(err, "invalid 'args'")
+	}
+
+	if c.MaxSize < 0 {
+		return errors.New("multi-file max size can't be negative")
+	}
+
+	c.Files = args.Files
+	c.FileName = multiFileArchive
+	c.SoftwareFilesystem = args.SoftwareFilesystem
+	c.SoftwareName = args.SoftwareName
+	c.SoftwareVersion = args.SoftwareVersion
+
+	return nil
+}
+
+// generateMultiFile extracts the files of the input archive in dir and
+// runs mender-artifact on them, with their specs as meta-data.
+func (c *SingleFileCmd) generateMultiFile(ctx context.Context, dir, input, output string) error {
+	files, err := ioutil.TempDir(dir, "files")
+	if err != nil {
+		return errors.Wrapf(err, "failed to create temp dir under %s", dir)
+	}
+
+	md, err := multifile.Extract(input, files, c.Files, c.MaxSize)
+	if err != nil {
+		return errors.Wrap(err, "invalid input archive")
+	}
+
+	meta, err := ioutil.TempFile(dir, "meta-data")
+	if err != nil {
+		return errors.Wrap(err, "failed to write meta-data")
+	}
+	err = json.NewEncoder(meta).Encode(md)
+	if cerr := meta.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return errors.Wrap(err, "failed to write meta-data")
+	}
+
+	args := []string{
+		"write", "module-image",
+		"-T", generatorMultiFile,
+		"-n", c.ArtifactName,
+		"-o", output,
+		"-m", meta.Name(),
+	}
+	if c.SoftwareFilesystem != "" {
+		args = append(args, "--software-filesystem", c.SoftwareFilesystem)
+	}
+	if c.SoftwareName != "" {
+		args = append(args, "--software-name", c.SoftwareName)
+	}
+	if c.SoftwareVersion != "" {
+		args = append(args, "--software-version", c.SoftwareVersion)
+	}
+
+	for _, deviceType := range c.DeviceTypes {
+		args = append(args, "-t", deviceType)
+	}
+	for _, f := range md.Files {
+		args = append(args, "-f", filepath.Join(files, f.Name))
+	}
+
+	return c.runGenerator(ctx, dir, output, c.Generator, args)
+}
+
+// checkExistingFiles verifies the artifact has the files of the archive.
+func (c *SingleFileCmd) checkExistingFiles(a *client.Artifact, archive string) error {
+	return multifile.Walk(archive, c.Files, c.MaxSize, func(f multifile.File, r io.Reader) error {
+		uf := a.File(f.Name)
+		if uf == nil {
+			return errors.Wrapf(client.ErrArtifactConflict,
+				"artifact %s exists without file %s", c.ArtifactId, f.Name)
+		}
+
+		h := sha256.New()
+		if _, err := io.Copy(h, r); err != nil {
+			return errors.Wrapf(err, "cannot read %s of the archive", f.Name)
+		}
+
+		if checksum := hex.EncodeToString(h.Sum(nil)); uf.Checksum != checksum {
+			return errors.Wrapf(client.ErrArtifactConflict,
+				"artifact %s exists with a different %s (checksum %s, expected %s)",
+				c.ArtifactId, f.Name, uf.Checksum, checksum)
+		}
+
+		return nil
+	})
+}
@@ -0,0 +1,240 @@
+// Copyright 2024 Northern.tech AS
+//
+//	Licensed under the Apache License, Version 2.0 (the "License");
+//	you may not use this file except in compliance with the License.
+//	You may obtain a copy of the License at
+//
+//	    http://www.apache.org/licenses/LICENSE-2.0
+//
+//	Unless required by applicable law or agreed to in writing, software
+//	distributed under the License is distributed on an "AS IS" BASIS,
+//	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//	See the License for the specific language governing permissions and
+//	limitations under the License.
+package cmd
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/mendersoftware/create-artifact-worker/client"
+	"github.com/mendersoftware/create-artifact-worker/multifile"
+)
+
+const testMultiFileArgs = `{"files":{` +
+	`"conf/app.conf":{"dest":"/etc/app/app.conf","mode":"0640","owner":"app"},` +
+	`"ca.pem":{"dest":"/etc/app/ca.pem"}},"software_name":"app"}`
+
+// recordingMenderArtifact records the payload files and the meta-data
+// it's given at %[1]s
+const recordingMenderArtifact = `#!/bin/sh
+: > %[1]s
+while [ $# -gt 0 ]; do
+	case "$1" in
+		-o) out="$2"; shift;;
+		-T) echo "type $2" >> %[1]s; shift;;
+		-m) cp "$2" %[1]s.meta; shift;;
+		-f) echo "file $(basename "$2") $(cat "$2")" >> %[1]s; shift;;
+		--software-name) echo "software-name $2" >> %[1]s; shift;;
+	esac
+	shift
+done
+echo generated > "$out"
+`
+
+func testArchive(t *testing.T) []byte {
+	var b bytes.Buffer
+	tw := tar.NewWriter(&b)
+	for _, f := range []struct{ name, data string }{
+		{"conf/app.conf", "conf"},
+		{"ca.pem", "cert"},
+	} {
+		assert.NoError(t, tw.WriteHeader(&tar.Header{
+			Name: f.name, Mode: 0644, Size: int64(len(f.data)), Typeflag: tar.TypeReg,
+		}))
+		_, err := tw.Write([]byte(f.data))
+		assert.NoError(t, err)
+	}
+	assert.NoError(t, tw.Close())
+	return b.Bytes()
+}
+
+func newArchiveStorage(t *testing.T) *httptest.Server {
+	archive := testArchive(t)
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			_, _ = w.Write(archive)
+		case http.MethodDelete:
+			w.WriteHeader(http.StatusNoContent)
+		}
+	}))
+}
+
+func newTestMultiFileCmd(t *testing.T, deplUrl, storageUrl, generator string) *SingleFileCmd {
+	c := newTestSingleFileCmd(t, deplUrl, storageUrl, generator)
+	c.Type = generatorMultiFile
+	c.AuthToken = testToken("tid")
+	c.Args = testMultiFileArgs
+	c.MaxSize = 1024
+	return c
+}
+
+func TestMultiFileCmdValidate(t *testing.T) {
+	tc := map[string]struct {
+		args    string
+		maxSize int64
+
+		files multifile.Files
+		err   string
+	}{
+		"ok": {
+			args:    testMultiFileArgs,
+			maxSize: 1024,
+			files: multifile.Files{
+				"conf/app.conf": {Dest: "/etc/app/app.conf", Mode: "0640", Owner: "app", Group: "app"},
+				"ca.pem":        {Dest: "/etc/app/ca.pem", Mode: "0644", Owner: "root", Group: "root"},
+			},
+		},
+		"single-file args": {
+			args: `{"filename":"file","dest_dir":"/etc"}`,
+			err:  `can't parse 'args': json: unknown field "filename"`,
+		},
+		"no files": {
+			args: `{"files":{}}`,
+			err:  "invalid 'args': no files",
+		},
+		"escaping path": {
+			args: `{"files":{"../x":{"dest":"/x"}}}`,
+			err:  `invalid 'args': invalid archive path "../x"`,
+		},
+		"negative max size": {
+			args:    testMultiFileArgs,
+			maxSize: -1,
+			err:     "multi-file max size can't be negative",
+		},
+	}
+
+	for name, tc := range tc {
+		t.Run(name, func(t *testing.T) {
+			c := newTestMultiFileCmd(t, "http://deployments", "http://storage", fakeGenerator)
+			c.Args = tc.args
+			c.MaxSize = tc.maxSize
+
+			err := c.Validate()
+			if tc.err != "" {
+				assert.EqualError(t, err, tc.err)
+				return
+			}
+
+			assert.NoError(t, err)
+			assert.Equal(t, tc.files, c.Files)
+			assert.Equal(t, multiFileArchive, c.FileName)
+			assert.Equal(t, "app", c.SoftwareName)
+		})
+	}
+}
+
+func TestMultiFileCmdRun(t *testing.T) {
+	depl := &fakeDeployments{}
+	deplServer := httptest.NewServer(depl)
+	defer deplServer.Close()
+
+	storage := newArchiveStorage(t)
+	defer storage.Close()
+
+	rec := filepath.Join(t.TempDir(), "rec")
+	c := newTestMultiFileCmd(t, deplServer.URL, storage.URL,
+		fmt.Sprintf(recordingMenderArtifact, rec))
+	assert.NoError(t, c.Validate())
+
+	assert.NoError(t, c.Run())
+	assert.Equal(t, []string{"aid"}, depl.uploads)
+
+	b, err := ioutil.ReadFile(rec)
+	assert.NoError(t, err)
+	assert.Equal(t, "type multi-file\nsoftware-name app\nfile app.conf conf\nfile ca.pem cert\n",
+		string(b))
+
+	b, err = ioutil.ReadFile(rec + ".meta")
+	assert.NoError(t, err)
+	assert.JSONEq(t, `{"files":[`+
+		`{"name":"app.conf","dest":"/etc/app/app.conf","mode":"0640","owner":"app","group":"app"},`+
+		`{"name":"ca.pem","dest":"/etc/app/ca.pem","mode":"0644","owner":"root","group":"root"}]}`,
+		string(b))
+}
+
+func TestMultiFileCmdRunExistingArtifact(t *testing.T) {
+	checksum := func(s string) string {
+		sum := sha256.Sum256([]byte(s))
+		return hex.EncodeToString(sum[:])
+	}
+
+	artifact := func(files ...client.UpdateFile) *client.Artifact {
+		return &client.Artifact{
+			Id:      "aid",
+			Name:    "name",
+			Updates: []client.Update{{Files: files}},
+		}
+	}
+
+	tc := map[string]struct {
+		artifact *client.Artifact
+
+		err string
+	}{
+		"already uploaded": {
+			artifact: artifact(
+				client.UpdateFile{Name: "app.conf", Checksum: checksum("conf")},
+				client.UpdateFile{Name: "ca.pem", Checksum: checksum("cert")},
+			),
+		},
+		"different file": {
+			artifact: artifact(
+				client.UpdateFile{Name: "app.conf", Checksum: checksum("conf")},
+				client.UpdateFile{Name: "ca.pem", Checksum: checksum("other")},
+			),
+			err: "artifact aid exists with a different ca.pem",
+		},
+		"missing file": {
+			artifact: artifact(client.UpdateFile{Name: "app.conf", Checksum: checksum("conf")}),
+			err:      "artifact aid exists without file ca.pem",
+		},
+	}
+
+	for name, tc := range tc {
+		t.Run(name, func(t *testing.T) {
+			depl := &fakeDeployments{artifact: tc.artifact}
+			deplServer := httptest.NewServer(depl)
+			defer deplServer.Close()
+
+			storage := newArchiveStorage(t)
+			defer storage.Close()
+
+			// generating again must not be needed
+			c := newTestMultiFileCmd(t, deplServer.URL, storage.URL, failingGenerator)
+			assert.NoError(t, c.Validate())
+
+			err := c.Run()
+			if tc.err != "" {
+				assert.True(t, errors.Is(err, client.ErrArtifactConflict), "%v", err)
+				assert.Contains(t, err.Error(), tc.err)
+			} else {
+				assert.NoError(t, err)
+			}
+
+			assert.Empty(t, depl.uploads)
+		})
+	}
+}
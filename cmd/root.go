@@ -17,9 +17,11 @@ package cmd
 import (
 	"os"
 
+	"github.com/pkg/errors"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
 
+	"github.com/mendersoftware/create-artifact-worker/client"
 	"github.com/mendersoftware/create-artifact-worker/config"
 	mlog "github.com/mendersoftware/create-artifact-worker/log"
 )
@@ -32,13 +34,83 @@ var rootCmd = &cobra.Command{
 Supports the following env vars:
 
 
-	CREATE_ARTIFACT_VERBOSE          enable verbose logging (default: false).
-	CREATE_ARTIFACT_WORKDIR          Working directory where the single-file-generator is executed.
-	CREATE_ARTIFACT_SKIPVERIFY       Skip TLS hostname verification.
-	CREATE_ARTIFACT_DEPLOYMENTS_URL  URL to the deployments service (default: "http://mender-deployments:8080").
+	CREATE_ARTIFACT_VERBOSE                       enable verbose logging, same as log level debug (default: false).
+	CREATE_ARTIFACT_LOG_FORMAT                    Log format: logfmt or json (default: "logfmt").
+	CREATE_ARTIFACT_LOG_LEVEL                     Minimum log level: debug, info, warn or error (default: "info").
+	CREATE_ARTIFACT_WORKDIR                       Working directory where the single-file-generator is executed.
+	CREATE_ARTIFACT_SKIPVERIFY                    Skip TLS hostname verification.
+	CREATE_ARTIFACT_DEPLOYMENTS_URL               URL to the deployments service (default: "http://mender-deployments:8080").
+	CREATE_ARTIFACT_STORAGE_TYPE                  Storage backend of the pre-signed urls: auto, s3, azure or file (default: "auto").
+	CREATE_ARTIFACT_FILE_ROOT                     Root directory file:// uris are confined to; file:// is disabled if empty.
+	CREATE_ARTIFACT_DOWNLOAD_CONCURRENCY          Number of parallel ranged GETs for downloads; 1 disables (default: 1).
+	CREATE_ARTIFACT_DOWNLOAD_CHUNK_SIZE           Size in bytes of each ranged GET (default: 16777216).
+	CREATE_ARTIFACT_DOWNLOAD_RETRIES              Retries of a failed chunk, and restarts of a download whose object changed (default: 3).
+	CREATE_ARTIFACT_DIRECT_UPLOAD                 Upload generated artifacts straight to storage via a pre-signed link from deployments (default: false).
+	CREATE_ARTIFACT_UPLOAD_API                    Deployments API used for uploads: "internal", or "management" authenticated with --token (default: "internal").
+	CREATE_ARTIFACT_TLS_CA_FILE                   PEM CA bundle trusted in addition to the system roots.
+	CREATE_ARTIFACT_TLS_CERT_FILE                 PEM client certificate for mutual TLS; reloaded when the file changes.
+	CREATE_ARTIFACT_TLS_KEY_FILE                  PEM key of the client certificate; reloaded when the file changes.
+	CREATE_ARTIFACT_TLS_MIN_VERSION               Minimum TLS version: 1.0, 1.1, 1.2 or 1.3 (default: "1.2").
+	CREATE_ARTIFACT_HTTP_DIAL_TIMEOUT             Timeout of establishing connections (default: 30s).
+	CREATE_ARTIFACT_HTTP_TLS_HANDSHAKE_TIMEOUT    Timeout of TLS handshakes (default: 10s).
+	CREATE_ARTIFACT_HTTP_RESPONSE_HEADER_TIMEOUT  Timeout of waiting for response headers once the request is sent; 0 disables (default: 0).
+	CREATE_ARTIFACT_HTTP_IDLE_CONN_TIMEOUT        How long idle connections are kept open (default: 90s).
+	CREATE_ARTIFACT_HTTP_MAX_IDLE_CONNS           Maximum idle connections in total; 0 means no limit (default: 100).
+	CREATE_ARTIFACT_HTTP_MAX_IDLE_CONNS_PER_HOST  Maximum idle connections per host; 0 means 2 (default: 0).
+	CREATE_ARTIFACT_HTTP_MAX_CONNS_PER_HOST       Maximum connections per host; 0 means no limit (default: 0).
+	CREATE_ARTIFACT_TIMEOUT_DOWNLOAD              Deadline of downloading the input file (default: 15m).
+	CREATE_ARTIFACT_TIMEOUT_UPLOAD                Deadline of uploading the generated artifact (default: 15m).
+	CREATE_ARTIFACT_TIMEOUT_DELETE                Deadline of deleting the input file (default: 15m).
+	CREATE_ARTIFACT_TIMEOUT_API                   Deadline of other deployments API calls (default: 15m).
+	HTTP_PROXY, HTTPS_PROXY, NO_PROXY             Standard proxy settings, honored by all HTTP clients.
+	CREATE_ARTIFACT_REPORT_STATUS                 Report job status and failure reasons to deployments (default: true).
+	CREATE_ARTIFACT_SINGLE_FILE_GENERATOR         Path to the single-file artifact generator (default: "/usr/bin/single-file-artifact-gen").
+	CREATE_ARTIFACT_MULTI_FILE_GENERATOR          Path to mender-artifact, generating multi-file artifacts (default: "/usr/bin/mender-artifact").
+	CREATE_ARTIFACT_MULTI_FILE_MAX_SIZE           Limit in bytes of the files of a multi-file archive, uncompressed; 0 disables (default: 1073741824).
+	CREATE_ARTIFACT_DELTA_GENERATOR               Path to mender-artifact, generating delta artifacts (default: "/usr/bin/mender-artifact").
+	CREATE_ARTIFACT_DELTA_BACKEND                 Tool computing binary deltas: xdelta3 (VCDIFF) or bsdiff (default: "xdelta3").
+	CREATE_ARTIFACT_DELTA_BACKEND_PATH            Path to the delta tool; looked up in PATH by name if empty.
+	CREATE_ARTIFACT_SIGNING_KEY                   PEM file of the RSA, ECDSA P-256 or ed25519 private key signing modified artifacts; unsigned if empty.
+	CREATE_ARTIFACT_METRICS_TEXTFILE              node-exporter textfile the job adds its Prometheus metrics to, e.g. /var/lib/node_exporter/create_artifact.prom.
+	CREATE_ARTIFACT_METRICS_PUSHGATEWAY_URL       Pushgateway the job adds its Prometheus metrics to, summed with the ones of earlier jobs of the host.
+	CREATE_ARTIFACT_TRACING_ENDPOINT              OTLP/HTTP collector url traces are exported to, e.g. http://otel-collector:4318; tracing is off if empty.
+	CREATE_ARTIFACT_PROGRESS_INTERVAL             Interval of progress reports of downloads, generation and uploads; 0 disables them (default: 10s).
+	CREATE_ARTIFACT_PROGRESS_URL                  Callback url every progress report is POSTed to as json (default: none).
+	CREATE_ARTIFACT_SANDBOX_CPU_TIME              Cpu time limit of the generator and each of its children, e.g. 10m; 0 disables (default: 0).
+	CREATE_ARTIFACT_SANDBOX_MEMORY                Address space limit in bytes of the generator and each of its children; 0 disables (default: 0).
+	CREATE_ARTIFACT_SANDBOX_FILE_SIZE             Limit in bytes of the files the generator writes; 0 disables (default: 0).
+	CREATE_ARTIFACT_SANDBOX_OPEN_FILES            Limit of open files of the generator and each of its children; 0 disables (default: 0).
+	CREATE_ARTIFACT_SANDBOX_ENV                   Comma separated env vars passed to the generator, which gets only HOME, TMPDIR, LANG and PATH otherwise.
+	CREATE_ARTIFACT_SANDBOX_NAMESPACES            Run the generator in new user, mount (with private mounts) and network namespaces; Linux only (default: false).
+	CREATE_ARTIFACT_NATS_URI                      NATS server the worker command takes jobs from (default: "nats://mender-nats:4222").
+	CREATE_ARTIFACT_NATS_STREAM_NAME              JetStream stream of the workflows service (default: "WORKFLOWS").
+	CREATE_ARTIFACT_NATS_SUBSCRIBER_TOPIC         Workflow topic of the jobs, subscribed to as <stream>.<topic> (default: "generate_artifact").
+	CREATE_ARTIFACT_NATS_SUBSCRIBER_DURABLE       Name of the durable JetStream consumer (default: "create-artifact-worker").
+	CREATE_ARTIFACT_WORKER_CONCURRENCY            Maximum number of jobs the worker and serve commands, or variants the batch command, run in parallel (default: 10).
+	CREATE_ARTIFACT_WORKER_MAX_DELIVER            Attempts of a job failing with a transient error; 0 means no limit (default: 3).
+	CREATE_ARTIFACT_WORKER_DRAIN_TIMEOUT          Time running jobs get to finish on shutdown before they're cancelled; the worker requeues them (default: 10m).
+	CREATE_ARTIFACT_SERVE_LISTEN                  Listen address of the serve command's job API (default: ":8080").
+	CREATE_ARTIFACT_SERVE_API_KEY                 Bearer token required by the job API; serve refuses to start without one, unless anonymous access is allowed.
+	CREATE_ARTIFACT_SERVE_ALLOW_ANONYMOUS         Serve the job API without an API key, to anyone who can reach it (default: false).
+	CREATE_ARTIFACT_SERVE_QUEUE_SIZE              Jobs the job API queues while all workers are busy; more are rejected with 503 (default: 100).
+	TRACEPARENT, TRACESTATE                       W3C trace context of the job's parent span, unless given with --traceparent/--tracestate; worker and serve jobs take it from their inputs.
 `,
 }
 
+const (
+	exitCodeError = 1
+	// the artifact clashes with an existing one, retrying won't help
+	exitCodeConflict = 3
+)
+
+func exitCode(err error) int {
+	if errors.Is(err, client.ErrArtifactConflict) {
+		return exitCodeConflict
+	}
+
+	return exitCodeError
+}
+
 func Execute() {
 	if err := rootCmd.Execute(); err != nil {
 		mlog.Error(err.Error())
@@ -48,7 +120,23 @@ func Execute() {
 
 func init() {
 	rootCmd.AddCommand(singleFileCmd)
+	rootCmd.AddCommand(multiFileCmd)
+	rootCmd.AddCommand(deltaCmd)
+	rootCmd.AddCommand(modifyCmd)
+	rootCmd.AddCommand(inspectCmd)
+	rootCmd.AddCommand(workerCmd)
+	rootCmd.AddCommand(serveCmd)
+	rootCmd.AddCommand(batchCmd)
 
 	config.Init()
-	mlog.Init(viper.GetBool(config.CfgVerbose))
+
+	level := viper.GetString(config.CfgLogLevel)
+	if viper.GetBool(config.CfgVerbose) {
+		level = "debug"
+	}
+
+	if err := mlog.Init(viper.GetString(config.CfgLogFormat), level); err != nil {
+		mlog.Error(err.Error())
+		os.Exit(1)
+	}
 }
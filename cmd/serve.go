@@ -0,0 +1,172 @@
+// Copyright 2024 Northern.tech AS
+//
+//	Licensed under the Apache License, Version 2.0 (the "License");
+//	you may not use this file except in compliance with the License.
+//	You may obtain a copy of the License at
+//
+//	    http://www.apache.org/licenses/LICENSE-2.0
+//
+//	Unless required by applicable law or agreed to in writing, software
+//	distributed under the License is distributed on an "AS IS" BASIS,
+//	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//	See the License for the specific language governing permissions and
+//	limitations under the License.
+package cmd
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+
+	"github.com/mendersoftware/create-artifact-worker/api"
+	"github.com/mendersoftware/create-artifact-worker/client"
+	"github.com/mendersoftware/create-artifact-worker/config"
+	mlog "github.com/mendersoftware/create-artifact-worker/log"
+	"github.com/mendersoftware/create-artifact-worker/tracing"
+)
+
+var serveCmd = &cobra.Command{
+	Use:   "serve",
+	Short: "Serve an HTTP API running artifact generation jobs.",
+	Long: "\nRuns single-file jobs in-process on request, without the workflows service:\n\n" +
+		"POST /jobs with a json object of the generate_artifact workflow's input\n" +
+		"parameters queues a job, in the trace of its traceparent and tracestate if\n" +
+		"given; GET /jobs/{id} returns its status and logs, and DELETE /jobs/{id}\n" +
+		"cancels it.\n\n" +
+		"Supports the env vars of single-file, and the following:\n\n" +
+		"CREATE_ARTIFACT_SERVE_LISTEN listen address (default: :8080)\n" +
+		"CREATE_ARTIFACT_SERVE_API_KEY bearer token required by the api (default: none)\n" +
+		"CREATE_ARTIFACT_SERVE_ALLOW_ANONYMOUS serve without an api key (default: false)\n" +
+		"CREATE_ARTIFACT_SERVE_QUEUE_SIZE jobs waiting for a worker (default: 100)\n" +
+		"CREATE_ARTIFACT_WORKER_CONCURRENCY parallel jobs (default: 10)\n" +
+		"CREATE_ARTIFACT_WORKER_DRAIN_TIMEOUT time to finish jobs on shutdown (default: 10m)\n",
+	Run: func(cmd *cobra.Command, args []string) {
+		c, err := NewServeCmd()
+		if err != nil {
+			mlog.Error(err.Error())
+			os.Exit(1)
+		}
+
+		err = c.Run()
+		if err != nil {
+			mlog.Error(err.Error())
+			os.Exit(1)
+		}
+	},
+}
+
+type ServeCmd struct {
+	Api     api.Config
+	Tracing tracing.Config
+
+	// AllowAnonymous serves the api without Api.ApiKey, which is
+	// required otherwise.
+	AllowAnonymous bool
+
+	// Job is the configuration of the jobs; each job fills in the rest
+	// from its input parameters.
+	Job SingleFileCmd
+}
+
+func NewServeCmd() (*ServeCmd, error) {
+	c := &ServeCmd{}
+
+	c.Job.initConfig()
+	c.Tracing = c.Job.Tracing
+	c.Api = api.Config{
+		Listen:       viper.GetString(config.CfgServeListen),
+		ApiKey:       viper.GetString(config.CfgServeApiKey),
+		Concurrency:  viper.GetInt(config.CfgWorkerConcurrency),
+		QueueSize:    viper.GetInt(config.CfgServeQueueSize),
+		DrainTimeout: viper.GetDuration(config.CfgWorkerDrainTimeout),
+	}
+	c.AllowAnonymous = viper.GetBool(config.CfgServeAllowAnonymous)
+
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+func (c *ServeCmd) Validate() error {
+	if c.Api.Listen == "" {
+		return errors.New("listen address can't be empty")
+	}
+
+	if c.Api.ApiKey == "" && !c.AllowAnonymous {
+		return errors.New("an api key is required, " +
+			"unless CREATE_ARTIFACT_SERVE_ALLOW_ANONYMOUS is set")
+	}
+
+	if c.Api.Concurrency <= 0 {
+		return errors.New("worker concurrency must be positive")
+	}
+
+	if c.Api.QueueSize < 0 {
+		return errors.New("queue size can't be negative")
+	}
+
+	if err := config.ValidAbsPath(c.Job.Workdir); err != nil {
+		return errors.Wrap(err, "invalid workdir")
+	}
+
+	// fail early on a broken ca bundle or client certificate
+	if _, err := client.NewTLSConfig(c.Job.TLS); err != nil {
+		return errors.Wrap(err, "invalid tls configuration")
+	}
+
+	if err := c.Job.Sandbox.Validate(); err != nil {
+		return errors.Wrap(err, "invalid sandbox configuration")
+	}
+
+	return nil
+}
+
+// Run serves the api until SIGINT or SIGTERM, then drains.
+func (c *ServeCmd) Run() error {
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	shutdown, err := tracing.Init(context.Background(), c.Tracing)
+	if err != nil {
+		return err
+	}
+	defer flushTraces(mlog.With(), shutdown)
+
+	mlog.Info("config:\n%s", config.Dump())
+
+	if c.Api.ApiKey == "" {
+		mlog.Warn("no api key configured, the job api is open to anyone who can reach it")
+	}
+
+	return c.RunContext(ctx)
+}
+
+func (c *ServeCmd) RunContext(ctx context.Context) error {
+	return c.server().Run(ctx)
+}
+
+func (c *ServeCmd) server() *api.Server {
+	return api.New(c.Api, c.newTask)
+}
+
+func (c *ServeCmd) newTask(inputs map[string]string) (*api.Task, error) {
+	sc, err := c.Job.fromInputs(func(name string) string {
+		return inputs[name]
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &api.Task{
+		ArtifactId: sc.ArtifactId,
+		TenantId:   sc.TenantId,
+		Run:        sc.RunContext,
+	}, nil
+}
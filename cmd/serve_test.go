@@ -0,0 +1,162 @@
+// Copyright 2024 Northern.tech AS
+//
+//	Licensed under the Apache License, Version 2.0 (the "License");
+//	you may not use this file except in compliance with the License.
+//	You may obtain a copy of the License at
+//
+//	    http://www.apache.org/licenses/LICENSE-2.0
+//
+//	Unless required by applicable law or agreed to in writing, software
+//	distributed under the License is distributed on an "AS IS" BASIS,
+//	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//	See the License for the specific language governing permissions and
+//	limitations under the License.
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/mendersoftware/create-artifact-worker/api"
+)
+
+func testInputs(storageUrl string) map[string]string {
+	inputs := map[string]string{}
+	for _, p := range testJob(storageUrl).InputParameters {
+		inputs[p.Name] = p.Value
+	}
+	return inputs
+}
+
+func TestServeCmdNewTask(t *testing.T) {
+	c := &ServeCmd{Job: *newTestSingleFileCmd(t, "http://deployments", "http://storage", fakeGenerator)}
+
+	task, err := c.newTask(testInputs("http://storage"))
+	assert.NoError(t, err)
+	assert.Equal(t, "aid", task.ArtifactId)
+	assert.Equal(t, "tid", task.TenantId)
+
+	inputs := testInputs("http://storage")
+	delete(inputs, inputToken)
+	_, err = c.newTask(inputs)
+	assert.EqualError(t, err, "missing input parameter token")
+}
+
+func TestServeCmdValidate(t *testing.T) {
+	tc := map[string]struct {
+		apiKey         string
+		allowAnonymous bool
+
+		err string
+	}{
+		"api key": {
+			apiKey: "key",
+		},
+		"anonymous, allowed": {
+			allowAnonymous: true,
+		},
+		"anonymous": {
+			err: "an api key is required, unless CREATE_ARTIFACT_SERVE_ALLOW_ANONYMOUS is set",
+		},
+	}
+
+	for name, tc := range tc {
+		t.Run(name, func(t *testing.T) {
+			c := &ServeCmd{
+				Api: api.Config{
+					Listen:      ":8080",
+					ApiKey:      tc.apiKey,
+					Concurrency: 1,
+				},
+				AllowAnonymous: tc.allowAnonymous,
+				Job:            *newTestSingleFileCmd(t, "http://deployments", "http://storage", fakeGenerator),
+			}
+
+			err := c.Validate()
+			if tc.err != "" {
+				assert.EqualError(t, err, tc.err)
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
+
+func TestServeCmdRun(t *testing.T) {
+	depl := &fakeDeployments{}
+	deplServer := httptest.NewServer(depl)
+	defer deplServer.Close()
+
+	storage := newStorageServer(t)
+	defer storage.Close()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	addr := l.Addr().String()
+	l.Close()
+
+	c := &ServeCmd{
+		Api: api.Config{
+			Listen:       addr,
+			ApiKey:       "key",
+			Concurrency:  1,
+			QueueSize:    1,
+			DrainTimeout: 10 * time.Second,
+		},
+		Job: *newTestSingleFileCmd(t, deplServer.URL, storage.URL, fakeGenerator),
+	}
+	assert.NoError(t, c.Validate())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- c.RunContext(ctx)
+	}()
+
+	b, err := json.Marshal(testInputs(storage.URL))
+	assert.NoError(t, err)
+
+	var rsp *http.Response
+	assert.Eventually(t, func() bool {
+		req, _ := http.NewRequest(http.MethodPost, "http://"+addr+"/jobs", strings.NewReader(string(b)))
+		req.Header.Set("Authorization", "Bearer key")
+		rsp, err = http.DefaultClient.Do(req)
+		return err == nil
+	}, 10*time.Second, 10*time.Millisecond)
+	defer rsp.Body.Close()
+	assert.Equal(t, http.StatusAccepted, rsp.StatusCode)
+
+	var job api.Job
+	assert.NoError(t, json.NewDecoder(rsp.Body).Decode(&job))
+
+	assert.Eventually(t, func() bool {
+		req, _ := http.NewRequest(http.MethodGet, "http://"+addr+"/jobs/"+job.Id, nil)
+		req.Header.Set("Authorization", "Bearer key")
+		rsp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return false
+		}
+		defer rsp.Body.Close()
+
+		job = api.Job{}
+		_ = json.NewDecoder(rsp.Body).Decode(&job)
+		return job.Status == api.StatusDone
+	}, 10*time.Second, 10*time.Millisecond)
+
+	assert.Contains(t, strings.Join(job.Logs, "\n"), "artifact_id=aid")
+
+	cancel()
+	assert.NoError(t, <-done)
+
+	depl.Lock()
+	defer depl.Unlock()
+	assert.Equal(t, []string{"aid"}, depl.uploads)
+}
@@ -14,22 +14,37 @@
 package cmd
 
 import (
+	"bytes"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
 	"os/exec"
+	"os/signal"
 	"path/filepath"
 	"strings"
+	"syscall"
+	"time"
 
 	"github.com/pkg/errors"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
+	"go.opentelemetry.io/otel/attribute"
 
+	"github.com/mendersoftware/create-artifact-worker/artifact"
 	"github.com/mendersoftware/create-artifact-worker/client"
 	"github.com/mendersoftware/create-artifact-worker/config"
+	"github.com/mendersoftware/create-artifact-worker/delta"
 	mlog "github.com/mendersoftware/create-artifact-worker/log"
+	"github.com/mendersoftware/create-artifact-worker/metrics"
+	"github.com/mendersoftware/create-artifact-worker/multifile"
+	"github.com/mendersoftware/create-artifact-worker/progress"
+	"github.com/mendersoftware/create-artifact-worker/sandbox"
+	"github.com/mendersoftware/create-artifact-worker/tracing"
 )
 
 const (
@@ -40,16 +55,61 @@ const (
 	argArtifactId     = "artifact-id"
 	argGetArtifactUri = "get-artifact-uri"
 	argDelArtifactUri = "delete-artifact-uri"
+	argPutArtifactUri = "put-artifact-uri"
 	argTenantId       = "tenant-id"
 	argArgs           = "args"
+	argTraceparent    = "traceparent"
+	argTracestate     = "tracestate"
+	argInput          = "input"
+	argOutput         = "output"
+)
+
+// onlineArgs are required, except with --input and --output
+var onlineArgs = []string{
+	argToken,
+	argArtifactId,
+	argGetArtifactUri,
+	argDelArtifactUri,
+	argTenantId,
+}
+
+const generatorSingleFile = "single-file"
+
+// input parameters of the generate_artifact workflow, see
+// workflows/generate_artifact.json
+const (
+	inputArtifactId     = "artifact_id"
+	inputArtifactName   = "name"
+	inputDelArtifactUri = "delete_artifact_uri"
+	inputDescription    = "description"
+	inputDeviceTypes    = "device_types_compatible"
+	inputGetArtifactUri = "get_artifact_uri"
+	inputTenantId       = "tenant_id"
+	inputToken          = "token"
+	inputArgs           = "args"
+	inputTraceparent    = "traceparent"
+	inputTracestate     = "tracestate"
+)
+
+const (
+	traceFlushTimeout = 5 * time.Second
+
+	// statusReportTimeout bounds reporting the final status of a
+	// cancelled job, which can't use the job's context
+	statusReportTimeout = 30 * time.Second
+)
+
+const (
+	uploadApiInternal   = "internal"
+	uploadApiManagement = "management"
 )
 
 type args struct {
-	Filename           string `json:"filename"`
-	DestDir            string `json:"dest_dir"`
-	SoftwareFilesystem string `json:"software_filesystem"`
-	SoftwareName       string `json:"software_name"`
-	SoftwareVersion    string `json:"software_version"`
+	Filename           string `json:"filename" yaml:"filename"`
+	DestDir            string `json:"dest_dir" yaml:"dest_dir"`
+	SoftwareFilesystem string `json:"software_filesystem" yaml:"software_filesystem"`
+	SoftwareName       string `json:"software_name" yaml:"software_name"`
+	SoftwareVersion    string `json:"software_version" yaml:"software_version"`
 }
 
 var singleFileCmd = &cobra.Command{
@@ -57,8 +117,44 @@ var singleFileCmd = &cobra.Command{
 	Short: "Generate an update using a single-file update module.",
 	Long: "\nBesides command line args, supports the following env vars:\n\n" +
 		"CREATE_ARTIFACT_SKIPVERIFY skip ssl verification (default: false)\n" +
+		"CREATE_ARTIFACT_LOG_FORMAT log format: logfmt, json (default: logfmt)\n" +
+		"CREATE_ARTIFACT_LOG_LEVEL log level: debug, info, warn, error (default: info)\n" +
 		"CREATE_ARTIFACT_WORKDIR working dir for processing (default: /var)\n" +
-		"CREATE_ARTIFACT_DEPLOYMENTS_URL internal deployments service url\n",
+		"CREATE_ARTIFACT_DEPLOYMENTS_URL internal deployments service url\n" +
+		"CREATE_ARTIFACT_STORAGE_TYPE storage backend: auto, s3, azure, file (default: auto)\n" +
+		"CREATE_ARTIFACT_FILE_ROOT root dir allowed for file:// uris (default: none)\n" +
+		"CREATE_ARTIFACT_DOWNLOAD_CONCURRENCY parallel ranged GETs, 1 disables (default: 1)\n" +
+		"CREATE_ARTIFACT_DOWNLOAD_CHUNK_SIZE bytes per ranged GET (default: 16777216)\n" +
+		"CREATE_ARTIFACT_DOWNLOAD_RETRIES retries per failed chunk or changed object (default: 3)\n" +
+		"CREATE_ARTIFACT_DIRECT_UPLOAD upload straight to storage via a link from deployments " +
+		"(default: false)\n" +
+		"CREATE_ARTIFACT_UPLOAD_API deployments api to upload to with: internal, management " +
+		"(default: internal)\n" +
+		"CREATE_ARTIFACT_TLS_CA_FILE extra trusted ca bundle (default: none)\n" +
+		"CREATE_ARTIFACT_TLS_CERT_FILE client certificate for mutual tls (default: none)\n" +
+		"CREATE_ARTIFACT_TLS_KEY_FILE client certificate key for mutual tls (default: none)\n" +
+		"CREATE_ARTIFACT_TLS_MIN_VERSION minimum tls version (default: 1.2)\n" +
+		"CREATE_ARTIFACT_HTTP_* connection timeouts and pooling, see main help\n" +
+		"CREATE_ARTIFACT_TIMEOUT_{DOWNLOAD,UPLOAD,DELETE,API} operation deadlines " +
+		"(default: 15m)\n" +
+		"HTTP_PROXY, HTTPS_PROXY, NO_PROXY proxy settings\n" +
+		"CREATE_ARTIFACT_REPORT_STATUS report job progress to deployments (default: true)\n" +
+		"CREATE_ARTIFACT_SINGLE_FILE_GENERATOR generator script " +
+		"(default: /usr/bin/single-file-artifact-gen)\n" +
+		"CREATE_ARTIFACT_METRICS_TEXTFILE node-exporter textfile for metrics (default: none)\n" +
+		"CREATE_ARTIFACT_METRICS_PUSHGATEWAY_URL pushgateway for metrics (default: none)\n" +
+		"CREATE_ARTIFACT_TRACING_ENDPOINT otlp/http collector for traces (default: none)\n" +
+		"CREATE_ARTIFACT_PROGRESS_INTERVAL interval of progress reports, 0 disables (default: 10s)\n" +
+		"CREATE_ARTIFACT_PROGRESS_URL callback for progress reports (default: none)\n" +
+		"CREATE_ARTIFACT_SANDBOX_{CPU_TIME,MEMORY,FILE_SIZE,OPEN_FILES} generator limits, " +
+		"0 disables (default: 0)\n" +
+		"CREATE_ARTIFACT_SANDBOX_ENV env vars passed to the generator (default: none)\n" +
+		"CREATE_ARTIFACT_SANDBOX_NAMESPACES run the generator in new namespaces (default: false)\n" +
+		"TRACEPARENT, TRACESTATE parent trace context, see --traceparent\n\n" +
+		"With --input and --output it generates the artifact of a local file, without\n" +
+		"storage or deployments, and prints a summary of it; --token, --tenant-id, the\n" +
+		"artifact id and the uris aren't needed then.\n",
+	PreRunE: liftOnlineArgs,
 	Run: func(cmd *cobra.Command, args []string) {
 		c, err := NewSingleFileCmd(cmd, args)
 		if err != nil {
@@ -69,61 +165,112 @@ var singleFileCmd = &cobra.Command{
 		err = c.Run()
 		if err != nil {
 			mlog.Error(err.Error())
-			os.Exit(1)
+			os.Exit(exitCode(err))
 		}
 	},
 }
 
 func init() {
-	singleFileCmd.Flags().String(argToken, "", "auth token")
-	_ = singleFileCmd.MarkFlagRequired(argToken)
+	// json string of specific args: dest dir, file name
+	addJobFlags(singleFileCmd,
+		"specific args in json form: {\"file\":<DESTINATION_FILE_NAME_ON_DEVICE>,"+
+			" \"dest_dir\":<DESTINATION_DIR_ON_DEVICE>},"+
+			" \"software_filesystem\":<SOFTWARE_FILESYSTEM>},"+
+			" \"software_name\":<SOFTWARE_NAME>},"+
+			" \"software_version\":<SOFTWARE_VERSION>}",
+	)
+	addLocalFlags(singleFileCmd)
+}
 
-	singleFileCmd.Flags().String(argArtifactName, "", "artifact name")
-	_ = singleFileCmd.MarkFlagRequired(argArtifactName)
+// addJobFlags adds the flags of a generation job to cmd.
+func addJobFlags(cmd *cobra.Command, argsUsage string) {
+	cmd.Flags().String(argToken, "", "auth token")
+	_ = cmd.MarkFlagRequired(argToken)
 
-	singleFileCmd.Flags().String(argArtifactId, "", "artifact id")
-	_ = singleFileCmd.MarkFlagRequired(argArtifactId)
+	cmd.Flags().String(argArtifactName, "", "artifact name")
+	_ = cmd.MarkFlagRequired(argArtifactName)
 
-	singleFileCmd.Flags().String(
+	cmd.Flags().String(argArtifactId, "", "artifact id")
+	_ = cmd.MarkFlagRequired(argArtifactId)
+
+	cmd.Flags().String(
 		argGetArtifactUri,
 		"",
 		"pre-signed s3 url to uploaded temp artifact (GET)",
 	)
-	_ = singleFileCmd.MarkFlagRequired(argGetArtifactUri)
+	_ = cmd.MarkFlagRequired(argGetArtifactUri)
 
-	singleFileCmd.Flags().String(
+	cmd.Flags().String(
 		argDelArtifactUri,
 		"",
 		"pre-signed s3 url to uploaded temp artifact (DELETE)",
 	)
-	_ = singleFileCmd.MarkFlagRequired(argDelArtifactUri)
+	_ = cmd.MarkFlagRequired(argDelArtifactUri)
+
+	cmd.Flags().String(
+		argPutArtifactUri,
+		"",
+		"pre-signed url to upload the generated artifact to (PUT), bypassing deployments",
+	)
 
-	singleFileCmd.Flags().String(argTenantId, "", "tenant id")
-	_ = singleFileCmd.MarkFlagRequired(argTenantId)
+	cmd.Flags().String(argTenantId, "", "tenant id")
+	_ = cmd.MarkFlagRequired(argTenantId)
 
-	singleFileCmd.Flags().String(argDeviceType, "", "device type")
-	_ = singleFileCmd.MarkFlagRequired(argDeviceType)
+	cmd.Flags().String(argDeviceType, "", "device type")
+	_ = cmd.MarkFlagRequired(argDeviceType)
 
-	// json string of specific args: dest dir, file name
-	singleFileCmd.Flags().String(
-		argArgs,
+	cmd.Flags().String(argArgs, "", argsUsage)
+	_ = cmd.MarkFlagRequired(argArgs)
+
+	cmd.Flags().String(argDescription, "", "artifact description")
+
+	cmd.Flags().String(
+		argTraceparent,
 		"",
-		"specific args in json form: {\"file\":<DESTINATION_FILE_NAME_ON_DEVICE>,"+
-			" \"dest_dir\":<DESTINATION_DIR_ON_DEVICE>},"+
-			" \"software_filesystem\":<SOFTWARE_FILESYSTEM>},"+
-			" \"software_name\":<SOFTWARE_NAME>},"+
-			" \"software_version\":<SOFTWARE_VERSION>}",
+		"W3C traceparent of the job's parent span (default: $TRACEPARENT)",
+	)
+	cmd.Flags().String(
+		argTracestate,
+		"",
+		"W3C tracestate going with --traceparent (default: $TRACESTATE)",
 	)
-	_ = singleFileCmd.MarkFlagRequired(argArgs)
+}
 
-	singleFileCmd.Flags().String(argDescription, "", "artifact description")
+// addLocalFlags adds the flags of a local run, see liftOnlineArgs.
+func addLocalFlags(cmd *cobra.Command) {
+	cmd.Flags().String(argInput, "", "local input file, for a run without storage or deployments")
+	cmd.Flags().String(argOutput, "", "local path of the artifact generated of --input")
+	cmd.MarkFlagsRequiredTogether(argInput, argOutput)
+}
+
+// liftOnlineArgs makes the online args optional for a local run.
+func liftOnlineArgs(cmd *cobra.Command, args []string) error {
+	if cmd.Flags().Changed(argInput) {
+		for _, arg := range onlineArgs {
+			_ = cmd.Flags().SetAnnotation(arg, cobra.BashCompOneRequiredFlag, []string{"false"})
+		}
+	}
+	return nil
 }
 
 type SingleFileCmd struct {
 	ServerUrl      string
 	DeploymentsUrl string
 	SkipVerify     bool
+	TLS            client.TLSConfig
+	HTTP           client.HTTPConfig
 	Workdir        string
+	StorageType    string
+	FileRoot       string
+	Download       client.ParallelDownload
+	DirectUpload   bool
+	UploadApi      string
+	ReportStatus   bool
+	Generator      string
+	Metrics        metrics.Config
+	Tracing        tracing.Config
+	Progress       progress.Reporter
+	Sandbox        sandbox.Config
 
 	ArtifactName   string
 	Description    string
@@ -131,9 +278,27 @@ type SingleFileCmd struct {
 	ArtifactId     string
 	GetArtifactUri string
 	DelArtifactUri string
+	PutArtifactUri string
 	Args           string
 	TenantId       string
 	AuthToken      string
+	Claims         *client.Claims
+	Traceparent    string
+	Tracestate     string
+
+	// Redelivered tells if the job runs again after a transient failure
+	// or being cancelled, which then isn't reported as failed.
+	Redelivered bool
+
+	// Input and Output are local paths for a run without storage or
+	// deployments
+	Input  string
+	Output string
+	stdout io.Writer
+
+	// Type is the update module of the artifact, single-file by default;
+	// multi-file ones are generated of an archive.
+	Type string
 
 	// type-specific args
 	FileName           string
@@ -141,6 +306,22 @@ type SingleFileCmd struct {
 	SoftwareFilesystem string
 	SoftwareName       string
 	SoftwareVersion    string
+
+	// multi-file args: the files of the archive, adding up to MaxSize
+	// bytes at most
+	Files   multifile.Files
+	MaxSize int64
+
+	// delta args: the base image the input is the target of, and the
+	// tool computing the delta
+	BaseArtifactUri string
+	Delta           delta.Backend
+
+	// modify args: the changes of the input artifact, and the key the
+	// result is signed with
+	Modification artifact.Modification
+	SigningKey   string
+	Signer       artifact.Signer
 }
 
 func NewSingleFileCmd(cmd *cobra.Command, args []string) (*SingleFileCmd, error) {
@@ -158,9 +339,7 @@ func NewSingleFileCmd(cmd *cobra.Command, args []string) (*SingleFileCmd, error)
 }
 
 func (c *SingleFileCmd) init(cmd *cobra.Command) error {
-	c.DeploymentsUrl = viper.GetString(config.CfgDeploymentsUrl)
-	c.SkipVerify = viper.GetBool(config.CfgSkipVerify)
-	c.Workdir = viper.GetString(config.CfgWorkDir)
+	c.initConfig()
 
 	var arg string
 	arg, err := cmd.Flags().GetString(argArtifactName)
@@ -199,6 +378,12 @@ func (c *SingleFileCmd) init(cmd *cobra.Command) error {
 		return err
 	}
 
+	arg, err = cmd.Flags().GetString(argPutArtifactUri)
+	c.PutArtifactUri = arg
+	if err != nil {
+		return err
+	}
+
 	arg, err = cmd.Flags().GetString(argTenantId)
 	c.TenantId = arg
 	if err != nil {
@@ -211,6 +396,39 @@ func (c *SingleFileCmd) init(cmd *cobra.Command) error {
 		return err
 	}
 
+	arg, err = cmd.Flags().GetString(argTraceparent)
+	c.Traceparent = arg
+	if err != nil {
+		return err
+	}
+	if c.Traceparent == "" {
+		c.Traceparent = os.Getenv("TRACEPARENT")
+	}
+
+	arg, err = cmd.Flags().GetString(argTracestate)
+	c.Tracestate = arg
+	if err != nil {
+		return err
+	}
+	if c.Tracestate == "" {
+		c.Tracestate = os.Getenv("TRACESTATE")
+	}
+
+	// not all the generators support local runs
+	if cmd.Flags().Lookup(argInput) != nil {
+		arg, err = cmd.Flags().GetString(argInput)
+		c.Input = arg
+		if err != nil {
+			return err
+		}
+
+		arg, err = cmd.Flags().GetString(argOutput)
+		c.Output = arg
+		if err != nil {
+			return err
+		}
+	}
+
 	arg, err = cmd.Flags().GetString(argArgs)
 	c.Args = arg
 	if err != nil {
@@ -220,11 +438,177 @@ func (c *SingleFileCmd) init(cmd *cobra.Command) error {
 	return nil
 }
 
+// initConfig sets up the job's environment from the configuration.
+func (c *SingleFileCmd) initConfig() {
+	c.DeploymentsUrl = viper.GetString(config.CfgDeploymentsUrl)
+	c.SkipVerify = viper.GetBool(config.CfgSkipVerify)
+	c.TLS = client.TLSConfig{
+		SkipVerify: c.SkipVerify,
+		CAFile:     viper.GetString(config.CfgTLSCAFile),
+		CertFile:   viper.GetString(config.CfgTLSCertFile),
+		KeyFile:    viper.GetString(config.CfgTLSKeyFile),
+		MinVersion: viper.GetString(config.CfgTLSMinVersion),
+	}
+	c.HTTP = client.HTTPConfig{
+		TLS:                   c.TLS,
+		DialTimeout:           viper.GetDuration(config.CfgHTTPDialTimeout),
+		TLSHandshakeTimeout:   viper.GetDuration(config.CfgHTTPTLSHandshakeTimeout),
+		ResponseHeaderTimeout: viper.GetDuration(config.CfgHTTPResponseHeaderTimeout),
+		IdleConnTimeout:       viper.GetDuration(config.CfgHTTPIdleConnTimeout),
+		MaxIdleConns:          viper.GetInt(config.CfgHTTPMaxIdleConns),
+		MaxIdleConnsPerHost:   viper.GetInt(config.CfgHTTPMaxIdleConnsPerHost),
+		MaxConnsPerHost:       viper.GetInt(config.CfgHTTPMaxConnsPerHost),
+		Timeouts: client.Timeouts{
+			Download: viper.GetDuration(config.CfgTimeoutDownload),
+			Upload:   viper.GetDuration(config.CfgTimeoutUpload),
+			Delete:   viper.GetDuration(config.CfgTimeoutDelete),
+			API:      viper.GetDuration(config.CfgTimeoutApi),
+		},
+	}
+	c.Workdir = viper.GetString(config.CfgWorkDir)
+	c.StorageType = viper.GetString(config.CfgStorageType)
+	c.FileRoot = viper.GetString(config.CfgFileRoot)
+	c.DirectUpload = viper.GetBool(config.CfgDirectUpload)
+	c.UploadApi = viper.GetString(config.CfgUploadApi)
+	c.ReportStatus = viper.GetBool(config.CfgReportStatus)
+	c.Generator = viper.GetString(config.CfgSingleFileGenerator)
+	switch c.kind() {
+	case generatorMultiFile:
+		c.Generator = viper.GetString(config.CfgMultiFileGenerator)
+	case generatorDelta:
+		c.Generator = viper.GetString(config.CfgDeltaGenerator)
+	}
+	c.MaxSize = viper.GetInt64(config.CfgMultiFileMaxSize)
+	c.Delta = delta.Backend{
+		Name: viper.GetString(config.CfgDeltaBackend),
+		Path: viper.GetString(config.CfgDeltaBackendPath),
+	}
+	c.SigningKey = viper.GetString(config.CfgSigningKey)
+	c.Metrics = metrics.Config{
+		Textfile:       viper.GetString(config.CfgMetricsTextfile),
+		PushgatewayUrl: viper.GetString(config.CfgMetricsPushgatewayUrl),
+	}
+	c.Tracing = tracing.Config{
+		Endpoint: viper.GetString(config.CfgTracingEndpoint),
+	}
+	c.Sandbox = sandbox.Config{
+		CPUTime:    viper.GetDuration(config.CfgSandboxCPUTime),
+		Memory:     viper.GetInt64(config.CfgSandboxMemory),
+		FileSize:   viper.GetInt64(config.CfgSandboxFileSize),
+		OpenFiles:  viper.GetInt64(config.CfgSandboxOpenFiles),
+		Env:        config.List(viper.GetString(config.CfgSandboxEnv)),
+		Namespaces: viper.GetBool(config.CfgSandboxNamespaces),
+	}
+	c.Progress = progress.Reporter{
+		Interval:    viper.GetDuration(config.CfgProgressInterval),
+		CallbackUrl: viper.GetString(config.CfgProgressUrl),
+	}
+	c.Download = client.ParallelDownload{
+		Concurrency: viper.GetInt(config.CfgDownloadConcurrency),
+		ChunkSize:   viper.GetInt64(config.CfgDownloadChunkSize),
+		Retries:     viper.GetInt(config.CfgDownloadRetries),
+	}
+}
+
+// fromInputs makes the command of a job given the inputs of the
+// generate_artifact workflow, with c as the configuration.
+func (c SingleFileCmd) fromInputs(input func(name string) string) (*SingleFileCmd, error) {
+	for _, in := range []string{
+		inputArtifactId,
+		inputArtifactName,
+		inputDelArtifactUri,
+		inputDeviceTypes,
+		inputGetArtifactUri,
+		inputToken,
+		inputArgs,
+	} {
+		if input(in) == "" {
+			return nil, errors.Errorf("missing input parameter %s", in)
+		}
+	}
+
+	c.ArtifactId = input(inputArtifactId)
+	c.ArtifactName = input(inputArtifactName)
+	c.DelArtifactUri = input(inputDelArtifactUri)
+	c.Description = input(inputDescription)
+	c.DeviceTypes = strings.Split(input(inputDeviceTypes), ",")
+	c.GetArtifactUri = input(inputGetArtifactUri)
+	c.TenantId = input(inputTenantId)
+	c.AuthToken = input(inputToken)
+	c.Args = input(inputArgs)
+	// the caller's trace, not one the process was started in
+	c.Traceparent = input(inputTraceparent)
+	c.Tracestate = input(inputTracestate)
+
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+
+	return &c, nil
+}
+
 func (c *SingleFileCmd) Validate() error {
 	if err := config.ValidAbsPath(c.Workdir); err != nil {
 		return errors.Wrap(err, "invalid workdir")
 	}
 
+	// fail early on a broken ca bundle or client certificate
+	if _, err := client.NewTLSConfig(c.TLS); err != nil {
+		return errors.Wrap(err, "invalid tls configuration")
+	}
+
+	if c.Download.Concurrency > 1 && c.Download.ChunkSize <= 0 {
+		return errors.New("download chunk size must be positive")
+	}
+
+	if c.FileRoot != "" {
+		if err := config.ValidAbsPath(c.FileRoot); err != nil {
+			return errors.Wrap(err, "invalid file storage root")
+		}
+	}
+
+	if c.Progress.CallbackUrl != "" {
+		if err := config.ValidUrl(c.Progress.CallbackUrl); err != nil {
+			return errors.Wrap(err, "invalid progress url")
+		}
+	}
+
+	if err := c.Sandbox.Validate(); err != nil {
+		return errors.Wrap(err, "invalid sandbox configuration")
+	}
+
+	if c.UploadApi != uploadApiInternal && c.UploadApi != uploadApiManagement {
+		return errors.Errorf("invalid upload api %q", c.UploadApi)
+	}
+
+	if c.local() {
+		if err := c.validateLocal(); err != nil {
+			return err
+		}
+	} else {
+		claims, err := client.ParseClaims(c.AuthToken)
+		if err != nil {
+			return errors.Wrap(err, "invalid auth token")
+		}
+
+		// the token comes from the user's request, while the tenant id is
+		// what the internal endpoints trust - they must agree
+		if claims.Tenant != c.TenantId {
+			return errors.Errorf("token tenant %q doesn't match tenant id %q",
+				claims.Tenant, c.TenantId)
+		}
+		c.Claims = claims
+	}
+
+	switch c.kind() {
+	case generatorMultiFile:
+		return c.parseMultiFileArgs()
+	case generatorDelta:
+		return c.parseDeltaArgs()
+	case generatorModify:
+		return c.parseModifyArgs()
+	}
+
 	var args args
 
 	err := json.Unmarshal([]byte(c.Args), &args)
@@ -249,48 +633,401 @@ func (c *SingleFileCmd) Validate() error {
 	return nil
 }
 
+// kind returns the update module type generated.
+func (c *SingleFileCmd) kind() string {
+	if c.Type == "" {
+		return generatorSingleFile
+	}
+	return c.Type
+}
+
+// local tells if it's a run on local files, without storage or deployments.
+func (c *SingleFileCmd) local() bool {
+	return c.Input != "" || c.Output != ""
+}
+
+func (c *SingleFileCmd) validateLocal() error {
+	if c.Input == "" || c.Output == "" {
+		return errors.New("a local run needs both an input and an output")
+	}
+
+	fi, err := os.Stat(c.Input)
+	if err != nil {
+		return errors.Wrap(err, "invalid input")
+	}
+	if !fi.Mode().IsRegular() {
+		return errors.Errorf("invalid input: %s isn't a regular file", c.Input)
+	}
+
+	// the generator runs in a temp dir
+	if c.Input, err = filepath.Abs(c.Input); err != nil {
+		return errors.Wrap(err, "invalid input")
+	}
+	if c.Output, err = filepath.Abs(c.Output); err != nil {
+		return errors.Wrap(err, "invalid output")
+	}
+
+	return nil
+}
+
+// Run runs the job as the only one in the process, until it's done or
+// cancelled by SIGINT or SIGTERM.
 func (c *SingleFileCmd) Run() error {
-	mlog.Info("running single-file update module generation:\n%s", c.dumpArgs())
-	mlog.Info("config:\n%s", config.Dump())
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	// a second signal kills the process right away
+	go func() {
+		<-ctx.Done()
+		stop()
+	}()
+
+	shutdown, err := tracing.Init(context.Background(), c.Tracing)
+	if err != nil {
+		return err
+	}
+	defer flushTraces(mlog.With("artifact_id", c.ArtifactId, "tenant_id", c.TenantId), shutdown)
+
+	return c.RunContext(ctx)
+}
 
-	cd, err := client.NewDeployments(c.DeploymentsUrl, c.SkipVerify)
+// RunContext runs the job; the process wide tracing is set up by the caller.
+func (c *SingleFileCmd) RunContext(ctx context.Context) error {
+	if c.local() {
+		return c.runLocal(ctx)
+	}
+
+	l := mlog.FromContext(ctx).With("artifact_id", c.ArtifactId, "tenant_id", c.TenantId)
+
+	l.Info("running %s update module generation:\n%s", c.kind(), c.dumpArgs())
+	l.Info("config:\n%s", config.Dump())
+
+	cd, err := client.NewDeploymentsWithToken(c.DeploymentsUrl, c.AuthToken, c.httpConfig())
 	if err != nil {
-		return errors.New("failed to configure 'deployments' client")
+		return errors.Wrap(err, "failed to configure 'deployments' client")
+	}
+
+	cs3, err := client.NewStorageForUrl(c.GetArtifactUri, c.storageConfig())
+	if err != nil {
+		return errors.Wrap(err, "failed to configure storage client")
+	}
+
+	c.Progress.ArtifactId = c.ArtifactId
+	c.Progress.TenantId = c.TenantId
+	if c.Progress.CallbackUrl != "" {
+		c.Progress.Client, err = client.NewTracingHTTPClient(c.httpConfig())
+		if err != nil {
+			return errors.Wrap(err, "failed to configure progress callback client")
+		}
+	}
+
+	job := metrics.NewJob(c.kind())
+	defer c.exportMetrics(l)
+
+	ctx = tracing.WithParent(ctx, c.Traceparent, c.Tracestate)
+	ctx, span := tracing.Start(ctx, "create-artifact "+c.kind(),
+		attribute.String("artifact_id", c.ArtifactId),
+		attribute.String("tenant_id", c.TenantId),
+	)
+	if span.SpanContext().IsValid() {
+		l = l.With("trace_id", span.SpanContext().TraceID().String())
+	}
+
+	ctx = mlog.NewContext(ctx, l)
+	ctx = metrics.NewContext(ctx, job)
+	start := time.Now()
+
+	err = c.run(ctx, cd, cs3)
+	if err != nil && ctx.Err() != nil {
+		// the failure cancelling caused, e.g. the generator killed
+		err = errors.Wrapf(err, "job cancelled (%s)", ctx.Err())
+	}
+	if err != nil && c.Redelivered && transient(ctx, err) {
+		job.Fail(errorClass(err))
+		l.With("duration", time.Since(start)).Warn("job failed, to be run again: %s", err.Error())
+		tracing.End(span, err)
+		return err
+	}
+	if err != nil {
+		job.Fail(errorClass(err))
+		// a cancelled job still gets its failure reported
+		sctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), statusReportTimeout)
+		c.reportStatus(sctx, cd, client.StatusFailed, mlog.Redact(err.Error()))
+		cancel()
+		l.With("duration", time.Since(start)).Error("job failed: %s", err.Error())
+		tracing.End(span, err)
+		return err
+	}
+
+	job.Done()
+	c.reportStatus(ctx, cd, client.StatusDone, "")
+	l.With("duration", time.Since(start)).Info("job done")
+	tracing.End(span, nil)
+
+	return nil
+}
+
+// flushTraces exports the spans still buffered; best effort.
+func flushTraces(l *mlog.Logger, shutdown func(context.Context) error) {
+	ctx, cancel := context.WithTimeout(context.Background(), traceFlushTimeout)
+	defer cancel()
+
+	if err := shutdown(ctx); err != nil {
+		l.Error("failed to export traces: %s", err.Error())
+	}
+}
+
+// transient tells if the job failing with err may succeed if run again:
+// it was cancelled, or the failure is temporary.
+func transient(ctx context.Context, err error) bool {
+	return ctx.Err() != nil || client.IsRetryable(err)
+}
+
+// errorClass sorts job failures for the metrics.
+func errorClass(err error) string {
+	var exitErr *exec.ExitError
+
+	switch {
+	case sandbox.IsLimit(err):
+		return "limit"
+	case errors.As(err, &exitErr):
+		return "generator"
+	case client.IsConflict(err):
+		return "conflict"
+	case client.IsAuth(err):
+		return "auth"
+	case client.IsValidation(err):
+		return "validation"
+	case errors.Is(err, context.DeadlineExceeded):
+		return "timeout"
+	case errors.Is(err, context.Canceled):
+		return "cancelled"
+	case client.IsRetryable(err):
+		return "transient"
 	}
 
-	cs3 := client.NewStorage(c.SkipVerify)
+	return "other"
+}
 
-	ctx := context.Background()
+// exportMetrics is best effort, like status reporting.
+func (c *SingleFileCmd) exportMetrics(l *mlog.Logger) {
+	if err := metrics.Export(c.Metrics); err != nil {
+		l.Error(err.Error())
+	}
+}
+
+func (c *SingleFileCmd) run(ctx context.Context, cd client.Deployments, cs3 client.Storage) error {
+	l := mlog.FromContext(ctx)
+	job := metrics.FromContext(ctx)
 
-	mlog.Verbose("creating temp dir at", c.Workdir)
+	l.Debug("creating temp dir at %s", c.Workdir)
 
 	downloadDir, err := ioutil.TempDir(c.Workdir, "single-file")
 	if err != nil {
 		return errors.Wrapf(err, "failed to create temp dir under workdir %s", c.Workdir)
 	}
+	defer c.removeDir(ctx, downloadDir)
 
 	//gotcha: must download under the correct name (destination name on the device)
 	//artifact generator will not allow renaming it
 	downloadFile := filepath.Join(downloadDir, c.FileName)
 
-	mlog.Verbose("downloading temp artifact to %s", downloadFile)
+	// a retried job may find its artifact already uploaded
+	existing := c.lookupArtifact(ctx, cd)
+
+	sl := l.With("stage", "download")
+	sl.Debug("downloading temp artifact to %s", downloadFile)
+	c.reportStatus(ctx, cd, client.StatusDownloading, "")
+	job.Stage(metrics.StageDownload)
 
-	err = cs3.Download(ctx, c.GetArtifactUri, downloadFile)
+	start := time.Now()
+	spanCtx, span := tracing.Start(ctx, "storage.Download")
+	tr := c.Progress.Start(spanCtx, progress.StageDownload, 0)
+	err = cs3.Download(progress.NewContext(spanCtx, tr), c.GetArtifactUri, downloadFile)
+	tr.Done()
+	tracing.End(span, err)
+	if client.IsNotFound(err) && c.uploadedAs(existing) {
+		// the input is deleted only after generating succeeded
+		sl.Info("artifact already uploaded and input file gone, nothing to do")
+		return nil
+	}
 	if err != nil {
-		return errors.Wrapf(err, "failed to download input file at %s", c.GetArtifactUri)
+		return errors.Wrapf(err, "failed to download input file at %s",
+			mlog.RedactURL(c.GetArtifactUri))
+	}
+	sl.With("duration", time.Since(start)).Info("downloaded input file")
+	if fi, err := os.Stat(downloadFile); err == nil {
+		job.Downloaded(fi.Size())
+	}
+
+	if c.kind() == generatorDelta {
+		if err := c.downloadBase(mlog.NewContext(ctx, sl), downloadDir); err != nil {
+			return err
+		}
+	}
+
+	if existing != nil {
+		err = c.checkExisting(ctx, existing, downloadFile)
+		if err != nil {
+			return err
+		}
+
+		l.Info("artifact already uploaded, skipping generation")
+
+		err = c.deleteInput(ctx, cs3)
+		if err != nil {
+			l.Error("failed to delete artifact at %s: %s",
+				mlog.RedactURL(c.DelArtifactUri), err.Error())
+		}
+
+		return nil
 	}
 
 	// make the filename unique by naming it after the artifact
 	outfile := c.ArtifactId + "-generated"
 	outfile = filepath.Join(downloadDir, outfile)
 
-	mlog.Verbose("generating output artifact %s", outfile)
+	c.reportStatus(ctx, cd, client.StatusGenerating, "")
+	job.Stage(metrics.StageGenerate)
+
+	err = c.generate(ctx, downloadDir, downloadFile, outfile)
+	if err != nil {
+		return err
+	}
+
+	c.reportStatus(ctx, cd, client.StatusUploading, "")
+	job.Stage(metrics.StageUpload)
+
+	sl = l.With("stage", "upload")
+	sl.Debug("deleting temp file from S3")
+
+	err = c.deleteInput(ctx, cs3)
+	if err != nil {
+		return errors.Wrapf(err, "failed to delete artifact at %s",
+			mlog.RedactURL(c.DelArtifactUri))
+	}
+
+	if err := c.uploadGenerated(mlog.NewContext(ctx, sl), cd, outfile, downloadFile); err != nil {
+		return err
+	}
+	if fi, err := os.Stat(outfile); err == nil {
+		job.Uploaded(fi.Size())
+	}
+
+	return nil
+}
+
+// uploadGenerated uploads the artifact at path, generated of input; the
+// artifact uploaded by an earlier attempt of the job isn't a conflict.
+func (c *SingleFileCmd) uploadGenerated(
+	ctx context.Context,
+	cd client.Deployments,
+	path, input string,
+) error {
+	l := mlog.FromContext(ctx)
+
+	l.Debug("uploading generated artifact")
+	start := time.Now()
+	tr := c.Progress.Start(ctx, progress.StageUpload, 0)
+	err := c.upload(progress.NewContext(ctx, tr), cd, path)
+	tr.Done()
+	if errors.Is(err, client.ErrArtifactConflict) {
+		// did an earlier attempt of this job upload it after all?
+		a, lerr := cd.GetArtifact(ctx, c.ArtifactId, c.TenantId)
+		if lerr == nil && c.checkExisting(ctx, a, input) == nil {
+			l.Info("artifact already uploaded")
+			err = nil
+		}
+	}
+	if err != nil {
+		return errors.Wrapf(err, "failed to upload generated artifact")
+	}
+	l.With("duration", time.Since(start)).Info("uploaded artifact")
+
+	return nil
+}
+
+// runLocal generates the artifact of a local file, validating and
+// generating like a job would but without storage or deployments, and
+// prints its summary.
+func (c *SingleFileCmd) runLocal(ctx context.Context) error {
+	l := mlog.FromContext(ctx)
+
+	l.Info("running local %s update module generation of %s:\n%s",
+		c.kind(), c.Input, c.dumpArgs())
+
+	dir, err := ioutil.TempDir(c.Workdir, "single-file")
+	if err != nil {
+		return errors.Wrapf(err, "failed to create temp dir under workdir %s", c.Workdir)
+	}
+	defer c.removeDir(ctx, dir)
+
+	// the generator names the file on the device after the input
+	input := filepath.Join(dir, c.FileName)
+	if err := copyFile(c.Input, input); err != nil {
+		return err
+	}
+
+	if err := c.generate(ctx, dir, input, c.Output); err != nil {
+		return err
+	}
+
+	f, err := os.Open(c.Output)
+	if err != nil {
+		return errors.Wrap(err, "failed to open the generated artifact")
+	}
+	defer f.Close()
+
+	a, err := artifact.Read(f)
+	if err != nil {
+		return errors.Wrap(err, "failed to read the generated artifact")
+	}
+
+	out := c.stdout
+	if out == nil {
+		out = os.Stdout
+	}
+	fmt.Fprintf(out, "Artifact %s\n%s", c.Output, a)
+
+	return nil
+}
+
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return errors.Wrap(err, "failed to open input")
+	}
+	defer in.Close()
+
+	out, err := os.Create(dst)
+	if err != nil {
+		return errors.Wrap(err, "failed to copy input")
+	}
+
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return errors.Wrap(err, "failed to copy input")
+	}
+
+	return errors.Wrap(out.Close(), "failed to copy input")
+}
+
+// generate runs the generator in dir, making output of input.
+func (c *SingleFileCmd) generate(ctx context.Context, dir, input, output string) error {
+	switch c.kind() {
+	case generatorMultiFile:
+		return c.generateMultiFile(ctx, dir, input, output)
+	case generatorDelta:
+		return c.generateDelta(ctx, dir, input, output)
+	case generatorModify:
+		return c.generateModify(ctx, input, output)
+	}
 
 	// run gen script
 	args := []string{
 		"-n", c.ArtifactName,
 		"-d", c.DestDir,
-		"-o", outfile,
+		"-o", output,
 	}
 	if c.SoftwareFilesystem != "" {
 		args = append(args, "--software-filesystem", c.SoftwareFilesystem)
@@ -305,44 +1042,297 @@ func (c *SingleFileCmd) Run() error {
 	for _, deviceType := range c.DeviceTypes {
 		args = append(args, "-t", deviceType)
 	}
-	args = append(args, downloadFile)
-	cmd := exec.Command("/usr/bin/single-file-artifact-gen", args...)
+	args = append(args, input)
+
+	return c.runGenerator(ctx, dir, output, c.Generator, args)
+}
+
+// runGenerator runs the generator, or another tool named name, in dir
+// with args, making output.
+func (c *SingleFileCmd) runGenerator(
+	ctx context.Context,
+	dir, output, name string,
+	args []string,
+) error {
+	sl := mlog.FromContext(ctx).With("stage", "generate")
+	sl.Debug("generating output artifact %s", output)
+
+	// the output goes to the log line by line, and into the error
+	var std bytes.Buffer
+	genLog := sl.Writer(mlog.LevelDebug)
 
-	std, err := cmd.CombinedOutput()
-	mlog.Info(string(std))
+	start := time.Now()
+	_, span := tracing.Start(ctx, "generator",
+		attribute.String("generator", name))
+	// the artifact's final size isn't known, only what's written so far
+	tr := c.Progress.Start(ctx, progress.StageGenerate, 0)
+	tr.WatchFile(output)
+	// the generator processes tenant input, it runs sandboxed in the
+	// job's temp dir
+	err := sandbox.Run(ctx, c.Sandbox, dir, io.MultiWriter(&std, genLog),
+		name, args...)
+	tr.Done()
+	genLog.Close()
+	tracing.End(span, err)
 	if err != nil {
-		return errors.Wrapf(err, "single-file-artifact-gen exited with error %s", std)
+		return errors.Wrapf(err, "%s exited with error %s", filepath.Base(name), std.String())
 	}
+	sl.With("duration", time.Since(start)).Info("generated artifact")
 
-	mlog.Verbose("deleting temp file from S3")
+	return nil
+}
 
-	err = cs3.Delete(ctx, c.DelArtifactUri)
-	if err != nil {
-		return errors.Wrapf(err, "failed to delete artifact at %s", c.DelArtifactUri)
+func (c *SingleFileCmd) deleteInput(ctx context.Context, cs3 client.Storage) error {
+	// a modified artifact's source is kept unless asked to delete it
+	if c.DelArtifactUri == "" {
+		return nil
 	}
 
-	mlog.Verbose("uploading generated artifact")
-	err = cd.UploadArtifactInternal(ctx, outfile, c.ArtifactId, c.TenantId, c.Description)
+	ctx, span := tracing.Start(ctx, "storage.Delete")
+	err := cs3.Delete(ctx, c.DelArtifactUri)
+	tracing.End(span, err)
+
+	return err
+}
+
+func (c *SingleFileCmd) upload(ctx context.Context, cd client.Deployments, path string) error {
+	var err error
+
+	switch {
+	case c.PutArtifactUri != "" || c.DirectUpload:
+		ctx, span := tracing.Start(ctx, "upload.Direct")
+		err = c.uploadDirect(ctx, cd, path)
+		tracing.End(span, err)
+	case c.UploadApi == uploadApiManagement:
+		ctx, span := tracing.Start(ctx, "deployments.UploadArtifact")
+		err = cd.UploadArtifact(ctx, path, c.ArtifactId, c.Description)
+		tracing.End(span, err)
+	default:
+		ctx, span := tracing.Start(ctx, "deployments.UploadArtifactInternal")
+		err = cd.UploadArtifactInternal(ctx, path, c.ArtifactId, c.TenantId, c.Description)
+		tracing.End(span, err)
+	}
+
+	return err
+}
+
+// lookupArtifact returns the artifact if it's been uploaded already;
+// errors are only logged - the upload will tell if there's a conflict.
+func (c *SingleFileCmd) lookupArtifact(ctx context.Context, cd client.Deployments) *client.Artifact {
+	a, err := cd.GetArtifact(ctx, c.ArtifactId, c.TenantId)
 	if err != nil {
-		return errors.Wrapf(err, "failed to upload generated artifact")
+		if !errors.Is(err, client.ErrArtifactNotFound) {
+			mlog.FromContext(ctx).Error("failed to look up artifact: %s", err.Error())
+		}
+		return nil
+	}
+
+	return a
+}
+
+// uploadedAs tells if a, looked up before the input turned out to be gone,
+// is what this job uploads, as far as can be told without the input: the
+// name, device types and description, and for a single file its name.
+func (c *SingleFileCmd) uploadedAs(a *client.Artifact) bool {
+	if a == nil || a.Name != c.ArtifactName {
+		return false
+	}
+
+	deviceTypes := c.DeviceTypes
+	if c.kind() == generatorModify {
+		// the input's own unless changed
+		deviceTypes = c.Modification.DeviceTypes
+	} else if a.Description != c.Description {
+		return false
+	}
+	if len(deviceTypes) > 0 && !sameStrings(a.DeviceTypesCompatible, deviceTypes) {
+		return false
+	}
+
+	return c.kind() != generatorSingleFile || a.File(c.FileName) != nil
+}
+
+// checkExisting verifies an already uploaded artifact is the one this
+// job generates: same name and the same input file, or files of the input
+// archive, as payload; for a delta, the same base and target; for a
+// modified artifact, the name and device types.
+func (c *SingleFileCmd) checkExisting(
+	ctx context.Context,
+	a *client.Artifact,
+	input string,
+) error {
+	if c.kind() == generatorModify {
+		return c.checkExistingModify(a, input)
+	}
+
+	if a.Name != c.ArtifactName {
+		return errors.Wrapf(client.ErrArtifactConflict,
+			"artifact %s exists with name %q", c.ArtifactId, a.Name)
+	}
+
+	switch c.kind() {
+	case generatorMultiFile:
+		return c.checkExistingFiles(a, input)
+	case generatorDelta:
+		return c.checkExistingDelta(ctx, a, input)
 	}
 
-	err = os.RemoveAll(downloadDir)
+	f := a.File(c.FileName)
+	if f == nil {
+		return errors.Wrapf(client.ErrArtifactConflict,
+			"artifact %s exists without file %s", c.ArtifactId, c.FileName)
+	}
+
+	_, checksum, err := c.fileChecksum(ctx, input)
 	if err != nil {
-		mlog.Error("failed to remove temp working dir %s: %v", downloadDir, err.Error())
+		return err
+	}
+
+	if f.Checksum != checksum {
+		return errors.Wrapf(client.ErrArtifactConflict,
+			"artifact %s exists with a different %s (checksum %s, expected %s)",
+			c.ArtifactId, c.FileName, f.Checksum, checksum)
 	}
 
 	return nil
 }
 
+func (c *SingleFileCmd) removeDir(ctx context.Context, dir string) {
+	err := os.RemoveAll(dir)
+	if err != nil {
+		mlog.FromContext(ctx).Error("failed to remove temp working dir %s: %v", dir, err.Error())
+	}
+}
+
+// reportStatus lets deployments know how the job is going; it's best
+// effort, failing to report doesn't fail the job.
+func (c *SingleFileCmd) reportStatus(
+	ctx context.Context,
+	cd client.Deployments,
+	status, reason string,
+) {
+	if !c.ReportStatus {
+		return
+	}
+
+	err := cd.ReportStatus(ctx, c.ArtifactId, c.TenantId, &client.JobStatus{
+		Status: status,
+		Reason: reason,
+	})
+	if err != nil {
+		mlog.FromContext(ctx).Error("failed to report status %s: %s", status, err.Error())
+	}
+}
+
+// uploadDirect uploads the artifact straight to the object storage - to
+// --put-artifact-uri or a link handed out by deployments - and then lets
+// deployments know it's there.
+func (c *SingleFileCmd) uploadDirect(ctx context.Context, cd client.Deployments, path string) error {
+	size, checksum, err := c.fileChecksum(ctx, path)
+	if err != nil {
+		return err
+	}
+
+	link := &client.UploadLink{Uri: c.PutArtifactUri}
+	if link.Uri == "" {
+		link, err = cd.GetUploadLink(ctx, c.ArtifactId, c.TenantId, size)
+		if err != nil {
+			return err
+		}
+	}
+
+	complete := &client.UploadComplete{
+		ArtifactId:  c.ArtifactId,
+		Size:        size,
+		Checksum:    checksum,
+		Description: c.Description,
+	}
+
+	if len(link.PartUris) > 0 {
+		st, err := client.NewStorageForUrl(link.PartUris[0], c.storageConfig())
+		if err != nil {
+			return errors.Wrap(err, "failed to configure storage client")
+		}
+
+		mu, ok := st.(client.MultipartUploader)
+		if !ok {
+			return errors.New("storage doesn't support multipart uploads")
+		}
+
+		mlog.FromContext(ctx).Debug("uploading artifact in %d parts", len(link.PartUris))
+		complete.Parts, err = mu.UploadParts(ctx, link.PartUris, link.PartSize, path)
+		if err != nil {
+			return err
+		}
+	} else {
+		st, err := client.NewStorageForUrl(link.Uri, c.storageConfig())
+		if err != nil {
+			return errors.Wrap(err, "failed to configure storage client")
+		}
+
+		err = st.Upload(ctx, link.Uri, path)
+		if err != nil {
+			return err
+		}
+	}
+
+	return cd.CompleteUpload(ctx, c.TenantId, complete)
+}
+
+func (c *SingleFileCmd) storageConfig() client.StorageConfig {
+	return client.StorageConfig{
+		Kind:     c.StorageType,
+		HTTP:     c.httpConfig(),
+		FileRoot: c.FileRoot,
+		Download: c.Download,
+	}
+}
+
+func (c *SingleFileCmd) httpConfig() client.HTTPConfig {
+	return c.HTTP
+}
+
+// fileChecksum returns the size and hex sha256 of a file.
+func (c *SingleFileCmd) fileChecksum(ctx context.Context, path string) (int64, string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, "", errors.Wrapf(err, "cannot read file %s", path)
+	}
+	defer f.Close()
+
+	var total int64
+	if fi, err := f.Stat(); err == nil {
+		total = fi.Size()
+	}
+
+	tr := c.Progress.Start(ctx, progress.StageChecksum, total)
+	defer tr.Done()
+
+	h := sha256.New()
+	n, err := io.Copy(h, tr.Reader(f))
+	if err != nil {
+		return 0, "", errors.Wrapf(err, "cannot read file %s", path)
+	}
+
+	return n, hex.EncodeToString(h.Sum(nil)), nil
+}
+
 func (c *SingleFileCmd) dumpArgs() string {
-	return dumpArg(argArtifactName, c.ArtifactName) +
+	// pre-signed uris grant access to tenant data until they expire
+	var base string
+	if c.kind() == generatorDelta {
+		base = dumpArg(argBaseArtifactUri, mlog.RedactURL(c.BaseArtifactUri))
+	}
+
+	return base +
+		dumpArg(argArtifactName, c.ArtifactName) +
 		dumpArg(argDescription, c.Description) +
 		dumpArg(argArtifactId, c.ArtifactId) +
 		dumpArg(argDeviceType, strings.Join(c.DeviceTypes, ",")) +
 		dumpArg(argTenantId, c.TenantId) +
-		dumpArg(argGetArtifactUri, c.GetArtifactUri) +
-		dumpArg(argDelArtifactUri, c.DelArtifactUri) +
+		dumpArg(argGetArtifactUri, mlog.RedactURL(c.GetArtifactUri)) +
+		dumpArg(argDelArtifactUri, mlog.RedactURL(c.DelArtifactUri)) +
+		dumpArg(argPutArtifactUri, mlog.RedactURL(c.PutArtifactUri)) +
 		dumpArg(argArgs, c.Args)
 }
 
@@ -0,0 +1,700 @@
+// Copyright 2024 Northern.tech AS
+//
+//	Licensed under the Apache License, Version 2.0 (the "License");
+//	you may not use this file except in compliance with the License.
+//	You may obtain a copy of the License at
+//
+//	    http://www.apache.org/licenses/LICENSE-2.0
+//
+//	Unless required by applicable law or agreed to in writing, software
+//	distributed under the License is distributed on an "AS IS" BASIS,
+//	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//	See the License for the specific language governing permissions and
+//	limitations under the License.
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel"
+
+	"github.com/mendersoftware/create-artifact-worker/client"
+	mlog "github.com/mendersoftware/create-artifact-worker/log"
+	"github.com/mendersoftware/create-artifact-worker/progress"
+)
+
+const (
+	fakeGenerator = `#!/bin/sh
+while [ $# -gt 0 ]; do
+	case "$1" in
+		-o) out="$2"; shift;;
+	esac
+	shift
+done
+echo generated > "$out"
+echo "Writing Artifact..."
+echo "Done"
+`
+	failingGenerator = `#!/bin/sh
+echo "no space left on device"
+exit 1
+`
+	// artifactGenerator makes a real, if minimal, v3 artifact
+	artifactGenerator = `#!/bin/sh
+set -e
+while [ $# -gt 0 ]; do
+	case "$1" in
+		-o) out="$2"; shift;;
+		-n) name="$2"; shift;;
+		-t) dt="$2"; shift;;
+		-d) shift;;
+		*) in="$1";;
+	esac
+	shift
+done
+mkdir -p a/headers/0000 a/data d
+cd a
+echo '{"format":"mender","version":3}' > version
+printf '{"payloads":[{"type":"single-file"}],"artifact_provides":{"artifact_name":"%s"},' "$name" > header-info
+printf '"artifact_depends":{"device_type":["%s"]}}' "$dt" >> header-info
+echo '{"type":"single-file"}' > headers/0000/type-info
+tar czf header.tar.gz header-info headers
+cp "$in" ../d/
+tar czf data/0000.tar.gz -C ../d "$(basename "$in")"
+sha256sum version header.tar.gz data/0000.tar.gz > manifest
+tar cf "$out" version manifest header.tar.gz data/0000.tar.gz
+`
+)
+
+// fakeDeployments records the job statuses and uploads
+type fakeDeployments struct {
+	sync.Mutex
+
+	statuses []client.JobStatus
+	uploads  []string
+
+	// artifact is returned on lookups, 404 if nil
+	artifact *client.Artifact
+	// artifacts are returned on lookups by id, instead of artifact
+	artifacts map[string]*client.Artifact
+	// conflict makes uploads fail with 409
+	conflict bool
+
+	traceparents []string
+}
+
+func (f *fakeDeployments) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.Lock()
+	defer f.Unlock()
+
+	f.traceparents = append(f.traceparents, r.Header.Get("traceparent"))
+
+	switch {
+	case strings.HasSuffix(r.URL.Path, "/status"):
+		s := client.JobStatus{}
+		_ = json.NewDecoder(r.Body).Decode(&s)
+		f.statuses = append(f.statuses, s)
+		w.WriteHeader(http.StatusNoContent)
+	case r.Method == http.MethodGet && strings.Contains(r.URL.Path, "/artifacts/"):
+		a := f.artifact
+		if f.artifacts != nil {
+			a = f.artifacts[path.Base(r.URL.Path)]
+		}
+		if a == nil {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		_ = json.NewEncoder(w).Encode(a)
+	case strings.HasSuffix(r.URL.Path, "/artifacts") && f.conflict:
+		w.WriteHeader(http.StatusConflict)
+	case strings.HasSuffix(r.URL.Path, "/artifacts"):
+		_ = r.ParseMultipartForm(1024)
+		f.uploads = append(f.uploads, r.FormValue("artifact_id"))
+		w.WriteHeader(http.StatusCreated)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func (f *fakeDeployments) status() []string {
+	f.Lock()
+	defer f.Unlock()
+
+	var s []string
+	for _, st := range f.statuses {
+		s = append(s, st.Status)
+	}
+	return s
+}
+
+func newStorageServer(t *testing.T) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			_, _ = w.Write([]byte("input file"))
+		case http.MethodDelete:
+			w.WriteHeader(http.StatusNoContent)
+		}
+	}))
+}
+
+func newTestSingleFileCmd(t *testing.T, deplUrl, storageUrl, generator string) *SingleFileCmd {
+	dir := t.TempDir()
+
+	gen := filepath.Join(dir, "generator")
+	assert.NoError(t, ioutil.WriteFile(gen, []byte(generator), 0755))
+
+	return &SingleFileCmd{
+		DeploymentsUrl: deplUrl,
+		Workdir:        dir,
+		StorageType:    client.StorageS3,
+		UploadApi:      uploadApiInternal,
+		ReportStatus:   true,
+		Generator:      gen,
+
+		ArtifactName:   "name",
+		DeviceTypes:    []string{"dt"},
+		ArtifactId:     "aid",
+		GetArtifactUri: storageUrl + "/input?X-Amz-Signature=s3cr3t-get",
+		DelArtifactUri: storageUrl + "/input?X-Amz-Signature=s3cr3t-delete",
+		TenantId:       "tid",
+
+		FileName: "file",
+		DestDir:  "/etc",
+	}
+}
+
+func TestSingleFileCmdRunReportsStatus(t *testing.T) {
+	tc := map[string]struct {
+		generator string
+
+		statuses []string
+		uploads  []string
+		reason   string
+		err      string
+	}{
+		"ok": {
+			generator: fakeGenerator,
+			statuses: []string{
+				client.StatusDownloading,
+				client.StatusGenerating,
+				client.StatusUploading,
+				client.StatusDone,
+			},
+			uploads: []string{"aid"},
+		},
+		"generator fails": {
+			generator: failingGenerator,
+			statuses: []string{
+				client.StatusDownloading,
+				client.StatusGenerating,
+				client.StatusFailed,
+			},
+			reason: "no space left on device",
+			err:    "exited with error",
+		},
+	}
+
+	for name, tc := range tc {
+		t.Run(name, func(t *testing.T) {
+			depl := &fakeDeployments{}
+			deplServer := httptest.NewServer(depl)
+			defer deplServer.Close()
+
+			storage := newStorageServer(t)
+			defer storage.Close()
+
+			c := newTestSingleFileCmd(t, deplServer.URL, storage.URL, tc.generator)
+
+			err := c.Run()
+			if tc.err != "" {
+				assert.Error(t, err)
+				assert.Contains(t, err.Error(), tc.err)
+			} else {
+				assert.NoError(t, err)
+			}
+
+			assert.Equal(t, tc.statuses, depl.status())
+			assert.Equal(t, tc.uploads, depl.uploads)
+
+			last := depl.statuses[len(depl.statuses)-1]
+			assert.Contains(t, last.Reason, tc.reason)
+		})
+	}
+}
+
+func TestSingleFileCmdRunExistingArtifact(t *testing.T) {
+	sum := sha256.Sum256([]byte("input file"))
+	checksum := hex.EncodeToString(sum[:])
+
+	artifact := func(name, checksum string) *client.Artifact {
+		return &client.Artifact{
+			Id:                    "aid",
+			Name:                  name,
+			DeviceTypesCompatible: []string{"dt"},
+			Updates: []client.Update{{
+				Files: []client.UpdateFile{{Name: "file", Checksum: checksum}},
+			}},
+		}
+	}
+
+	tc := map[string]struct {
+		artifact *client.Artifact
+		conflict bool
+		// the status of downloading the input, if it fails
+		download int
+
+		uploads  []string
+		conflErr bool
+		err      string
+	}{
+		"already uploaded": {
+			artifact: artifact("name", checksum),
+		},
+		"already uploaded, input gone": {
+			artifact: artifact("name", checksum),
+			download: http.StatusNotFound,
+		},
+		"input gone, other device types": {
+			artifact: func() *client.Artifact {
+				a := artifact("name", checksum)
+				a.DeviceTypesCompatible = []string{"other"}
+				return a
+			}(),
+			download: http.StatusNotFound,
+			err:      "failed to download input file",
+		},
+		"input gone, other file": {
+			artifact: func() *client.Artifact {
+				a := artifact("name", checksum)
+				a.Updates[0].Files[0].Name = "other"
+				return a
+			}(),
+			download: http.StatusNotFound,
+			err:      "failed to download input file",
+		},
+		"download fails": {
+			artifact: artifact("name", checksum),
+			download: http.StatusInternalServerError,
+			err:      "failed to download input file",
+		},
+		"download forbidden": {
+			artifact: artifact("name", checksum),
+			download: http.StatusForbidden,
+			err:      "failed to download input file",
+		},
+		"different input": {
+			artifact: artifact("name", "deadbeef"),
+			conflErr: true,
+		},
+		"different name": {
+			artifact: artifact("other", checksum),
+			conflErr: true,
+		},
+		"upload conflict": {
+			conflict: true,
+			conflErr: true,
+		},
+	}
+
+	for name, tc := range tc {
+		t.Run(name, func(t *testing.T) {
+			depl := &fakeDeployments{
+				artifact: tc.artifact,
+				conflict: tc.conflict,
+			}
+			deplServer := httptest.NewServer(depl)
+			defer deplServer.Close()
+
+			var storage *httptest.Server
+			if tc.download != 0 {
+				storage = httptest.NewServer(http.HandlerFunc(
+					func(w http.ResponseWriter, r *http.Request) {
+						w.WriteHeader(tc.download)
+					}))
+			} else {
+				storage = newStorageServer(t)
+			}
+			defer storage.Close()
+
+			// generating again must not be needed
+			gen := failingGenerator
+			if tc.conflict {
+				gen = fakeGenerator
+			}
+			c := newTestSingleFileCmd(t, deplServer.URL, storage.URL, gen)
+
+			err := c.Run()
+			if tc.err != "" {
+				assert.Error(t, err)
+				assert.Contains(t, err.Error(), tc.err)
+			} else if tc.conflErr {
+				assert.True(t, errors.Is(err, client.ErrArtifactConflict), "%v", err)
+				assert.Equal(t, exitCodeConflict, exitCode(err))
+			} else {
+				assert.NoError(t, err)
+			}
+
+			assert.Equal(t, tc.uploads, depl.uploads)
+		})
+	}
+}
+
+type notFoundDeployments struct {
+	client.Deployments
+}
+
+func (notFoundDeployments) GetArtifact(ctx context.Context, aid, tid string) (*client.Artifact, error) {
+	return nil, errors.Wrap(client.ErrArtifactNotFound, "wrapped")
+}
+
+func TestSingleFileCmdLookupArtifactNotFound(t *testing.T) {
+	var out bytes.Buffer
+	mlog.SetOutput(&out)
+	defer mlog.SetOutput(os.Stderr)
+
+	c := newTestSingleFileCmd(t, "http://deployments", "http://storage", fakeGenerator)
+	assert.Nil(t, c.lookupArtifact(context.Background(), notFoundDeployments{}))
+	// not finding it is the usual first run
+	assert.NotContains(t, out.String(), "failed to look up artifact")
+}
+
+func TestSingleFileCmdRunLogsGeneratorOutput(t *testing.T) {
+	var out bytes.Buffer
+	mlog.SetOutput(&out)
+	assert.NoError(t, mlog.Init(mlog.FormatJSON, "debug"))
+	defer func() {
+		mlog.SetOutput(os.Stderr)
+		_ = mlog.Init(mlog.FormatLogfmt, "info")
+	}()
+
+	depl := &fakeDeployments{}
+	deplServer := httptest.NewServer(depl)
+	defer deplServer.Close()
+
+	storage := newStorageServer(t)
+	defer storage.Close()
+
+	c := newTestSingleFileCmd(t, deplServer.URL, storage.URL, fakeGenerator)
+	assert.NoError(t, c.Run())
+
+	var lines []string
+	for _, l := range strings.Split(strings.TrimSpace(out.String()), "\n") {
+		e := map[string]interface{}{}
+		assert.NoError(t, json.Unmarshal([]byte(l), &e))
+
+		assert.Equal(t, "aid", e["artifact_id"])
+		assert.Equal(t, "tid", e["tenant_id"])
+
+		if e["stage"] == "generate" && e["level"] == "debug" {
+			lines = append(lines, e["msg"].(string))
+		}
+	}
+
+	assert.Contains(t, lines, "Writing Artifact...")
+	assert.Contains(t, lines, "Done")
+}
+
+func TestSingleFileCmdRunRedactsSecrets(t *testing.T) {
+	var out bytes.Buffer
+	mlog.SetOutput(&out)
+	assert.NoError(t, mlog.Init(mlog.FormatLogfmt, "debug"))
+	defer func() {
+		mlog.SetOutput(os.Stderr)
+		_ = mlog.Init(mlog.FormatLogfmt, "info")
+	}()
+
+	depl := &fakeDeployments{}
+	deplServer := httptest.NewServer(depl)
+	defer deplServer.Close()
+
+	storage := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusForbidden)
+		_, _ = w.Write([]byte("<Error><Code>AccessDenied</Code></Error>"))
+	}))
+	defer storage.Close()
+
+	c := newTestSingleFileCmd(t, deplServer.URL, storage.URL, fakeGenerator)
+	c.PutArtifactUri = storage.URL + "/output?X-Amz-Signature=s3cr3t-put"
+
+	err := c.Run()
+	assert.Error(t, err)
+	mlog.Error(err.Error())
+
+	assert.Contains(t, out.String(), "X-Amz-Signature=xxxxx")
+	assert.NotContains(t, out.String(), "s3cr3t")
+
+	for _, s := range depl.statuses {
+		assert.NotContains(t, s.Reason, "s3cr3t")
+	}
+	assert.Contains(t, depl.statuses[len(depl.statuses)-1].Reason, "AccessDenied")
+}
+
+func TestSingleFileCmdRunExportsMetrics(t *testing.T) {
+	depl := &fakeDeployments{}
+	deplServer := httptest.NewServer(depl)
+	defer deplServer.Close()
+
+	storage := newStorageServer(t)
+	defer storage.Close()
+
+	textfile := filepath.Join(t.TempDir(), "create_artifact.prom")
+
+	c := newTestSingleFileCmd(t, deplServer.URL, storage.URL, failingGenerator)
+	c.Metrics.Textfile = textfile
+	assert.Error(t, c.Run())
+
+	b, err := ioutil.ReadFile(textfile)
+	assert.NoError(t, err)
+	assert.Contains(t, string(b), `create_artifact_failures_total{`+
+		`class="generator",generator="single-file",stage="generate"}`)
+	assert.Contains(t, string(b), `create_artifact_downloaded_bytes_total{generator="single-file"}`)
+}
+
+func TestSingleFileCmdRunReportsProgress(t *testing.T) {
+	var mu sync.Mutex
+	final := map[string]progress.Update{}
+	callback := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		u := progress.Update{}
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&u))
+
+		mu.Lock()
+		defer mu.Unlock()
+		if u.Done {
+			final[u.Stage] = u
+		}
+	}))
+	defer callback.Close()
+
+	depl := &fakeDeployments{}
+	deplServer := httptest.NewServer(depl)
+	defer deplServer.Close()
+
+	storage := newStorageServer(t)
+	defer storage.Close()
+
+	c := newTestSingleFileCmd(t, deplServer.URL, storage.URL, fakeGenerator)
+	c.Progress.Interval = time.Hour
+	c.Progress.CallbackUrl = callback.URL
+
+	assert.NoError(t, c.Run())
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	assert.Len(t, final, 3)
+
+	// "input file"
+	assert.Equal(t, int64(10), final[progress.StageDownload].Bytes)
+	assert.Equal(t, "aid", final[progress.StageDownload].ArtifactId)
+	assert.Equal(t, "tid", final[progress.StageDownload].TenantId)
+
+	// "generated\n"
+	assert.Equal(t, int64(10), final[progress.StageGenerate].Bytes)
+
+	// the multipart form around the artifact
+	up := final[progress.StageUpload]
+	assert.True(t, up.Bytes > 10)
+	assert.Equal(t, up.Total, up.Bytes)
+	assert.Equal(t, float64(100), up.Percent)
+}
+
+func TestSingleFileCmdRunTraces(t *testing.T) {
+	prev := otel.GetTracerProvider()
+	defer otel.SetTracerProvider(prev)
+
+	var mu sync.Mutex
+	var exported int
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		if r.URL.Path == "/v1/traces" {
+			exported++
+		}
+	}))
+	defer collector.Close()
+
+	depl := &fakeDeployments{}
+	deplServer := httptest.NewServer(depl)
+	defer deplServer.Close()
+
+	storage := newStorageServer(t)
+	defer storage.Close()
+
+	c := newTestSingleFileCmd(t, deplServer.URL, storage.URL, fakeGenerator)
+	c.Tracing.Endpoint = collector.URL
+	c.Traceparent = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+
+	assert.NoError(t, c.Run())
+
+	assert.NotEmpty(t, depl.traceparents)
+	for _, tp := range depl.traceparents {
+		// same trace, but a span of the job as parent
+		assert.Regexp(t, "^00-4bf92f3577b34da6a3ce929d0e0e4736-[0-9a-f]{16}-01$", tp)
+		assert.NotEqual(t, c.Traceparent, tp)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Equal(t, 1, exported)
+}
+
+func TestSingleFileCmdRunLocal(t *testing.T) {
+	dir := t.TempDir()
+	input := filepath.Join(dir, "input.conf")
+	assert.NoError(t, ioutil.WriteFile(input, []byte("input file"), 0644))
+
+	// no deployments, storage, token or tenant
+	c := newTestSingleFileCmd(t, "http://localhost:1", "http://localhost:1", artifactGenerator)
+	c.AuthToken = ""
+	c.TenantId = "tid"
+	c.ArtifactId = ""
+	c.GetArtifactUri = ""
+	c.DelArtifactUri = ""
+	c.Args = `{"filename":"app.conf","dest_dir":"/etc"}`
+	c.Input = input
+	c.Output = filepath.Join(dir, "out.mender")
+
+	var out bytes.Buffer
+	c.stdout = &out
+
+	assert.NoError(t, c.Validate())
+	assert.NoError(t, c.Run())
+
+	assert.Equal(t, "Artifact "+c.Output+`
+Format: mender, version 3
+Compression: gzip
+Signature: no
+Name: name
+Compatible devices: dt
+Provides:
+  artifact_name: name
+Depends:
+  device_type: dt
+Payload 0: single-file
+  Files:
+    app.conf (10 bytes, sha256 ae2132f49016c5f7de1dbdcae027fcd4da86de355e3d1cfaf3d46e9005d14241)
+`, out.String())
+
+	// the temp dir is gone
+	dirs, _ := filepath.Glob(filepath.Join(c.Workdir, "single-file*"))
+	assert.Empty(t, dirs)
+}
+
+func TestSingleFileCmdValidateLocal(t *testing.T) {
+	dir := t.TempDir()
+	input := filepath.Join(dir, "input")
+	assert.NoError(t, ioutil.WriteFile(input, []byte("input file"), 0644))
+
+	testCases := map[string]struct {
+		input  string
+		output string
+
+		err string
+	}{
+		"ok": {
+			input:  input,
+			output: "out.mender",
+		},
+		"no output": {
+			input: input,
+			err:   "a local run needs both an input and an output",
+		},
+		"missing input": {
+			input:  filepath.Join(dir, "missing"),
+			output: "out.mender",
+			err:    "invalid input",
+		},
+		"input is a dir": {
+			input:  dir,
+			output: "out.mender",
+			err:    "isn't a regular file",
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			c := newTestSingleFileCmd(t, "http://localhost:1", "http://localhost:1", fakeGenerator)
+			c.AuthToken = ""
+			c.Args = `{"filename":"file","dest_dir":"/etc"}`
+			c.Input = tc.input
+			c.Output = tc.output
+
+			err := c.Validate()
+			if tc.err != "" {
+				assert.Error(t, err)
+				assert.Contains(t, err.Error(), tc.err)
+				return
+			}
+
+			assert.NoError(t, err)
+			assert.True(t, filepath.IsAbs(c.Output))
+		})
+	}
+}
+
+func TestSingleFileCmdLocalFlags(t *testing.T) {
+	testCases := map[string]struct {
+		args []string
+
+		err string
+	}{
+		"local": {
+			args: []string{"--input", "in", "--output", "out",
+				"--artifact-name", "name", "--device-type", "dt", "--args", "{}"},
+		},
+		"local without output": {
+			args: []string{"--input", "in",
+				"--artifact-name", "name", "--device-type", "dt", "--args", "{}"},
+			err: "if any flags in the group [input output] are set they must all be set; missing [output]",
+		},
+		"online": {
+			args: []string{"--artifact-name", "name", "--device-type", "dt", "--args", "{}"},
+			err:  `required flag(s) "artifact-id", "delete-artifact-uri", "get-artifact-uri", "tenant-id", "token" not set`,
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			cmd := &cobra.Command{PreRunE: singleFileCmd.PreRunE}
+			cmd.Flags().AddFlagSet(singleFileCmd.Flags())
+			cmd.Flags().VisitAll(func(f *pflag.Flag) {
+				f.Changed = false
+				if required, ok := f.Annotations[cobra.BashCompOneRequiredFlag]; ok && required[0] == "false" {
+					f.Annotations[cobra.BashCompOneRequiredFlag] = []string{"true"}
+				}
+			})
+
+			assert.NoError(t, cmd.ParseFlags(tc.args))
+			assert.NoError(t, cmd.PreRunE(cmd, nil))
+
+			err := cmd.ValidateRequiredFlags()
+			if err == nil {
+				err = cmd.ValidateFlagGroups()
+			}
+			if tc.err != "" {
+				assert.EqualError(t, err, tc.err)
+				return
+			}
+			assert.NoError(t, err)
+		})
+	}
+}
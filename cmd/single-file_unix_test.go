@@ -0,0 +1,159 @@
+// Copyright 2024 Northern.tech AS
+//
+//	Licensed under the Apache License, Version 2.0 (the "License");
+//	you may not use this file except in compliance with the License.
+//	You may obtain a copy of the License at
+//
+//	    http://www.apache.org/licenses/LICENSE-2.0
+//
+//	Unless required by applicable law or agreed to in writing, software
+//	distributed under the License is distributed on an "AS IS" BASIS,
+//	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//	See the License for the specific language governing permissions and
+//	limitations under the License.
+
+//go:build unix
+
+package cmd
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/mendersoftware/create-artifact-worker/client"
+	"github.com/mendersoftware/create-artifact-worker/sandbox"
+)
+
+// alive tells if the process is running, zombies aside
+func alive(pid int) bool {
+	stat, err := ioutil.ReadFile("/proc/" + strconv.Itoa(pid) + "/stat")
+	if err != nil {
+		return false
+	}
+
+	// pid (comm) state ...
+	fields := strings.Fields(string(stat[strings.LastIndexByte(string(stat), ')')+1:]))
+	return len(fields) > 0 && fields[0] != "Z"
+}
+
+func TestSingleFileCmdRunCancelled(t *testing.T) {
+	if _, err := os.Stat("/proc/self/stat"); err != nil {
+		t.Skip("needs /proc")
+	}
+
+	depl := &fakeDeployments{}
+	deplServer := httptest.NewServer(depl)
+	defer deplServer.Close()
+
+	storage := newStorageServer(t)
+	defer storage.Close()
+
+	// the generator hangs on a child of its own
+	pidFile := filepath.Join(t.TempDir(), "pid")
+	generator := "#!/bin/sh\nsleep 60 &\necho $! > " + pidFile + "\nwait\n"
+
+	c := newTestSingleFileCmd(t, deplServer.URL, storage.URL, generator)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- c.RunContext(ctx)
+	}()
+
+	var pid int
+	assert.Eventually(t, func() bool {
+		b, err := ioutil.ReadFile(pidFile)
+		if err != nil {
+			return false
+		}
+		pid, err = strconv.Atoi(strings.TrimSpace(string(b)))
+		return err == nil
+	}, 10*time.Second, 10*time.Millisecond)
+	assert.True(t, alive(pid))
+
+	cancel()
+
+	var err error
+	select {
+	case err = <-done:
+	case <-time.After(sandbox.KillDelay):
+		t.Fatal("the job didn't stop on cancellation")
+	}
+
+	assert.Contains(t, err.Error(), "job cancelled (context canceled)")
+	// the cause is kept: the generator was killed
+	var exitErr *exec.ExitError
+	assert.True(t, errors.As(err, &exitErr), "%v", err)
+	assert.Equal(t, "generator", errorClass(err))
+
+	// the generator's whole process group is gone
+	assert.Eventually(t, func() bool {
+		return !alive(pid)
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// the failure is reported despite the cancelled context
+	assert.Equal(t, []string{
+		client.StatusDownloading,
+		client.StatusGenerating,
+		client.StatusFailed,
+	}, depl.status())
+	assert.Contains(t, depl.statuses[2].Reason, "job cancelled")
+
+	// and the temp dir cleaned up
+	dirs, _ := filepath.Glob(filepath.Join(c.Workdir, "single-file*"))
+	assert.Empty(t, dirs)
+}
+
+func TestSingleFileCmdRunSandboxed(t *testing.T) {
+	t.Setenv("CREATE_ARTIFACT_SECRET", "s3cr3t")
+
+	depl := &fakeDeployments{}
+	deplServer := httptest.NewServer(depl)
+	defer deplServer.Close()
+
+	storage := newStorageServer(t)
+	defer storage.Close()
+
+	// the generator leaks its env, then writes too much
+	envFile := filepath.Join(t.TempDir(), "env")
+	generator := "#!/bin/sh\nenv > " + envFile + "\npwd >> " + envFile + "\n" +
+		"head -c 8192 /dev/zero > big\n"
+
+	c := newTestSingleFileCmd(t, deplServer.URL, storage.URL, generator)
+	c.Sandbox = sandbox.Config{FileSize: 4096}
+	c.Metrics.Textfile = filepath.Join(t.TempDir(), "create_artifact.prom")
+
+	err := c.Run()
+	assert.True(t, sandbox.IsLimit(err), "%v", err)
+	assert.Equal(t, "limit", errorClass(err))
+
+	assert.Equal(t, []string{
+		client.StatusDownloading,
+		client.StatusGenerating,
+		client.StatusFailed,
+	}, depl.status())
+	assert.Contains(t, depl.statuses[2].Reason, "exceeded the file size limit")
+
+	b, err := ioutil.ReadFile(c.Metrics.Textfile)
+	assert.NoError(t, err)
+	assert.Contains(t, string(b), `create_artifact_failures_total{`+
+		`class="limit",generator="single-file",stage="generate"}`)
+
+	// the generator ran in the job's temp dir, without our env
+	b, err = ioutil.ReadFile(envFile)
+	assert.NoError(t, err)
+	assert.NotContains(t, string(b), "s3cr3t")
+	assert.Contains(t, string(b), "HOME="+c.Workdir+"/single-file")
+	assert.Contains(t, string(b), "\n"+c.Workdir+"/single-file")
+}
@@ -0,0 +1,165 @@
+// Copyright 2024 Northern.tech AS
+//
+//	Licensed under the Apache License, Version 2.0 (the "License");
+//	you may not use this file except in compliance with the License.
+//	You may obtain a copy of the License at
+//
+//	    http://www.apache.org/licenses/LICENSE-2.0
+//
+//	Unless required by applicable law or agreed to in writing, software
+//	distributed under the License is distributed on an "AS IS" BASIS,
+//	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//	See the License for the specific language governing permissions and
+//	limitations under the License.
+package cmd
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+
+	"github.com/mendersoftware/create-artifact-worker/client"
+	"github.com/mendersoftware/create-artifact-worker/config"
+	mlog "github.com/mendersoftware/create-artifact-worker/log"
+	"github.com/mendersoftware/create-artifact-worker/tracing"
+	"github.com/mendersoftware/create-artifact-worker/worker"
+)
+
+const workflowGenerateArtifact = "generate_artifact"
+
+var workerCmd = &cobra.Command{
+	Use:   "worker",
+	Short: "Process generate_artifact workflow jobs from NATS JetStream.",
+	Long: "\nTakes the jobs the workflows service publishes to NATS JetStream and runs\n" +
+		"them in-process, like single-file would; the workflows service must know the\n" +
+		"workflows/generate_artifact.json definition and set up the stream. The\n" +
+		"durable consumer is added if it's missing, an existing one is kept as it is.\n" +
+		"Jobs join the trace of their traceparent and tracestate inputs.\n\n" +
+		"Supports the env vars of single-file, and the following:\n\n" +
+		"CREATE_ARTIFACT_NATS_URI nats server (default: nats://mender-nats:4222)\n" +
+		"CREATE_ARTIFACT_NATS_STREAM_NAME jetstream stream (default: WORKFLOWS)\n" +
+		"CREATE_ARTIFACT_NATS_SUBSCRIBER_TOPIC workflow topic (default: generate_artifact)\n" +
+		"CREATE_ARTIFACT_NATS_SUBSCRIBER_DURABLE durable consumer " +
+		"(default: create-artifact-worker)\n" +
+		"CREATE_ARTIFACT_WORKER_CONCURRENCY parallel jobs (default: 10)\n" +
+		"CREATE_ARTIFACT_WORKER_MAX_DELIVER attempts of a job (default: 3)\n" +
+		"CREATE_ARTIFACT_WORKER_DRAIN_TIMEOUT time to finish jobs on shutdown (default: 10m)\n",
+	Run: func(cmd *cobra.Command, args []string) {
+		c, err := NewWorkerCmd()
+		if err != nil {
+			mlog.Error(err.Error())
+			os.Exit(1)
+		}
+
+		err = c.Run()
+		if err != nil {
+			mlog.Error(err.Error())
+			os.Exit(1)
+		}
+	},
+}
+
+type WorkerCmd struct {
+	Worker  worker.Config
+	Tracing tracing.Config
+
+	// Job is the configuration of the jobs; each job fills in the rest
+	// from its input parameters.
+	Job SingleFileCmd
+}
+
+func NewWorkerCmd() (*WorkerCmd, error) {
+	c := &WorkerCmd{}
+
+	c.Job.initConfig()
+	c.Tracing = c.Job.Tracing
+	c.Worker = worker.Config{
+		Url:          viper.GetString(config.CfgNatsUri),
+		Stream:       viper.GetString(config.CfgNatsStreamName),
+		Topic:        viper.GetString(config.CfgNatsSubscriberTopic),
+		Durable:      viper.GetString(config.CfgNatsSubscriberDurable),
+		Concurrency:  viper.GetInt(config.CfgWorkerConcurrency),
+		MaxDeliver:   viper.GetInt(config.CfgWorkerMaxDeliver),
+		DrainTimeout: viper.GetDuration(config.CfgWorkerDrainTimeout),
+	}
+
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+func (c *WorkerCmd) Validate() error {
+	if err := config.ValidUrl(c.Worker.Url); err != nil {
+		return errors.Wrap(err, "invalid nats uri")
+	}
+
+	if c.Worker.Stream == "" || c.Worker.Topic == "" || c.Worker.Durable == "" {
+		return errors.New("nats stream, topic and durable can't be empty")
+	}
+
+	if c.Worker.Concurrency <= 0 {
+		return errors.New("worker concurrency must be positive")
+	}
+
+	if err := config.ValidAbsPath(c.Job.Workdir); err != nil {
+		return errors.Wrap(err, "invalid workdir")
+	}
+
+	// fail early on a broken ca bundle or client certificate
+	if _, err := client.NewTLSConfig(c.Job.TLS); err != nil {
+		return errors.Wrap(err, "invalid tls configuration")
+	}
+
+	if err := c.Job.Sandbox.Validate(); err != nil {
+		return errors.Wrap(err, "invalid sandbox configuration")
+	}
+
+	return nil
+}
+
+// Run processes jobs until SIGINT or SIGTERM, then drains.
+func (c *WorkerCmd) Run() error {
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	shutdown, err := tracing.Init(context.Background(), c.Tracing)
+	if err != nil {
+		return err
+	}
+	defer flushTraces(mlog.With(), shutdown)
+
+	mlog.Info("config:\n%s", config.Dump())
+
+	return c.RunContext(ctx)
+}
+
+func (c *WorkerCmd) RunContext(ctx context.Context) error {
+	return worker.New(c.Worker, c.handle).Run(ctx)
+}
+
+func (c *WorkerCmd) handle(ctx context.Context, j *worker.Job) error {
+	if j.WorkflowName != workflowGenerateArtifact {
+		return worker.Permanent(errors.Errorf("unsupported workflow %q", j.WorkflowName))
+	}
+
+	sc, err := c.Job.fromInputs(j.Input)
+	if err != nil {
+		return worker.Permanent(errors.Wrap(err, "invalid job"))
+	}
+	sc.Redelivered = j.Redelivered
+
+	err = sc.RunContext(ctx)
+	// a job cancelled by draining is left for another worker
+	if err != nil && !transient(ctx, err) {
+		return worker.Permanent(err)
+	}
+
+	return err
+}
@@ -0,0 +1,314 @@
+// Copyright 2024 Northern.tech AS
+//
+//	Licensed under the Apache License, Version 2.0 (the "License");
+//	you may not use this file except in compliance with the License.
+//	You may obtain a copy of the License at
+//
+//	    http://www.apache.org/licenses/LICENSE-2.0
+//
+//	Unless required by applicable law or agreed to in writing, software
+//	distributed under the License is distributed on an "AS IS" BASIS,
+//	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//	See the License for the specific language governing permissions and
+//	limitations under the License.
+package cmd
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats-server/v2/server"
+	"github.com/nats-io/nats.go"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/mendersoftware/create-artifact-worker/client"
+	"github.com/mendersoftware/create-artifact-worker/worker"
+)
+
+const testTraceparent = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+
+func testToken(tenant string) string {
+	return "eyJhbGciOiJSUzI1NiJ9." +
+		base64.RawURLEncoding.EncodeToString(
+			[]byte(`{"sub":"user","mender.tenant":"`+tenant+`"}`)) +
+		".c2lnbmF0dXJl"
+}
+
+func testJob(storageUrl string) *worker.Job {
+	return &worker.Job{
+		Id:           "job",
+		WorkflowName: workflowGenerateArtifact,
+		InputParameters: []worker.InputParameter{
+			{Name: inputArtifactId, Value: "aid"},
+			{Name: inputArtifactName, Value: "name"},
+			{Name: inputDelArtifactUri, Value: storageUrl + "/input?X-Amz-Signature=s3cr3t-delete"},
+			{Name: inputDescription, Value: "desc"},
+			{Name: inputDeviceTypes, Value: "dt1,dt2"},
+			{Name: inputGetArtifactUri, Value: storageUrl + "/input?X-Amz-Signature=s3cr3t-get"},
+			{Name: inputTenantId, Value: "tid"},
+			{Name: inputToken, Value: testToken("tid")},
+			{Name: inputArgs, Value: `{"filename":"file","dest_dir":"/etc"}`},
+			{Name: inputTraceparent, Value: testTraceparent},
+			{Name: inputTracestate, Value: "vendor=value"},
+		},
+	}
+}
+
+func withInput(j *worker.Job, name, value string) *worker.Job {
+	for i, p := range j.InputParameters {
+		if p.Name == name {
+			j.InputParameters[i].Value = value
+		}
+	}
+	return j
+}
+
+func newTestWorkerCmd(t *testing.T, natsUrl, deplUrl, storageUrl, generator string) *WorkerCmd {
+	return &WorkerCmd{
+		Worker: worker.Config{
+			Url:          natsUrl,
+			Stream:       "WORKFLOWS",
+			Topic:        workflowGenerateArtifact,
+			Durable:      "create-artifact-worker",
+			Concurrency:  1,
+			MaxDeliver:   1,
+			DrainTimeout: 10 * time.Second,
+		},
+		Job: *newTestSingleFileCmd(t, deplUrl, storageUrl, generator),
+	}
+}
+
+func TestSingleFileCmdFromInputs(t *testing.T) {
+	testCases := map[string]struct {
+		job *worker.Job
+
+		traceparent string
+		err         string
+	}{
+		"ok": {
+			job:         testJob("http://storage"),
+			traceparent: testTraceparent,
+		},
+		"ok, no trace context": {
+			job: withInput(withInput(testJob("http://storage"),
+				inputTraceparent, ""), inputTracestate, ""),
+		},
+		"missing input": {
+			job: withInput(testJob("http://storage"), inputGetArtifactUri, ""),
+			err: "missing input parameter get_artifact_uri",
+		},
+		"tenant mismatch": {
+			job: withInput(testJob("http://storage"), inputTenantId, "other"),
+			err: `token tenant "tid" doesn't match tenant id "other"`,
+		},
+		"invalid args": {
+			job: withInput(testJob("http://storage"), inputArgs, "{"),
+			err: "can't parse 'args'",
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			c := newTestWorkerCmd(t, "nats://localhost:4222", "http://deployments",
+				"http://storage", fakeGenerator)
+			// the worker's own trace context isn't the job's
+			c.Job.Traceparent = "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01"
+
+			sc, err := c.Job.fromInputs(tc.job.Input)
+			if tc.err != "" {
+				assert.Error(t, err)
+				assert.Contains(t, err.Error(), tc.err)
+				return
+			}
+
+			assert.NoError(t, err)
+			assert.Equal(t, "aid", sc.ArtifactId)
+			assert.Equal(t, "name", sc.ArtifactName)
+			assert.Equal(t, "desc", sc.Description)
+			assert.Equal(t, []string{"dt1", "dt2"}, sc.DeviceTypes)
+			assert.Equal(t, "http://storage/input?X-Amz-Signature=s3cr3t-get", sc.GetArtifactUri)
+			assert.Equal(t, "tid", sc.TenantId)
+			assert.Equal(t, "file", sc.FileName)
+			assert.Equal(t, "/etc", sc.DestDir)
+			assert.Equal(t, tc.traceparent, sc.Traceparent)
+			if tc.traceparent != "" {
+				assert.Equal(t, "vendor=value", sc.Tracestate)
+			} else {
+				assert.Empty(t, sc.Tracestate)
+			}
+
+			// the config is copied, not shared between jobs
+			assert.Equal(t, c.Job.Generator, sc.Generator)
+			assert.NotNil(t, sc.Claims)
+			assert.Nil(t, c.Job.Claims)
+		})
+	}
+}
+
+func TestWorkerCmdHandle(t *testing.T) {
+	depl := &fakeDeployments{}
+	deplServer := httptest.NewServer(depl)
+	defer deplServer.Close()
+
+	storage := newStorageServer(t)
+	defer storage.Close()
+
+	unavailable := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer unavailable.Close()
+
+	redelivered := func(j *worker.Job) *worker.Job {
+		j.Redelivered = true
+		return j
+	}
+
+	testCases := map[string]struct {
+		job       *worker.Job
+		generator string
+
+		permanent bool
+		err       bool
+		failed    bool
+	}{
+		"transient failure, redelivered": {
+			job:       redelivered(testJob(unavailable.URL)),
+			generator: fakeGenerator,
+			err:       true,
+		},
+		"transient failure, last delivery": {
+			job:       testJob(unavailable.URL),
+			generator: fakeGenerator,
+			err:       true,
+			failed:    true,
+		},
+		"ok": {
+			job:       testJob(storage.URL),
+			generator: fakeGenerator,
+		},
+		"unsupported workflow": {
+			job:       &worker.Job{WorkflowName: "provision_device"},
+			generator: fakeGenerator,
+			permanent: true,
+		},
+		"invalid job": {
+			job:       withInput(testJob(storage.URL), inputToken, "garbage"),
+			generator: fakeGenerator,
+			permanent: true,
+		},
+		"generator failure": {
+			job:       redelivered(testJob(storage.URL)),
+			generator: failingGenerator,
+			permanent: true,
+			failed:    true,
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			depl.Lock()
+			depl.statuses = nil
+			depl.Unlock()
+
+			c := newTestWorkerCmd(t, "nats://localhost:4222", deplServer.URL,
+				storage.URL, tc.generator)
+
+			err := c.handle(context.Background(), tc.job)
+			switch {
+			case tc.permanent:
+				assert.Error(t, err)
+				assert.True(t, worker.IsPermanent(err))
+			case tc.err:
+				assert.Error(t, err)
+				assert.False(t, worker.IsPermanent(err))
+			default:
+				assert.NoError(t, err)
+			}
+
+			// only a job that won't run again is reported failed
+			assert.Equal(t, tc.failed, contains(depl.status(), client.StatusFailed))
+		})
+	}
+}
+
+func TestWorkerCmdRun(t *testing.T) {
+	s, err := server.NewServer(&server.Options{
+		Host:      "127.0.0.1",
+		Port:      -1,
+		JetStream: true,
+		StoreDir:  t.TempDir(),
+	})
+	assert.NoError(t, err)
+	go s.Start()
+	if !s.ReadyForConnections(10 * time.Second) {
+		t.Fatal("nats-server not ready")
+	}
+	defer s.Shutdown()
+
+	depl := &fakeDeployments{}
+	deplServer := httptest.NewServer(depl)
+	defer deplServer.Close()
+
+	storage := newStorageServer(t)
+	defer storage.Close()
+
+	c := newTestWorkerCmd(t, s.ClientURL(), deplServer.URL, storage.URL, fakeGenerator)
+
+	nc, err := nats.Connect(s.ClientURL())
+	assert.NoError(t, err)
+	defer nc.Close()
+
+	js, err := nc.JetStream()
+	assert.NoError(t, err)
+
+	// the workflows service sets up the stream
+	_, err = js.AddStream(&nats.StreamConfig{
+		Name:     "WORKFLOWS",
+		Subjects: []string{"WORKFLOWS.>"},
+	})
+	assert.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- c.RunContext(ctx)
+	}()
+
+	// the worker sets up the consumer
+	assert.Eventually(t, func() bool {
+		_, err := js.ConsumerInfo("WORKFLOWS", "create-artifact-worker")
+		return err == nil
+	}, 10*time.Second, 10*time.Millisecond)
+
+	b, err := json.Marshal(testJob(storage.URL))
+	assert.NoError(t, err)
+	_, err = js.Publish("WORKFLOWS.generate_artifact", b)
+	assert.NoError(t, err)
+
+	assert.Eventually(t, func() bool {
+		ci, err := js.ConsumerInfo("WORKFLOWS", "create-artifact-worker")
+		return err == nil && ci.NumPending == 0 && ci.NumAckPending == 0 &&
+			ci.AckFloor.Consumer == 1
+	}, 10*time.Second, 10*time.Millisecond)
+
+	cancel()
+	assert.NoError(t, <-done)
+
+	depl.Lock()
+	defer depl.Unlock()
+	assert.Equal(t, []string{"aid"}, depl.uploads)
+}
+
+func contains(s []string, e string) bool {
+	for _, v := range s {
+		if v == e {
+			return true
+		}
+	}
+	return false
+}
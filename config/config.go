@@ -16,7 +16,10 @@ package config
 import (
 	"fmt"
 	"net/url"
+	"os"
 	"path/filepath"
+	"strings"
+	"time"
 
 	"github.com/pkg/errors"
 	"github.com/spf13/viper"
@@ -26,8 +29,74 @@ const (
 	//translate to env vars: CREATE_ARTIFACT_<CAPITALIZED>
 	CfgSkipVerify     = "skipverify"
 	CfgVerbose        = "verbose"
+	CfgLogFormat      = "log_format"
+	CfgLogLevel       = "log_level"
 	CfgWorkDir        = "workdir"
 	CfgDeploymentsUrl = "deployments_url"
+	CfgStorageType    = "storage_type"
+	CfgFileRoot       = "file_root"
+
+	CfgDownloadConcurrency = "download_concurrency"
+	CfgDownloadChunkSize   = "download_chunk_size"
+	CfgDownloadRetries     = "download_retries"
+
+	CfgDirectUpload = "direct_upload"
+	CfgUploadApi    = "upload_api"
+
+	CfgTLSCAFile     = "tls_ca_file"
+	CfgTLSCertFile   = "tls_cert_file"
+	CfgTLSKeyFile    = "tls_key_file"
+	CfgTLSMinVersion = "tls_min_version"
+
+	CfgHTTPDialTimeout           = "http_dial_timeout"
+	CfgHTTPTLSHandshakeTimeout   = "http_tls_handshake_timeout"
+	CfgHTTPResponseHeaderTimeout = "http_response_header_timeout"
+	CfgHTTPIdleConnTimeout       = "http_idle_conn_timeout"
+	CfgHTTPMaxIdleConns          = "http_max_idle_conns"
+	CfgHTTPMaxIdleConnsPerHost   = "http_max_idle_conns_per_host"
+	CfgHTTPMaxConnsPerHost       = "http_max_conns_per_host"
+
+	CfgTimeoutDownload = "timeout_download"
+	CfgTimeoutUpload   = "timeout_upload"
+	CfgTimeoutDelete   = "timeout_delete"
+	CfgTimeoutApi      = "timeout_api"
+
+	CfgReportStatus        = "report_status"
+	CfgSingleFileGenerator = "single_file_generator"
+	CfgMultiFileGenerator  = "multi_file_generator"
+	CfgMultiFileMaxSize    = "multi_file_max_size"
+	CfgDeltaGenerator      = "delta_generator"
+	CfgDeltaBackend        = "delta_backend"
+	CfgDeltaBackendPath    = "delta_backend_path"
+	CfgSigningKey          = "signing_key"
+
+	CfgMetricsTextfile       = "metrics_textfile"
+	CfgMetricsPushgatewayUrl = "metrics_pushgateway_url"
+
+	CfgTracingEndpoint = "tracing_endpoint"
+
+	CfgProgressInterval = "progress_interval"
+	CfgProgressUrl      = "progress_url"
+
+	CfgNatsUri               = "nats_uri"
+	CfgNatsStreamName        = "nats_stream_name"
+	CfgNatsSubscriberTopic   = "nats_subscriber_topic"
+	CfgNatsSubscriberDurable = "nats_subscriber_durable"
+	CfgWorkerConcurrency     = "worker_concurrency"
+	CfgWorkerMaxDeliver      = "worker_max_deliver"
+	CfgWorkerDrainTimeout    = "worker_drain_timeout"
+
+	CfgSandboxCPUTime    = "sandbox_cpu_time"
+	CfgSandboxMemory     = "sandbox_memory"
+	CfgSandboxFileSize   = "sandbox_file_size"
+	CfgSandboxOpenFiles  = "sandbox_open_files"
+	CfgSandboxEnv        = "sandbox_env"
+	CfgSandboxNamespaces = "sandbox_namespaces"
+
+	CfgServeListen         = "serve_listen"
+	CfgServeApiKey         = "serve_api_key"
+	CfgServeAllowAnonymous = "serve_allow_anonymous"
+	CfgServeQueueSize      = "serve_queue_size"
 )
 
 func Init() {
@@ -36,8 +105,65 @@ func Init() {
 
 	viper.SetDefault(CfgSkipVerify, false)
 	viper.SetDefault(CfgVerbose, false)
+	viper.SetDefault(CfgLogFormat, "logfmt")
+	viper.SetDefault(CfgLogLevel, "info")
 	viper.SetDefault(CfgWorkDir, "/var")
 	viper.SetDefault(CfgDeploymentsUrl, "http://mender-deployments:8080")
+	viper.SetDefault(CfgStorageType, "auto")
+	viper.SetDefault(CfgFileRoot, "")
+	viper.SetDefault(CfgDownloadConcurrency, 1)
+	viper.SetDefault(CfgDownloadChunkSize, 16*1024*1024)
+	viper.SetDefault(CfgDownloadRetries, 3)
+	viper.SetDefault(CfgDirectUpload, false)
+	viper.SetDefault(CfgUploadApi, "internal")
+	viper.SetDefault(CfgTLSCAFile, "")
+	viper.SetDefault(CfgTLSCertFile, "")
+	viper.SetDefault(CfgTLSKeyFile, "")
+	viper.SetDefault(CfgTLSMinVersion, "1.2")
+
+	viper.SetDefault(CfgHTTPDialTimeout, 30*time.Second)
+	viper.SetDefault(CfgHTTPTLSHandshakeTimeout, 10*time.Second)
+	viper.SetDefault(CfgHTTPResponseHeaderTimeout, 0)
+	viper.SetDefault(CfgHTTPIdleConnTimeout, 90*time.Second)
+	viper.SetDefault(CfgHTTPMaxIdleConns, 100)
+	viper.SetDefault(CfgHTTPMaxIdleConnsPerHost, 0)
+	viper.SetDefault(CfgHTTPMaxConnsPerHost, 0)
+
+	viper.SetDefault(CfgTimeoutDownload, 900*time.Second)
+	viper.SetDefault(CfgTimeoutUpload, 900*time.Second)
+	viper.SetDefault(CfgTimeoutDelete, 900*time.Second)
+	viper.SetDefault(CfgTimeoutApi, 900*time.Second)
+
+	viper.SetDefault(CfgReportStatus, true)
+	viper.SetDefault(CfgSingleFileGenerator, "/usr/bin/single-file-artifact-gen")
+	viper.SetDefault(CfgMultiFileGenerator, "/usr/bin/mender-artifact")
+	viper.SetDefault(CfgMultiFileMaxSize, 1024*1024*1024)
+	viper.SetDefault(CfgDeltaGenerator, "/usr/bin/mender-artifact")
+	viper.SetDefault(CfgDeltaBackend, "xdelta3")
+	viper.SetDefault(CfgDeltaBackendPath, "")
+	viper.SetDefault(CfgSigningKey, "")
+	viper.SetDefault(CfgMetricsTextfile, "")
+	viper.SetDefault(CfgMetricsPushgatewayUrl, "")
+	viper.SetDefault(CfgTracingEndpoint, "")
+	viper.SetDefault(CfgProgressInterval, 10*time.Second)
+	viper.SetDefault(CfgProgressUrl, "")
+
+	viper.SetDefault(CfgNatsUri, "nats://mender-nats:4222")
+	viper.SetDefault(CfgNatsStreamName, "WORKFLOWS")
+	viper.SetDefault(CfgNatsSubscriberTopic, "generate_artifact")
+	viper.SetDefault(CfgNatsSubscriberDurable, "create-artifact-worker")
+	viper.SetDefault(CfgWorkerConcurrency, 10)
+	viper.SetDefault(CfgWorkerMaxDeliver, 3)
+	viper.SetDefault(CfgWorkerDrainTimeout, 10*time.Minute)
+	viper.SetDefault(CfgSandboxCPUTime, 0)
+	viper.SetDefault(CfgSandboxMemory, 0)
+	viper.SetDefault(CfgSandboxFileSize, 0)
+	viper.SetDefault(CfgSandboxOpenFiles, 0)
+	viper.SetDefault(CfgSandboxEnv, "")
+	viper.SetDefault(CfgSandboxNamespaces, false)
+	viper.SetDefault(CfgServeListen, ":8080")
+	viper.SetDefault(CfgServeAllowAnonymous, false)
+	viper.SetDefault(CfgServeQueueSize, 100)
 }
 
 func ValidUrl(s string) error {
@@ -61,14 +187,107 @@ func ValidAbsPath(s string) error {
 	return nil
 }
 
+// List splits a comma separated list, dropping blanks.
+func List(s string) []string {
+	var l []string
+	for _, e := range strings.Split(s, ",") {
+		if e = strings.TrimSpace(e); e != "" {
+			l = append(l, e)
+		}
+	}
+	return l
+}
+
 func Dump() string {
 	return dump(CfgSkipVerify) +
 		dump(CfgVerbose) +
+		dump(CfgLogFormat) +
+		dump(CfgLogLevel) +
 		dump(CfgWorkDir) +
 		dump(CfgDeploymentsUrl) +
-		dump(CfgDeploymentsUrl)
+		dump(CfgStorageType) +
+		dump(CfgFileRoot) +
+		dump(CfgDownloadConcurrency) +
+		dump(CfgDownloadChunkSize) +
+		dump(CfgDownloadRetries) +
+		dump(CfgDirectUpload) +
+		dump(CfgUploadApi) +
+		dump(CfgTLSCAFile) +
+		dump(CfgTLSCertFile) +
+		dump(CfgTLSKeyFile) +
+		dump(CfgTLSMinVersion) +
+		dump(CfgHTTPDialTimeout) +
+		dump(CfgHTTPTLSHandshakeTimeout) +
+		dump(CfgHTTPResponseHeaderTimeout) +
+		dump(CfgHTTPIdleConnTimeout) +
+		dump(CfgHTTPMaxIdleConns) +
+		dump(CfgHTTPMaxIdleConnsPerHost) +
+		dump(CfgHTTPMaxConnsPerHost) +
+		dump(CfgTimeoutDownload) +
+		dump(CfgTimeoutUpload) +
+		dump(CfgTimeoutDelete) +
+		dump(CfgTimeoutApi) +
+		dump(CfgReportStatus) +
+		dump(CfgSingleFileGenerator) +
+		dump(CfgMultiFileGenerator) +
+		dump(CfgMultiFileMaxSize) +
+		dump(CfgDeltaGenerator) +
+		dump(CfgDeltaBackend) +
+		dump(CfgDeltaBackendPath) +
+		dump(CfgSigningKey) +
+		dump(CfgMetricsTextfile) +
+		dump(CfgMetricsPushgatewayUrl) +
+		dump(CfgTracingEndpoint) +
+		dump(CfgProgressInterval) +
+		dump(CfgProgressUrl) +
+		dump(CfgNatsUri) +
+		dump(CfgNatsStreamName) +
+		dump(CfgNatsSubscriberTopic) +
+		dump(CfgNatsSubscriberDurable) +
+		dump(CfgWorkerConcurrency) +
+		dump(CfgWorkerMaxDeliver) +
+		dump(CfgWorkerDrainTimeout) +
+		dump(CfgSandboxCPUTime) +
+		dump(CfgSandboxMemory) +
+		dump(CfgSandboxFileSize) +
+		dump(CfgSandboxOpenFiles) +
+		dump(CfgSandboxEnv) +
+		dump(CfgSandboxNamespaces) +
+		dump(CfgServeListen) +
+		dumpSecret(CfgServeApiKey) +
+		dump(CfgServeAllowAnonymous) +
+		dump(CfgServeQueueSize) +
+		dumpEnv("HTTP_PROXY") +
+		dumpEnv("HTTPS_PROXY") +
+		dumpEnv("NO_PROXY")
 }
 
 func dump(n string) string {
 	return fmt.Sprintf("%s: %v\n", n, viper.Get(n))
 }
+
+// dumpSecret shows whether a secret is set, not its value
+func dumpSecret(n string) string {
+	v := ""
+	if viper.GetString(n) != "" {
+		v = "xxxxx"
+	}
+
+	return fmt.Sprintf("%s: %v\n", n, v)
+}
+
+// dumpEnv shows env vars used by the standard library (e.g. proxies),
+// checking the lower case variants too; url credentials are masked
+func dumpEnv(n string) string {
+	v, ok := os.LookupEnv(n)
+	if !ok {
+		v = os.Getenv(strings.ToLower(n))
+	}
+
+	if u, err := url.Parse(v); err == nil && u.User != nil {
+		u.User = url.User("xxxxx")
+		v = u.String()
+	}
+
+	return fmt.Sprintf("%s: %v\n", n, v)
+}
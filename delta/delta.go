@@ -0,0 +1,68 @@
+// Copyright 2024 Northern.tech AS
+//
+//	Licensed under the Apache License, Version 2.0 (the "License");
+//	you may not use this file except in compliance with the License.
+//	You may obtain a copy of the License at
+//
+//	    http://www.apache.org/licenses/LICENSE-2.0
+//
+//	Unless required by applicable law or agreed to in writing, software
+//	distributed under the License is distributed on an "AS IS" BASIS,
+//	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//	See the License for the specific language governing permissions and
+//	limitations under the License.
+
+// Package delta computes binary deltas between two images with an
+// external tool, the backend.
+package delta
+
+import (
+	"github.com/pkg/errors"
+)
+
+const (
+	// XDelta3 makes VCDIFF (RFC 3284) deltas
+	XDelta3 = "xdelta3"
+	BSDiff  = "bsdiff"
+)
+
+// Backend is the tool computing the deltas.
+type Backend struct {
+	// Name is the backend, e.g. XDelta3
+	Name string
+
+	// Path is the tool's executable, looked up in PATH by name if
+	// empty.
+	Path string
+}
+
+func (b Backend) Validate() error {
+	switch b.Name {
+	case XDelta3, BSDiff:
+		return nil
+	}
+
+	return errors.Errorf("unsupported delta backend %q", b.Name)
+}
+
+// Ext is the file name extension of the deltas.
+func (b Backend) Ext() string {
+	if b.Name == XDelta3 {
+		return ".vcdiff"
+	}
+	return "." + b.Name
+}
+
+// Command returns the command writing the delta of base to target to
+// out.
+func (b Backend) Command(base, target, out string) (string, []string) {
+	path := b.Path
+	if path == "" {
+		path = b.Name
+	}
+
+	if b.Name == XDelta3 {
+		return path, []string{"-e", "-f", "-s", base, target, out}
+	}
+	return path, []string{base, target, out}
+}
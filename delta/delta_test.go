@@ -0,0 +1,64 @@
+// Copyright 2024 Northern.tech AS
+//
+//	Licensed under the Apache License, Version 2.0 (the "License");
+//	you may not use this file except in compliance with the License.
+//	You may obtain a copy of the License at
+//
+//	    http://www.apache.org/licenses/LICENSE-2.0
+//
+//	Unless required by applicable law or agreed to in writing, software
+//	distributed under the License is distributed on an "AS IS" BASIS,
+//	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//	See the License for the specific language governing permissions and
+//	limitations under the License.
+package delta
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBackend(t *testing.T) {
+	tc := map[string]struct {
+		backend Backend
+
+		name string
+		args []string
+		ext  string
+		err  string
+	}{
+		"xdelta3": {
+			backend: Backend{Name: XDelta3},
+			name:    "xdelta3",
+			args:    []string{"-e", "-f", "-s", "base", "target", "out"},
+			ext:     ".vcdiff",
+		},
+		"bsdiff, with path": {
+			backend: Backend{Name: BSDiff, Path: "/opt/bin/bsdiff"},
+			name:    "/opt/bin/bsdiff",
+			args:    []string{"base", "target", "out"},
+			ext:     ".bsdiff",
+		},
+		"unsupported": {
+			backend: Backend{Name: "rsync"},
+			err:     `unsupported delta backend "rsync"`,
+		},
+	}
+
+	for name, tc := range tc {
+		t.Run(name, func(t *testing.T) {
+			err := tc.backend.Validate()
+			if tc.err != "" {
+				assert.EqualError(t, err, tc.err)
+				return
+			}
+
+			assert.NoError(t, err)
+			name, args := tc.backend.Command("base", "target", "out")
+			assert.Equal(t, tc.name, name)
+			assert.Equal(t, tc.args, args)
+			assert.Equal(t, tc.ext, tc.backend.Ext())
+		})
+	}
+}
@@ -14,25 +14,306 @@
 package log
 
 import (
-	"log"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+type Level int
+
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+var levelNames = []string{"debug", "info", "warn", "error"}
+
+func (l Level) String() string {
+	if l < LevelDebug || l > LevelError {
+		return "level(" + strconv.Itoa(int(l)) + ")"
+	}
+	return levelNames[l]
+}
+
+func ParseLevel(s string) (Level, error) {
+	for i, n := range levelNames {
+		if strings.EqualFold(s, n) {
+			return Level(i), nil
+		}
+	}
+
+	return LevelInfo, errors.Errorf("invalid log level %q", s)
+}
+
+const (
+	FormatLogfmt = "logfmt"
+	FormatJSON   = "json"
 )
 
-var isVerbose bool
+// output is shared by all loggers; writes are serialized so concurrent
+// entries don't interleave.
+type output struct {
+	mu     sync.Mutex
+	w      io.Writer
+	format string
+	level  Level
+	now    func() time.Time
+}
+
+var std = &output{
+	w:      os.Stderr,
+	format: FormatLogfmt,
+	level:  LevelInfo,
+	now:    time.Now,
+}
+
+// Init sets the format (logfmt or json) and the minimum level of entries.
+func Init(format, level string) error {
+	if format != FormatLogfmt && format != FormatJSON {
+		return errors.Errorf("invalid log format %q", format)
+	}
+
+	l, err := ParseLevel(level)
+	if err != nil {
+		return err
+	}
+
+	std.mu.Lock()
+	defer std.mu.Unlock()
+
+	std.format = format
+	std.level = l
+
+	return nil
+}
+
+// SetOutput redirects all entries to w.
+func SetOutput(w io.Writer) {
+	std.mu.Lock()
+	defer std.mu.Unlock()
+
+	std.w = w
+}
+
+// Logger writes entries carrying a fixed set of fields.
+type Logger struct {
+	out *output
+
+	// key, value pairs
+	fields []interface{}
+
+	// tee gets a copy of every entry, if set
+	tee io.Writer
+}
+
+var root = &Logger{out: std}
+
+// With returns a logger adding the key, value pairs kv to every entry.
+func With(kv ...interface{}) *Logger {
+	return root.With(kv...)
+}
+
+func (l *Logger) With(kv ...interface{}) *Logger {
+	if len(kv)%2 != 0 {
+		kv = append(kv, "(missing)")
+	}
+
+	fields := make([]interface{}, 0, len(l.fields)+len(kv))
+	fields = append(fields, l.fields...)
+	fields = append(fields, kv...)
+
+	return &Logger{out: l.out, fields: fields, tee: l.tee}
+}
+
+// Tee returns a logger also writing its entries, and those of loggers
+// derived from it, to w; e.g. to keep the log of a single job.
+func (l *Logger) Tee(w io.Writer) *Logger {
+	return &Logger{out: l.out, fields: l.fields, tee: w}
+}
+
+func (l *Logger) Debug(format string, args ...interface{}) {
+	l.log(LevelDebug, format, args...)
+}
+
+func (l *Logger) Info(format string, args ...interface{}) {
+	l.log(LevelInfo, format, args...)
+}
+
+func (l *Logger) Warn(format string, args ...interface{}) {
+	l.log(LevelWarn, format, args...)
+}
+
+func (l *Logger) Error(format string, args ...interface{}) {
+	l.log(LevelError, format, args...)
+}
+
+func (l *Logger) log(level Level, format string, args ...interface{}) {
+	o := l.out
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if level < o.level {
+		return
+	}
+
+	msg := format
+	if len(args) > 0 {
+		msg = fmt.Sprintf(format, args...)
+	}
+	msg = Redact(msg)
+
+	kv := append([]interface{}{
+		"time", o.now().UTC().Format(time.RFC3339Nano),
+		"level", level.String(),
+		"msg", msg,
+	}, l.fields...)
+
+	var b bytes.Buffer
+	if o.format == FormatJSON {
+		encodeJSON(&b, kv)
+	} else {
+		encodeLogfmt(&b, kv)
+	}
+	b.WriteByte('\n')
 
-func Init(verbose bool) {
-	isVerbose = verbose
+	_, _ = o.w.Write(b.Bytes())
+	if l.tee != nil {
+		_, _ = l.tee.Write(b.Bytes())
+	}
 }
 
-func Error(fmt string, args ...interface{}) {
-	log.Printf("ERROR "+fmt+"\n", args...)
+func encodeLogfmt(b *bytes.Buffer, kv []interface{}) {
+	for i := 0; i < len(kv); i += 2 {
+		if i > 0 {
+			b.WriteByte(' ')
+		}
+		b.WriteString(fmt.Sprint(kv[i]))
+		b.WriteByte('=')
+
+		v := fmt.Sprint(value(kv[i+1]))
+		if v == "" || strings.ContainsAny(v, " =\"\t\r\n") {
+			v = strconv.Quote(v)
+		}
+		b.WriteString(v)
+	}
 }
 
-func Info(fmt string, args ...interface{}) {
-	log.Printf(fmt+"\n", args...)
+func encodeJSON(b *bytes.Buffer, kv []interface{}) {
+	b.WriteByte('{')
+	for i := 0; i < len(kv); i += 2 {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+
+		k, _ := json.Marshal(fmt.Sprint(kv[i]))
+		b.Write(k)
+		b.WriteByte(':')
+
+		v, err := json.Marshal(value(kv[i+1]))
+		if err != nil {
+			v, _ = json.Marshal(Redact(fmt.Sprint(kv[i+1])))
+		}
+		b.Write(v)
+	}
+	b.WriteByte('}')
 }
 
-func Verbose(fmt string, args ...interface{}) {
-	if isVerbose {
-		log.Printf(" -- "+fmt+"\n", args...)
+// value turns errors, durations etc. into their readable string form,
+// redacting any secrets.
+func value(v interface{}) interface{} {
+	switch v := v.(type) {
+	case string:
+		return Redact(v)
+	case error:
+		return Redact(v.Error())
+	case fmt.Stringer:
+		return Redact(v.String())
 	}
+	return v
+}
+
+// Writer returns a writer logging each line written to it as an entry
+// of the given level; Close flushes an unterminated last line.
+func (l *Logger) Writer(level Level) io.WriteCloser {
+	return &lineWriter{l: l, level: level}
+}
+
+type lineWriter struct {
+	mu    sync.Mutex
+	l     *Logger
+	level Level
+	buf   []byte
+}
+
+func (w *lineWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.buf = append(w.buf, p...)
+	for {
+		i := bytes.IndexByte(w.buf, '\n')
+		if i < 0 {
+			break
+		}
+
+		w.l.log(w.level, "%s", strings.TrimRight(string(w.buf[:i]), "\r"))
+		w.buf = w.buf[i+1:]
+	}
+
+	return len(p), nil
+}
+
+func (w *lineWriter) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if len(w.buf) > 0 {
+		w.l.log(w.level, "%s", string(w.buf))
+		w.buf = nil
+	}
+
+	return nil
+}
+
+type ctxKey struct{}
+
+// NewContext returns a context carrying l.
+func NewContext(ctx context.Context, l *Logger) context.Context {
+	return context.WithValue(ctx, ctxKey{}, l)
+}
+
+// FromContext returns the logger carried by ctx, or the default one.
+func FromContext(ctx context.Context) *Logger {
+	if l, ok := ctx.Value(ctxKey{}).(*Logger); ok {
+		return l
+	}
+	return root
+}
+
+func Debug(format string, args ...interface{}) {
+	root.log(LevelDebug, format, args...)
+}
+
+func Info(format string, args ...interface{}) {
+	root.log(LevelInfo, format, args...)
+}
+
+func Warn(format string, args ...interface{}) {
+	root.log(LevelWarn, format, args...)
+}
+
+func Error(format string, args ...interface{}) {
+	root.log(LevelError, format, args...)
 }
@@ -0,0 +1,154 @@
+// Copyright 2024 Northern.tech AS
+//
+//	Licensed under the Apache License, Version 2.0 (the "License");
+//	you may not use this file except in compliance with the License.
+//	You may obtain a copy of the License at
+//
+//	    http://www.apache.org/licenses/LICENSE-2.0
+//
+//	Unless required by applicable law or agreed to in writing, software
+//	distributed under the License is distributed on an "AS IS" BASIS,
+//	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//	See the License for the specific language governing permissions and
+//	limitations under the License.
+package log
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func testOutput(t *testing.T, format, level string) *bytes.Buffer {
+	var b bytes.Buffer
+
+	SetOutput(&b)
+	std.now = func() time.Time {
+		return time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	}
+	assert.NoError(t, Init(format, level))
+
+	t.Cleanup(func() {
+		SetOutput(os.Stderr)
+		std.now = time.Now
+		_ = Init(FormatLogfmt, "info")
+	})
+
+	return &b
+}
+
+func TestLog(t *testing.T) {
+	tc := map[string]struct {
+		format string
+		level  string
+		log    func()
+
+		out string
+	}{
+		"logfmt": {
+			format: FormatLogfmt,
+			level:  "info",
+			log: func() {
+				With("artifact_id", "aid", "tenant_id", "").
+					With("stage", "upload", "duration", 1500*time.Millisecond).
+					Info("uploaded %d bytes", 10)
+			},
+			out: `time=2024-01-02T03:04:05Z level=info msg="uploaded 10 bytes" ` +
+				`artifact_id=aid tenant_id="" stage=upload duration=1.5s` + "\n",
+		},
+		"json": {
+			format: FormatJSON,
+			level:  "info",
+			log: func() {
+				With("artifact_id", "aid", "size", 10, "err", errors.New("foo")).
+					Error("failed")
+			},
+			out: `{"time":"2024-01-02T03:04:05Z","level":"error","msg":"failed",` +
+				`"artifact_id":"aid","size":10,"err":"foo"}` + "\n",
+		},
+		"below level": {
+			format: FormatLogfmt,
+			level:  "warn",
+			log: func() {
+				Info("foo")
+				Debug("bar")
+				Warn("baz")
+			},
+			out: "time=2024-01-02T03:04:05Z level=warn msg=baz\n",
+		},
+		"odd fields": {
+			format: FormatLogfmt,
+			level:  "debug",
+			log: func() {
+				With("key").Debug("foo")
+			},
+			out: "time=2024-01-02T03:04:05Z level=debug msg=foo key=(missing)\n",
+		},
+		"writer": {
+			format: FormatLogfmt,
+			level:  "debug",
+			log: func() {
+				w := With("stage", "generate").Writer(LevelDebug)
+				_, _ = w.Write([]byte("line 1\nline"))
+				_, _ = w.Write([]byte(" 2\r\nno newline"))
+				_ = w.Close()
+			},
+			out: `time=2024-01-02T03:04:05Z level=debug msg="line 1" stage=generate` + "\n" +
+				`time=2024-01-02T03:04:05Z level=debug msg="line 2" stage=generate` + "\n" +
+				`time=2024-01-02T03:04:05Z level=debug msg="no newline" stage=generate` + "\n",
+		},
+		"context": {
+			format: FormatLogfmt,
+			level:  "info",
+			log: func() {
+				ctx := NewContext(context.Background(), With("artifact_id", "aid"))
+				FromContext(ctx).Info("foo")
+				FromContext(context.Background()).Info("bar")
+			},
+			out: "time=2024-01-02T03:04:05Z level=info msg=foo artifact_id=aid\n" +
+				"time=2024-01-02T03:04:05Z level=info msg=bar\n",
+		},
+	}
+
+	for name, tc := range tc {
+		t.Run(name, func(t *testing.T) {
+			b := testOutput(t, tc.format, tc.level)
+
+			tc.log()
+
+			assert.Equal(t, tc.out, b.String())
+		})
+	}
+}
+
+func TestInit(t *testing.T) {
+	testOutput(t, FormatLogfmt, "info")
+
+	assert.EqualError(t, Init("xml", "info"), `invalid log format "xml"`)
+	assert.EqualError(t, Init(FormatJSON, "verbose"), `invalid log level "verbose"`)
+	assert.NoError(t, Init(FormatJSON, "DEBUG"))
+}
+
+func TestTee(t *testing.T) {
+	out := testOutput(t, FormatLogfmt, "info")
+
+	var job bytes.Buffer
+	l := With("job_id", "1").Tee(&job)
+
+	l.With("stage", "download").Info("downloading")
+	l.Debug("filtered")
+	With("job_id", "2").Info("other job")
+
+	assert.Equal(t,
+		"time=2024-01-02T03:04:05Z level=info msg=downloading job_id=1 stage=download\n",
+		job.String())
+	assert.Equal(t,
+		"time=2024-01-02T03:04:05Z level=info msg=downloading job_id=1 stage=download\n"+
+			"time=2024-01-02T03:04:05Z level=info msg=\"other job\" job_id=2\n",
+		out.String())
+}
@@ -0,0 +1,114 @@
+// Copyright 2024 Northern.tech AS
+//
+//	Licensed under the Apache License, Version 2.0 (the "License");
+//	you may not use this file except in compliance with the License.
+//	You may obtain a copy of the License at
+//
+//	    http://www.apache.org/licenses/LICENSE-2.0
+//
+//	Unless required by applicable law or agreed to in writing, software
+//	distributed under the License is distributed on an "AS IS" BASIS,
+//	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//	See the License for the specific language governing permissions and
+//	limitations under the License.
+package log
+
+import (
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+const redacted = "xxxxx"
+
+// secretParams are query params granting access on their own: pre-signed
+// url signatures (S3, GCS, Azure SAS) and tokens.
+var secretParams = map[string]bool{
+	"x-amz-signature":      true,
+	"x-amz-credential":     true,
+	"x-amz-security-token": true,
+	"x-goog-signature":     true,
+	"x-goog-credential":    true,
+	"awsaccesskeyid":       true,
+	"signature":            true,
+	"sig":                  true,
+	"token":                true,
+	"access_token":         true,
+	"jwt":                  true,
+	"password":             true,
+	"secret":               true,
+}
+
+var (
+	reURL    = regexp.MustCompile("[a-zA-Z][a-zA-Z0-9+.-]*://[^\\s\"'`<>]+")
+	reBearer = regexp.MustCompile(`(?i)(bearer\s+)[^\s"']+`)
+	reJWT    = regexp.MustCompile(`eyJ[A-Za-z0-9_-]*\.[A-Za-z0-9_-]+\.[A-Za-z0-9_-]*`)
+)
+
+// Redact masks the secrets in free text: credentials and signatures of
+// any urls in it, bearer tokens and JWTs. All log entries go through it.
+func Redact(s string) string {
+	s = reURL.ReplaceAllStringFunc(s, func(u string) string {
+		// punctuation ending a sentence isn't part of the url
+		trimmed := strings.TrimRight(u, ",.;:)]")
+		return RedactURL(trimmed) + u[len(trimmed):]
+	})
+	s = reBearer.ReplaceAllString(s, "${1}"+redacted)
+	s = reJWT.ReplaceAllString(s, redacted)
+
+	return s
+}
+
+// RedactURL masks the password (or token used as user name) and the
+// secret query params of a url, leaving the rest as it was.
+func RedactURL(s string) string {
+	i := strings.Index(s, "://")
+	if i < 0 {
+		return s
+	}
+
+	rest := s[i+3:]
+	end := strings.IndexAny(rest, "/?#")
+	if end < 0 {
+		end = len(rest)
+	}
+
+	if at := strings.LastIndex(rest[:end], "@"); at >= 0 {
+		user := rest[:at]
+		if c := strings.Index(user, ":"); c >= 0 {
+			user = user[:c+1] + redacted
+		} else {
+			user = redacted
+		}
+		rest = user + rest[at:]
+	}
+	s = s[:i+3] + rest
+
+	q := strings.Index(s, "?")
+	if q < 0 {
+		return s
+	}
+
+	query, fragment := s[q+1:], ""
+	if h := strings.Index(query, "#"); h >= 0 {
+		query, fragment = query[:h], query[h:]
+	}
+
+	params := strings.Split(query, "&")
+	for j, p := range params {
+		k := p
+		if e := strings.Index(p, "="); e >= 0 {
+			k = p[:e]
+		}
+
+		if name, err := url.QueryUnescape(k); err == nil {
+			k = name
+		}
+
+		if secretParams[strings.ToLower(k)] {
+			params[j] = strings.SplitN(p, "=", 2)[0] + "=" + redacted
+		}
+	}
+
+	return s[:q+1] + strings.Join(params, "&") + fragment
+}
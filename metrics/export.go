@@ -0,0 +1,354 @@
+// Copyright 2024 Northern.tech AS
+//
+//	Licensed under the Apache License, Version 2.0 (the "License");
+//	you may not use this file except in compliance with the License.
+//	You may obtain a copy of the License at
+//
+//	    http://www.apache.org/licenses/LICENSE-2.0
+//
+//	Unless required by applicable law or agreed to in writing, software
+//	distributed under the License is distributed on an "AS IS" BASIS,
+//	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//	See the License for the specific language governing permissions and
+//	limitations under the License.
+package metrics
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/push"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+	"google.golang.org/protobuf/proto"
+)
+
+const (
+	pushJob     = "create_artifact"
+	pushTimeout = 30 * time.Second
+)
+
+// the metrics the Pushgateway adds to each group
+var pushgatewayMetrics = map[string]bool{
+	"push_time_seconds":         true,
+	"push_failure_time_seconds": true,
+}
+
+// Config tells where to export the metrics; both may be set.
+type Config struct {
+	// Textfile is a node-exporter textfile collector file, e.g.
+	// /var/lib/node_exporter/create_artifact.prom. Jobs add up their
+	// counters and histograms to the ones already in the file.
+	Textfile string
+
+	// PushgatewayUrl is the base url of a Pushgateway; metrics are added
+	// under job "create_artifact" and this host's instance label, to the
+	// counters and histograms already pushed.
+	PushgatewayUrl string
+}
+
+// pending are the metrics gathered but not exported to a destination
+// yet, e.g. as the Pushgateway was down; they're added to its next export.
+var pending struct {
+	sync.Mutex
+	push, textfile []*dto.MetricFamily
+}
+
+// Export writes out the metrics recorded since the last export, so a
+// worker running many jobs adds every job to the textfile only once. A
+// destination failing doesn't keep the other from being written to.
+func Export(c Config) error {
+	cur, err := gather()
+	if err != nil {
+		return errors.Wrap(err, "failed to gather metrics")
+	}
+
+	pending.Lock()
+	defer pending.Unlock()
+
+	if c.PushgatewayUrl != "" {
+		err = export(&pending.push, cur, func(mfs []*dto.MetricFamily) error {
+			return pushMetrics(c.PushgatewayUrl, mfs)
+		})
+		if err != nil {
+			err = errors.Wrapf(err, "failed to push metrics to %s", c.PushgatewayUrl)
+		}
+	}
+
+	if c.Textfile != "" {
+		ferr := export(&pending.textfile, cur, func(mfs []*dto.MetricFamily) error {
+			return writeTextfile(c.Textfile, mfs)
+		})
+		if ferr != nil {
+			ferr = errors.Wrapf(ferr, "failed to write metrics to %s", c.Textfile)
+			if err != nil {
+				return errors.Errorf("%s; %s", err, ferr)
+			}
+			return ferr
+		}
+	}
+
+	return err
+}
+
+// export adds cur to the metrics not exported to a destination yet and
+// exports them with f, keeping them for the next time if it fails.
+func export(unexported *[]*dto.MetricFamily, cur []*dto.MetricFamily, f func([]*dto.MetricFamily) error) error {
+	prev := map[string]*dto.MetricFamily{}
+	for _, mf := range *unexported {
+		prev[mf.GetName()] = mf
+	}
+
+	// merging modifies the metrics, each export merges a copy
+	all := merge(prev, clone(cur))
+	if err := f(clone(all)); err != nil {
+		*unexported = all
+		return err
+	}
+
+	*unexported = nil
+	return nil
+}
+
+// gather takes the metrics recorded so far and starts over.
+func gather() ([]*dto.MetricFamily, error) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	mfs, err := registry.Gather()
+	if err != nil {
+		return nil, err
+	}
+	reset()
+
+	return mfs, nil
+}
+
+func clone(mfs []*dto.MetricFamily) []*dto.MetricFamily {
+	c := make([]*dto.MetricFamily, len(mfs))
+	for i, mf := range mfs {
+		c[i] = proto.Clone(mf).(*dto.MetricFamily)
+	}
+	return c
+}
+
+// pushMetrics adds cur to the metrics of this host's group and pushes
+// the sums; the jobs of the host take turns, like with the textfile.
+func pushMetrics(url string, cur []*dto.MetricFamily) error {
+	host, err := os.Hostname()
+	if err != nil {
+		return err
+	}
+
+	unlock, err := lockFile(filepath.Join(os.TempDir(), pushJob+"_pushgateway.lock"))
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	c := &http.Client{Timeout: pushTimeout}
+
+	prev, err := readGroup(c, url, host)
+	if err != nil {
+		return err
+	}
+
+	merged := merge(prev, cur)
+
+	return push.New(url, pushJob).
+		Client(c).
+		Gatherer(prometheus.GathererFunc(func() ([]*dto.MetricFamily, error) {
+			return merged, nil
+		})).
+		Grouping("instance", host).
+		Add()
+}
+
+// readGroup returns the metrics pushed to the group of host, without
+// the grouping labels.
+func readGroup(c *http.Client, url, host string) (map[string]*dto.MetricFamily, error) {
+	res, err := c.Get(strings.TrimSuffix(url, "/") + "/metrics")
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read pushed metrics")
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return nil, errors.Errorf("failed to read pushed metrics: http %d", res.StatusCode)
+	}
+
+	var p expfmt.TextParser
+	all, err := p.TextToMetricFamilies(res.Body)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to parse pushed metrics")
+	}
+
+	group := map[string]*dto.MetricFamily{}
+	for name, mf := range all {
+		if pushgatewayMetrics[name] {
+			continue
+		}
+
+		var ms []*dto.Metric
+		for _, m := range mf.Metric {
+			if labels, ok := ungroup(m.Label, host); ok {
+				m.Label = labels
+				ms = append(ms, m)
+			}
+		}
+		if len(ms) > 0 {
+			mf.Metric = ms
+			group[name] = mf
+		}
+	}
+
+	return group, nil
+}
+
+// ungroup returns the labels but the grouping ones, if they're of the
+// group of host.
+func ungroup(labels []*dto.LabelPair, host string) ([]*dto.LabelPair, bool) {
+	var rest []*dto.LabelPair
+	job, instance := false, false
+
+	for _, l := range labels {
+		switch l.GetName() {
+		case "job":
+			job = l.GetValue() == pushJob
+		case "instance":
+			instance = l.GetValue() == host
+		default:
+			rest = append(rest, l)
+		}
+	}
+
+	return rest, job && instance
+}
+
+func writeTextfile(path string, cur []*dto.MetricFamily) error {
+	unlock, err := lockFile(path + ".lock")
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	prev, err := readTextfile(path)
+	if err != nil {
+		return err
+	}
+
+	merged := merge(prev, cur)
+
+	return prometheus.WriteToTextfile(path, prometheus.GathererFunc(
+		func() ([]*dto.MetricFamily, error) {
+			return merged, nil
+		}))
+}
+
+func readTextfile(path string) (map[string]*dto.MetricFamily, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var p expfmt.TextParser
+	mfs, err := p.TextToMetricFamilies(f)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to parse existing metrics")
+	}
+
+	return mfs, nil
+}
+
+// merge adds the counters and histograms of cur to those in prev;
+// gauges are replaced, series only in prev are kept as they are.
+func merge(prev map[string]*dto.MetricFamily, cur []*dto.MetricFamily) []*dto.MetricFamily {
+	var merged []*dto.MetricFamily
+
+	for _, mf := range cur {
+		old, ok := prev[mf.GetName()]
+		delete(prev, mf.GetName())
+
+		if ok && old.GetType() == mf.GetType() {
+			mergeFamily(old, mf)
+		}
+		merged = append(merged, mf)
+	}
+
+	for _, mf := range prev {
+		merged = append(merged, mf)
+	}
+
+	sort.Slice(merged, func(i, j int) bool {
+		return merged[i].GetName() < merged[j].GetName()
+	})
+
+	return merged
+}
+
+func mergeFamily(old, mf *dto.MetricFamily) {
+	olds := map[string]*dto.Metric{}
+	for _, m := range old.Metric {
+		olds[labelsKey(m)] = m
+	}
+
+	for _, m := range mf.Metric {
+		o, ok := olds[labelsKey(m)]
+		if !ok {
+			continue
+		}
+		delete(olds, labelsKey(m))
+
+		switch mf.GetType() {
+		case dto.MetricType_COUNTER:
+			v := m.GetCounter().GetValue() + o.GetCounter().GetValue()
+			m.Counter.Value = &v
+		case dto.MetricType_HISTOGRAM:
+			mergeHistogram(o.GetHistogram(), m.GetHistogram())
+		}
+	}
+
+	for _, m := range old.Metric {
+		if _, ok := olds[labelsKey(m)]; ok {
+			mf.Metric = append(mf.Metric, m)
+		}
+	}
+}
+
+func mergeHistogram(old, h *dto.Histogram) {
+	count := h.GetSampleCount() + old.GetSampleCount()
+	sum := h.GetSampleSum() + old.GetSampleSum()
+	h.SampleCount = &count
+	h.SampleSum = &sum
+
+	olds := map[float64]uint64{}
+	for _, b := range old.Bucket {
+		olds[b.GetUpperBound()] = b.GetCumulativeCount()
+	}
+
+	for _, b := range h.Bucket {
+		c := b.GetCumulativeCount() + olds[b.GetUpperBound()]
+		b.CumulativeCount = &c
+	}
+}
+
+func labelsKey(m *dto.Metric) string {
+	var pairs []string
+	for _, l := range m.Label {
+		pairs = append(pairs, l.GetName()+"="+l.GetValue())
+	}
+	sort.Strings(pairs)
+
+	return strings.Join(pairs, ",")
+}
@@ -0,0 +1,214 @@
+// Copyright 2024 Northern.tech AS
+//
+//	Licensed under the Apache License, Version 2.0 (the "License");
+//	you may not use this file except in compliance with the License.
+//	You may obtain a copy of the License at
+//
+//	    http://www.apache.org/licenses/LICENSE-2.0
+//
+//	Unless required by applicable law or agreed to in writing, software
+//	distributed under the License is distributed on an "AS IS" BASIS,
+//	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//	See the License for the specific language governing permissions and
+//	limitations under the License.
+
+// Package metrics records Prometheus metrics of generation jobs. Every job
+// is a short lived process, so instead of being scraped the metrics are
+// written to a node-exporter textfile or pushed to a Pushgateway when the
+// job ends.
+package metrics
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const namespace = "create_artifact"
+
+const (
+	StageDownload = "download"
+	StageGenerate = "generate"
+	StageUpload   = "upload"
+)
+
+const (
+	ResultSuccess = "success"
+	ResultFailure = "failure"
+)
+
+var (
+	jobs = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "jobs_total",
+		Help:      "Generation jobs by generator and result.",
+	}, []string{"generator", "result"})
+
+	failures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "failures_total",
+		Help:      "Failed jobs by generator, stage and error class.",
+	}, []string{"generator", "stage", "class"})
+
+	stageDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "stage_duration_seconds",
+		Help:      "Duration of job stages, failed ones included.",
+		Buckets:   []float64{0.1, 0.5, 1, 5, 10, 30, 60, 120, 300, 600, 1800},
+	}, []string{"generator", "stage"})
+
+	downloaded = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "downloaded_bytes_total",
+		Help:      "Bytes of input files downloaded.",
+	}, []string{"generator"})
+
+	uploaded = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "uploaded_bytes_total",
+		Help:      "Bytes of generated artifacts uploaded.",
+	}, []string{"generator"})
+
+	unverified = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "unverified_downloads_total",
+		Help:      "Parallel downloads the storage published no usable checksum of.",
+	}, []string{"generator"})
+)
+
+var registry = prometheus.NewRegistry()
+
+// mu keeps jobs from recording while the metrics are exported and reset
+var mu sync.Mutex
+
+func init() {
+	registry.MustRegister(jobs, failures, stageDuration, downloaded, uploaded, unverified)
+}
+
+func reset() {
+	jobs.Reset()
+	failures.Reset()
+	stageDuration.Reset()
+	downloaded.Reset()
+	uploaded.Reset()
+	unverified.Reset()
+}
+
+// Job tracks the stages of one job. A nil *Job records nothing, so code
+// paths without metrics don't need to check.
+type Job struct {
+	generator string
+
+	stage string
+	start time.Time
+	now   func() time.Time
+}
+
+func NewJob(generator string) *Job {
+	return &Job{
+		generator: generator,
+		now:       time.Now,
+	}
+}
+
+// Stage ends the current stage, if any, and starts the named one.
+func (j *Job) Stage(name string) {
+	if j == nil {
+		return
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	j.endStage()
+	j.stage = name
+	j.start = j.now()
+}
+
+func (j *Job) endStage() {
+	if j.stage == "" {
+		return
+	}
+
+	stageDuration.WithLabelValues(j.generator, j.stage).
+		Observe(j.now().Sub(j.start).Seconds())
+	j.stage = ""
+}
+
+func (j *Job) Downloaded(n int64) {
+	if j == nil {
+		return
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	downloaded.WithLabelValues(j.generator).Add(float64(n))
+}
+
+func (j *Job) Uploaded(n int64) {
+	if j == nil {
+		return
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	uploaded.WithLabelValues(j.generator).Add(float64(n))
+}
+
+// Unverified counts a download there was no checksum to verify.
+func (j *Job) Unverified() {
+	if j == nil {
+		return
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	unverified.WithLabelValues(j.generator).Inc()
+}
+
+// Done ends the job successfully.
+func (j *Job) Done() {
+	if j == nil {
+		return
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	j.endStage()
+	jobs.WithLabelValues(j.generator, ResultSuccess).Inc()
+}
+
+// Fail ends the job, counting a failure of class in the current stage.
+func (j *Job) Fail(class string) {
+	if j == nil {
+		return
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	stage := j.stage
+	if stage == "" {
+		stage = "setup"
+	}
+
+	j.endStage()
+	failures.WithLabelValues(j.generator, stage, class).Inc()
+	jobs.WithLabelValues(j.generator, ResultFailure).Inc()
+}
+
+type ctxKey struct{}
+
+// NewContext returns a context carrying j.
+func NewContext(ctx context.Context, j *Job) context.Context {
+	return context.WithValue(ctx, ctxKey{}, j)
+}
+
+// FromContext returns the job carried by ctx, nil if none.
+func FromContext(ctx context.Context) *Job {
+	j, _ := ctx.Value(ctxKey{}).(*Job)
+	return j
+}
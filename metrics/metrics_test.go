@@ -0,0 +1,303 @@
+// Copyright 2024 Northern.tech AS
+//
+//	Licensed under the Apache License, Version 2.0 (the "License");
+//	you may not use this file except in compliance with the License.
+//	You may obtain a copy of the License at
+//
+//	    http://www.apache.org/licenses/LICENSE-2.0
+//
+//	Unless required by applicable law or agreed to in writing, software
+//	distributed under the License is distributed on an "AS IS" BASIS,
+//	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//	See the License for the specific language governing permissions and
+//	limitations under the License.
+package metrics
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/protobuf/proto"
+)
+
+// fakeClock advances by step on every reading
+func fakeClock(step time.Duration) func() time.Time {
+	t := time.Unix(0, 0)
+	return func() time.Time {
+		t = t.Add(step)
+		return t
+	}
+}
+
+func TestJob(t *testing.T) {
+	reset()
+	defer reset()
+
+	ok := NewJob("single-file")
+	ok.now = fakeClock(time.Second)
+	ok.Stage(StageDownload)
+	ok.Downloaded(100)
+	ok.Stage(StageGenerate)
+	ok.Stage(StageUpload)
+	ok.Uploaded(200)
+	ok.Unverified()
+	ok.Done()
+
+	failed := NewJob("single-file")
+	failed.now = fakeClock(time.Second)
+	failed.Stage(StageDownload)
+	failed.Fail("auth")
+
+	var none *Job
+	none.Stage(StageDownload)
+	none.Downloaded(1)
+	none.Unverified()
+	none.Done()
+
+	assert.Equal(t, 1.0, testutil.ToFloat64(jobs.WithLabelValues("single-file", ResultSuccess)))
+	assert.Equal(t, 1.0, testutil.ToFloat64(jobs.WithLabelValues("single-file", ResultFailure)))
+	assert.Equal(t, 1.0, testutil.ToFloat64(
+		failures.WithLabelValues("single-file", StageDownload, "auth")))
+	assert.Equal(t, 100.0, testutil.ToFloat64(downloaded.WithLabelValues("single-file")))
+	assert.Equal(t, 200.0, testutil.ToFloat64(uploaded.WithLabelValues("single-file")))
+	assert.Equal(t, 1.0, testutil.ToFloat64(unverified.WithLabelValues("single-file")))
+
+	assert.NoError(t, testutil.GatherAndCompare(registry, strings.NewReader(`
+# HELP create_artifact_stage_duration_seconds Duration of job stages, failed ones included.
+# TYPE create_artifact_stage_duration_seconds histogram
+create_artifact_stage_duration_seconds_bucket{generator="single-file",stage="download",le="0.1"} 0
+create_artifact_stage_duration_seconds_bucket{generator="single-file",stage="download",le="0.5"} 0
+create_artifact_stage_duration_seconds_bucket{generator="single-file",stage="download",le="1"} 2
+create_artifact_stage_duration_seconds_bucket{generator="single-file",stage="download",le="5"} 2
+create_artifact_stage_duration_seconds_bucket{generator="single-file",stage="download",le="10"} 2
+create_artifact_stage_duration_seconds_bucket{generator="single-file",stage="download",le="30"} 2
+create_artifact_stage_duration_seconds_bucket{generator="single-file",stage="download",le="60"} 2
+create_artifact_stage_duration_seconds_bucket{generator="single-file",stage="download",le="120"} 2
+create_artifact_stage_duration_seconds_bucket{generator="single-file",stage="download",le="300"} 2
+create_artifact_stage_duration_seconds_bucket{generator="single-file",stage="download",le="600"} 2
+create_artifact_stage_duration_seconds_bucket{generator="single-file",stage="download",le="1800"} 2
+create_artifact_stage_duration_seconds_bucket{generator="single-file",stage="download",le="+Inf"} 2
+create_artifact_stage_duration_seconds_sum{generator="single-file",stage="download"} 2
+create_artifact_stage_duration_seconds_count{generator="single-file",stage="download"} 2
+`), "create_artifact_stage_duration_seconds_count"))
+
+	// download, generate, upload
+	assert.Equal(t, 3, testutil.CollectAndCount(stageDuration))
+}
+
+func TestJobContext(t *testing.T) {
+	j := NewJob("single-file")
+
+	assert.Equal(t, j, FromContext(NewContext(context.Background(), j)))
+	assert.Nil(t, FromContext(context.Background()))
+}
+
+func TestExportTextfile(t *testing.T) {
+	reset()
+	defer reset()
+
+	path := filepath.Join(t.TempDir(), "create_artifact.prom")
+
+	// a job per export, adding up in the file; exporting starts over, so
+	// jobs of one process aren't added twice
+	for i := 0; i < 2; i++ {
+		j := NewJob("single-file")
+		j.Stage(StageDownload)
+		j.Downloaded(100)
+		j.Fail("transient")
+
+		assert.NoError(t, Export(Config{Textfile: path}))
+	}
+
+	j := NewJob("multi-file")
+	j.Done()
+	assert.NoError(t, Export(Config{Textfile: path}))
+
+	b, err := ioutil.ReadFile(path)
+	assert.NoError(t, err)
+
+	out := string(b)
+	assert.Contains(t, out,
+		`create_artifact_downloaded_bytes_total{generator="single-file"} 200`)
+	assert.Contains(t, out,
+		`create_artifact_jobs_total{generator="single-file",result="failure"} 2`)
+	assert.Contains(t, out,
+		`create_artifact_jobs_total{generator="multi-file",result="success"} 1`)
+	assert.Contains(t, out,
+		`create_artifact_failures_total{class="transient",generator="single-file",stage="download"} 2`)
+	assert.Contains(t, out,
+		`create_artifact_stage_duration_seconds_count{generator="single-file",stage="download"} 2`)
+
+	// no temp files left for node-exporter to pick up
+	files, err := filepath.Glob(filepath.Join(filepath.Dir(path), "*.prom"))
+	assert.NoError(t, err)
+	assert.Len(t, files, 1)
+}
+
+func TestExportTextfileInvalid(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "create_artifact.prom")
+	assert.NoError(t, ioutil.WriteFile(path, []byte("not { metrics"), 0644))
+
+	err := Export(Config{Textfile: path})
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "failed to parse existing metrics")
+	pending.textfile = nil
+}
+
+// fakePushgateway keeps the metrics pushed to a group and serves them
+// with the grouping labels, next to another instance's and its own
+type fakePushgateway struct {
+	sync.Mutex
+
+	requests []string
+	pushed   map[string]*dto.MetricFamily
+	down     bool
+}
+
+func (f *fakePushgateway) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.Lock()
+	defer f.Unlock()
+
+	f.requests = append(f.requests, r.Method+" "+r.URL.Path)
+	if f.down {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		host, _ := os.Hostname()
+		for _, mf := range f.pushed {
+			mf = proto.Clone(mf).(*dto.MetricFamily)
+			for _, m := range mf.Metric {
+				m.Label = append(m.Label,
+					&dto.LabelPair{Name: proto.String("instance"), Value: proto.String(host)},
+					&dto.LabelPair{Name: proto.String("job"), Value: proto.String(pushJob)},
+				)
+			}
+			_, _ = expfmt.MetricFamilyToText(w, mf)
+		}
+		fmt.Fprintf(w, "push_time_seconds{instance=%q,job=%q} 1\n", host, pushJob)
+		fmt.Fprintf(w, "other_instance_total{instance=\"other\",job=%q} 5\n", pushJob)
+	case http.MethodPost:
+		dec := expfmt.NewDecoder(r.Body, expfmt.ResponseFormat(r.Header))
+		for {
+			mf := &dto.MetricFamily{}
+			if err := dec.Decode(mf); err != nil {
+				break
+			}
+			f.pushed[mf.GetName()] = mf
+		}
+	}
+}
+
+func TestExportPushgateway(t *testing.T) {
+	reset()
+	defer reset()
+
+	host, err := os.Hostname()
+	assert.NoError(t, err)
+
+	pg := &fakePushgateway{pushed: map[string]*dto.MetricFamily{}}
+	server := httptest.NewServer(pg)
+	defer server.Close()
+
+	// a job per export, each in a process of its own as far as the
+	// registry goes
+	for i := 0; i < 2; i++ {
+		j := NewJob("single-file")
+		j.Stage(StageUpload)
+		j.Uploaded(42)
+		j.Done()
+
+		assert.NoError(t, Export(Config{PushgatewayUrl: server.URL}))
+	}
+
+	group := "/metrics/job/create_artifact/instance/" + host
+	assert.Equal(t, []string{
+		http.MethodGet + " /metrics", http.MethodPost + " " + group,
+		http.MethodGet + " /metrics", http.MethodPost + " " + group,
+	}, pg.requests)
+
+	// the pushes add up
+	uploaded := pg.pushed["create_artifact_uploaded_bytes_total"]
+	if assert.NotNil(t, uploaded) && assert.Len(t, uploaded.Metric, 1) {
+		assert.Equal(t, 84.0, uploaded.Metric[0].GetCounter().GetValue())
+		for _, l := range uploaded.Metric[0].Label {
+			assert.NotContains(t, []string{"job", "instance"}, l.GetName())
+		}
+	}
+	jobs := pg.pushed["create_artifact_jobs_total"]
+	if assert.NotNil(t, jobs) && assert.Len(t, jobs.Metric, 1) {
+		assert.Equal(t, 2.0, jobs.Metric[0].GetCounter().GetValue())
+	}
+	duration := pg.pushed["create_artifact_stage_duration_seconds"]
+	if assert.NotNil(t, duration) && assert.Len(t, duration.Metric, 1) {
+		assert.Equal(t, uint64(2), duration.Metric[0].GetHistogram().GetSampleCount())
+	}
+
+	// other groups' and the gateway's own metrics aren't pushed back
+	assert.NotContains(t, pg.pushed, "push_time_seconds")
+	assert.NotContains(t, pg.pushed, "other_instance_total")
+
+	server.Close()
+	err = Export(Config{PushgatewayUrl: server.URL})
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "failed to push metrics")
+}
+
+func TestExportPushgatewayDown(t *testing.T) {
+	reset()
+	defer reset()
+	defer func() { pending.push, pending.textfile = nil, nil }()
+
+	pg := &fakePushgateway{pushed: map[string]*dto.MetricFamily{}, down: true}
+	server := httptest.NewServer(pg)
+	defer server.Close()
+
+	c := Config{
+		Textfile:       filepath.Join(t.TempDir(), "create_artifact.prom"),
+		PushgatewayUrl: server.URL,
+	}
+
+	jobs := func() string {
+		b, err := ioutil.ReadFile(c.Textfile)
+		assert.NoError(t, err)
+		return string(b)
+	}
+
+	// the textfile is written anyway, the push is kept for the next one
+	NewJob("single-file").Done()
+	err := Export(c)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "failed to push metrics")
+	assert.Contains(t, jobs(),
+		`create_artifact_jobs_total{generator="single-file",result="success"} 1`)
+
+	pg.Lock()
+	pg.down = false
+	pg.Unlock()
+
+	NewJob("single-file").Done()
+	assert.NoError(t, Export(c))
+	assert.Contains(t, jobs(),
+		`create_artifact_jobs_total{generator="single-file",result="success"} 2`)
+
+	pushed := pg.pushed["create_artifact_jobs_total"]
+	if assert.NotNil(t, pushed) && assert.Len(t, pushed.Metric, 1) {
+		assert.Equal(t, 2.0, pushed.Metric[0].GetCounter().GetValue())
+	}
+}
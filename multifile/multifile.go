@@ -0,0 +1,356 @@
+// Copyright 2024 Northern.tech AS
+//
+//	Licensed under the Apache License, Version 2.0 (the "License");
+//	you may not use this file except in compliance with the License.
+//	You may obtain a copy of the License at
+//
+//	    http://www.apache.org/licenses/LICENSE-2.0
+//
+//	Unless required by applicable law or agreed to in writing, software
+//	distributed under the License is distributed on an "AS IS" BASIS,
+//	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//	See the License for the specific language governing permissions and
+//	limitations under the License.
+
+// Package multifile reads the tar or zip archives of multi-file artifacts:
+// each file of the archive is installed on the device at its own path,
+// with its own mode and owner.
+package multifile
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
+	"compress/gzip"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	DefaultMode  = "0644"
+	DefaultOwner = "root"
+)
+
+// Spec says where and how a file of the archive is installed.
+type Spec struct {
+	Dest  string `json:"dest"`
+	Mode  string `json:"mode,omitempty"`
+	Owner string `json:"owner,omitempty"`
+	Group string `json:"group,omitempty"`
+}
+
+// Files maps the paths of the files in the archive to their specs.
+type Files map[string]Spec
+
+// File is a file of the payload, named after its base name in the
+// archive, as listed in the meta-data.
+type File struct {
+	Name  string `json:"name"`
+	Dest  string `json:"dest"`
+	Mode  string `json:"mode"`
+	Owner string `json:"owner"`
+	Group string `json:"group"`
+}
+
+// MetaData is the meta-data of the payload, telling the update module
+// where to install its files.
+type MetaData struct {
+	Files []File `json:"files"`
+}
+
+// user and group names, as accepted by useradd; or numeric ids
+var ownerRe = regexp.MustCompile(`^([a-z_][a-z0-9_-]*\$?|[0-9]+)$`)
+
+// Validate checks the specs and fills in the defaults: the archive paths
+// must be clean and relative, the destinations absolute, and neither the
+// destinations nor the base names, naming the payload files, may repeat.
+func (f Files) Validate() error {
+	if len(f) == 0 {
+		return errors.New("no files")
+	}
+
+	dests := map[string]string{}
+	names := map[string]string{}
+	for _, p := range f.paths() {
+		s := f[p]
+
+		if err := validPath(p); err != nil {
+			return err
+		}
+
+		if !path.IsAbs(s.Dest) || path.Clean(s.Dest) != s.Dest || s.Dest == "/" {
+			return errors.Errorf("invalid destination %q of %s", s.Dest, p)
+		}
+		if other, ok := dests[s.Dest]; ok {
+			return errors.Errorf("%s and %s have the same destination %s", other, p, s.Dest)
+		}
+		dests[s.Dest] = p
+
+		name := path.Base(p)
+		if other, ok := names[name]; ok {
+			return errors.Errorf("%s and %s have the same name", other, p)
+		}
+		names[name] = p
+
+		if s.Mode == "" {
+			s.Mode = DefaultMode
+		}
+		if m, err := strconv.ParseUint(s.Mode, 8, 32); err != nil || m > 07777 {
+			return errors.Errorf("invalid mode %q of %s", s.Mode, p)
+		}
+
+		if s.Owner == "" {
+			s.Owner = DefaultOwner
+		}
+		if !ownerRe.MatchString(s.Owner) {
+			return errors.Errorf("invalid owner %q of %s", s.Owner, p)
+		}
+		if s.Group == "" {
+			s.Group = s.Owner
+		}
+		if !ownerRe.MatchString(s.Group) {
+			return errors.Errorf("invalid group %q of %s", s.Group, p)
+		}
+
+		f[p] = s
+	}
+
+	return nil
+}
+
+func (f Files) paths() []string {
+	paths := make([]string, 0, len(f))
+	for p := range f {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+// validPath rejects the paths escaping the archive, like ../x or /x, and
+// the ones not in canonical form.
+func validPath(p string) error {
+	if p == "" || path.IsAbs(p) || strings.Contains(p, `\`) ||
+		path.Clean(p) != p || p == ".." || strings.HasPrefix(p, "../") {
+		return errors.Errorf("invalid archive path %q", p)
+	}
+	return nil
+}
+
+// entry is a file or dir of an archive
+type entry struct {
+	name string
+	dir  bool
+	// regular tells if it's a regular file, or a dir
+	regular bool
+	open    func() (io.ReadCloser, error)
+}
+
+// Walk calls fn for each file of the archive at name, a tar, a gzipped
+// tar or a zip, in archive order. The archive may only have the files of
+// f, and dirs; its paths must be valid and unique, and the files mustn't
+// add up to more than maxSize bytes, if positive.
+func Walk(name string, f Files, maxSize int64, fn func(File, io.Reader) error) error {
+	seen := map[string]bool{}
+	var total int64
+
+	err := walkArchive(name, func(e *entry) error {
+		p := strings.TrimSuffix(strings.TrimPrefix(e.name, "./"), "/")
+		if e.dir && p == "." {
+			return nil
+		}
+		if err := validPath(p); err != nil {
+			return err
+		}
+		if seen[p] {
+			return errors.Errorf("duplicate archive path %s", p)
+		}
+		seen[p] = true
+
+		if e.dir {
+			return nil
+		}
+		if !e.regular {
+			return errors.Errorf("%s isn't a regular file", p)
+		}
+		s, ok := f[p]
+		if !ok {
+			return errors.Errorf("%s has no destination", p)
+		}
+
+		r, err := e.open()
+		if err != nil {
+			return errors.Wrapf(err, "failed to read %s", p)
+		}
+		defer r.Close()
+
+		// count what's read, the sizes in the headers can lie
+		lr := &limitedReader{r: r, n: maxSize - total, limited: maxSize > 0}
+		err = fn(File{
+			Name:  path.Base(p),
+			Dest:  s.Dest,
+			Mode:  s.Mode,
+			Owner: s.Owner,
+			Group: s.Group,
+		}, lr)
+		total += lr.read
+		if lr.exceeded {
+			return errors.Errorf("the files exceed the size limit of %d bytes", maxSize)
+		}
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, p := range f.paths() {
+		if !seen[p] {
+			return errors.Errorf("%s is missing from the archive", p)
+		}
+	}
+
+	return nil
+}
+
+// Extract writes the files of the archive into dir, named as in the
+// payload, and returns the meta-data; see Walk.
+func Extract(name, dir string, f Files, maxSize int64) (*MetaData, error) {
+	md := &MetaData{Files: []File{}}
+
+	err := Walk(name, f, maxSize, func(file File, r io.Reader) error {
+		out, err := os.OpenFile(filepath.Join(dir, file.Name),
+			os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if err != nil {
+			return errors.Wrapf(err, "failed to extract %s", file.Name)
+		}
+		if _, err := io.Copy(out, r); err != nil {
+			out.Close()
+			return errors.Wrapf(err, "failed to extract %s", file.Name)
+		}
+		if err := out.Close(); err != nil {
+			return errors.Wrapf(err, "failed to extract %s", file.Name)
+		}
+
+		md.Files = append(md.Files, file)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return md, nil
+}
+
+var zipMagic = []byte("PK\x03\x04")
+
+func walkArchive(name string, fn func(*entry) error) error {
+	f, err := os.Open(name)
+	if err != nil {
+		return errors.Wrap(err, "failed to open archive")
+	}
+	defer f.Close()
+
+	br := bufio.NewReader(f)
+	magic, _ := br.Peek(4)
+
+	switch {
+	case string(magic) == string(zipMagic):
+		fi, err := f.Stat()
+		if err != nil {
+			return errors.Wrap(err, "failed to open archive")
+		}
+		return walkZip(f, fi.Size(), fn)
+	case len(magic) >= 2 && magic[0] == 0x1f && magic[1] == 0x8b:
+		zr, err := gzip.NewReader(br)
+		if err != nil {
+			return errors.Wrap(err, "invalid archive")
+		}
+		defer zr.Close()
+		return walkTar(zr, fn)
+	}
+
+	return walkTar(br, fn)
+}
+
+func walkTar(r io.Reader, fn func(*entry) error) error {
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return errors.Wrap(err, "invalid archive")
+		}
+
+		err = fn(&entry{
+			name:    hdr.Name,
+			dir:     hdr.Typeflag == tar.TypeDir,
+			regular: hdr.Typeflag == tar.TypeReg,
+			open: func() (io.ReadCloser, error) {
+				return io.NopCloser(tr), nil
+			},
+		})
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func walkZip(r io.ReaderAt, size int64, fn func(*entry) error) error {
+	zr, err := zip.NewReader(r, size)
+	if err != nil {
+		return errors.Wrap(err, "invalid archive")
+	}
+
+	for _, zf := range zr.File {
+		mode := zf.Mode()
+		err := fn(&entry{
+			name:    zf.Name,
+			dir:     mode.IsDir(),
+			regular: mode.IsRegular(),
+			open:    zf.Open,
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// limitedReader fails reads past n bytes, when limited
+type limitedReader struct {
+	r        io.Reader
+	n        int64
+	limited  bool
+	read     int64
+	exceeded bool
+}
+
+func (l *limitedReader) Read(p []byte) (int, error) {
+	if l.limited && l.read >= l.n {
+		// is there more?
+		var b [1]byte
+		if n, _ := l.r.Read(b[:]); n > 0 {
+			l.exceeded = true
+			return 0, errors.New("size limit exceeded")
+		}
+		return 0, io.EOF
+	}
+	if l.limited && int64(len(p)) > l.n-l.read {
+		p = p[:l.n-l.read]
+	}
+
+	n, err := l.r.Read(p)
+	l.read += int64(n)
+	return n, err
+}
@@ -0,0 +1,269 @@
+// Copyright 2024 Northern.tech AS
+//
+//	Licensed under the Apache License, Version 2.0 (the "License");
+//	you may not use this file except in compliance with the License.
+//	You may obtain a copy of the License at
+//
+//	    http://www.apache.org/licenses/LICENSE-2.0
+//
+//	Unless required by applicable law or agreed to in writing, software
+//	distributed under the License is distributed on an "AS IS" BASIS,
+//	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//	See the License for the specific language governing permissions and
+//	limitations under the License.
+package multifile
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type testEntry struct {
+	name string
+	data string
+	// typ is a tar type flag, regular files by default
+	typ byte
+}
+
+func tarOf(t *testing.T, entries ...testEntry) []byte {
+	var b bytes.Buffer
+	tw := tar.NewWriter(&b)
+	for _, e := range entries {
+		typ := e.typ
+		if typ == 0 {
+			typ = tar.TypeReg
+		}
+		hdr := &tar.Header{Name: e.name, Mode: 0644, Typeflag: typ}
+		if typ == tar.TypeReg {
+			hdr.Size = int64(len(e.data))
+		}
+		if typ == tar.TypeSymlink {
+			hdr.Linkname = e.data
+		}
+		assert.NoError(t, tw.WriteHeader(hdr))
+		if typ == tar.TypeReg {
+			_, err := tw.Write([]byte(e.data))
+			assert.NoError(t, err)
+		}
+	}
+	assert.NoError(t, tw.Close())
+	return b.Bytes()
+}
+
+func gz(t *testing.T, b []byte) []byte {
+	var out bytes.Buffer
+	zw := gzip.NewWriter(&out)
+	_, err := zw.Write(b)
+	assert.NoError(t, err)
+	assert.NoError(t, zw.Close())
+	return out.Bytes()
+}
+
+func zipOf(t *testing.T, entries ...testEntry) []byte {
+	var b bytes.Buffer
+	zw := zip.NewWriter(&b)
+	for _, e := range entries {
+		w, err := zw.Create(e.name)
+		assert.NoError(t, err)
+		_, err = w.Write([]byte(e.data))
+		assert.NoError(t, err)
+	}
+	assert.NoError(t, zw.Close())
+	return b.Bytes()
+}
+
+func testFiles() Files {
+	return Files{
+		"conf/app.conf": {Dest: "/etc/app/app.conf", Mode: "0640", Owner: "app"},
+		"certs/ca.pem":  {Dest: "/etc/app/ca.pem"},
+	}
+}
+
+func TestFilesValidate(t *testing.T) {
+	tc := map[string]struct {
+		files Files
+
+		res Files
+		err string
+	}{
+		"ok, with defaults": {
+			files: testFiles(),
+			res: Files{
+				"conf/app.conf": {Dest: "/etc/app/app.conf", Mode: "0640", Owner: "app", Group: "app"},
+				"certs/ca.pem":  {Dest: "/etc/app/ca.pem", Mode: "0644", Owner: "root", Group: "root"},
+			},
+		},
+		"numeric owner": {
+			files: Files{"a": {Dest: "/a", Owner: "1000", Group: "100"}},
+			res:   Files{"a": {Dest: "/a", Mode: "0644", Owner: "1000", Group: "100"}},
+		},
+		"no files": {
+			files: Files{},
+			err:   "no files",
+		},
+		"escaping path": {
+			files: Files{"../etc/passwd": {Dest: "/etc/passwd"}},
+			err:   `invalid archive path "../etc/passwd"`,
+		},
+		"absolute path": {
+			files: Files{"/etc/passwd": {Dest: "/etc/passwd"}},
+			err:   `invalid archive path "/etc/passwd"`,
+		},
+		"unclean path": {
+			files: Files{"a/../b": {Dest: "/b"}},
+			err:   `invalid archive path "a/../b"`,
+		},
+		"relative destination": {
+			files: Files{"a": {Dest: "etc/a"}},
+			err:   `invalid destination "etc/a" of a`,
+		},
+		"same destination": {
+			files: Files{"a": {Dest: "/etc/x"}, "b": {Dest: "/etc/x"}},
+			err:   "a and b have the same destination /etc/x",
+		},
+		"same name": {
+			files: Files{"a/x": {Dest: "/a/x"}, "b/x": {Dest: "/b/x"}},
+			err:   "a/x and b/x have the same name",
+		},
+		"invalid mode": {
+			files: Files{"a": {Dest: "/a", Mode: "0999"}},
+			err:   `invalid mode "0999" of a`,
+		},
+		"invalid owner": {
+			files: Files{"a": {Dest: "/a", Owner: "root; rm -rf /"}},
+			err:   `invalid owner "root; rm -rf /" of a`,
+		},
+		"invalid group": {
+			files: Files{"a": {Dest: "/a", Group: "-x"}},
+			err:   `invalid group "-x" of a`,
+		},
+	}
+
+	for name, tc := range tc {
+		t.Run(name, func(t *testing.T) {
+			err := tc.files.Validate()
+			if tc.err != "" {
+				assert.EqualError(t, err, tc.err)
+				return
+			}
+
+			assert.NoError(t, err)
+			assert.Equal(t, tc.res, tc.files)
+		})
+	}
+}
+
+func TestExtract(t *testing.T) {
+	ok := []testEntry{
+		{name: "conf/", typ: tar.TypeDir},
+		{name: "conf/app.conf", data: "conf"},
+		{name: "./certs/ca.pem", data: "cert"},
+	}
+	md := &MetaData{Files: []File{
+		{Name: "app.conf", Dest: "/etc/app/app.conf", Mode: "0640", Owner: "app", Group: "app"},
+		{Name: "ca.pem", Dest: "/etc/app/ca.pem", Mode: "0644", Owner: "root", Group: "root"},
+	}}
+
+	tc := map[string]struct {
+		archive []byte
+		maxSize int64
+
+		res *MetaData
+		err string
+	}{
+		"tar": {
+			archive: tarOf(t, ok...),
+			res:     md,
+		},
+		"tar.gz": {
+			archive: gz(t, tarOf(t, ok...)),
+			res:     md,
+		},
+		"zip": {
+			archive: zipOf(t,
+				testEntry{name: "conf/app.conf", data: "conf"},
+				testEntry{name: "certs/ca.pem", data: "cert"},
+			),
+			res: md,
+		},
+		"within size limit": {
+			archive: tarOf(t, ok...),
+			maxSize: 8,
+			res:     md,
+		},
+		"zip slip": {
+			archive: zipOf(t, testEntry{name: "../../etc/passwd", data: "x"}),
+			err:     `invalid archive path "../../etc/passwd"`,
+		},
+		"absolute path": {
+			archive: tarOf(t, testEntry{name: "/etc/passwd", data: "x"}),
+			err:     `invalid archive path "/etc/passwd"`,
+		},
+		"duplicate": {
+			archive: tarOf(t,
+				testEntry{name: "conf/app.conf", data: "conf"},
+				testEntry{name: "./conf/app.conf", data: "evil"},
+			),
+			err: "duplicate archive path conf/app.conf",
+		},
+		"symlink": {
+			archive: tarOf(t, testEntry{name: "conf/app.conf", data: "/etc/shadow", typ: tar.TypeSymlink}),
+			err:     "conf/app.conf isn't a regular file",
+		},
+		"unmapped file": {
+			archive: tarOf(t, append(ok, testEntry{name: "extra", data: "x"})...),
+			err:     "extra has no destination",
+		},
+		"missing file": {
+			archive: tarOf(t, testEntry{name: "conf/app.conf", data: "conf"}),
+			err:     "certs/ca.pem is missing from the archive",
+		},
+		"size limit": {
+			archive: tarOf(t, ok...),
+			maxSize: 7,
+			err:     "the files exceed the size limit of 7 bytes",
+		},
+		"not an archive": {
+			archive: []byte("not an archive, not at all, no sir, not even close to one!"),
+			err:     "invalid archive",
+		},
+	}
+
+	for name, tc := range tc {
+		t.Run(name, func(t *testing.T) {
+			dir := t.TempDir()
+			archive := filepath.Join(dir, "archive")
+			assert.NoError(t, ioutil.WriteFile(archive, tc.archive, 0644))
+			out := filepath.Join(dir, "out")
+			assert.NoError(t, os.Mkdir(out, 0755))
+
+			files := testFiles()
+			assert.NoError(t, files.Validate())
+
+			res, err := Extract(archive, out, files, tc.maxSize)
+			if tc.err != "" {
+				assert.Error(t, err)
+				assert.Contains(t, err.Error(), tc.err)
+				return
+			}
+
+			assert.NoError(t, err)
+			assert.Equal(t, tc.res, res)
+
+			b, err := ioutil.ReadFile(filepath.Join(out, "app.conf"))
+			assert.NoError(t, err)
+			assert.Equal(t, "conf", string(b))
+			b, err = ioutil.ReadFile(filepath.Join(out, "ca.pem"))
+			assert.NoError(t, err)
+			assert.Equal(t, "cert", string(b))
+		})
+	}
+}
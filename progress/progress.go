@@ -0,0 +1,334 @@
+// Copyright 2024 Northern.tech AS
+//
+//	Licensed under the Apache License, Version 2.0 (the "License");
+//	you may not use this file except in compliance with the License.
+//	You may obtain a copy of the License at
+//
+//	    http://www.apache.org/licenses/LICENSE-2.0
+//
+//	Unless required by applicable law or agreed to in writing, software
+//	distributed under the License is distributed on an "AS IS" BASIS,
+//	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//	See the License for the specific language governing permissions and
+//	limitations under the License.
+
+// Package progress reports the progress of long running job stages, as
+// periodic log entries and optionally POSTs to a callback url.
+package progress
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"math"
+	"net/http"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+
+	mlog "github.com/mendersoftware/create-artifact-worker/log"
+)
+
+const (
+	StageDownload = "download"
+	StageChecksum = "checksum"
+	StageGenerate = "generate"
+	StageUpload   = "upload"
+)
+
+const callbackTimeout = 10 * time.Second
+
+// Update is a progress report, also the json body POSTed to the callback.
+type Update struct {
+	ArtifactId string `json:"artifact_id"`
+	TenantId   string `json:"tenant_id"`
+	Stage      string `json:"stage"`
+
+	Bytes int64 `json:"bytes"`
+	// Total is 0 if unknown, so are Percent and ETA then
+	Total          int64   `json:"total"`
+	Percent        float64 `json:"percent"`
+	BytesPerSecond float64 `json:"bytes_per_second"`
+	ETASeconds     float64 `json:"eta_seconds"`
+
+	Done bool `json:"done"`
+}
+
+// Reporter starts the trackers of one job's stages.
+type Reporter struct {
+	ArtifactId string
+	TenantId   string
+
+	// Interval between reports of a stage; <= 0 disables reporting.
+	Interval time.Duration
+
+	// CallbackUrl receives every update as a json POST, if set.
+	CallbackUrl string
+	Client      *http.Client
+}
+
+// Start starts tracking a stage of total bytes (0 if not known yet),
+// reporting until Done is called. Returns nil if reporting is disabled.
+// The callback requests are cancelled with ctx, the job's.
+func (r *Reporter) Start(ctx context.Context, stage string, total int64) *Tracker {
+	if r == nil || r.Interval <= 0 {
+		return nil
+	}
+
+	t := &Tracker{
+		r:     r,
+		ctx:   ctx,
+		l:     mlog.FromContext(ctx).With("stage", stage),
+		stage: stage,
+		start: time.Now(),
+		now:   time.Now,
+		stop:  make(chan struct{}),
+		done:  make(chan struct{}),
+	}
+	t.total.Store(total)
+
+	go t.loop(r.Interval)
+
+	return t
+}
+
+// Tracker counts the bytes processed in a stage. A nil *Tracker counts
+// nothing, so code paths without progress reporting don't need to check.
+type Tracker struct {
+	r     *Reporter
+	ctx   context.Context
+	l     *mlog.Logger
+	stage string
+
+	// set while an update is being posted, the following ones are
+	// dropped meanwhile
+	posting atomic.Bool
+	posts   sync.WaitGroup
+
+	bytes atomic.Int64
+	total atomic.Int64
+
+	mu   sync.Mutex
+	file string
+
+	start time.Time
+	now   func() time.Time
+
+	stopOnce sync.Once
+	stop     chan struct{}
+	done     chan struct{}
+}
+
+// SetTotal sets the stage's size once it's known, e.g. from a response.
+func (t *Tracker) SetTotal(n int64) {
+	if t == nil || n < 0 {
+		return
+	}
+	t.total.Store(n)
+}
+
+// Add counts n more bytes.
+func (t *Tracker) Add(n int64) {
+	if t == nil {
+		return
+	}
+	t.bytes.Add(n)
+}
+
+// Reader counts the bytes read through r.
+func (t *Tracker) Reader(r io.Reader) io.Reader {
+	if t == nil {
+		return r
+	}
+	return &reader{r: r, t: t}
+}
+
+// WatchFile takes the bytes processed from the size of a file written by
+// someone else, e.g. the artifact a generator subprocess writes.
+func (t *Tracker) WatchFile(path string) {
+	if t == nil {
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.file = path
+}
+
+// Done stops the tracker, reporting the final state.
+func (t *Tracker) Done() {
+	if t == nil {
+		return
+	}
+
+	t.stopOnce.Do(func() {
+		close(t.stop)
+	})
+	<-t.done
+}
+
+func (t *Tracker) loop(interval time.Duration) {
+	defer close(t.done)
+
+	tick := time.NewTicker(interval)
+	defer tick.Stop()
+
+	for {
+		select {
+		case <-tick.C:
+			t.report(false)
+		case <-t.stop:
+			t.report(true)
+			return
+		}
+	}
+}
+
+// Update returns the current state of the stage.
+func (t *Tracker) Update() Update {
+	t.mu.Lock()
+	file := t.file
+	t.mu.Unlock()
+
+	if file != "" {
+		if fi, err := os.Stat(file); err == nil {
+			t.bytes.Store(fi.Size())
+		}
+	}
+
+	u := Update{
+		ArtifactId: t.r.ArtifactId,
+		TenantId:   t.r.TenantId,
+		Stage:      t.stage,
+		Bytes:      t.bytes.Load(),
+		Total:      t.total.Load(),
+	}
+
+	elapsed := t.now().Sub(t.start).Seconds()
+	if elapsed > 0 {
+		u.BytesPerSecond = float64(u.Bytes) / elapsed
+	}
+
+	if u.Total > 0 {
+		u.Percent = 100 * float64(u.Bytes) / float64(u.Total)
+		if u.Percent > 100 {
+			u.Percent = 100
+		}
+
+		if u.BytesPerSecond > 0 && u.Bytes < u.Total {
+			u.ETASeconds = float64(u.Total-u.Bytes) / u.BytesPerSecond
+		}
+	}
+
+	return u
+}
+
+func (t *Tracker) report(done bool) {
+	u := t.Update()
+	u.Done = done
+
+	t.l.With(
+		"bytes", u.Bytes,
+		"total", u.Total,
+		"percent", round(u.Percent),
+		"bytes_per_second", int64(u.BytesPerSecond),
+		"eta_seconds", int64(math.Ceil(u.ETASeconds)),
+	).Info("progress")
+
+	if t.r.CallbackUrl == "" {
+		return
+	}
+
+	if done {
+		// the final update is neither dropped nor overtaken
+		t.posts.Wait()
+		t.post(&u)
+		return
+	}
+
+	// a slow callback mustn't hold up the ticks
+	if !t.posting.CompareAndSwap(false, true) {
+		return
+	}
+	t.posts.Add(1)
+	go func() {
+		defer t.posts.Done()
+		defer t.posting.Store(false)
+		t.post(&u)
+	}()
+}
+
+func (t *Tracker) post(u *Update) {
+	err := t.r.post(t.ctx, u)
+	// a cancelled job's updates don't matter anymore
+	if err != nil && t.ctx.Err() == nil {
+		t.l.Error("failed to post progress: %s", err.Error())
+	}
+}
+
+func (r *Reporter) post(ctx context.Context, u *Update) error {
+	body, err := json.Marshal(u)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, callbackTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, r.CallbackUrl,
+		bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	c := r.Client
+	if c == nil {
+		c = http.DefaultClient
+	}
+
+	res, err := c.Do(req)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+
+	if res.StatusCode >= 300 {
+		return errors.Errorf("progress callback returned http %d", res.StatusCode)
+	}
+
+	return nil
+}
+
+func round(f float64) float64 {
+	return float64(int64(f*10+0.5)) / 10
+}
+
+type reader struct {
+	r io.Reader
+	t *Tracker
+}
+
+func (r *reader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.t.Add(int64(n))
+	return n, err
+}
+
+type ctxKey struct{}
+
+// NewContext returns a context carrying t, for code deep down the call
+// stack to report to.
+func NewContext(ctx context.Context, t *Tracker) context.Context {
+	return context.WithValue(ctx, ctxKey{}, t)
+}
+
+// FromContext returns the tracker carried by ctx, nil if none.
+func FromContext(ctx context.Context) *Tracker {
+	t, _ := ctx.Value(ctxKey{}).(*Tracker)
+	return t
+}
@@ -0,0 +1,308 @@
+// Copyright 2024 Northern.tech AS
+//
+//	Licensed under the Apache License, Version 2.0 (the "License");
+//	you may not use this file except in compliance with the License.
+//	You may obtain a copy of the License at
+//
+//	    http://www.apache.org/licenses/LICENSE-2.0
+//
+//	Unless required by applicable law or agreed to in writing, software
+//	distributed under the License is distributed on an "AS IS" BASIS,
+//	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//	See the License for the specific language governing permissions and
+//	limitations under the License.
+package progress
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	mlog "github.com/mendersoftware/create-artifact-worker/log"
+)
+
+func TestTrackerUpdate(t *testing.T) {
+	testCases := map[string]struct {
+		bytes   int64
+		total   int64
+		elapsed time.Duration
+
+		percent float64
+		bps     float64
+		eta     float64
+	}{
+		"half way": {
+			bytes:   50,
+			total:   100,
+			elapsed: 10 * time.Second,
+
+			percent: 50,
+			bps:     5,
+			eta:     10,
+		},
+		"unknown total": {
+			bytes:   50,
+			elapsed: 10 * time.Second,
+
+			bps: 5,
+		},
+		"done": {
+			bytes:   100,
+			total:   100,
+			elapsed: 4 * time.Second,
+
+			percent: 100,
+			bps:     25,
+		},
+		"nothing yet": {
+			total:   100,
+			elapsed: time.Second,
+		},
+		"more than expected": {
+			bytes:   150,
+			total:   100,
+			elapsed: 10 * time.Second,
+
+			percent: 100,
+			bps:     15,
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			r := &Reporter{ArtifactId: "aid", TenantId: "tid", Interval: time.Hour}
+
+			tr := r.Start(context.Background(), StageDownload, tc.total)
+			defer tr.Done()
+
+			now := tr.start.Add(tc.elapsed)
+			tr.now = func() time.Time { return now }
+			tr.Add(tc.bytes)
+
+			u := tr.Update()
+			assert.Equal(t, "aid", u.ArtifactId)
+			assert.Equal(t, "tid", u.TenantId)
+			assert.Equal(t, StageDownload, u.Stage)
+			assert.Equal(t, tc.bytes, u.Bytes)
+			assert.Equal(t, tc.total, u.Total)
+			assert.InDelta(t, tc.percent, u.Percent, 0.001)
+			assert.InDelta(t, tc.bps, u.BytesPerSecond, 0.001)
+			assert.InDelta(t, tc.eta, u.ETASeconds, 0.001)
+			assert.False(t, u.Done)
+		})
+	}
+}
+
+func TestReporterCallback(t *testing.T) {
+	var mu sync.Mutex
+	var updates []Update
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, http.MethodPost, r.Method)
+		assert.Equal(t, "application/json", r.Header.Get("Content-Type"))
+
+		var u Update
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&u))
+
+		mu.Lock()
+		updates = append(updates, u)
+		mu.Unlock()
+	}))
+	defer srv.Close()
+
+	var out bytes.Buffer
+	mlog.SetOutput(&out)
+	defer mlog.SetOutput(os.Stderr)
+
+	r := &Reporter{
+		ArtifactId:  "aid",
+		TenantId:    "tid",
+		Interval:    time.Millisecond,
+		CallbackUrl: srv.URL,
+	}
+
+	tr := r.Start(context.Background(), StageUpload, 0)
+	tr.SetTotal(1024)
+
+	n, err := io.Copy(ioutil.Discard, tr.Reader(bytes.NewReader(make([]byte, 1024))))
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1024), n)
+
+	time.Sleep(10 * time.Millisecond)
+	tr.Done()
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	// ticks until done, then the final report
+	assert.True(t, len(updates) > 1)
+	last := updates[len(updates)-1]
+	assert.True(t, last.Done)
+	assert.Equal(t, "aid", last.ArtifactId)
+	assert.Equal(t, StageUpload, last.Stage)
+	assert.Equal(t, int64(1024), last.Bytes)
+	assert.Equal(t, int64(1024), last.Total)
+	assert.Equal(t, float64(100), last.Percent)
+	for _, u := range updates[:len(updates)-1] {
+		assert.False(t, u.Done)
+	}
+
+	assert.Contains(t, out.String(), "msg=progress")
+	assert.Contains(t, out.String(), "stage=upload")
+	assert.Contains(t, out.String(), "bytes=1024 total=1024 percent=100")
+}
+
+func TestReporterCallbackFailure(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer srv.Close()
+
+	var out bytes.Buffer
+	mlog.SetOutput(&out)
+	defer mlog.SetOutput(os.Stderr)
+
+	r := &Reporter{Interval: time.Hour, CallbackUrl: srv.URL}
+
+	// a failing callback is only logged
+	tr := r.Start(context.Background(), StageChecksum, 0)
+	tr.Done()
+
+	assert.Contains(t, out.String(), "failed to post progress: progress callback returned http 503")
+}
+
+func TestReporterCallbackSlow(t *testing.T) {
+	var posts atomic.Int32
+	var mu sync.Mutex
+	var updates []Update
+	release := make(chan struct{})
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var u Update
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&u))
+
+		mu.Lock()
+		updates = append(updates, u)
+		mu.Unlock()
+
+		if posts.Add(1) == 1 {
+			<-release
+		}
+	}))
+	defer srv.Close()
+
+	var out bytes.Buffer
+	mlog.SetOutput(&out)
+	defer mlog.SetOutput(os.Stderr)
+
+	r := &Reporter{Interval: time.Millisecond, CallbackUrl: srv.URL}
+	tr := r.Start(context.Background(), StageUpload, 0)
+
+	time.Sleep(50 * time.Millisecond)
+	assert.Equal(t, int32(1), posts.Load())
+
+	close(release)
+	tr.Done()
+
+	// the ticks went on, their updates dropped while the first was posted
+	assert.Greater(t, strings.Count(out.String(), "msg=progress"), 5)
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	// the final one waits for it, a tick may have made it in between
+	assert.LessOrEqual(t, len(updates), 3)
+	assert.False(t, updates[0].Done)
+	assert.True(t, updates[len(updates)-1].Done)
+}
+
+func TestReporterCallbackCancelled(t *testing.T) {
+	block := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-block
+	}))
+	defer srv.Close()
+	defer close(block)
+
+	var out bytes.Buffer
+	mlog.SetOutput(&out)
+	defer mlog.SetOutput(os.Stderr)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	r := &Reporter{Interval: time.Millisecond, CallbackUrl: srv.URL}
+	tr := r.Start(ctx, StageUpload, 0)
+
+	time.Sleep(10 * time.Millisecond)
+	cancel()
+
+	// the posts end with the job
+	done := make(chan struct{})
+	go func() {
+		tr.Done()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(callbackTimeout / 2):
+		t.Fatal("progress posts outlived the job")
+	}
+
+	assert.NotContains(t, out.String(), "failed to post progress")
+}
+
+func TestWatchFile(t *testing.T) {
+	f := filepath.Join(t.TempDir(), "artifact")
+
+	r := &Reporter{Interval: time.Hour}
+	tr := r.Start(context.Background(), StageGenerate, 0)
+	defer tr.Done()
+
+	tr.WatchFile(f)
+	assert.Equal(t, int64(0), tr.Update().Bytes)
+
+	assert.NoError(t, ioutil.WriteFile(f, []byte(strings.Repeat("x", 42)), 0644))
+	assert.Equal(t, int64(42), tr.Update().Bytes)
+}
+
+func TestDisabled(t *testing.T) {
+	var nilReporter *Reporter
+
+	testCases := map[string]*Reporter{
+		"nil reporter":  nilReporter,
+		"zero interval": {CallbackUrl: "http://localhost:1"},
+	}
+
+	for name, r := range testCases {
+		t.Run(name, func(t *testing.T) {
+			tr := r.Start(context.Background(), StageDownload, 10)
+			assert.Nil(t, tr)
+
+			// a nil tracker is safe to use
+			in := strings.NewReader("data")
+			assert.Equal(t, io.Reader(in), tr.Reader(in))
+			tr.SetTotal(10)
+			tr.Add(4)
+			tr.WatchFile("/nonexistent")
+			tr.Done()
+
+			ctx := NewContext(context.Background(), tr)
+			assert.Nil(t, FromContext(ctx))
+		})
+	}
+
+	assert.Nil(t, FromContext(context.Background()))
+}
@@ -0,0 +1,38 @@
+// Copyright 2024 Northern.tech AS
+//
+//	Licensed under the Apache License, Version 2.0 (the "License");
+//	you may not use this file except in compliance with the License.
+//	You may obtain a copy of the License at
+//
+//	    http://www.apache.org/licenses/LICENSE-2.0
+//
+//	Unless required by applicable law or agreed to in writing, software
+//	distributed under the License is distributed on an "AS IS" BASIS,
+//	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//	See the License for the specific language governing permissions and
+//	limitations under the License.
+
+package sandbox
+
+import (
+	"os"
+	"syscall"
+)
+
+const namespacesSupported = true
+
+// namespaces puts the process in new user, mount and network namespaces,
+// as our own user and group, without network access. The mount namespace
+// is unshared rather than cloned so that the runtime makes / recursively
+// private, mounts don't propagate in or out of it.
+func namespaces(a *syscall.SysProcAttr) {
+	a.Cloneflags = syscall.CLONE_NEWUSER | syscall.CLONE_NEWNET
+	a.Unshareflags = syscall.CLONE_NEWNS
+	a.UidMappings = []syscall.SysProcIDMap{
+		{ContainerID: os.Getuid(), HostID: os.Getuid(), Size: 1},
+	}
+	a.GidMappings = []syscall.SysProcIDMap{
+		{ContainerID: os.Getgid(), HostID: os.Getgid(), Size: 1},
+	}
+	a.GidMappingsEnableSetgroups = false
+}
@@ -0,0 +1,245 @@
+// Copyright 2024 Northern.tech AS
+//
+//	Licensed under the Apache License, Version 2.0 (the "License");
+//	you may not use this file except in compliance with the License.
+//	You may obtain a copy of the License at
+//
+//	    http://www.apache.org/licenses/LICENSE-2.0
+//
+//	Unless required by applicable law or agreed to in writing, software
+//	distributed under the License is distributed on an "AS IS" BASIS,
+//	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//	See the License for the specific language governing permissions and
+//	limitations under the License.
+
+// Package sandbox runs untrusted work, like generator scripts processing
+// tenant input, in a subprocess with resource limits, a scrubbed
+// environment, a private working directory and optionally Linux
+// namespaces.
+package sandbox
+
+import (
+	"context"
+	"io"
+	"os"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// KillDelay is how long a cancelled process gets to exit after
+	// SIGTERM before it's killed.
+	KillDelay = 10 * time.Second
+
+	// cpuTimeGrace is the time in seconds between the soft cpu time
+	// limit, sending SIGXCPU, and the hard one, sending SIGKILL.
+	cpuTimeGrace = 5
+
+	// defaultPath is the PATH of sandboxed processes, unless passed
+	// through.
+	defaultPath = "/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin"
+
+	// outputTail is how much of the output is searched for the errors of
+	// calls failing over the memory and open files limits.
+	outputTail = 4096
+)
+
+var (
+	// ENOMEM as reported by libc, coreutils, python, go and c++
+	reMemoryError = regexp.MustCompile(`(?i)cannot allocate memory|memory exhausted|` +
+		`out of memory|MemoryError|bad_alloc`)
+	// EMFILE
+	reOpenFilesError = regexp.MustCompile(`(?i)too many open files`)
+)
+
+// Config configures the sandbox; zero values disable the limits.
+type Config struct {
+	// CPUTime limits the cpu time, user and system, of the process and
+	// of each of its children.
+	CPUTime time.Duration
+
+	// Memory limits the address space in bytes.
+	Memory int64
+
+	// FileSize limits the size in bytes of the files written.
+	FileSize int64
+
+	// OpenFiles limits the number of open file descriptors.
+	OpenFiles int64
+
+	// Env names the environment variables passed through; the rest are
+	// dropped, and HOME, TMPDIR, LANG and PATH are set.
+	Env []string
+
+	// Namespaces runs the process in new user, mount and network
+	// namespaces, mounts made private; Linux only.
+	Namespaces bool
+}
+
+func (c Config) Validate() error {
+	if c.CPUTime < 0 || c.Memory < 0 || c.FileSize < 0 || c.OpenFiles < 0 {
+		return errors.New("limits can't be negative")
+	}
+
+	if c.limited() && !limitsSupported {
+		return errors.New("resource limits aren't supported on this platform")
+	}
+
+	if c.Namespaces && !namespacesSupported {
+		return errors.New("namespaces are only supported on linux")
+	}
+
+	return nil
+}
+
+func (c Config) limited() bool {
+	return c.CPUTime > 0 || c.Memory > 0 || c.FileSize > 0 || c.OpenFiles > 0
+}
+
+// LimitError is the failure of a process killed for exceeding a limit.
+type LimitError struct {
+	// Resource is the exceeded limit, e.g. "cpu time"
+	Resource string
+
+	err error
+}
+
+func (e *LimitError) Error() string {
+	return "exceeded the " + e.Resource + " limit: " + e.err.Error()
+}
+
+func (e *LimitError) Unwrap() error {
+	return e.err
+}
+
+func IsLimit(err error) bool {
+	var l *LimitError
+	return errors.As(err, &l)
+}
+
+// Run runs name with args within the sandbox, in dir - its private
+// working and home directory - and writes its output to out. When ctx is
+// done the process and all of its children are terminated.
+//
+// The cpu time and file size limits kill the process, with a *LimitError.
+// The memory and open files ones make the calls over them fail; the
+// process exiting with an error and reporting ENOMEM or EMFILE makes a
+// *LimitError too.
+func Run(ctx context.Context, c Config, dir string, out io.Writer, name string, args ...string) error {
+	tmp, err := os.MkdirTemp(dir, "tmp")
+	if err != nil {
+		return errors.Wrap(err, "failed to create the sandbox temp dir")
+	}
+	defer os.RemoveAll(tmp)
+
+	if c.limited() {
+		// the shell exec'ing the process sets the limits, so they're
+		// inherited by its children too
+		args = append([]string{"-c", ulimitScript(c), name}, args...)
+		name = "/bin/sh"
+	}
+
+	cmd := exec.CommandContext(ctx, name, args...)
+	cmd.Dir = dir
+	cmd.Env = env(c, dir, tmp)
+	tail := &tailWriter{}
+	cmd.Stdout = io.MultiWriter(out, tail)
+	cmd.Stderr = cmd.Stdout
+
+	stop, err := setup(cmd, c)
+	if err != nil {
+		return err
+	}
+
+	err = cmd.Run()
+	stop()
+	if err != nil {
+		return limitError(c, cmd, tail.b, err)
+	}
+
+	return nil
+}
+
+// outputLimitError tells the limit a process exiting with an error ran
+// into, from its output.
+func outputLimitError(c Config, output []byte, err error) error {
+	switch {
+	case c.Memory > 0 && reMemoryError.Match(output):
+		return &LimitError{Resource: "memory", err: err}
+	case c.OpenFiles > 0 && reOpenFilesError.Match(output):
+		return &LimitError{Resource: "open files", err: err}
+	}
+
+	return err
+}
+
+// tailWriter keeps the last outputTail bytes written.
+type tailWriter struct {
+	b []byte
+}
+
+func (t *tailWriter) Write(p []byte) (int, error) {
+	t.b = append(t.b, p...)
+	if len(t.b) > outputTail {
+		t.b = append(t.b[:0], t.b[len(t.b)-outputTail:]...)
+	}
+
+	return len(p), nil
+}
+
+// env scrubs the environment, the process mustn't see our credentials.
+func env(c Config, home, tmp string) []string {
+	e := []string{
+		"HOME=" + home,
+		"TMPDIR=" + tmp,
+		"LANG=C.UTF-8",
+	}
+
+	path := defaultPath
+	for _, n := range c.Env {
+		v, ok := os.LookupEnv(n)
+		switch {
+		case !ok:
+		case n == "PATH":
+			path = v
+		default:
+			e = append(e, n+"="+v)
+		}
+	}
+
+	return append(e, "PATH="+path)
+}
+
+// ulimitScript sets the limits and execs "$0" "$@".
+func ulimitScript(c Config) string {
+	var s []string
+
+	if c.CPUTime > 0 {
+		secs := int64((c.CPUTime + time.Second - 1) / time.Second)
+		s = append(s,
+			"ulimit -S -t "+itoa(secs),
+			"ulimit -H -t "+itoa(secs+cpuTimeGrace))
+	}
+	if c.Memory > 0 {
+		// in KiB
+		s = append(s, "ulimit -v "+itoa((c.Memory+1023)/1024))
+	}
+	if c.FileSize > 0 {
+		// in 512 byte blocks, as in POSIX
+		s = append(s, "ulimit -f "+itoa((c.FileSize+511)/512))
+	}
+	if c.OpenFiles > 0 {
+		s = append(s, "ulimit -n "+itoa(c.OpenFiles))
+	}
+
+	return strings.Join(append(s, `exec "$0" "$@"`), " && ")
+}
+
+func itoa(i int64) string {
+	return strconv.FormatInt(i, 10)
+}
@@ -0,0 +1,30 @@
+// Copyright 2024 Northern.tech AS
+//
+//	Licensed under the Apache License, Version 2.0 (the "License");
+//	you may not use this file except in compliance with the License.
+//	You may obtain a copy of the License at
+//
+//	    http://www.apache.org/licenses/LICENSE-2.0
+//
+//	Unless required by applicable law or agreed to in writing, software
+//	distributed under the License is distributed on an "AS IS" BASIS,
+//	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//	See the License for the specific language governing permissions and
+//	limitations under the License.
+
+//go:build !unix
+
+package sandbox
+
+import "os/exec"
+
+const limitsSupported = false
+
+func setup(cmd *exec.Cmd, c Config) (func(), error) {
+	cmd.WaitDelay = KillDelay
+	return func() {}, nil
+}
+
+func limitError(c Config, cmd *exec.Cmd, output []byte, err error) error {
+	return err
+}
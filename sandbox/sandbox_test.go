@@ -0,0 +1,220 @@
+// Copyright 2024 Northern.tech AS
+//
+//	Licensed under the Apache License, Version 2.0 (the "License");
+//	you may not use this file except in compliance with the License.
+//	You may obtain a copy of the License at
+//
+//	    http://www.apache.org/licenses/LICENSE-2.0
+//
+//	Unless required by applicable law or agreed to in writing, software
+//	distributed under the License is distributed on an "AS IS" BASIS,
+//	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//	See the License for the specific language governing permissions and
+//	limitations under the License.
+
+//go:build unix
+
+package sandbox
+
+import (
+	"bytes"
+	"context"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRun(t *testing.T) {
+	testCases := map[string]struct {
+		c      Config
+		script string
+
+		out      string
+		resource string
+		err      string
+	}{
+		"ok": {
+			script: "echo hello",
+			out:    "hello\n",
+		},
+		"failure": {
+			script: "echo failed; exit 3",
+			out:    "failed\n",
+			err:    "exit status 3",
+		},
+		"cpu time": {
+			c:        Config{CPUTime: time.Second},
+			script:   "while :; do :; done",
+			resource: "cpu time",
+		},
+		"file size": {
+			c:        Config{FileSize: 4096},
+			script:   "exec head -c 8192 /dev/zero > big",
+			resource: "file size",
+		},
+		"file size, in a child": {
+			c:        Config{FileSize: 4096},
+			script:   "head -c 8192 /dev/zero > big; exit $?",
+			resource: "file size",
+		},
+		"cpu time, in a child": {
+			c:        Config{CPUTime: time.Second},
+			script:   "sh -c 'while :; do :; done'; exit $?",
+			resource: "cpu time",
+		},
+		"open files": {
+			c:      Config{OpenFiles: 16},
+			script: "ulimit -n",
+			out:    "16\n",
+		},
+		"memory": {
+			c:      Config{Memory: 64 << 20},
+			script: "ulimit -v",
+			out:    "65536\n",
+		},
+		"memory, allocation failed": {
+			c:        Config{Memory: 64 << 20},
+			script:   "dd if=/dev/zero of=/dev/null bs=128M count=1",
+			resource: "memory",
+		},
+		"memory, no limit": {
+			script: "echo 'out of memory'; exit 1",
+			err:    "exit status 1",
+		},
+		"open files, opening failed": {
+			c:        Config{OpenFiles: 16},
+			script:   "echo 'open: Too many open files' >&2; exit 24",
+			resource: "open files",
+		},
+		"open files, exit status 0": {
+			c:      Config{OpenFiles: 16},
+			script: "echo 'Too many open files'",
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			var out bytes.Buffer
+			err := Run(context.Background(), tc.c, t.TempDir(), &out, "/bin/sh", "-c", tc.script)
+
+			switch {
+			case tc.resource != "":
+				var l *LimitError
+				if assert.True(t, errors.As(err, &l), "%v", err) {
+					assert.Equal(t, tc.resource, l.Resource)
+				}
+				var exitErr *exec.ExitError
+				assert.True(t, errors.As(err, &exitErr))
+			case tc.err != "":
+				assert.EqualError(t, err, tc.err)
+				assert.False(t, IsLimit(err))
+			default:
+				assert.NoError(t, err)
+			}
+
+			if tc.out != "" {
+				assert.Equal(t, tc.out, out.String())
+			}
+		})
+	}
+}
+
+func TestRunEnv(t *testing.T) {
+	t.Setenv("CREATE_ARTIFACT_SECRET", "s3cr3t")
+	t.Setenv("KEPT", "value")
+
+	dir := t.TempDir()
+
+	var out bytes.Buffer
+	err := Run(context.Background(), Config{Env: []string{"KEPT", "MISSING"}},
+		dir, &out, "/bin/sh", "-c", "env; pwd; touch $TMPDIR/tmpfile")
+	assert.NoError(t, err)
+
+	env := out.String()
+	assert.NotContains(t, env, "s3cr3t")
+	assert.Contains(t, env, "KEPT=value\n")
+	assert.NotContains(t, env, "MISSING")
+	assert.Contains(t, env, "HOME="+dir+"\n")
+	assert.Contains(t, env, "TMPDIR="+dir+"/tmp")
+	assert.Contains(t, env, "PATH="+defaultPath+"\n")
+	assert.True(t, strings.HasSuffix(env, dir+"\n"))
+
+	// the temp dir goes away with the process
+	left, _ := filepath.Glob(filepath.Join(dir, "tmp*"))
+	assert.Empty(t, left)
+}
+
+func TestRunCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	done := make(chan error)
+	go func() {
+		// the child keeps the output pipe open
+		done <- Run(ctx, Config{}, t.TempDir(), &bytes.Buffer{},
+			"/bin/sh", "-c", "sleep 60 & wait")
+	}()
+
+	time.Sleep(100 * time.Millisecond)
+	cancel()
+
+	select {
+	case err := <-done:
+		assert.Error(t, err)
+		assert.False(t, IsLimit(err))
+	case <-time.After(KillDelay):
+		t.Fatal("the process group wasn't terminated")
+	}
+}
+
+func TestRunNamespaces(t *testing.T) {
+	if !namespacesSupported {
+		t.Skip("namespaces not supported")
+	}
+
+	var out bytes.Buffer
+	err := Run(context.Background(), Config{Namespaces: true}, t.TempDir(), &out,
+		"/bin/sh", "-c", "cat /proc/self/uid_map /proc/net/dev /proc/self/mountinfo")
+	if err != nil {
+		// e.g. unprivileged user namespaces disabled
+		t.Skipf("can't create namespaces here: %s", err.Error())
+	}
+
+	// only the loopback device in the new network namespace
+	assert.Contains(t, out.String(), "lo:")
+	assert.NotContains(t, out.String(), "eth0:")
+	assert.Contains(t, out.String(), " 1\n")
+	// mounts don't propagate in or out
+	assert.NotContains(t, out.String(), "shared:")
+	assert.NotContains(t, out.String(), "master:")
+}
+
+func TestTailWriter(t *testing.T) {
+	w := &tailWriter{}
+	_, _ = w.Write(bytes.Repeat([]byte("a"), outputTail))
+	_, _ = w.Write([]byte("Too many open files"))
+
+	assert.Len(t, w.b, outputTail)
+	assert.True(t, bytes.HasSuffix(w.b, []byte("aToo many open files")))
+}
+
+func TestConfigValidate(t *testing.T) {
+	assert.NoError(t, Config{}.Validate())
+	assert.NoError(t, Config{CPUTime: time.Second, Memory: 1 << 30}.Validate())
+	assert.EqualError(t, Config{FileSize: -1}.Validate(), "limits can't be negative")
+}
+
+func TestUlimitScript(t *testing.T) {
+	s := ulimitScript(Config{
+		CPUTime:   1500 * time.Millisecond,
+		Memory:    1 << 20,
+		FileSize:  1000,
+		OpenFiles: 64,
+	})
+	assert.Equal(t, "ulimit -S -t 2 && ulimit -H -t 7 && ulimit -v 1024 && "+
+		`ulimit -f 2 && ulimit -n 64 && exec "$0" "$@"`, s)
+}
@@ -0,0 +1,89 @@
+// Copyright 2024 Northern.tech AS
+//
+//	Licensed under the Apache License, Version 2.0 (the "License");
+//	you may not use this file except in compliance with the License.
+//	You may obtain a copy of the License at
+//
+//	    http://www.apache.org/licenses/LICENSE-2.0
+//
+//	Unless required by applicable law or agreed to in writing, software
+//	distributed under the License is distributed on an "AS IS" BASIS,
+//	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//	See the License for the specific language governing permissions and
+//	limitations under the License.
+
+//go:build unix
+
+package sandbox
+
+import (
+	"os/exec"
+	"syscall"
+	"time"
+)
+
+const limitsSupported = true
+
+// setup runs cmd in a process group of its own and, when its context is
+// done, terminates the whole group - a script's children would otherwise
+// outlive it - and kills what's left after KillDelay. The returned func,
+// called once cmd has been waited for, calls off the kill: the group's id
+// may be reused by then.
+func setup(cmd *exec.Cmd, c Config) (func(), error) {
+	// set by Cancel, which Wait waits for
+	var kill *time.Timer
+
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	cmd.Cancel = func() error {
+		pgid := -cmd.Process.Pid
+		kill = time.AfterFunc(KillDelay, func() {
+			_ = syscall.Kill(pgid, syscall.SIGKILL)
+		})
+
+		return syscall.Kill(pgid, syscall.SIGTERM)
+	}
+	// children still holding the output pipe mustn't block Wait
+	cmd.WaitDelay = KillDelay
+
+	if c.Namespaces {
+		namespaces(cmd.SysProcAttr)
+	}
+
+	return func() {
+		if kill != nil {
+			kill.Stop()
+		}
+	}, nil
+}
+
+// limitError tells the limit the process, or a child it exited after,
+// was killed for exceeding or, from its output, ran into, if any.
+func limitError(c Config, cmd *exec.Cmd, output []byte, err error) error {
+	if cmd.ProcessState == nil {
+		return err
+	}
+
+	ws, ok := cmd.ProcessState.Sys().(syscall.WaitStatus)
+	if !ok {
+		return err
+	}
+
+	killedBy := func(sig syscall.Signal) bool {
+		// shells exit with 128+n after a child killed by signal n
+		return ws.Signaled() && ws.Signal() == sig ||
+			ws.Exited() && ws.ExitStatus() == 128+int(sig)
+	}
+	cpu := cmd.ProcessState.UserTime() + cmd.ProcessState.SystemTime()
+
+	switch {
+	case c.CPUTime > 0 && killedBy(syscall.SIGXCPU),
+		c.CPUTime > 0 && killedBy(syscall.SIGKILL) && cpu >= c.CPUTime:
+		return &LimitError{Resource: "cpu time", err: err}
+	case c.FileSize > 0 && killedBy(syscall.SIGXFSZ):
+		return &LimitError{Resource: "file size", err: err}
+	case ws.Exited() && ws.ExitStatus() != 0:
+		return outputLimitError(c, output, err)
+	}
+
+	return err
+}
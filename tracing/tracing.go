@@ -0,0 +1,111 @@
+// Copyright 2024 Northern.tech AS
+//
+//	Licensed under the Apache License, Version 2.0 (the "License");
+//	you may not use this file except in compliance with the License.
+//	You may obtain a copy of the License at
+//
+//	    http://www.apache.org/licenses/LICENSE-2.0
+//
+//	Unless required by applicable law or agreed to in writing, software
+//	distributed under the License is distributed on an "AS IS" BASIS,
+//	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//	See the License for the specific language governing permissions and
+//	limitations under the License.
+
+// Package tracing sets up OpenTelemetry tracing of generation jobs,
+// exported over OTLP/HTTP. Without an endpoint spans aren't recorded, but
+// a parent trace context is still propagated to the services called.
+package tracing
+
+import (
+	"context"
+
+	"github.com/pkg/errors"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+
+	mlog "github.com/mendersoftware/create-artifact-worker/log"
+)
+
+const (
+	serviceName = "create-artifact-worker"
+	tracerName  = "github.com/mendersoftware/create-artifact-worker"
+)
+
+// Config configures the trace export.
+type Config struct {
+	// Endpoint is the OTLP/HTTP collector url, e.g.
+	// http://otel-collector:4318; tracing is off if empty.
+	Endpoint string
+}
+
+func init() {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(
+		propagation.TraceContext{},
+		propagation.Baggage{},
+	))
+}
+
+// Init installs the global tracer provider. The returned func flushes and
+// stops the export; call it before exiting.
+func Init(ctx context.Context, c Config) (func(context.Context) error, error) {
+	if c.Endpoint == "" {
+		return func(context.Context) error { return nil }, nil
+	}
+
+	exp, err := otlptracehttp.New(ctx, otlptracehttp.WithEndpointURL(c.Endpoint))
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create trace exporter")
+	}
+
+	tp := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exp),
+		sdktrace.WithResource(resource.NewSchemaless(
+			attribute.String("service.name", serviceName),
+		)),
+	)
+	otel.SetTracerProvider(tp)
+
+	return tp.Shutdown, nil
+}
+
+// WithParent returns ctx carrying the remote span context of a W3C
+// traceparent (and optional tracestate), e.g. from the workflow input.
+func WithParent(ctx context.Context, traceparent, tracestate string) context.Context {
+	if traceparent == "" {
+		return ctx
+	}
+
+	carrier := propagation.MapCarrier{"traceparent": traceparent}
+	if tracestate != "" {
+		carrier["tracestate"] = tracestate
+	}
+
+	return otel.GetTextMapPropagator().Extract(ctx, carrier)
+}
+
+// Start starts a span; finish it with End.
+func Start(
+	ctx context.Context,
+	name string,
+	attrs ...attribute.KeyValue,
+) (context.Context, trace.Span) {
+	return otel.Tracer(tracerName).Start(ctx, name, trace.WithAttributes(attrs...))
+}
+
+// End ends span, marking it failed if err isn't nil.
+func End(span trace.Span, err error) {
+	if err != nil {
+		// errors may carry pre-signed urls
+		msg := mlog.Redact(err.Error())
+		span.RecordError(errors.New(msg))
+		span.SetStatus(codes.Error, msg)
+	}
+	span.End()
+}
@@ -0,0 +1,123 @@
+// Copyright 2024 Northern.tech AS
+//
+//	Licensed under the Apache License, Version 2.0 (the "License");
+//	you may not use this file except in compliance with the License.
+//	You may obtain a copy of the License at
+//
+//	    http://www.apache.org/licenses/LICENSE-2.0
+//
+//	Unless required by applicable law or agreed to in writing, software
+//	distributed under the License is distributed on an "AS IS" BASIS,
+//	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//	See the License for the specific language governing permissions and
+//	limitations under the License.
+package tracing
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	testTraceparent = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	testTraceId     = "4bf92f3577b34da6a3ce929d0e0e4736"
+)
+
+func recordSpans(t *testing.T) *tracetest.SpanRecorder {
+	prev := otel.GetTracerProvider()
+	t.Cleanup(func() {
+		otel.SetTracerProvider(prev)
+	})
+
+	sr := tracetest.NewSpanRecorder()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(sr)))
+
+	return sr
+}
+
+func TestWithParent(t *testing.T) {
+	ctx := WithParent(context.Background(), testTraceparent, "vendor=value")
+
+	sc := trace.SpanContextFromContext(ctx)
+	assert.True(t, sc.IsValid())
+	assert.True(t, sc.IsRemote())
+	assert.Equal(t, testTraceId, sc.TraceID().String())
+	assert.Equal(t, "vendor=value", sc.TraceState().String())
+
+	ctx = WithParent(context.Background(), "", "")
+	assert.False(t, trace.SpanContextFromContext(ctx).IsValid())
+
+	ctx = WithParent(context.Background(), "garbage", "")
+	assert.False(t, trace.SpanContextFromContext(ctx).IsValid())
+}
+
+func TestStartEnd(t *testing.T) {
+	sr := recordSpans(t)
+
+	ctx := WithParent(context.Background(), testTraceparent, "")
+	ctx, job := Start(ctx, "job")
+	_, dl := Start(ctx, "storage.Download")
+	End(dl, errors.New("failed to download http://s3/b/k?X-Amz-Signature=s3cr3t"))
+	End(job, nil)
+
+	spans := sr.Ended()
+	assert.Len(t, spans, 2)
+
+	assert.Equal(t, "storage.Download", spans[0].Name())
+	assert.Equal(t, job.SpanContext().SpanID(), spans[0].Parent().SpanID())
+	assert.Equal(t, codes.Error, spans[0].Status().Code)
+	assert.Equal(t,
+		"failed to download http://s3/b/k?X-Amz-Signature=xxxxx",
+		spans[0].Status().Description)
+	for _, ev := range spans[0].Events() {
+		for _, attr := range ev.Attributes {
+			assert.NotContains(t, attr.Value.Emit(), "s3cr3t")
+		}
+	}
+
+	assert.Equal(t, "job", spans[1].Name())
+	assert.Equal(t, testTraceId, spans[1].SpanContext().TraceID().String())
+	assert.Equal(t, codes.Unset, spans[1].Status().Code)
+}
+
+func TestInit(t *testing.T) {
+	prev := otel.GetTracerProvider()
+	defer otel.SetTracerProvider(prev)
+
+	shutdown, err := Init(context.Background(), Config{})
+	assert.NoError(t, err)
+	assert.NoError(t, shutdown(context.Background()))
+	assert.Equal(t, prev, otel.GetTracerProvider())
+
+	var mu sync.Mutex
+	var exported []string
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		exported = append(exported, r.Method+" "+r.URL.Path)
+	}))
+	defer collector.Close()
+
+	shutdown, err = Init(context.Background(), Config{Endpoint: collector.URL})
+	assert.NoError(t, err)
+
+	_, span := Start(context.Background(), "job")
+	End(span, nil)
+
+	assert.NoError(t, shutdown(context.Background()))
+
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Equal(t, []string{"POST /v1/traces"}, exported)
+}
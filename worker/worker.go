@@ -0,0 +1,360 @@
+// Copyright 2024 Northern.tech AS
+//
+//	Licensed under the Apache License, Version 2.0 (the "License");
+//	you may not use this file except in compliance with the License.
+//	You may obtain a copy of the License at
+//
+//	    http://www.apache.org/licenses/LICENSE-2.0
+//
+//	Unless required by applicable law or agreed to in writing, software
+//	distributed under the License is distributed on an "AS IS" BASIS,
+//	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//	See the License for the specific language governing permissions and
+//	limitations under the License.
+
+// Package worker consumes the jobs the workflows service publishes to NATS
+// JetStream, in place of the workflows worker running a CLI per job.
+package worker
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/pkg/errors"
+
+	mlog "github.com/mendersoftware/create-artifact-worker/log"
+)
+
+const (
+	DefaultAckWait = 30 * time.Second
+
+	// how long a fetch waits for a message before checking for shutdown
+	fetchWait = time.Second
+
+	// backoff after failing to fetch, e.g. while reconnecting
+	fetchRetryDelay = time.Second
+)
+
+// nakDelay is the delay before redelivering a failed job, multiplied by
+// the number of deliveries so far.
+var nakDelay = 10 * time.Second
+
+// Config configures the connection and the durable consumer.
+type Config struct {
+	Url string
+
+	// Stream is the JetStream stream of the workflows service; jobs of a
+	// workflow are published to <Stream>.<Topic>.
+	Stream  string
+	Topic   string
+	Durable string
+
+	// Concurrency is the number of jobs processed in parallel.
+	Concurrency int
+
+	// MaxDeliver is how many times a job is tried, retries included;
+	// 0 means no limit.
+	MaxDeliver int
+
+	// AckWait is how long a job may go without a sign of life before it
+	// is redelivered; running jobs report progress every AckWait/2.
+	AckWait time.Duration
+
+	// DrainTimeout is how long running jobs get to finish on shutdown,
+	// before being cancelled and handed back for redelivery.
+	DrainTimeout time.Duration
+}
+
+func (c Config) subject() string {
+	return c.Stream + "." + c.Topic
+}
+
+// Job is a workflow job as published by the workflows service.
+type Job struct {
+	Id              string           `json:"id"`
+	WorkflowName    string           `json:"workflowName"`
+	InputParameters []InputParameter `json:"inputParameters"`
+
+	// Redelivered tells if the job is delivered again if its handler
+	// fails, not permanently; false on the last delivery.
+	Redelivered bool `json:"-"`
+}
+
+type InputParameter struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+// Input returns the value of the named input parameter, "" if missing.
+func (j *Job) Input(name string) string {
+	for _, p := range j.InputParameters {
+		if p.Name == name {
+			return p.Value
+		}
+	}
+	return ""
+}
+
+// Handler processes a job. A job whose handler fails is redelivered, up to
+// MaxDeliver times, unless the error is Permanent.
+type Handler func(ctx context.Context, j *Job) error
+
+type permanentError struct {
+	error
+}
+
+func (e *permanentError) Unwrap() error {
+	return e.error
+}
+
+func (e *permanentError) Cause() error {
+	return e.error
+}
+
+// Permanent marks err as a failure retrying won't fix.
+func Permanent(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &permanentError{err}
+}
+
+func IsPermanent(err error) bool {
+	var p *permanentError
+	return errors.As(err, &p)
+}
+
+type Worker struct {
+	c Config
+	h Handler
+}
+
+func New(c Config, h Handler) *Worker {
+	if c.Concurrency <= 0 {
+		c.Concurrency = 1
+	}
+	if c.AckWait <= 0 {
+		c.AckWait = DefaultAckWait
+	}
+
+	return &Worker{c: c, h: h}
+}
+
+// Run processes jobs until ctx is done, then drains: no new jobs are
+// fetched and the running ones get DrainTimeout to finish.
+func (w *Worker) Run(ctx context.Context) error {
+	l := mlog.FromContext(ctx)
+
+	nc, err := nats.Connect(w.c.Url,
+		nats.Name("create-artifact-worker"),
+		nats.MaxReconnects(-1),
+	)
+	if err != nil {
+		return errors.Wrapf(err, "failed to connect to nats at %s", mlog.RedactURL(w.c.Url))
+	}
+	defer nc.Close()
+
+	js, err := nc.JetStream()
+	if err != nil {
+		return errors.Wrap(err, "failed to init jetstream")
+	}
+
+	if err := w.ensureConsumer(js); err != nil {
+		return err
+	}
+
+	sub, err := js.PullSubscribe(w.c.subject(), w.c.Durable, nats.Bind(w.c.Stream, w.c.Durable))
+	if err != nil {
+		return errors.Wrapf(err, "failed to subscribe to %s", w.c.subject())
+	}
+	// bound to the consumer, so this leaves it in place for the next run
+	defer func() { _ = sub.Unsubscribe() }()
+
+	l.Info("processing jobs from %s as %s, %d at a time",
+		w.c.subject(), w.c.Durable, w.c.Concurrency)
+
+	// jobs outlive ctx while draining
+	jobCtx, cancelJobs := context.WithCancel(context.WithoutCancel(ctx))
+	defer cancelJobs()
+
+	sem := make(chan struct{}, w.c.Concurrency)
+	wg := sync.WaitGroup{}
+
+fetch:
+	for {
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+			break fetch
+		}
+
+		msg, err := w.fetch(ctx, sub)
+		if err != nil {
+			<-sem
+			if ctx.Err() != nil {
+				break fetch
+			}
+
+			l.Error("failed to fetch jobs: %s", err.Error())
+			select {
+			case <-time.After(fetchRetryDelay):
+			case <-ctx.Done():
+				break fetch
+			}
+			continue
+		}
+		if msg == nil {
+			<-sem
+			continue
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			w.process(jobCtx, msg)
+		}()
+	}
+
+	l.Info("draining, waiting for running jobs to finish")
+
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(w.c.DrainTimeout):
+		l.Warn("drain timeout of %s exceeded, cancelling running jobs", w.c.DrainTimeout)
+		cancelJobs()
+		<-done
+	}
+
+	l.Info("drained")
+
+	return nil
+}
+
+// ensureConsumer adds the durable pull consumer if it's missing; an
+// existing one is left as it is. The stream is the workflows service's,
+// it's never created or changed here.
+func (w *Worker) ensureConsumer(js nats.JetStreamContext) error {
+	_, err := js.StreamInfo(w.c.Stream)
+	if errors.Is(err, nats.ErrStreamNotFound) {
+		return errors.Errorf("stream %s not found; it's set up by the workflows service",
+			w.c.Stream)
+	}
+	if err != nil {
+		return errors.Wrapf(err, "failed to look up stream %s", w.c.Stream)
+	}
+
+	cc := &nats.ConsumerConfig{
+		Durable:       w.c.Durable,
+		FilterSubject: w.c.subject(),
+		AckPolicy:     nats.AckExplicitPolicy,
+		AckWait:       w.c.AckWait,
+		MaxDeliver:    w.c.MaxDeliver,
+		MaxAckPending: w.c.Concurrency,
+	}
+
+	_, err = js.ConsumerInfo(w.c.Stream, w.c.Durable)
+	if errors.Is(err, nats.ErrConsumerNotFound) {
+		_, err = js.AddConsumer(w.c.Stream, cc)
+	}
+	if err != nil {
+		return errors.Wrapf(err, "failed to set up consumer %s", w.c.Durable)
+	}
+
+	return nil
+}
+
+// fetch returns the next message, nil if none came in fetchWait.
+func (w *Worker) fetch(ctx context.Context, sub *nats.Subscription) (*nats.Msg, error) {
+	ctx, cancel := context.WithTimeout(ctx, fetchWait)
+	defer cancel()
+
+	msgs, err := sub.Fetch(1, nats.Context(ctx))
+	if errors.Is(err, context.DeadlineExceeded) || errors.Is(err, nats.ErrTimeout) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(msgs) == 0 {
+		return nil, nil
+	}
+
+	return msgs[0], nil
+}
+
+func (w *Worker) process(ctx context.Context, msg *nats.Msg) {
+	l := mlog.FromContext(ctx)
+
+	job := &Job{}
+	if err := json.Unmarshal(msg.Data, job); err != nil {
+		l.Error("dropping malformed job: %s", err.Error())
+		_ = msg.Term()
+		return
+	}
+
+	l = l.With("job_id", job.Id, "workflow", job.WorkflowName)
+
+	delivered := uint64(1)
+	if meta, err := msg.Metadata(); err == nil {
+		delivered = meta.NumDelivered
+	}
+	l.Info("processing job, delivery %d", delivered)
+	job.Redelivered = w.c.MaxDeliver <= 0 || delivered < uint64(w.c.MaxDeliver)
+
+	stop := w.keepAlive(msg)
+	err := w.h(mlog.NewContext(ctx, l), job)
+	stop()
+
+	switch {
+	case err == nil:
+		err = msg.Ack()
+	case IsPermanent(err):
+		l.Error("job failed: %s", err.Error())
+		err = msg.Term()
+	default:
+		l.Warn("job failed, to be retried: %s", err.Error())
+		err = msg.NakWithDelay(time.Duration(delivered) * nakDelay)
+	}
+	if err != nil {
+		l.Error("failed to acknowledge job: %s", err.Error())
+	}
+}
+
+// keepAlive keeps msg from being redelivered while its job runs, which
+// may take a lot longer than AckWait.
+func (w *Worker) keepAlive(msg *nats.Msg) func() {
+	stop := make(chan struct{})
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+
+		tick := time.NewTicker(w.c.AckWait / 2)
+		defer tick.Stop()
+
+		for {
+			select {
+			case <-tick.C:
+				_ = msg.InProgress()
+			case <-stop:
+				return
+			}
+		}
+	}()
+
+	return func() {
+		close(stop)
+		<-done
+	}
+}
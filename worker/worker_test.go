@@ -0,0 +1,433 @@
+// Copyright 2024 Northern.tech AS
+//
+//	Licensed under the Apache License, Version 2.0 (the "License");
+//	you may not use this file except in compliance with the License.
+//	You may obtain a copy of the License at
+//
+//	    http://www.apache.org/licenses/LICENSE-2.0
+//
+//	Unless required by applicable law or agreed to in writing, software
+//	distributed under the License is distributed on an "AS IS" BASIS,
+//	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//	See the License for the specific language governing permissions and
+//	limitations under the License.
+package worker
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats-server/v2/server"
+	"github.com/nats-io/nats.go"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+// newTestServer starts an embedded JetStream enabled nats-server, with
+// the WORKFLOWS stream the workflows service would set up.
+func newTestServer(t *testing.T) *server.Server {
+	s := newTestServerNoStream(t)
+
+	nc, err := nats.Connect(s.ClientURL())
+	assert.NoError(t, err)
+	defer nc.Close()
+
+	js, err := nc.JetStream()
+	assert.NoError(t, err)
+
+	_, err = js.AddStream(&nats.StreamConfig{
+		Name:     "WORKFLOWS",
+		Subjects: []string{"WORKFLOWS.>"},
+		MaxAge:   time.Hour,
+	})
+	assert.NoError(t, err)
+
+	return s
+}
+
+func newTestServerNoStream(t *testing.T) *server.Server {
+	s, err := server.NewServer(&server.Options{
+		Host:      "127.0.0.1",
+		Port:      -1,
+		JetStream: true,
+		StoreDir:  t.TempDir(),
+	})
+	assert.NoError(t, err)
+
+	go s.Start()
+	if !s.ReadyForConnections(10 * time.Second) {
+		t.Fatal("nats-server not ready")
+	}
+	t.Cleanup(s.Shutdown)
+
+	return s
+}
+
+func testConfig(url string) Config {
+	return Config{
+		Url:          url,
+		Stream:       "WORKFLOWS",
+		Topic:        "generate_artifact",
+		Durable:      "create-artifact-worker",
+		Concurrency:  2,
+		MaxDeliver:   2,
+		AckWait:      time.Second,
+		DrainTimeout: 10 * time.Second,
+	}
+}
+
+func publish(t *testing.T, url string, jobs ...*Job) {
+	nc, err := nats.Connect(url)
+	assert.NoError(t, err)
+	defer nc.Close()
+
+	js, err := nc.JetStream()
+	assert.NoError(t, err)
+
+	for _, j := range jobs {
+		b, err := json.Marshal(j)
+		assert.NoError(t, err)
+
+		_, err = js.Publish("WORKFLOWS.generate_artifact", b)
+		assert.NoError(t, err)
+	}
+}
+
+func publishRaw(t *testing.T, url string, data []byte) {
+	nc, err := nats.Connect(url)
+	assert.NoError(t, err)
+	defer nc.Close()
+
+	js, err := nc.JetStream()
+	assert.NoError(t, err)
+
+	_, err = js.Publish("WORKFLOWS.generate_artifact", data)
+	assert.NoError(t, err)
+}
+
+func consumerInfo(t *testing.T, url string) *nats.ConsumerInfo {
+	nc, err := nats.Connect(url)
+	assert.NoError(t, err)
+	defer nc.Close()
+
+	js, err := nc.JetStream()
+	assert.NoError(t, err)
+
+	ci, err := js.ConsumerInfo("WORKFLOWS", "create-artifact-worker")
+	assert.NoError(t, err)
+
+	return ci
+}
+
+// start runs the worker until the returned func is called
+func start(t *testing.T, w *Worker) func() {
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+
+	go func() {
+		done <- w.Run(ctx)
+	}()
+
+	return func() {
+		cancel()
+		assert.NoError(t, <-done)
+	}
+}
+
+func job(id string) *Job {
+	return &Job{
+		Id:           id,
+		WorkflowName: "generate_artifact",
+		InputParameters: []InputParameter{
+			{Name: "artifact_id", Value: "aid-" + id},
+		},
+	}
+}
+
+func TestWorker(t *testing.T) {
+	defer func(d time.Duration) { nakDelay = d }(nakDelay)
+	nakDelay = time.Millisecond
+
+	testCases := map[string]struct {
+		err error
+
+		calls       int32
+		redelivered []bool
+	}{
+		"ok": {
+			calls:       1,
+			redelivered: []bool{true},
+		},
+		"transient failure, retried": {
+			err:   errors.New("connection reset"),
+			calls: 2,
+			// MaxDeliver 2
+			redelivered: []bool{true, false},
+		},
+		"permanent failure": {
+			err:         Permanent(errors.New("invalid token")),
+			calls:       1,
+			redelivered: []bool{true},
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			s := newTestServer(t)
+
+			var calls int32
+			var mu sync.Mutex
+			var redelivered []bool
+			w := New(testConfig(s.ClientURL()), func(ctx context.Context, j *Job) error {
+				mu.Lock()
+				redelivered = append(redelivered, j.Redelivered)
+				mu.Unlock()
+
+				assert.Equal(t, "1", j.Id)
+				assert.Equal(t, "generate_artifact", j.WorkflowName)
+				assert.Equal(t, "aid-1", j.Input("artifact_id"))
+				assert.Equal(t, "", j.Input("missing"))
+
+				atomic.AddInt32(&calls, 1)
+				return tc.err
+			})
+
+			stop := start(t, w)
+			publish(t, s.ClientURL(), job("1"))
+
+			assert.Eventually(t, func() bool {
+				ci := consumerInfo(t, s.ClientURL())
+				return ci.NumPending == 0 && ci.NumAckPending == 0 &&
+					atomic.LoadInt32(&calls) >= tc.calls
+			}, 10*time.Second, 10*time.Millisecond)
+
+			// no more deliveries after acking or giving up
+			time.Sleep(50 * time.Millisecond)
+			stop()
+
+			assert.Equal(t, tc.calls, atomic.LoadInt32(&calls))
+			mu.Lock()
+			assert.Equal(t, tc.redelivered, redelivered)
+			mu.Unlock()
+		})
+	}
+}
+
+func TestWorkerNoStream(t *testing.T) {
+	s := newTestServerNoStream(t)
+
+	w := New(testConfig(s.ClientURL()), func(ctx context.Context, j *Job) error {
+		return nil
+	})
+
+	err := w.Run(context.Background())
+	assert.EqualError(t, err,
+		"stream WORKFLOWS not found; it's set up by the workflows service")
+
+	nc, err := nats.Connect(s.ClientURL())
+	assert.NoError(t, err)
+	defer nc.Close()
+	js, err := nc.JetStream()
+	assert.NoError(t, err)
+
+	_, err = js.StreamInfo("WORKFLOWS")
+	assert.True(t, errors.Is(err, nats.ErrStreamNotFound), "%v", err)
+}
+
+func TestWorkerKeepsStreamAndConsumer(t *testing.T) {
+	s := newTestServer(t)
+
+	nc, err := nats.Connect(s.ClientURL())
+	assert.NoError(t, err)
+	defer nc.Close()
+	js, err := nc.JetStream()
+	assert.NoError(t, err)
+
+	// set up by an operator with other settings
+	_, err = js.AddConsumer("WORKFLOWS", &nats.ConsumerConfig{
+		Durable:       "create-artifact-worker",
+		FilterSubject: "WORKFLOWS.generate_artifact",
+		AckPolicy:     nats.AckExplicitPolicy,
+		AckWait:       time.Minute,
+		MaxDeliver:    5,
+		MaxAckPending: 100,
+	})
+	assert.NoError(t, err)
+
+	var calls int32
+	w := New(testConfig(s.ClientURL()), func(ctx context.Context, j *Job) error {
+		atomic.AddInt32(&calls, 1)
+		return nil
+	})
+
+	stop := start(t, w)
+	publish(t, s.ClientURL(), job("1"))
+	assert.Eventually(t, func() bool {
+		return atomic.LoadInt32(&calls) == 1
+	}, 10*time.Second, 10*time.Millisecond)
+	stop()
+
+	ci := consumerInfo(t, s.ClientURL())
+	assert.Equal(t, 5, ci.Config.MaxDeliver)
+	assert.Equal(t, time.Minute, ci.Config.AckWait)
+	assert.Equal(t, 100, ci.Config.MaxAckPending)
+
+	si, err := js.StreamInfo("WORKFLOWS")
+	assert.NoError(t, err)
+	assert.Equal(t, time.Hour, si.Config.MaxAge)
+}
+
+func TestWorkerMalformedJob(t *testing.T) {
+	s := newTestServer(t)
+
+	var calls int32
+	w := New(testConfig(s.ClientURL()), func(ctx context.Context, j *Job) error {
+		atomic.AddInt32(&calls, 1)
+		return nil
+	})
+
+	stop := start(t, w)
+	defer stop()
+
+	publishRaw(t, s.ClientURL(), []byte("not { json"))
+	publish(t, s.ClientURL(), job("1"))
+
+	assert.Eventually(t, func() bool {
+		ci := consumerInfo(t, s.ClientURL())
+		return ci.NumPending == 0 && ci.NumAckPending == 0
+	}, 10*time.Second, 10*time.Millisecond)
+
+	assert.Equal(t, int32(1), atomic.LoadInt32(&calls))
+}
+
+func TestWorkerConcurrency(t *testing.T) {
+	s := newTestServer(t)
+
+	var mu sync.Mutex
+	var running, maxRunning, done int
+
+	w := New(testConfig(s.ClientURL()), func(ctx context.Context, j *Job) error {
+		mu.Lock()
+		running++
+		if running > maxRunning {
+			maxRunning = running
+		}
+		mu.Unlock()
+
+		time.Sleep(50 * time.Millisecond)
+
+		mu.Lock()
+		running--
+		done++
+		mu.Unlock()
+
+		return nil
+	})
+
+	stop := start(t, w)
+	defer stop()
+
+	publish(t, s.ClientURL(), job("1"), job("2"), job("3"), job("4"), job("5"))
+
+	assert.Eventually(t, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return done == 5
+	}, 10*time.Second, 10*time.Millisecond)
+
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Equal(t, 2, maxRunning)
+}
+
+func TestWorkerKeepsLongJobs(t *testing.T) {
+	s := newTestServer(t)
+
+	var calls int32
+	w := New(testConfig(s.ClientURL()), func(ctx context.Context, j *Job) error {
+		atomic.AddInt32(&calls, 1)
+		// several times the ack wait
+		time.Sleep(3 * time.Second)
+		return nil
+	})
+
+	stop := start(t, w)
+	defer stop()
+
+	publish(t, s.ClientURL(), job("1"))
+
+	assert.Eventually(t, func() bool {
+		ci := consumerInfo(t, s.ClientURL())
+		return ci.NumPending == 0 && ci.NumAckPending == 0 && ci.NumRedelivered == 0 &&
+			atomic.LoadInt32(&calls) == 1
+	}, 10*time.Second, 50*time.Millisecond)
+}
+
+func TestWorkerDrain(t *testing.T) {
+	testCases := map[string]struct {
+		drainTimeout time.Duration
+
+		// acked, or handed back for another worker
+		acked bool
+	}{
+		"running job finishes": {
+			drainTimeout: 10 * time.Second,
+			acked:        true,
+		},
+		"drain timeout cancels running job": {
+			drainTimeout: 10 * time.Millisecond,
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			s := newTestServer(t)
+
+			c := testConfig(s.ClientURL())
+			c.DrainTimeout = tc.drainTimeout
+			c.MaxDeliver = 0
+
+			started := make(chan struct{})
+			w := New(c, func(ctx context.Context, j *Job) error {
+				close(started)
+
+				select {
+				case <-time.After(200 * time.Millisecond):
+					return nil
+				case <-ctx.Done():
+					return ctx.Err()
+				}
+			})
+
+			stop := start(t, w)
+			publish(t, s.ClientURL(), job("1"))
+
+			<-started
+			stop()
+
+			ci := consumerInfo(t, s.ClientURL())
+			if tc.acked {
+				assert.Equal(t, uint64(0), ci.NumPending)
+				assert.Equal(t, 0, ci.NumAckPending)
+			} else {
+				// nak'ed with a delay, waiting for redelivery
+				assert.Equal(t, 1, ci.NumAckPending)
+			}
+		})
+	}
+}
+
+func TestPermanent(t *testing.T) {
+	err := errors.New("invalid token")
+
+	assert.Nil(t, Permanent(nil))
+	assert.False(t, IsPermanent(err))
+	assert.True(t, IsPermanent(Permanent(err)))
+	assert.True(t, IsPermanent(errors.Wrap(Permanent(err), "job failed")))
+	assert.Equal(t, err, errors.Cause(Permanent(err)))
+	assert.True(t, errors.Is(Permanent(err), err))
+}